@@ -7,11 +7,14 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/tomquartz/pyxis-k8s/pkg/client"
 	"github.com/tomquartz/pyxis-k8s/pkg/gateway"
 	"github.com/tomquartz/pyxis-k8s/pkg/gateway/arbiter"
+	"github.com/tomquartz/pyxis-k8s/pkg/harness"
+	"github.com/tomquartz/pyxis-k8s/pkg/kernel"
 	"github.com/tomquartz/pyxis-k8s/pkg/workload"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -24,6 +27,15 @@ var maxout int
 var configDir string
 var arbiterFramework string
 var debug bool
+var storageEndpoints string
+var computeURL string
+var local bool
+var localShards int
+var localCacheEntries int
+var localProtocol string
+var computeKernel string
+var requestTimeout float64
+var retryConfig string
 
 func main() {
 	flag.BoolVar(&debug, "debug", false, "Enable debug log")
@@ -31,6 +43,15 @@ func main() {
 	flag.IntVar(&maxout, "maxout", 8, "Number of requests to send concurrently")
 	flag.StringVar(&arbiterFramework, "arbiter", "pyxis", "Arbiter framework. Options: kayak, pyxis")
 	flag.StringVar(&configDir, "config", "manifests", "Path to json config file directory")
+	flag.StringVar(&storageEndpoints, "storage-endpoints", workload.StorageServiceURL, "Comma-separated base URLs of the storage replicas, in shard order")
+	flag.StringVar(&computeURL, "compute-url", workload.ComputeServiceURL, "URL of the compute service")
+	flag.BoolVar(&local, "local", false, "Run compute and storage servers in-process on localhost instead of connecting to the cluster")
+	flag.IntVar(&localShards, "local-shards", 1, "Number of storage replicas to run with -local")
+	flag.StringVar(&localProtocol, "local-protocol", "http", "Protocol of kv requests from compute to storage with -local. Options: http, wire")
+	flag.IntVar(&localCacheEntries, "local-cache-entries", 0, "Number of storage keys the compute server caches with -local, 0 to disable the cache")
+	flag.StringVar(&computeKernel, "kernel", "", "CPU kernel to compute with in every task profile instead of the kernel in tasks.json. Options: "+strings.Join(kernel.Names(), ", "))
+	flag.Float64Var(&requestTimeout, "timeout", gateway.DefaultRequestTimeout.Seconds(), "Seconds a request may take before its deadline passes and the servers drop it")
+	flag.StringVar(&retryConfig, "retry", "", "Json file of retry policies in the config dir, e.g. retry.json, empty to not retry failed requests")
 	flag.Parse()
 
 	opts := ctrlzap.Options{
@@ -63,6 +84,24 @@ func main() {
 		ctrl.Log.Error(err, "Failed to unmarshal task profiles")
 		return
 	}
+	if computeKernel != "" {
+		if _, err := kernel.Lookup(computeKernel); err != nil {
+			ctrl.Log.Error(err, "Invalid -kernel")
+			return
+		}
+		for i := range profiles {
+			profiles[i].Kernel = computeKernel
+		}
+	}
+	for _, profile := range profiles {
+		if profile.Hedge == nil {
+			continue
+		}
+		if err := profile.Hedge.Validate(); err != nil {
+			ctrl.Log.Error(err, "Invalid hedge policy", "typeID", profile.TypeID)
+			return
+		}
+	}
 
 	// read arbiter config
 	arbiterBytes, err := os.ReadFile(filepath.Join(configDir, arbiterFramework+".json"))
@@ -72,28 +111,51 @@ func main() {
 	}
 
 	// create arbiter
-	var arbiterImpl arbiter.Arbiter
-	switch arbiterFramework {
-	case "kayak":
-		var arbiterConfig arbiter.KayakConfig
-		if err := json.Unmarshal(arbiterBytes, &arbiterConfig); err != nil {
-			ctrl.Log.Error(err, "Failed to unmarshal arbiter config from "+arbiterFramework+".json")
+	arbiterImpl, err := arbiter.New(arbiterFramework, arbiterBytes, profiles)
+	if err != nil {
+		ctrl.Log.Error(err, "Failed to create arbiter")
+		return
+	}
+
+	// read retry policies
+	var retry gateway.RetryConfig
+	if retryConfig != "" {
+		retryBytes, err := os.ReadFile(filepath.Join(configDir, retryConfig))
+		if err != nil {
+			ctrl.Log.Error(err, "Failed to read retry policies from "+retryConfig)
 			return
 		}
-		arbiterConfig.TaskProfiles = profiles
-		arbiterImpl = arbiter.NewKayak(&arbiterConfig)
-	case "pyxis":
-		var arbiterConfig arbiter.PyxisConfig
-		if err := json.Unmarshal(arbiterBytes, &arbiterConfig); err != nil {
-			ctrl.Log.Error(err, "Failed to unmarshal arbiter config from "+arbiterFramework+".json")
+		if retry, err = gateway.ParseRetryConfig(retryBytes); err != nil {
+			ctrl.Log.Error(err, "Invalid retry policies")
 			return
 		}
-		arbiterConfig.TaskProfiles = profiles
-		arbiterImpl = arbiter.NewPyxis(&arbiterConfig)
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	// create gateway
-	gw := gateway.NewGateway(maxout, arbiterImpl)
+	var gw *gateway.Gateway
+	var cluster *harness.Cluster
+	if local {
+		// the servers outlive the client so that its last requests complete
+		cluster, err = harness.Start(ctrl.LoggerInto(context.Background(), ctrl.Log), &harness.Config{StorageShards: localShards, CacheEntries: localCacheEntries, Protocol: localProtocol, RequestTimeoutSecs: requestTimeout, Retry: retry})
+		if err != nil {
+			ctrl.Log.Error(err, "Failed to start local cluster")
+			return
+		}
+		gw = cluster.Gateway(maxout, arbiterImpl, profiles)
+	} else {
+		gw = gateway.NewGateway(&gateway.GatewayConfig{
+			MaxOut:             maxout,
+			Arbiter:            arbiterImpl,
+			ComputeURL:         computeURL,
+			StorageEndpoints:   strings.Split(storageEndpoints, ","),
+			RequestTimeoutSecs: requestTimeout,
+			Retry:              retry,
+			TaskProfiles:       profiles,
+		})
+	}
 
 	// create client
 	cl := client.NewClient(maxout, profiles)
@@ -101,7 +163,6 @@ func main() {
 
 	// run
 	ctrl.Log.Info(fmt.Sprintf("Running for %v seconds", nSeconds))
-	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
 		<-time.After(time.Duration(nSeconds) * time.Second)
 		cancel()
@@ -2,8 +2,13 @@ package main
 
 import (
 	"flag"
+	"os"
+	"strings"
 
+	"github.com/tomquartz/pyxis-k8s/pkg/admission"
 	"github.com/tomquartz/pyxis-k8s/pkg/compute"
+	"github.com/tomquartz/pyxis-k8s/pkg/drain"
+	"github.com/tomquartz/pyxis-k8s/pkg/workload"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -12,10 +17,36 @@ import (
 
 var nWorkers int
 var debug bool
+var storageReplicas int
+var storageEndpoints string
+var listenAddr string
+var storageProtocol string
+var storageWireAddrs string
+var maxQueue int
+var maxQueueWaitSecs float64
+var retryAfterSecs int
+var drainTimeoutSecs float64
+var unreadyDelaySecs float64
+var cacheEntries int
+var cacheTTLSecs float64
+var advertiseURL string
 
 func main() {
 	flag.BoolVar(&debug, "debug", false, "Enable debug log")
 	flag.IntVar(&nWorkers, "workers", 8, "Number of workers to run in the compute server")
+	flag.IntVar(&storageReplicas, "storage-replicas", 1, "Number of storage replicas to shard keys across")
+	flag.StringVar(&storageEndpoints, "storage-endpoints", "", "Comma-separated base URLs of the storage replicas in shard order, overrides -storage-replicas")
+	flag.StringVar(&listenAddr, "listen", workload.ComputeListenPort, "Address to listen on")
+	flag.StringVar(&storageProtocol, "storage-protocol", compute.ProtocolHTTP, "Protocol of kv requests to storage. Options: http, wire")
+	flag.StringVar(&storageWireAddrs, "storage-wire-addrs", "", "Comma-separated binary protocol addresses of the storage replicas in shard order, overrides -storage-replicas")
+	flag.IntVar(&maxQueue, "max-queue", 1024, "Maximum number of requests waiting for a worker before rejecting with 429, 0 for no limit")
+	flag.Float64Var(&maxQueueWaitSecs, "max-queue-wait", 5, "Seconds a request may wait for a worker before it is rejected with 429, 0 for no limit")
+	flag.IntVar(&retryAfterSecs, "retry-after", admission.DefaultRetryAfterSecs, "Seconds sent in the Retry-After header of rejections")
+	flag.Float64Var(&drainTimeoutSecs, "drain-timeout", drain.DefaultTimeout.Seconds(), "Seconds queued and in-flight requests get to finish on shutdown")
+	flag.Float64Var(&unreadyDelaySecs, "unready-delay", drain.DefaultUnreadyDelay.Seconds(), "Seconds to keep serving with failed readiness on shutdown before closing the listener")
+	flag.IntVar(&cacheEntries, "cache-entries", 0, "Number of storage keys to cache, 0 to read every key from storage")
+	flag.Float64Var(&cacheTTLSecs, "cache-ttl", 0, "Seconds a cached key is served before it is read again, 0 to keep it until invalidated")
+	flag.StringVar(&advertiseURL, "advertise-url", "", "Base URL storage replicas send cache invalidations to")
 	flag.Parse()
 
 	opts := ctrlzap.Options{
@@ -26,6 +57,39 @@ func main() {
 	}
 	ctrl.SetLogger(ctrlzap.New(ctrlzap.UseFlagOptions(&opts)))
 
-	computeServer := compute.NewComputeServer(nWorkers)
+	cfg := &compute.ComputeConfig{
+		NumWorkers:       nWorkers,
+		StorageEndpoints: workload.StorageShardInternalURLs(storageReplicas),
+		StorageWireAddrs: workload.StorageShardWireAddrs(storageReplicas),
+		Protocol:         storageProtocol,
+		ListenAddr:       listenAddr,
+		Admission: &admission.Config{
+			MaxQueue:       maxQueue,
+			MaxWaitSecs:    maxQueueWaitSecs,
+			RetryAfterSecs: retryAfterSecs,
+		},
+		Drain: &drain.Config{
+			TimeoutSecs:      drainTimeoutSecs,
+			UnreadyDelaySecs: unreadyDelaySecs,
+		},
+	}
+	if storageEndpoints != "" {
+		cfg.StorageEndpoints = strings.Split(storageEndpoints, ",")
+	}
+	if storageWireAddrs != "" {
+		cfg.StorageWireAddrs = strings.Split(storageWireAddrs, ",")
+	}
+	if cacheEntries > 0 {
+		cfg.Cache = &compute.CacheConfig{
+			MaxEntries:   cacheEntries,
+			TTLSecs:      cacheTTLSecs,
+			AdvertiseURL: advertiseURL,
+		}
+	}
+	computeServer, err := compute.NewComputeServer(cfg)
+	if err != nil {
+		ctrl.Log.Error(err, "Failed to create compute server")
+		os.Exit(1)
+	}
 	computeServer.Run(ctrl.SetupSignalHandler())
 }
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tomquartz/pyxis-k8s/pkg/drain"
+	"github.com/tomquartz/pyxis-k8s/pkg/gateway"
+	"github.com/tomquartz/pyxis-k8s/pkg/gateway/arbiter"
+	"github.com/tomquartz/pyxis-k8s/pkg/workload"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	ctrl "sigs.k8s.io/controller-runtime"
+	ctrlzap "sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+var debug bool
+var listenAddr string
+var configDir string
+var arbiterFramework string
+var maxout int
+var computeURL string
+var storageReplicas int
+var storageEndpoints string
+var requestTimeout float64
+var retryConfig string
+var drainTimeoutSecs float64
+var unreadyDelaySecs float64
+
+func main() {
+	flag.BoolVar(&debug, "debug", false, "Enable debug log")
+	flag.StringVar(&listenAddr, "listen", workload.GatewayListenPort, "Address to listen on")
+	flag.StringVar(&configDir, "config", "manifests", "Path to json config file directory")
+	flag.StringVar(&arbiterFramework, "arbiter", arbiter.FrameworkPyxis, "Arbiter framework. Options: kayak, pyxis")
+	flag.IntVar(&maxout, "maxout", 64, "Number of requests queued in front of the gateway before callers wait")
+	flag.StringVar(&computeURL, "compute-url", workload.ComputeInternalURL, "URL of the compute service")
+	flag.IntVar(&storageReplicas, "storage-replicas", 1, "Number of storage replicas to shard keys across")
+	flag.StringVar(&storageEndpoints, "storage-endpoints", "", "Comma-separated base URLs of the storage replicas in shard order, overrides -storage-replicas")
+	flag.Float64Var(&requestTimeout, "timeout", gateway.DefaultRequestTimeout.Seconds(), "Seconds a request may take unless it sets its own deadline")
+	flag.StringVar(&retryConfig, "retry", "", "Json file of retry policies in the config dir, e.g. retry.json, empty to not retry failed requests")
+	flag.Float64Var(&drainTimeoutSecs, "drain-timeout", drain.DefaultTimeout.Seconds(), "Seconds in-flight requests get to finish on shutdown")
+	flag.Float64Var(&unreadyDelaySecs, "unready-delay", drain.DefaultUnreadyDelay.Seconds(), "Seconds to keep serving with failed readiness on shutdown before closing the listener")
+	flag.Parse()
+
+	opts := ctrlzap.Options{
+		Development: true,
+	}
+	if !debug {
+		opts.Level = zap.NewAtomicLevelAt(zapcore.InfoLevel)
+	}
+	ctrl.SetLogger(ctrlzap.New(ctrlzap.UseFlagOptions(&opts)))
+
+	// read task profiles
+	var profiles []workload.TaskProfile
+	tasksBytes, err := os.ReadFile(filepath.Join(configDir, "tasks.json"))
+	if err != nil {
+		ctrl.Log.Error(err, "Failed to read task profiles from tasks.json")
+		os.Exit(1)
+	}
+	if err := json.Unmarshal(tasksBytes, &profiles); err != nil {
+		ctrl.Log.Error(err, "Failed to unmarshal task profiles")
+		os.Exit(1)
+	}
+	for _, profile := range profiles {
+		if profile.Hedge == nil {
+			continue
+		}
+		if err := profile.Hedge.Validate(); err != nil {
+			ctrl.Log.Error(err, "Invalid hedge policy", "typeID", profile.TypeID)
+			os.Exit(1)
+		}
+	}
+
+	// create arbiter
+	arbiterBytes, err := os.ReadFile(filepath.Join(configDir, arbiterFramework+".json"))
+	if err != nil {
+		ctrl.Log.Error(err, "Failed to read arbiter config from "+arbiterFramework+".json")
+		os.Exit(1)
+	}
+	arbiterImpl, err := arbiter.New(arbiterFramework, arbiterBytes, profiles)
+	if err != nil {
+		ctrl.Log.Error(err, "Failed to create arbiter")
+		os.Exit(1)
+	}
+
+	// read retry policies
+	var retry gateway.RetryConfig
+	if retryConfig != "" {
+		retryBytes, err := os.ReadFile(filepath.Join(configDir, retryConfig))
+		if err != nil {
+			ctrl.Log.Error(err, "Failed to read retry policies from "+retryConfig)
+			os.Exit(1)
+		}
+		if retry, err = gateway.ParseRetryConfig(retryBytes); err != nil {
+			ctrl.Log.Error(err, "Invalid retry policies")
+			os.Exit(1)
+		}
+	}
+
+	endpoints := workload.StorageShardInternalURLs(storageReplicas)
+	if storageEndpoints != "" {
+		endpoints = strings.Split(storageEndpoints, ",")
+	}
+	gw := gateway.NewGateway(&gateway.GatewayConfig{
+		MaxOut:             maxout,
+		Arbiter:            arbiterImpl,
+		ComputeURL:         computeURL,
+		StorageEndpoints:   endpoints,
+		RequestTimeoutSecs: requestTimeout,
+		Retry:              retry,
+		TaskProfiles:       profiles,
+	})
+	server := gateway.NewServer(gw, &gateway.ServerConfig{
+		TaskTypes:  len(profiles),
+		ListenAddr: listenAddr,
+		Drain: &drain.Config{
+			TimeoutSecs:      drainTimeoutSecs,
+			UnreadyDelaySecs: unreadyDelaySecs,
+		},
+	})
+	server.Run(ctrl.SetupSignalHandler())
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tomquartz/pyxis-k8s/pkg/harness"
+	"github.com/tomquartz/pyxis-k8s/pkg/shard"
+	"github.com/tomquartz/pyxis-k8s/pkg/wire"
+	"github.com/tomquartz/pyxis-k8s/pkg/workload"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	ctrl "sigs.k8s.io/controller-runtime"
+	ctrlzap "sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+var debug bool
+var nSeconds float64
+var concurrency int
+var nShards int
+var nWorkers int
+var nKeys int
+var batchSize int
+var valueSize int
+var protocols string
+
+// kvbench compares the latency and throughput of kv requests over http and
+// over the binary protocol against in-process storage servers.
+func main() {
+	flag.BoolVar(&debug, "debug", false, "Enable debug log")
+	flag.Float64Var(&nSeconds, "time", 5, "Number of seconds to run each protocol")
+	flag.IntVar(&concurrency, "concurrency", 16, "Number of requests to send concurrently")
+	flag.IntVar(&nShards, "shards", 1, "Number of storage servers to shard keys across")
+	flag.IntVar(&nWorkers, "workers", 8, "Number of workers per storage server")
+	flag.IntVar(&nKeys, "keys", 10000, "Number of keys to load and read")
+	flag.IntVar(&batchSize, "batch", 1, "Number of keys read per request")
+	flag.IntVar(&valueSize, "value-size", 64, "Size of the values in bytes")
+	flag.StringVar(&protocols, "protocols", "http,wire", "Comma-separated protocols to benchmark. Options: http, wire")
+	flag.Parse()
+
+	opts := ctrlzap.Options{
+		Development: true,
+	}
+	if !debug {
+		opts.Level = zap.NewAtomicLevelAt(zapcore.WarnLevel)
+	}
+	ctrl.SetLogger(ctrlzap.New(ctrlzap.UseFlagOptions(&opts)))
+
+	ctx, cancel := context.WithCancel(ctrl.LoggerInto(context.Background(), ctrl.Log))
+	cluster, err := harness.Start(ctx, &harness.Config{StorageShards: nShards, StorageWorkers: nWorkers})
+	if err != nil {
+		ctrl.Log.Error(err, "Failed to start storage servers")
+		os.Exit(1)
+	}
+	defer cluster.Wait()
+	defer cancel()
+
+	shards := shard.NewMap(cluster.StorageEndpoints, shard.DefaultVirtualNodes)
+	httpRouter := shard.NewRouter(shards, cluster.Client)
+	if err := load(httpRouter); err != nil {
+		ctrl.Log.Error(err, "Failed to load keys")
+		return
+	}
+	fmt.Printf("%-6s %10s %10s %10s %10s %10s\n", "proto", "req/s", "keys/s", "avg(us)", "p50(us)", "p99(us)")
+	for _, protocol := range strings.Split(protocols, ",") {
+		router := httpRouter
+		if protocol == "wire" {
+			router = shard.NewRouter(shards, cluster.Client)
+			client := wire.NewClient(0, 0)
+			defer client.Close()
+			if err := router.UseWire(cluster.StorageWireAddrs, client); err != nil {
+				ctrl.Log.Error(err, "Failed to set up the binary protocol")
+				return
+			}
+		} else if protocol != "http" {
+			ctrl.Log.Error(fmt.Errorf("unknown protocol: %s", protocol), "Invalid -protocols")
+			return
+		}
+		latencies, errs := run(router)
+		report(protocol, latencies, errs)
+	}
+}
+
+func key(i int) string {
+	return fmt.Sprintf("key-%08d", i)
+}
+
+func load(router *shard.Router) error {
+	value := strings.Repeat("v", valueSize)
+	const loadBatch = 256
+	for start := 0; start < nKeys; start += loadBatch {
+		req := &workload.StorageRequest{ID: fmt.Sprintf("load-%d", start)}
+		for i := start; i < min(start+loadBatch, nKeys); i++ {
+			req.Keys = append(req.Keys, key(i))
+			req.Values = append(req.Values, value)
+		}
+		if _, err := router.Do(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run reads random keys from concurrent loops and returns the latencies of
+// the requests that succeeded.
+func run(router *shard.Router) ([]time.Duration, int) {
+	deadline := time.Now().Add(time.Duration(nSeconds * float64(time.Second)))
+	var mu sync.Mutex
+	var latencies []time.Duration
+	errs := 0
+	wg := sync.WaitGroup{}
+	for g := 0; g < concurrency; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(g)))
+			var local []time.Duration
+			localErrs := 0
+			for n := 0; time.Now().Before(deadline); n++ {
+				req := &workload.StorageRequest{ID: fmt.Sprintf("bench-%d-%d", g, n)}
+				for i := 0; i < batchSize; i++ {
+					req.Keys = append(req.Keys, key(rng.Intn(nKeys)))
+				}
+				start := time.Now()
+				if _, err := router.Do(req); err != nil {
+					localErrs++
+					continue
+				}
+				local = append(local, time.Since(start))
+			}
+			mu.Lock()
+			latencies = append(latencies, local...)
+			errs += localErrs
+			mu.Unlock()
+		}(g)
+	}
+	wg.Wait()
+	return latencies, errs
+}
+
+func report(protocol string, latencies []time.Duration, errs int) {
+	if errs > 0 {
+		ctrl.Log.Info("Some requests failed", "protocol", protocol, "errors", errs)
+	}
+	if len(latencies) == 0 {
+		fmt.Printf("%-6s no requests succeeded\n", protocol)
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	var total time.Duration
+	for _, l := range latencies {
+		total += l
+	}
+	reqs := float64(len(latencies)) / nSeconds
+	us := func(d time.Duration) float64 { return float64(d) / float64(time.Microsecond) }
+	fmt.Printf("%-6s %10.0f %10.0f %10.1f %10.1f %10.1f\n", protocol, reqs, reqs*float64(batchSize),
+		us(total/time.Duration(len(latencies))), us(latencies[len(latencies)/2]), us(latencies[len(latencies)*99/100]))
+}
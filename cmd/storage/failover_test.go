@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestFailoverScript(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a storage group and waits for failover")
+	}
+	for _, tool := range []string{"bash", "curl"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not found", tool)
+		}
+	}
+	// the script listens on this port and the next two
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	cmd := exec.Command("bash", "../../scripts/failover.sh")
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("BASE_PORT=%d", port),
+		"FAILOVER_TIMEOUT=1",
+		"OUT_DIR="+t.TempDir(),
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("failover script failed: %v\n%s", err, out)
+	}
+}
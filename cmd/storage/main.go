@@ -2,8 +2,14 @@ package main
 
 import (
 	"flag"
+	"os"
+	"strconv"
+	"strings"
 
+	"github.com/tomquartz/pyxis-k8s/pkg/admission"
+	"github.com/tomquartz/pyxis-k8s/pkg/drain"
 	"github.com/tomquartz/pyxis-k8s/pkg/storage"
+	"github.com/tomquartz/pyxis-k8s/pkg/workload"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -12,10 +18,72 @@ import (
 
 var nWorkers int
 var debug bool
+var engine string
+var nShards int
+var scanIndex bool
+var durable bool
+var dataDir string
+var snapshotIntervalSecs float64
+var compactThreshold int
+var fsync bool
+var replicas int
+var shardID int
+var shardEndpoints string
+var listenAddr string
+var wireListenAddr string
+var peers string
+var peerID int
+var backupReads bool
+var failoverTimeoutSecs float64
+var memoryLimitBytes int64
+var evictionPolicy string
+var namespaceSeparator string
+var subscriberHosts string
+var maxQueue int
+var maxQueueWaitSecs float64
+var retryAfterSecs int
+var kvWeight int
+var pushdownWeight int
+var reservedKVWorkers int
+var pushdownQuantumSecs float64
+var pushdownCPUCap float64
+var drainTimeoutSecs float64
+var unreadyDelaySecs float64
 
 func main() {
 	flag.BoolVar(&debug, "debug", false, "Enable debug log")
 	flag.IntVar(&nWorkers, "workers", 8, "Number of workers to run in the storage server")
+	flag.StringVar(&engine, "engine", storage.EngineMap, "Storage engine. Options: map, sharded, skiplist")
+	flag.IntVar(&nShards, "shards", storage.DefaultEngineShards, "Number of lock stripes in the sharded engine")
+	flag.BoolVar(&scanIndex, "scan-index", false, "Index the keys of the map and sharded engines for scans instead of sorting every scanned range, the skiplist engine is ordered already")
+	flag.BoolVar(&durable, "durable", false, "Persist puts to a write-ahead log and recover them on restart")
+	flag.StringVar(&dataDir, "data-dir", "/var/lib/pyxis", "Directory for the write-ahead log and snapshots")
+	flag.Float64Var(&snapshotIntervalSecs, "snapshot-interval", 60, "Seconds between snapshots, 0 to disable periodic snapshots")
+	flag.IntVar(&compactThreshold, "compact-threshold", 100000, "Number of log records that triggers a snapshot, 0 to disable")
+	flag.BoolVar(&fsync, "fsync", false, "Fsync the write-ahead log on every put")
+	flag.IntVar(&replicas, "replicas", 1, "Number of storage replicas to shard keys across")
+	flag.IntVar(&shardID, "shard-id", -1, "Index of this replica, defaults to the ordinal in the statefulset pod name")
+	flag.StringVar(&shardEndpoints, "shard-endpoints", "", "Comma-separated base URLs of the storage replicas in shard order, overrides -replicas")
+	flag.StringVar(&listenAddr, "listen", workload.StorageListenPort, "Address to listen on")
+	flag.StringVar(&wireListenAddr, "wire-listen", "", "Address to serve the binary kv protocol on, e.g. "+workload.StorageWireListenPort+", empty to disable")
+	flag.StringVar(&peers, "peers", "", "Comma-separated base URLs of the replication group in promotion order, empty to disable replication")
+	flag.IntVar(&peerID, "peer-id", 0, "Index of this server in -peers")
+	flag.BoolVar(&backupReads, "backup-reads", false, "Serve reads on backups")
+	flag.Float64Var(&failoverTimeoutSecs, "failover-timeout", 2, "Seconds the primary may be unreachable before a backup takes over")
+	flag.Int64Var(&memoryLimitBytes, "memory-limit", 0, "Memory limit in aligned bytes, 0 for no limit")
+	flag.StringVar(&evictionPolicy, "eviction", storage.EvictionLRU, "Eviction policy under the memory limit. Options: lru, lfu, random")
+	flag.StringVar(&namespaceSeparator, "namespace-separator", storage.DefaultNamespaceSeparator, "Separator between the namespace and the rest of a key in memory usage breakdowns")
+	flag.StringVar(&subscriberHosts, "subscriber-hosts", "", "Comma-separated host names, IPs and CIDRs of compute servers allowed to subscribe to invalidations, empty to only let them subscribe their own address")
+	flag.IntVar(&maxQueue, "max-queue", 1024, "Maximum number of requests waiting for a worker before rejecting with 429, 0 for no limit")
+	flag.Float64Var(&maxQueueWaitSecs, "max-queue-wait", 5, "Seconds a request may wait for a worker before it is rejected with 429, 0 for no limit")
+	flag.IntVar(&retryAfterSecs, "retry-after", admission.DefaultRetryAfterSecs, "Seconds sent in the Retry-After header of rejections")
+	flag.IntVar(&kvWeight, "kv-weight", storage.DefaultKVWeight, "Share of worker time for kv requests relative to pushdown requests")
+	flag.IntVar(&pushdownWeight, "pushdown-weight", storage.DefaultPushdownWeight, "Share of worker time for pushdown requests relative to kv requests")
+	flag.IntVar(&reservedKVWorkers, "reserved-kv-workers", 0, "Number of workers that only serve kv requests, less than -workers")
+	flag.Float64Var(&pushdownQuantumSecs, "pushdown-quantum", storage.DefaultPushdownQuantum.Seconds(), "Seconds a pushdown function runs before yielding to waiting kv requests, 0 to run it to completion")
+	flag.Float64Var(&pushdownCPUCap, "pushdown-cpu-cap", 0, "Fraction of the worker time pushdown functions may use, 0 for no cap")
+	flag.Float64Var(&drainTimeoutSecs, "drain-timeout", drain.DefaultTimeout.Seconds(), "Seconds queued and in-flight requests get to finish on shutdown")
+	flag.Float64Var(&unreadyDelaySecs, "unready-delay", drain.DefaultUnreadyDelay.Seconds(), "Seconds to keep serving with failed readiness on shutdown before closing the listener")
 	flag.Parse()
 
 	opts := ctrlzap.Options{
@@ -26,6 +94,77 @@ func main() {
 	}
 	ctrl.SetLogger(ctrlzap.New(ctrlzap.UseFlagOptions(&opts)))
 
-	storageServer := storage.NewStorageServer(nWorkers)
+	cfg := &storage.StorageConfig{
+		NumWorkers: nWorkers,
+		Engine:     engine,
+		NumShards:  nShards,
+		ScanIndex:  scanIndex,
+		ListenAddr: listenAddr,
+		WireAddr:   wireListenAddr,
+		Memory: &storage.MemoryConfig{
+			LimitBytes:         memoryLimitBytes,
+			Policy:             evictionPolicy,
+			NamespaceSeparator: namespaceSeparator,
+		},
+		Scheduler: &storage.SchedulerConfig{
+			KVWeight:          kvWeight,
+			PushdownWeight:    pushdownWeight,
+			ReservedKVWorkers: reservedKVWorkers,
+		},
+		Pushdown: &storage.PushdownConfig{
+			QuantumSecs: pushdownQuantumSecs,
+			CPUCap:      pushdownCPUCap,
+		},
+		Drain: &drain.Config{
+			TimeoutSecs:      drainTimeoutSecs,
+			UnreadyDelaySecs: unreadyDelaySecs,
+		},
+		Admission: &admission.Config{
+			MaxQueue:       maxQueue,
+			MaxWaitSecs:    maxQueueWaitSecs,
+			RetryAfterSecs: retryAfterSecs,
+		},
+	}
+	if subscriberHosts != "" {
+		cfg.SubscriberHosts = strings.Split(subscriberHosts, ",")
+	}
+	if durable {
+		cfg.Durable = &storage.DurableConfig{
+			Dir:                  dataDir,
+			SnapshotIntervalSecs: snapshotIntervalSecs,
+			CompactThreshold:     compactThreshold,
+			Fsync:                fsync,
+		}
+	}
+	if peers != "" {
+		cfg.Replication = &storage.ReplicationConfig{
+			Peers:               strings.Split(peers, ","),
+			Self:                peerID,
+			BackupReads:         backupReads,
+			FailoverTimeoutSecs: failoverTimeoutSecs,
+		}
+	}
+	endpoints := workload.StorageShardInternalURLs(replicas)
+	if shardEndpoints != "" {
+		endpoints = strings.Split(shardEndpoints, ",")
+	}
+	if len(endpoints) > 1 {
+		if shardID < 0 {
+			hostname, _ := os.Hostname()
+			ordinal, err := strconv.Atoi(hostname[strings.LastIndex(hostname, "-")+1:])
+			if err != nil {
+				ctrl.Log.Error(err, "Failed to infer shard id from hostname", "hostname", hostname)
+				os.Exit(1)
+			}
+			shardID = ordinal
+		}
+		cfg.ShardEndpoints = endpoints
+		cfg.ShardID = shardID
+	}
+	storageServer, err := storage.NewStorageServer(cfg)
+	if err != nil {
+		ctrl.Log.Error(err, "Failed to create storage server")
+		os.Exit(1)
+	}
 	storageServer.Run(ctrl.SetupSignalHandler())
 }
@@ -41,10 +41,10 @@ func doComputeSideExecution(req *workload.ClientRequest) (*workload.ClientRespon
 		if err != nil {
 			return nil, fmt.Errorf("failed to do kv req: %v", err)
 		}
-		key = kvResp.Values[0]
-		if key == "N/A" {
+		if len(kvResp.Found) != 1 || !kvResp.Found[0] {
 			break
 		}
+		key = kvResp.Values[0]
 	}
 	kvTime := time.Since(kvStartTime)
 	fmt.Printf("Pointer chasing stopped at %s\n", key)
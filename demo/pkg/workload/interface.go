@@ -85,6 +85,7 @@ type StorageResponse struct {
 	ID     string   `json:"id"`
 	Keys   []string `json:"keys,omitempty"`
 	Values []string `json:"values,omitempty"`
+	Found  []bool   `json:"found,omitempty"`
 	Error  error
 }
 
@@ -0,0 +1,131 @@
+package admission
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/tomquartz/pyxis-k8s/pkg/workload"
+)
+
+const DefaultRetryAfterSecs = 1
+
+type Config struct {
+	// maximum number of requests waiting for a worker, 0 for no limit
+	MaxQueue int
+	// maximum time a request may wait for a worker, 0 for no limit
+	MaxWaitSecs float64
+	// sent as Retry-After with rejections
+	RetryAfterSecs int
+}
+
+// Controller bounds the queue in front of the workers of a server. Requests
+// arriving at a full queue, or waiting longer than the deadline for a worker,
+// are rejected with 429 instead of waiting indefinitely. Requests also give up
+// waiting at their own deadline.
+type Controller struct {
+	cfg      Config
+	depth    int64
+	rejected int64
+}
+
+func NewController(cfg *Config) *Controller {
+	c := &Controller{}
+	if cfg != nil {
+		c.cfg = *cfg
+	}
+	if c.cfg.RetryAfterSecs <= 0 {
+		c.cfg.RetryAfterSecs = DefaultRetryAfterSecs
+	}
+	return c
+}
+
+// Depth returns the number of admitted requests not yet picked up by a worker.
+func (c *Controller) Depth() int {
+	return int(atomic.LoadInt64(&c.depth))
+}
+
+// Rejected returns the number of requests rejected so far.
+func (c *Controller) Rejected() int64 {
+	return atomic.LoadInt64(&c.rejected)
+}
+
+// Submit admits req, queues it with send and waits until a worker is done
+// with it. send must give up once expired fires and report whether req was
+// queued. Requests that cannot be admitted or time out are rejected, those
+// whose own deadline passes first fail with workload.DeadlineExceededCode.
+// Requests whose caller goes away are dropped without a reply.
+func (c *Controller) Submit(req *workload.ClientRequest, send func(expired <-chan time.Time) bool) {
+	if depth := atomic.AddInt64(&c.depth, 1); c.cfg.MaxQueue > 0 && depth > int64(c.cfg.MaxQueue) {
+		atomic.AddInt64(&c.depth, -1)
+		c.reject(req, "queue full")
+		return
+	}
+	wait := time.Duration(c.cfg.MaxWaitSecs * float64(time.Second))
+	remaining, hasDeadline := req.Deadline.Remaining()
+	// whether the request runs out of time before the queue wait limit
+	deadlineFirst := hasDeadline && (wait <= 0 || remaining < wait)
+	if deadlineFirst {
+		wait = max(remaining, 0)
+	}
+	var expired <-chan time.Time
+	if wait > 0 || deadlineFirst {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	if !send(expired) {
+		atomic.AddInt64(&c.depth, -1)
+		select {
+		case <-req.Canceled():
+		default:
+			c.expire(req, deadlineFirst)
+		}
+		return
+	}
+	select {
+	case <-req.Done():
+	case <-expired:
+		if req.Abandon() {
+			atomic.AddInt64(&c.depth, -1)
+			c.expire(req, deadlineFirst)
+			return
+		}
+		<-req.Done()
+	case <-req.Canceled():
+		if req.Abandon() {
+			atomic.AddInt64(&c.depth, -1)
+			return
+		}
+		<-req.Done()
+	}
+}
+
+// Start must be called by the worker picking up req. It returns false if req
+// has been rejected meanwhile, in which case the worker must skip it.
+func (c *Controller) Start(req *workload.ClientRequest) bool {
+	if !req.Start() {
+		return false
+	}
+	atomic.AddInt64(&c.depth, -1)
+	return true
+}
+
+// expire fails req that waited too long for a worker.
+func (c *Controller) expire(req *workload.ClientRequest, deadlineFirst bool) {
+	if deadlineFirst {
+		req.Error(fmt.Errorf("queued request: %w", workload.ErrDeadlineExceeded), workload.DeadlineExceededCode)
+		return
+	}
+	c.reject(req, "queue wait deadline exceeded")
+}
+
+func (c *Controller) reject(req *workload.ClientRequest, reason string) {
+	atomic.AddInt64(&c.rejected, 1)
+	depth := c.Depth()
+	req.ResponseWriter.Header().Set("Retry-After", strconv.Itoa(c.cfg.RetryAfterSecs))
+	req.ResponseWriter.Header().Set(workload.QueueDepthHeader, strconv.Itoa(depth))
+	req.Error(fmt.Errorf("server overloaded: %s (queue depth %d)", reason, depth), http.StatusTooManyRequests)
+}
@@ -0,0 +1,215 @@
+package admission
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tomquartz/pyxis-k8s/pkg/workload"
+)
+
+func newRequest(id string) (*workload.ClientRequest, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	return (&workload.ClientRequest{ID: id}).SetResponseWriter(w), w
+}
+
+// queue returns the send of Submit pushing req to ch, giving up once expired
+// fires.
+func queue(ch chan *workload.ClientRequest, req *workload.ClientRequest) func(<-chan time.Time) bool {
+	return func(expired <-chan time.Time) bool {
+		select {
+		case ch <- req:
+			return true
+		case <-expired:
+			return false
+		}
+	}
+}
+
+// serve starts and finishes n requests from ch like a worker.
+func serve(c *Controller, ch chan *workload.ClientRequest, n int) {
+	for i := 0; i < n; i++ {
+		if req := <-ch; c.Start(req) {
+			req.Close()
+		}
+	}
+}
+
+func waitDepth(t *testing.T, c *Controller, depth int) {
+	t.Helper()
+	for i := 0; c.Depth() != depth; i++ {
+		if i == 1000 {
+			t.Fatalf("queue depth %d, expected %d", c.Depth(), depth)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func checkRejected(t *testing.T, w *httptest.ResponseRecorder, reason, retryAfter string, depth int) {
+	t.Helper()
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), reason) {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Retry-After"); got != retryAfter {
+		t.Errorf("got Retry-After %q, expected %q", got, retryAfter)
+	}
+	if got := w.Header().Get(workload.QueueDepthHeader); got != strconv.Itoa(depth) {
+		t.Errorf("got queue depth %q, expected %d", got, depth)
+	}
+}
+
+func TestAdmitQueueLimit(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		cfg        *Config
+		queued     int
+		admit      bool
+		retryAfter string
+	}{
+		{"default", nil, 10, true, ""},
+		{"no limit", &Config{}, 10, true, ""},
+		{"below limit", &Config{MaxQueue: 3}, 2, true, ""},
+		{"at limit", &Config{MaxQueue: 3}, 3, false, "1"},
+		{"retry after", &Config{MaxQueue: 1, RetryAfterSecs: 5}, 1, false, "5"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			ctrl := NewController(c.cfg)
+			ch := make(chan *workload.ClientRequest, 100)
+			var waiting []chan struct{}
+			for i := 0; i < c.queued; i++ {
+				req, _ := newRequest("queued")
+				done := make(chan struct{})
+				go func() {
+					ctrl.Submit(req, queue(ch, req))
+					close(done)
+				}()
+				waiting = append(waiting, done)
+			}
+			waitDepth(t, ctrl, c.queued)
+			req, w := newRequest("r")
+			admitted := false
+			ctrl.Submit(req, func(<-chan time.Time) bool {
+				admitted = true
+				// served right away
+				go req.Close()
+				return ctrl.Start(req)
+			})
+			if admitted != c.admit {
+				t.Fatalf("admitted %v with %d queued", admitted, c.queued)
+			}
+			rejected := int64(0)
+			if !c.admit {
+				checkRejected(t, w, "queue full", c.retryAfter, c.queued)
+				rejected = 1
+			}
+			if ctrl.Rejected() != rejected {
+				t.Errorf("rejected %d, expected %d", ctrl.Rejected(), rejected)
+			}
+			// neither changed the depth of the queue
+			waitDepth(t, ctrl, c.queued)
+			serve(ctrl, ch, c.queued)
+			for _, done := range waiting {
+				<-done
+			}
+			waitDepth(t, ctrl, 0)
+		})
+	}
+}
+
+// A request queued longer than MaxWaitSecs is rejected and skipped by the
+// worker picking it up later.
+func TestRejectAfterQueueWait(t *testing.T) {
+	ctrl := NewController(&Config{MaxWaitSecs: 0.05, RetryAfterSecs: 2})
+	ch := make(chan *workload.ClientRequest, 1)
+	req, w := newRequest("r")
+	start := time.Now()
+	ctrl.Submit(req, queue(ch, req))
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("rejected after %v", elapsed)
+	}
+	checkRejected(t, w, "queue wait deadline exceeded", "2", 0)
+	if ctrl.Start(<-ch) {
+		t.Error("started a rejected request")
+	}
+	if ctrl.Depth() != 0 || ctrl.Rejected() != 1 {
+		t.Errorf("depth %d, rejected %d", ctrl.Depth(), ctrl.Rejected())
+	}
+}
+
+// A request that cannot even be queued within MaxWaitSecs is rejected too.
+func TestRejectWhenQueueBlocks(t *testing.T) {
+	ctrl := NewController(&Config{MaxWaitSecs: 0.05})
+	req, w := newRequest("r")
+	ctrl.Submit(req, queue(make(chan *workload.ClientRequest), req))
+	checkRejected(t, w, "queue wait deadline exceeded", "1", 0)
+	if ctrl.Depth() != 0 {
+		t.Errorf("depth %d", ctrl.Depth())
+	}
+}
+
+// Requests picked up in time are not rejected however long they run.
+func TestStartedRequestNotRejected(t *testing.T) {
+	ctrl := NewController(&Config{MaxWaitSecs: 0.05})
+	ch := make(chan *workload.ClientRequest, 1)
+	go func() {
+		req := <-ch
+		if ctrl.Start(req) {
+			time.Sleep(100 * time.Millisecond)
+			req.Close()
+		}
+	}()
+	req, w := newRequest("r")
+	ctrl.Submit(req, queue(ch, req))
+	if w.Code != http.StatusOK || req.Failed() || ctrl.Rejected() != 0 {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// A request whose own deadline comes before MaxWaitSecs fails with
+// DeadlineExceededCode instead of being rejected.
+func TestRequestDeadlineFirst(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		cfg      *Config
+		deadline time.Duration
+	}{
+		{"no queue wait", nil, 50 * time.Millisecond},
+		{"before queue wait", &Config{MaxWaitSecs: 10}, 50 * time.Millisecond},
+		{"already passed", &Config{MaxWaitSecs: 10}, -time.Second},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			ctrl := NewController(c.cfg)
+			ch := make(chan *workload.ClientRequest, 1)
+			req, w := newRequest("r")
+			req.Deadline = workload.DeadlineAt(time.Now().Add(c.deadline))
+			ctrl.Submit(req, queue(ch, req))
+			if w.Code != workload.DeadlineExceededCode || w.Header().Get("Retry-After") != "" {
+				t.Errorf("got %d: %s", w.Code, w.Body.String())
+			}
+			if ctrl.Depth() != 0 || ctrl.Rejected() != 0 {
+				t.Errorf("depth %d, rejected %d", ctrl.Depth(), ctrl.Rejected())
+			}
+		})
+	}
+}
+
+// A request whose caller went away is dropped without a reply.
+func TestCanceledRequestDropped(t *testing.T) {
+	ctrl := NewController(nil)
+	ch := make(chan *workload.ClientRequest, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	req, w := newRequest("r")
+	req.SetContext(ctx)
+	time.AfterFunc(20*time.Millisecond, cancel)
+	ctrl.Submit(req, queue(ch, req))
+	if w.Body.Len() != 0 || req.Failed() {
+		t.Errorf("replied %d: %s", w.Code, w.Body.String())
+	}
+	if ctrl.Start(<-ch) || ctrl.Depth() != 0 || ctrl.Rejected() != 0 {
+		t.Errorf("depth %d, rejected %d", ctrl.Depth(), ctrl.Rejected())
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/tomquartz/pyxis-k8s/pkg/gateway"
+	"github.com/tomquartz/pyxis-k8s/pkg/kernel"
 	"github.com/tomquartz/pyxis-k8s/pkg/workload"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 )
@@ -16,10 +17,17 @@ type Client struct {
 	maxout      int
 	profiles    []workload.TaskProfile
 	ratioCumsum []float64
-	sendChan    chan<- *workload.ClientRequest
-	recvChan    <-chan *workload.ClientResponse
+	gateway     *gateway.Gateway
 	results     []*workload.ClientResponse
-	duration    time.Duration
+	rejected    int
+	expired     int
+	// requests the gateway retried and the retries it made
+	retried int
+	retries int
+	// requests sent to both tiers and the tier whose attempt won
+	hedged   int
+	hedgeWon map[string]int
+	duration time.Duration
 }
 
 func NewClient(maxout int, profiles []workload.TaskProfile) *Client {
@@ -29,6 +37,11 @@ func NewClient(maxout int, profiles []workload.TaskProfile) *Client {
 		if i != profile.TypeID {
 			panic("profile typeID must be consecutive")
 		}
+		if profile.Kernel != "" {
+			if _, err := kernel.Lookup(profile.Kernel); err != nil {
+				panic(err)
+			}
+		}
 		sum += profile.Percentage
 		ratioCumsum[i] = sum
 	}
@@ -36,20 +49,24 @@ func NewClient(maxout int, profiles []workload.TaskProfile) *Client {
 		maxout:      maxout,
 		profiles:    profiles,
 		ratioCumsum: ratioCumsum,
+		hedgeWon:    map[string]int{},
 	}
 }
 
+// Connect sends the requests of the client through gateway, which may be
+// shared with other clients.
 func (c *Client) Connect(gateway *gateway.Gateway) {
-	c.sendChan = gateway.Input()
-	c.recvChan = gateway.Output()
+	c.gateway = gateway
 }
 
 func (c *Client) Run(ctx context.Context) {
 	logger := log.FromContext(ctx)
 	id := 0
+	// room for every outstanding response
+	recvChan := make(chan *workload.ClientResponse, c.maxout)
 	send := func() {
 		id++
-		c.sendChan <- c.newRequest(id)
+		c.gateway.Send(ctx, c.newRequest(id), recvChan)
 	}
 	start := time.Now()
 	for i := 0; i < c.maxout; i++ {
@@ -57,9 +74,25 @@ func (c *Client) Run(ctx context.Context) {
 	}
 	for {
 		select {
-		case resp := <-c.recvChan:
+		case resp := <-recvChan:
 			c.results = append(c.results, resp)
-			if resp.Status != workload.SUCCESS {
+			if resp.Attempts > 1 {
+				c.retried++
+				c.retries += resp.Attempts - 1
+			}
+			if resp.Hedged {
+				c.hedged++
+				if resp.Status == workload.SUCCESS {
+					c.hedgeWon[resp.Tier]++
+				}
+			}
+			if resp.Status == workload.FAIL_OVERLOADED {
+				c.rejected++
+				logger.V(1).Info("client request rejected by overloaded server", "id", resp.ID, "queueDepth", resp.QueueDepth)
+			} else if resp.Status == workload.FAIL_DEADLINE {
+				c.expired++
+				logger.V(1).Info("client request exceeded its deadline", "id", resp.ID, "latency", resp.Latency)
+			} else if resp.Status != workload.SUCCESS {
 				logger.Error(fmt.Errorf(resp.Result), "client received error response", "code", resp.Status)
 			}
 			send()
@@ -81,14 +114,15 @@ func (c *Client) newRequest(id int) *workload.ClientRequest {
 	for i := 0; i < profile.NumKV; i++ {
 		storageKeys[i] = fmt.Sprintf("%d", rand.Intn(profile.NumKV))
 	}
-	return &workload.ClientRequest{
-		ID:     fmt.Sprintf("%d", id),
-		TypeID: typeID,
-		DefaultFuncRequest: &workload.DefaultFuncRequest{
-			StorageKeys: storageKeys,
-			ComputeSecs: profile.ComputeSecs,
-		},
+	req, err := workload.NewClientRequest(fmt.Sprintf("%d", id), typeID, workload.FuncDefault, &workload.DefaultFuncRequest{
+		StorageKeys: storageKeys,
+		ComputeSecs: profile.ComputeSecs,
+		Kernel:      profile.Kernel,
+	})
+	if err != nil {
+		panic(err)
 	}
+	return req
 }
 
 func (c *Client) Summary() string {
@@ -118,7 +152,11 @@ func (c *Client) Summary() string {
 	// msg
 	tputMsg := fmt.Sprintf("Throughput: %.0f req/s\n", tput)
 	slowdownMsg := fmt.Sprintf("Slowdown: avg=%.1f p50=%.1f p90=%.1f(%.1f) p95=%.1f(%.1f) p99=%.1f(%.1f)\n", slowdownAvg, slowdownP50, slowdownP90, slowdownP90Avg, slowdownP95, slowdownP95Avg, slowdownP99, slowdownP99Avg)
-	return tputMsg + slowdownMsg
+	rejectedMsg := fmt.Sprintf("Rejected: %d/%d (overloaded)\n", c.rejected, len(c.results))
+	expiredMsg := fmt.Sprintf("Deadline exceeded: %d/%d\n", c.expired, len(c.results))
+	retriedMsg := fmt.Sprintf("Retried: %d/%d (%d retries)\n", c.retried, len(c.results), c.retries)
+	hedgedMsg := fmt.Sprintf("Hedged: %d/%d (won by compute %d, storage %d)\n", c.hedged, len(c.results), c.hedgeWon[workload.TierCompute], c.hedgeWon[workload.TierStorage])
+	return tputMsg + slowdownMsg + rejectedMsg + expiredMsg + retriedMsg + hedgedMsg
 }
 
 func avgF64Slice(x []float64) float64 {
@@ -0,0 +1,395 @@
+package compute
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tomquartz/pyxis-k8s/pkg/workload"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const DefaultSubscribeInterval = time.Second
+
+type CacheConfig struct {
+	// maximum number of cached keys
+	MaxEntries int
+	// time an entry is served without refetching it, 0 to keep entries until
+	// they are invalidated or evicted
+	TTLSecs float64
+	// base URL of this compute server that storage replicas send
+	// invalidations to
+	AdvertiseURL string
+}
+
+func validateCacheConfig(cfg *CacheConfig) error {
+	if cfg.MaxEntries <= 0 {
+		return fmt.Errorf("cache entries must be positive")
+	}
+	if cfg.TTLSecs < 0 {
+		return fmt.Errorf("cache ttl must not be negative")
+	}
+	if cfg.AdvertiseURL == "" {
+		return fmt.Errorf("missing advertise url for cache invalidations")
+	}
+	return nil
+}
+
+// CacheStats counts the keys read through the cache since startup.
+type CacheStats struct {
+	Entries       int     `json:"entries"`
+	Capacity      int     `json:"capacity"`
+	Hits          int64   `json:"hits"`
+	Misses        int64   `json:"misses"`
+	HitRate       float64 `json:"hitRate"`
+	Invalidations int64   `json:"invalidations"`
+	Evictions     int64   `json:"evictions"`
+	Flushes       int64   `json:"flushes"`
+	// whether every storage replica confirmed the subscription
+	Subscribed bool `json:"subscribed"`
+}
+
+type cacheEntry struct {
+	key     string
+	value   string
+	found   bool
+	expires time.Time
+}
+
+// fillToken is taken before a key is read from storage. The value read is only
+// cached if the key was not invalidated and the cache not flushed meanwhile.
+type fillToken struct {
+	ok  bool
+	gen uint64
+	seq uint64
+}
+
+// kvCache is an LRU cache of storage reads, including keys that were not
+// found. Entries are kept only while every storage replica delivers the
+// invalidations of changed keys, and the cache is flushed whenever a replica
+// may have lost some.
+type kvCache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	order    *list.List
+	entries  map[string]*list.Element
+	// fills are only accepted while subscribed
+	subscribed bool
+	// bumped by every flush
+	gen uint64
+	// bumped by every invalidation
+	seq uint64
+	// keys being read from storage and the last invalidation of each
+	inflight      map[string]int
+	invalidatedAt map[string]uint64
+	hits          int64
+	misses        int64
+	invalidations int64
+	evictions     int64
+	flushes       int64
+}
+
+func newKVCache(cfg *CacheConfig) *kvCache {
+	return &kvCache{
+		capacity:      cfg.MaxEntries,
+		ttl:           time.Duration(cfg.TTLSecs * float64(time.Second)),
+		order:         list.New(),
+		entries:       make(map[string]*list.Element),
+		inflight:      make(map[string]int),
+		invalidatedAt: make(map[string]uint64),
+	}
+}
+
+func (c *kvCache) get(key string) (value string, found bool, hit bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if ok {
+		entry := e.Value.(*cacheEntry)
+		if c.ttl <= 0 || time.Now().Before(entry.expires) {
+			c.order.MoveToFront(e)
+			c.hits++
+			return entry.value, entry.found, true
+		}
+		c.remove(e)
+	}
+	c.misses++
+	return "", false, false
+}
+
+// begin must be followed by fill or abort once the read finished.
+func (c *kvCache) begin(key string) fillToken {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inflight[key]++
+	return fillToken{ok: c.subscribed, gen: c.gen, seq: c.seq}
+}
+
+func (c *kvCache) fill(key, value string, found bool, tok fillToken) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stale := c.invalidatedAt[key] > tok.seq
+	c.end(key)
+	if !tok.ok || tok.gen != c.gen || stale {
+		return
+	}
+	entry := &cacheEntry{key: key, value: value, found: found, expires: time.Now().Add(c.ttl)}
+	if e, ok := c.entries[key]; ok {
+		e.Value = entry
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.capacity {
+		c.remove(c.order.Back())
+		c.evictions++
+	}
+}
+
+func (c *kvCache) abort(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.end(key)
+}
+
+func (c *kvCache) end(key string) {
+	if c.inflight[key]--; c.inflight[key] <= 0 {
+		delete(c.inflight, key)
+		delete(c.invalidatedAt, key)
+	}
+}
+
+func (c *kvCache) remove(e *list.Element) {
+	c.order.Remove(e)
+	delete(c.entries, e.Value.(*cacheEntry).key)
+}
+
+func (c *kvCache) invalidate(keys []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	for _, key := range keys {
+		if e, ok := c.entries[key]; ok {
+			c.remove(e)
+			c.invalidations++
+		}
+		if c.inflight[key] > 0 {
+			c.invalidatedAt[key] = c.seq
+		}
+	}
+}
+
+// flush drops every entry, including the reads in flight.
+func (c *kvCache) flush(subscribed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subscribed = subscribed
+	c.gen++
+	if c.order.Len() > 0 {
+		c.flushes++
+	}
+	c.order.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+func (c *kvCache) setSubscribed(subscribed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subscribed = subscribed
+}
+
+func (c *kvCache) stats() *CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := &CacheStats{
+		Entries:       c.order.Len(),
+		Capacity:      c.capacity,
+		Hits:          c.hits,
+		Misses:        c.misses,
+		Invalidations: c.invalidations,
+		Evictions:     c.evictions,
+		Flushes:       c.flushes,
+		Subscribed:    c.subscribed,
+	}
+	if total := c.hits + c.misses; total > 0 {
+		st.HitRate = float64(c.hits) / float64(total)
+	}
+	return st
+}
+
+// read serves the gets of req from the cache and reads the missing keys from
+// storage.
+func (s *ComputeServer) read(req *workload.StorageRequest) (*workload.StorageResponse, error) {
+	if s.cache == nil || req.HasWrites() {
+		return s.router.Do(req)
+	}
+	n := len(req.Keys)
+	resp := &workload.StorageResponse{
+		ID:      req.ID,
+		Keys:    req.Keys,
+		Values:  make([]string, n),
+		Found:   make([]bool, n),
+		Applied: make([]bool, n),
+	}
+	var misses []int
+	for i, key := range req.Keys {
+		if value, found, hit := s.cache.get(key); hit {
+			resp.Values[i], resp.Found[i] = value, found
+		} else {
+			misses = append(misses, i)
+		}
+	}
+	if len(misses) == 0 {
+		return resp, nil
+	}
+	tokens := make([]fillToken, len(misses))
+	for j, i := range misses {
+		tokens[j] = s.cache.begin(req.Keys[i])
+	}
+	missResp, err := s.router.Do(req.Subset(req.ID, misses))
+	if err == nil && missResp.Len() != len(misses) {
+		err = fmt.Errorf("storage returned %d entries for %d keys", missResp.Len(), len(misses))
+	}
+	for j, i := range misses {
+		if err != nil {
+			s.cache.abort(req.Keys[i])
+			continue
+		}
+		resp.Values[i], resp.Found[i] = missResp.Values[j], missResp.Found[j]
+		s.cache.fill(req.Keys[i], resp.Values[i], resp.Found[i], tokens[j])
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (s *ComputeServer) ServeInvalidate(w http.ResponseWriter, r *http.Request) {
+	inv := &workload.Invalidation{}
+	if err := json.NewDecoder(r.Body).Decode(inv); err != nil {
+		http.Error(w, fmt.Sprintf("failed to decode request: %v", err), http.StatusBadRequest)
+		return
+	}
+	s.cache.invalidate(inv.Keys)
+}
+
+// subscribe keeps this server subscribed to the invalidations of every storage
+// replica and flushes the cache whenever a replica cannot be reached or
+// starts a new session.
+func (s *ComputeServer) subscribe(ctx context.Context) {
+	sessions := make(map[string]int64)
+	ticker := time.NewTicker(DefaultSubscribeInterval)
+	defer ticker.Stop()
+	for {
+		s.resubscribe(ctx, sessions)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// resubscribe renews the subscriptions and keeps the cache only if every
+// replica kept the session it had in the last round.
+func (s *ComputeServer) resubscribe(ctx context.Context, sessions map[string]int64) {
+	logger := log.FromContext(ctx)
+	endpoints, err := s.subscriptionEndpoints(ctx)
+	if err != nil {
+		logger.V(1).Info("Failed to subscribe to invalidations", "err", err.Error())
+		clear(sessions)
+		s.cache.flush(false)
+		return
+	}
+	subscribed, changed := true, false
+	current := make(map[string]bool, len(endpoints))
+	for _, endpoint := range endpoints {
+		current[endpoint] = true
+		session, err := s.subscribeTo(ctx, endpoint)
+		if err != nil {
+			logger.V(1).Info("Failed to subscribe to invalidations", "endpoint", endpoint, "err", err.Error())
+			subscribed = false
+			delete(sessions, endpoint)
+			continue
+		}
+		// a replica not subscribed to before may have changed keys unnoticed
+		if old, ok := sessions[endpoint]; !ok || old != session {
+			if ok {
+				logger.Info("Storage replica started a new invalidation session", "endpoint", endpoint)
+			}
+			changed = true
+		}
+		sessions[endpoint] = session
+	}
+	for endpoint := range sessions {
+		if !current[endpoint] {
+			delete(sessions, endpoint)
+		}
+	}
+	if changed || !subscribed {
+		s.cache.flush(subscribed)
+	} else {
+		s.cache.setSubscribed(true)
+	}
+}
+
+// subscriptionEndpoints lists the base URLs of every storage replica. The
+// load-balanced storage service is replaced by the replicas behind it, since
+// only the replica that answers a subscription registers it.
+func (s *ComputeServer) subscriptionEndpoints(ctx context.Context) ([]string, error) {
+	var endpoints []string
+	shards := s.router.Shards()
+	for i := 0; i < shards.Len(); i++ {
+		for _, endpoint := range shards.Group(i) {
+			if endpoint != workload.StorageInternalURL {
+				endpoints = append(endpoints, endpoint)
+				continue
+			}
+			addrs, err := s.lookupHost(ctx, workload.StorageHeadlessHost)
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve storage replicas: %v", err)
+			}
+			for _, addr := range addrs {
+				endpoints = append(endpoints, "http://"+net.JoinHostPort(addr, strings.TrimPrefix(workload.StorageListenPort, ":")))
+			}
+		}
+	}
+	return endpoints, nil
+}
+
+func (s *ComputeServer) subscribeTo(ctx context.Context, endpoint string) (int64, error) {
+	reqJson, err := json.Marshal(&workload.InvalidationSubscription{URL: s.advertiseURL})
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal subscription: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, DefaultSubscribeInterval)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+workload.StorageSubscribePath, bytes.NewReader(reqJson))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create req: %v", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpResp, err := s.client.Do(httpReq)
+	if err != nil {
+		return 0, fmt.Errorf("failed to post subscription: %v", err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(httpResp.Body)
+		return 0, fmt.Errorf("subscription failed with status %d: %s", httpResp.StatusCode, string(msg))
+	}
+	sub := &workload.InvalidationSubscription{}
+	if err := json.NewDecoder(httpResp.Body).Decode(sub); err != nil {
+		return 0, fmt.Errorf("failed to decode subscription: %v", err)
+	}
+	return sub.Session, nil
+}
@@ -0,0 +1,210 @@
+package compute
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tomquartz/pyxis-k8s/pkg/workload"
+)
+
+func newTestCache(entries int, ttl float64) *kvCache {
+	return newKVCache(&CacheConfig{MaxEntries: entries, TTLSecs: ttl, AdvertiseURL: "http://compute"})
+}
+
+// read fills key as if it was read from storage with tok.
+func read(c *kvCache, key, value string, tok fillToken) {
+	c.fill(key, value, true, tok)
+}
+
+func cached(c *kvCache, key string) bool {
+	_, _, hit := c.get(key)
+	return hit
+}
+
+func TestCacheFillTokens(t *testing.T) {
+	c := newTestCache(8, 0)
+	read(c, "a", "v", c.begin("a"))
+	if cached(c, "a") {
+		t.Error("filled before subscribing")
+	}
+	c.setSubscribed(true)
+
+	tok := c.begin("a")
+	c.invalidate([]string{"a"})
+	read(c, "a", "old", tok)
+	if cached(c, "a") {
+		t.Error("filled a value read before the key was invalidated")
+	}
+
+	tok = c.begin("a")
+	c.invalidate([]string{"b"})
+	read(c, "a", "v", tok)
+	if value, _, hit := c.get("a"); !hit || value != "v" {
+		t.Errorf("got %q, %v after invalidating another key, expected the filled value", value, hit)
+	}
+
+	// two reads in flight, the key changes between them
+	c.invalidate([]string{"a"})
+	first := c.begin("a")
+	c.invalidate([]string{"a"})
+	second := c.begin("a")
+	read(c, "a", "new", second)
+	read(c, "a", "old", first)
+	if value, _, hit := c.get("a"); !hit || value != "new" {
+		t.Errorf("got %q, %v, expected the value read after the invalidation", value, hit)
+	}
+
+	tok = c.begin("b")
+	c.flush(true)
+	read(c, "b", "v", tok)
+	if cached(c, "a") || cached(c, "b") {
+		t.Error("kept entries or a read in flight across a flush")
+	}
+
+	tok = c.begin("b")
+	c.abort("b")
+	c.fill("missing", "", false, c.begin("missing"))
+	if value, found, hit := c.get("missing"); !hit || found || value != "" {
+		t.Errorf("got %q, %v, %v for a key not found in storage, expected it cached as not found", value, found, hit)
+	}
+	if len(c.inflight) != 0 || len(c.invalidatedAt) != 0 {
+		t.Errorf("%d reads still in flight and %d invalidations tracked after all reads ended", len(c.inflight), len(c.invalidatedAt))
+	}
+}
+
+func TestCacheBound(t *testing.T) {
+	c := newTestCache(2, 0)
+	c.setSubscribed(true)
+	read(c, "a", "v", c.begin("a"))
+	read(c, "b", "v", c.begin("b"))
+	c.get("a")
+	read(c, "c", "v", c.begin("c"))
+	if !cached(c, "a") || cached(c, "b") || !cached(c, "c") {
+		t.Error("expected the least recently used key evicted")
+	}
+	if st := c.stats(); st.Entries != 2 || st.Evictions != 1 {
+		t.Errorf("%d entries with %d evictions, expected 2 with 1", st.Entries, st.Evictions)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	c := newTestCache(2, 0.05)
+	c.setSubscribed(true)
+	read(c, "a", "v", c.begin("a"))
+	if !cached(c, "a") {
+		t.Fatal("expected a hit before the ttl ran out")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if cached(c, "a") {
+		t.Error("expected a miss after the ttl ran out")
+	}
+}
+
+// fakeReplica answers subscriptions with its current session, or fails them
+// while down.
+type fakeReplica struct {
+	session     atomic.Int64
+	down        atomic.Bool
+	subscribers atomic.Int64
+}
+
+func (f *fakeReplica) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sub := &workload.InvalidationSubscription{}
+	if r.URL.Path != workload.StorageSubscribePath || json.NewDecoder(r.Body).Decode(sub) != nil || sub.URL != "http://compute" {
+		http.Error(w, "bad subscription", http.StatusBadRequest)
+		return
+	}
+	if f.down.Load() {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+		return
+	}
+	f.subscribers.Add(1)
+	sub.Session = f.session.Load()
+	json.NewEncoder(w).Encode(sub)
+}
+
+func TestResubscribe(t *testing.T) {
+	replicas := []*fakeReplica{{}, {}}
+	var endpoints []string
+	for _, r := range replicas {
+		r.session.Store(1)
+		srv := httptest.NewServer(r)
+		defer srv.Close()
+		endpoints = append(endpoints, srv.URL)
+	}
+	s, err := NewComputeServer(&ComputeConfig{
+		NumWorkers:       1,
+		StorageEndpoints: endpoints,
+		Cache:            &CacheConfig{MaxEntries: 8, AdvertiseURL: "http://compute"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	sessions := make(map[string]int64)
+	fill := func() {
+		read(s.cache, "a", "v", s.cache.begin("a"))
+	}
+
+	s.resubscribe(ctx, sessions)
+	for i, r := range replicas {
+		if r.subscribers.Load() != 1 {
+			t.Errorf("replica %d got %d subscriptions, expected 1", i, r.subscribers.Load())
+		}
+	}
+	fill()
+	s.resubscribe(ctx, sessions)
+	if !cached(s.cache, "a") || !s.cache.stats().Subscribed {
+		t.Error("expected the cache kept while every replica kept its session")
+	}
+
+	replicas[1].session.Store(2)
+	s.resubscribe(ctx, sessions)
+	if cached(s.cache, "a") || !s.cache.stats().Subscribed {
+		t.Error("expected the cache flushed once a replica started a new session")
+	}
+
+	fill()
+	replicas[0].down.Store(true)
+	s.resubscribe(ctx, sessions)
+	fill()
+	if cached(s.cache, "a") || s.cache.stats().Subscribed {
+		t.Error("expected the cache flushed and not filled while a replica is unreachable")
+	}
+
+	replicas[0].down.Store(false)
+	s.resubscribe(ctx, sessions)
+	fill()
+	if !cached(s.cache, "a") || s.cache.stats().Flushes != 2 {
+		t.Errorf("expected the cache filled again after resubscribing, with %d flushes", s.cache.stats().Flushes)
+	}
+}
+
+func TestSubscriptionEndpointsResolveService(t *testing.T) {
+	s, err := NewComputeServer(&ComputeConfig{
+		NumWorkers: 1,
+		Cache:      &CacheConfig{MaxEntries: 8, AdvertiseURL: "http://compute"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.lookupHost = func(_ context.Context, host string) ([]string, error) {
+		if host != workload.StorageHeadlessHost {
+			t.Errorf("resolved %s, expected %s", host, workload.StorageHeadlessHost)
+		}
+		return []string{"10.0.0.1", "10.0.0.2"}, nil
+	}
+	endpoints, err := s.subscriptionEndpoints(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"http://10.0.0.1:8081", "http://10.0.0.2:8081"}; !reflect.DeepEqual(endpoints, want) {
+		t.Errorf("subscribing to %v, expected every replica behind the service %v", endpoints, want)
+	}
+}
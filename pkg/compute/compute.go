@@ -1,74 +1,245 @@
 package compute
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/go-logr/logr"
+	"github.com/tomquartz/pyxis-k8s/pkg/admission"
+	"github.com/tomquartz/pyxis-k8s/pkg/drain"
+	"github.com/tomquartz/pyxis-k8s/pkg/kernel"
+	"github.com/tomquartz/pyxis-k8s/pkg/shard"
+	"github.com/tomquartz/pyxis-k8s/pkg/stats"
+	"github.com/tomquartz/pyxis-k8s/pkg/wire"
 	"github.com/tomquartz/pyxis-k8s/pkg/workload"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
 const ComputeServerChanSize = 64
 
+// compute is cut into slices of this length to stop early for canceled requests
+const cancelCheckInterval = 10 * time.Millisecond
+
+// protocols for kv requests to storage
+const (
+	ProtocolHTTP = "http"
+	ProtocolWire = "wire"
+)
+
+type ComputeConfig struct {
+	NumWorkers int
+	// base URLs of the storage replicas in shard order, nil for the in-cluster
+	// storage service
+	StorageEndpoints []string
+	// used for requests to storage, nil for http.DefaultClient
+	Client *http.Client
+	// protocol of kv requests, empty for http
+	Protocol string
+	// binary protocol addresses of the storage replicas in the layout of
+	// StorageEndpoints, nil for the in-cluster storage service
+	StorageWireAddrs []string
+	// nil for an unbounded queue
+	Admission *admission.Config
+	// nil for the default drain timeouts
+	Drain *drain.Config
+	// nil to read every key from storage
+	Cache      *CacheConfig
+	ListenAddr string
+}
+
 type ComputeServer struct {
 	workerChan chan *workload.ClientRequest
 	nWorkers   int
+	router     *shard.Router
+	admission  *admission.Controller
+	stats      *stats.Recorder
+	tracker    drain.Tracker
+	drainCfg   *drain.Config
+	listenAddr string
+	mux        *http.ServeMux
+	client     *http.Client
+	cache      *kvCache
+	// where storage replicas send invalidations to
+	advertiseURL string
+	// resolves the storage replicas behind the storage service
+	lookupHost func(ctx context.Context, host string) ([]string, error)
 }
 
-func NewComputeServer(nWorkers int) *ComputeServer {
-	return &ComputeServer{
+func NewComputeServer(cfg *ComputeConfig) (*ComputeServer, error) {
+	endpoints := cfg.StorageEndpoints
+	if len(endpoints) == 0 {
+		endpoints = workload.StorageShardInternalURLs(1)
+	}
+	s := &ComputeServer{
 		workerChan: make(chan *workload.ClientRequest, ComputeServerChanSize),
-		nWorkers:   nWorkers,
+		nWorkers:   cfg.NumWorkers,
+		router:     shard.NewRouter(shard.NewMap(endpoints, shard.DefaultVirtualNodes), cfg.Client),
+		admission:  admission.NewController(cfg.Admission),
+		stats:      stats.NewRecorder(cfg.NumWorkers),
+		drainCfg:   cfg.Drain,
+		listenAddr: cfg.ListenAddr,
+		mux:        http.NewServeMux(),
+		client:     cfg.Client,
+		lookupHost: net.DefaultResolver.LookupHost,
+	}
+	if s.listenAddr == "" {
+		s.listenAddr = workload.ComputeListenPort
+	}
+	if s.client == nil {
+		s.client = http.DefaultClient
 	}
+	switch cfg.Protocol {
+	case "", ProtocolHTTP:
+	case ProtocolWire:
+		wireAddrs := cfg.StorageWireAddrs
+		if len(wireAddrs) == 0 {
+			wireAddrs = workload.StorageShardWireAddrs(1)
+		}
+		if err := s.router.UseWire(wireAddrs, wire.NewClient(0, 0)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown storage protocol: %s", cfg.Protocol)
+	}
+	if cfg.Cache != nil {
+		if err := validateCacheConfig(cfg.Cache); err != nil {
+			return nil, err
+		}
+		s.cache = newKVCache(cfg.Cache)
+		s.advertiseURL = cfg.Cache.AdvertiseURL
+		s.mux.HandleFunc(workload.ComputeInvalidatePath, s.ServeInvalidate)
+	}
+	s.mux.HandleFunc("/", s.tracker.Wrap(s.Serve))
+	s.mux.HandleFunc(workload.StatsPath, s.ServeStats)
+	s.mux.HandleFunc(workload.ReadyPath, s.tracker.ServeReady)
+	// before serving, so that load does not skew the kernels
+	kernel.Calibrate()
+	return s, nil
+}
+
+// Handler serves the endpoints of the compute server.
+func (s *ComputeServer) Handler() http.Handler {
+	return s.mux
 }
 
 func (s *ComputeServer) Serve(w http.ResponseWriter, r *http.Request) {
 	req := &workload.ClientRequest{}
 	err := json.NewDecoder(r.Body).Decode(req)
-	req = req.SetResponseWriter(w)
+	req = req.SetResponseWriter(w).SetContext(r.Context())
 	if err != nil {
 		req.Error(fmt.Errorf("failed to decode request: %v", err), http.StatusBadRequest)
 		return
 	}
-	s.workerChan <- req
-	<-req.Done()
+	if err := req.Prepare(); err != nil {
+		req.Error(err, workload.FunctionErrorCode(err))
+		return
+	}
+	if err := req.Check(); err != nil {
+		req.Error(err, workload.FunctionErrorCode(err))
+		return
+	}
+	s.admission.Submit(req, func(expired <-chan time.Time) bool {
+		select {
+		case s.workerChan <- req:
+			return true
+		case <-expired:
+			return false
+		case <-req.Canceled():
+			return false
+		}
+	})
 }
 
 func (s *ComputeServer) Run(ctx context.Context) {
+	ln, err := net.Listen("tcp", s.listenAddr)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Failed to listen", "addr", s.listenAddr)
+		return
+	}
+	s.RunListener(ctx, ln)
+}
+
+// RunListener runs the server on ln until ctx is done and the server drained.
+func (s *ComputeServer) RunListener(ctx context.Context, ln net.Listener) {
 	logger := log.FromContext(ctx)
+	workers := sync.WaitGroup{}
 	for i := 0; i < s.nWorkers; i++ {
-		w := NewComputeWorker(i, s.workerChan)
-		go w.Run(ctx)
+		w := NewComputeWorker(i, s)
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			w.Run(ctx)
+		}()
 	}
-	defer close(s.workerChan)
 
-	logger.Info("Starting compute server", "nWorkers", s.nWorkers)
-	http.HandleFunc("/", s.Serve)
-	if err := http.ListenAndServe(workload.ComputeListenPort, nil); err != http.ErrServerClosed {
+	if s.cache != nil {
+		go s.subscribe(ctx)
+	}
+	logger.Info("Starting compute server", "nWorkers", s.nWorkers, "addr", ln.Addr(), "cache", s.cache != nil)
+	srv := &http.Server{Handler: s.mux}
+	if err := s.tracker.Serve(ctx, logger, srv, ln, s.drainCfg); err != nil && err != http.ErrServerClosed {
 		logger.Error(err, "Failed to run compute server")
-	} else {
-		logger.Info("Compute server stopped")
 	}
+	// no handler is left to queue requests
+	close(s.workerChan)
+	workers.Wait()
+	logger.Info("Compute server stopped")
+}
+
+// ComputeStats is the reply of the stats endpoint.
+type ComputeStats struct {
+	*stats.Snapshot
+	// requests rejected by admission control since startup
+	Rejected int64 `json:"rejected"`
+	// nil if the cache is disabled
+	Cache *CacheStats `json:"cache,omitempty"`
+}
+
+// ServeStats replies with the load of the server over the last window=<secs>.
+func (s *ComputeServer) ServeStats(w http.ResponseWriter, r *http.Request) {
+	window, _ := strconv.ParseFloat(r.URL.Query().Get("window"), 64)
+	snap := s.stats.Snapshot(time.Duration(window * float64(time.Second)))
+	snap.QueueLength = s.admission.Depth()
+	w.Header().Set("Content-Type", "application/json")
+	st := &ComputeStats{Snapshot: snap, Rejected: s.admission.Rejected()}
+	if s.cache != nil {
+		st.Cache = s.cache.stats()
+	}
+	json.NewEncoder(w).Encode(st)
 }
 
 type ComputeWorker struct {
-	id    int
-	input chan *workload.ClientRequest
+	id     int
+	server *ComputeServer
 }
 
-func NewComputeWorker(id int, input chan *workload.ClientRequest) *ComputeWorker {
-	return &ComputeWorker{id: id, input: input}
+func NewComputeWorker(id int, server *ComputeServer) *ComputeWorker {
+	return &ComputeWorker{id: id, server: server}
 }
 
 func (w *ComputeWorker) Run(ctx context.Context) {
 	logger := log.FromContext(ctx).WithValues("id", w.id)
-	for req := range w.input {
+	for req := range w.server.workerChan {
+		if !w.server.admission.Start(req) {
+			logger.V(1).Info("skipping rejected request", "request", req.ID)
+			continue
+		}
+		if err := req.Check(); err != nil {
+			logger.V(1).Info("dropping request", "request", req.ID, "reason", err)
+			req.Error(fmt.Errorf("dequeued request: %w", err), workload.FunctionErrorCode(err))
+			req.Close()
+			continue
+		}
+		w.server.stats.Begin()
+		start := time.Now()
 		w.HandleRequest(logger, req)
+		w.server.stats.Done(req.TaskType(), time.Since(start), req.Failed())
 	}
 }
 
@@ -77,95 +248,74 @@ func (w *ComputeWorker) HandleRequest(logger logr.Logger, req *workload.ClientRe
 		panic("missing response writer")
 	}
 	defer req.Close()
-	logger.V(1).Info("processing request", "request", req.ID)
-	if req.DefaultFuncRequest != nil {
-		w.HandleDefaultFunc(logger, req)
-	} else if req.PointerChasingFuncRequest != nil {
-		w.HandlePointerChasing(logger, req)
-	} else {
-		req.Error(fmt.Errorf("unknown request"), http.StatusBadRequest)
+	logger.V(1).Info("processing request", "request", req.ID, "function", req.Function)
+	resp, err := req.Invoke(&computeEnv{server: w.server, req: req})
+	if err != nil {
+		req.Error(err, workload.FunctionErrorCode(err))
+		return
+	}
+	if err := req.Reply(resp); err != nil {
+		logger.Error(err, "failed to reply", "request", req.ID)
 	}
+	logger.V(1).Info("finish request", "request", req.ID)
+}
+
+// computeEnv runs functions on compute with every key read from storage.
+type computeEnv struct {
+	server *ComputeServer
+	// checked before every kv request
+	req   *workload.ClientRequest
+	reads int
 }
 
-func (w *ComputeWorker) HandleDefaultFunc(logger logr.Logger, req *workload.ClientRequest) {
-	// kv accesses
-	kvStartTime := time.Now()
+func (e *computeEnv) Get(keys []string) ([]string, []bool, error) {
+	if err := e.req.Check(); err != nil {
+		return nil, nil, err
+	}
+	e.reads++
 	kvReq := &workload.StorageRequest{
-		ID:   fmt.Sprintf("%s-kv", req.ID),
-		Keys: req.StorageKeys,
+		ID:       fmt.Sprintf("%s-kv%d", e.req.ID, e.reads),
+		Keys:     keys,
+		Deadline: e.req.Deadline,
 	}
-	kvReqJson, err := json.Marshal(kvReq)
+	resp, err := e.server.read(kvReq)
 	if err != nil {
-		req.Error(fmt.Errorf("failed to encode kv req: %v", err), http.StatusBadRequest)
-		return
+		return nil, nil, err
 	}
-	kvResp, err := http.Post(workload.StorageKVInternalURL, "application/json", bytes.NewReader(kvReqJson))
-	if err != nil {
-		req.Error(fmt.Errorf("failed to post kv req: %v", err), http.StatusInternalServerError)
-		return
+	if resp.Len() != len(keys) {
+		return nil, nil, fmt.Errorf("invalid kv resp with %d entries for %d keys", resp.Len(), len(keys))
 	}
-	defer kvResp.Body.Close()
-	kvTime := time.Since(kvStartTime)
-
-	// compute
-	computeStartTime := time.Now()
-	time.Sleep(time.Duration(req.ComputeSecs * float64(time.Second)))
-	computeTime := time.Since(computeStartTime)
+	return resp.Values, resp.Found, nil
+}
 
-	// reply
-	logger.V(1).Info("finish request", "request", req.ID)
-	resp := &workload.ClientResponse{
-		ID:              req.ID,
-		StorageTimeSecs: kvTime.Seconds(),
-		ComputeTimeSecs: computeTime.Seconds(),
+func (e *computeEnv) Put(keys, values []string) error {
+	if err := e.req.Check(); err != nil {
+		return err
 	}
-	if err := req.Reply(resp); err != nil {
-		logger.Error(err, "failed to reply", "request", req.ID)
+	e.reads++
+	kvReq := &workload.StorageRequest{
+		ID:       fmt.Sprintf("%s-kv%d", e.req.ID, e.reads),
+		Keys:     keys,
+		Values:   values,
+		Deadline: e.req.Deadline,
 	}
-	logger.V(1).Info("Finish default func", "request", req.ID)
-}
-
-func (w *ComputeWorker) HandlePointerChasing(logger logr.Logger, req *workload.ClientRequest) {
-	// kv accesses
-	kvStartTime := time.Now()
-	key := req.PointerChasingFuncRequest.InitialKey
-	for i := 0; i < req.PointerChasingFuncRequest.NumHops; i++ {
-		kvReq := &workload.StorageRequest{
-			ID:   fmt.Sprintf("%s-%d", req.ID, i),
-			Keys: []string{key},
-		}
-		kvReqJson, err := json.Marshal(kvReq)
-		if err != nil {
-			req.Error(fmt.Errorf("failed to encode kv req: %v", err), http.StatusBadRequest)
-			return
-		}
-		httpResp, err := http.Post(workload.StorageKVInternalURL, "application/json", bytes.NewReader(kvReqJson))
-		if err != nil {
-			req.Error(fmt.Errorf("failed to post kv req: %v", err), http.StatusInternalServerError)
-			return
-		}
-		defer httpResp.Body.Close()
-		resp := &workload.StorageResponse{}
-		if err := json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
-			req.Error(fmt.Errorf("failed to decode kv resp: %v", err), http.StatusInternalServerError)
-			return
-		}
-		key = resp.Values[0]
-		if key == "N/A" {
-			break
-		}
+	_, err := e.server.read(kvReq)
+	if e.server.cache != nil {
+		// do not wait for storage to invalidate the keys of our own writes
+		e.server.cache.invalidate(keys)
 	}
-	kvTime := time.Since(kvStartTime)
+	return err
+}
 
-	// reply
-	logger.V(1).Info("finish request", "request", req.ID)
-	resp := &workload.ClientResponse{
-		ID:              req.ID,
-		Result:          key,
-		StorageTimeSecs: kvTime.Seconds(),
+// Compute stops early once the request expired or its caller went away.
+func (e *computeEnv) Compute(name string, d time.Duration) {
+	work := kernel.Work(name)
+	for d > 0 && e.req.Check() == nil {
+		slice := min(d, cancelCheckInterval)
+		work(slice)
+		d -= slice
 	}
-	if err := req.Reply(resp); err != nil {
-		logger.Error(err, "failed to reply", "request", req.ID)
-	}
-	logger.V(1).Info("Finish pointer chasing func", "request", req.ID)
 }
+
+// Yield does nothing, compute workers do not serve other requests.
+func (e *computeEnv) Yield() {}
@@ -0,0 +1,125 @@
+package drain
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	DefaultTimeout      = 30 * time.Second
+	DefaultUnreadyDelay = time.Second
+)
+
+type Config struct {
+	// time queued and in-flight requests get to finish after shutdown begins
+	TimeoutSecs float64
+	// time the server keeps listening with failed readiness before it stops
+	// accepting connections, so that load balancers can take it out first
+	UnreadyDelaySecs float64
+}
+
+func (c *Config) timeout() time.Duration {
+	if c == nil || c.TimeoutSecs <= 0 {
+		return DefaultTimeout
+	}
+	return time.Duration(c.TimeoutSecs * float64(time.Second))
+}
+
+func (c *Config) unreadyDelay() time.Duration {
+	if c == nil {
+		return DefaultUnreadyDelay
+	}
+	return time.Duration(c.UnreadyDelaySecs * float64(time.Second))
+}
+
+// Tracker counts the requests in flight and turns new ones away once the
+// server is draining.
+type Tracker struct {
+	mu       sync.RWMutex
+	draining bool
+	inflight sync.WaitGroup
+}
+
+// Enter registers a new request and returns false if the server is draining.
+// Every successful Enter must be followed by a Leave.
+func (t *Tracker) Enter() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.draining {
+		return false
+	}
+	t.inflight.Add(1)
+	return true
+}
+
+func (t *Tracker) Leave() {
+	t.inflight.Done()
+}
+
+func (t *Tracker) Draining() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.draining
+}
+
+// Wrap rejects requests with 503 while draining.
+func (t *Tracker) Wrap(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !t.Enter() {
+			w.Header().Set("Connection", "close")
+			http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		defer t.Leave()
+		h(w, r)
+	}
+}
+
+// ServeReady is the readiness probe, which fails once the server is draining.
+func (t *Tracker) ServeReady(w http.ResponseWriter, r *http.Request) {
+	if t.Draining() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// Serve runs srv on ln until ctx is done and then drains it: readiness fails and new
+// requests are rejected, the listener closes after the unready delay, and
+// in-flight requests get until the timeout to finish. Serve returns once no
+// handler is running anymore, so the caller may stop its workers.
+func (t *Tracker) Serve(ctx context.Context, logger logr.Logger, srv *http.Server, ln net.Listener, cfg *Config) error {
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- srv.Serve(ln)
+	}()
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+	}
+	start := time.Now()
+	t.mu.Lock()
+	t.draining = true
+	t.mu.Unlock()
+	logger.Info("Draining server", "timeout", cfg.timeout(), "unreadyDelay", cfg.unreadyDelay())
+	time.Sleep(cfg.unreadyDelay())
+
+	shutdownCtx, cancel := context.WithDeadline(context.Background(), start.Add(cfg.timeout()))
+	defer cancel()
+	err := srv.Shutdown(shutdownCtx)
+	if err != nil {
+		logger.Error(err, "Drain timed out, closing remaining connections")
+		srv.Close()
+	}
+	// handlers of closed connections may still wait for their workers
+	t.inflight.Wait()
+	logger.Info("Server drained", "elapsed", time.Since(start))
+	return err
+}
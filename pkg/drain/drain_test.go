@@ -0,0 +1,86 @@
+package drain
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+func TestServeDrainsInFlightRequests(t *testing.T) {
+	const inflight = 8
+	var tracker Tracker
+	started := make(chan struct{}, inflight)
+	release := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", tracker.Wrap(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		io.WriteString(w, "done")
+	}))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + ln.Addr().String()
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- tracker.Serve(ctx, logr.Discard(), &http.Server{Handler: mux}, ln, &Config{TimeoutSecs: 5, UnreadyDelaySecs: 0.5})
+	}()
+
+	codes := make([]int, inflight)
+	wg := sync.WaitGroup{}
+	for i := 0; i < inflight; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := http.Get(url)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			codes[i] = resp.StatusCode
+		}(i)
+	}
+	for i := 0; i < inflight; i++ {
+		<-started
+	}
+	cancel()
+	for !tracker.Draining() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the listener stays open during the unready delay but turns requests away
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("new request during drain got %d, expected %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	select {
+	case err := <-served:
+		t.Fatalf("server stopped with requests in flight: %v", err)
+	default:
+	}
+
+	close(release)
+	wg.Wait()
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("in-flight request %d got %d, expected it to finish", i, code)
+		}
+	}
+	if err := <-served; err != nil {
+		t.Errorf("drain failed: %v", err)
+	}
+}
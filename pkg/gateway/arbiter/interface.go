@@ -2,6 +2,8 @@ package arbiter
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 
 	"github.com/tomquartz/pyxis-k8s/pkg/workload"
 )
@@ -17,6 +19,34 @@ const (
 	ToStorage
 )
 
+const (
+	FrameworkKayak = "kayak"
+	FrameworkPyxis = "pyxis"
+)
+
+// New creates the arbiter of framework from its json config, scheduling
+// requests of the given task profiles.
+func New(framework string, cfgJson []byte, profiles []workload.TaskProfile) (Arbiter, error) {
+	switch framework {
+	case FrameworkKayak:
+		var cfg KayakConfig
+		if err := json.Unmarshal(cfgJson, &cfg); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal %s config: %v", framework, err)
+		}
+		cfg.TaskProfiles = profiles
+		return NewKayak(&cfg), nil
+	case FrameworkPyxis:
+		var cfg PyxisConfig
+		if err := json.Unmarshal(cfgJson, &cfg); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal %s config: %v", framework, err)
+		}
+		cfg.TaskProfiles = profiles
+		return NewPyxis(&cfg), nil
+	default:
+		return nil, fmt.Errorf("unknown arbiter framework: %s", framework)
+	}
+}
+
 type ArbiterConfig struct {
 	IntervalSecs float64                `json:"intervalSecs"`
 	StartPoint   float64                `json:"startPoint"`
@@ -68,8 +68,12 @@ func (p *Pyxis) Schedule(req *workload.ClientRequest) (dest int) {
 	return dest
 }
 
+// Finish counts served requests only, so that failing fast on one tier does
+// not look like throughput.
 func (p *Pyxis) Finish(resp *workload.ClientResponse) {
-	p.tputMetric.Add()
+	if resp.Status == workload.SUCCESS {
+		p.tputMetric.Add()
+	}
 }
 
 func (p *Pyxis) Run(ctx context.Context) {
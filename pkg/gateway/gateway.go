@@ -4,37 +4,123 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/tomquartz/pyxis-k8s/pkg/gateway/arbiter"
+	"github.com/tomquartz/pyxis-k8s/pkg/shard"
 	"github.com/tomquartz/pyxis-k8s/pkg/workload"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
+const DefaultRequestTimeout = 10 * time.Second
+
+type GatewayConfig struct {
+	MaxOut  int
+	Arbiter arbiter.Arbiter
+	// client-facing URL of the compute service, empty for the node port
+	ComputeURL string
+	// client-facing base URLs of the storage replicas in shard order, nil for
+	// the node port
+	StorageEndpoints []string
+	// nil for http.DefaultClient
+	Client *http.Client
+	// deadline of requests that do not set one, 0 for the default
+	RequestTimeoutSecs float64
+	// nil to not retry failed requests
+	Retry RetryConfig
+	// hedge policies of the task types, indexed by TypeID, nil to not hedge
+	TaskProfiles []workload.TaskProfile
+}
+
+// Gateway schedules the requests of any number of callers to compute or
+// storage and routes every response back to the caller of its request.
 type Gateway struct {
-	requestChan  chan *workload.ClientRequest
-	responseChan chan *workload.ClientResponse
-	arbiter      arbiter.Arbiter
+	requestChan    chan *submission
+	arbiter        arbiter.Arbiter
+	computeURL     string
+	storageShards  *shard.Map
+	client         *http.Client
+	requestTimeout time.Duration
+	retry          RetryConfig
+	// by TypeID, nil entries are not hedged
+	hedge     []*workload.HedgePolicy
+	latencies *latencyTracker
 }
 
-func NewGateway(maxout int, arbiter arbiter.Arbiter) *Gateway {
-	return &Gateway{
-		requestChan:  make(chan *workload.ClientRequest, maxout),
-		responseChan: make(chan *workload.ClientResponse, maxout),
-		arbiter:      arbiter,
+func NewGateway(cfg *GatewayConfig) *Gateway {
+	g := &Gateway{
+		requestChan:    make(chan *submission, cfg.MaxOut),
+		arbiter:        cfg.Arbiter,
+		computeURL:     cfg.ComputeURL,
+		client:         cfg.Client,
+		requestTimeout: time.Duration(cfg.RequestTimeoutSecs * float64(time.Second)),
+		retry:          cfg.Retry,
+		latencies:      newLatencyTracker(),
+	}
+	for _, profile := range cfg.TaskProfiles {
+		if profile.Hedge == nil || profile.TypeID < 0 {
+			continue
+		}
+		if profile.TypeID >= len(g.hedge) {
+			g.hedge = append(g.hedge, make([]*workload.HedgePolicy, profile.TypeID+1-len(g.hedge))...)
+		}
+		g.hedge[profile.TypeID] = profile.Hedge
 	}
+	if g.computeURL == "" {
+		g.computeURL = workload.ComputeServiceURL
+	}
+	endpoints := cfg.StorageEndpoints
+	if len(endpoints) == 0 {
+		endpoints = []string{workload.StorageServiceURL}
+	}
+	g.storageShards = shard.NewMap(endpoints, shard.DefaultVirtualNodes)
+	if g.client == nil {
+		g.client = http.DefaultClient
+	}
+	if g.requestTimeout <= 0 {
+		g.requestTimeout = DefaultRequestTimeout
+	}
+	return g
+}
+
+// submission is a queued request and where its response goes.
+type submission struct {
+	ctx context.Context
+	req *workload.ClientRequest
+	out chan<- *workload.ClientResponse
 }
 
-func (g *Gateway) Input() chan<- *workload.ClientRequest {
-	return g.requestChan
+// Send queues req and delivers its response on out, which must have room for
+// it unless the caller keeps receiving. Canceling ctx gives up queueing and
+// cancels req once it is sent.
+func (g *Gateway) Send(ctx context.Context, req *workload.ClientRequest, out chan<- *workload.ClientResponse) error {
+	select {
+	case g.requestChan <- &submission{ctx: ctx, req: req, out: out}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func (g *Gateway) Output() <-chan *workload.ClientResponse {
-	return g.responseChan
+// Submit sends req and waits for its response.
+func (g *Gateway) Submit(ctx context.Context, req *workload.ClientRequest) (*workload.ClientResponse, error) {
+	out := make(chan *workload.ClientResponse, 1)
+	if err := g.Send(ctx, req, out); err != nil {
+		return nil, err
+	}
+	select {
+	case resp := <-out:
+		return resp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
 
 func (g *Gateway) Run(ctx context.Context) {
@@ -42,8 +128,8 @@ func (g *Gateway) Run(ctx context.Context) {
 	logger := log.FromContext(ctx)
 	for {
 		select {
-		case req := <-g.requestChan:
-			go g.handleRequest(ctx, logger, req)
+		case sub := <-g.requestChan:
+			go g.handleRequest(ctx, logger, sub)
 		case <-ctx.Done():
 			return
 		}
@@ -51,12 +137,21 @@ func (g *Gateway) Run(ctx context.Context) {
 }
 
 // assume req is assigned ID
-func (g *Gateway) handleRequest(ctx context.Context, _ logr.Logger, req *workload.ClientRequest) {
+func (g *Gateway) handleRequest(ctx context.Context, _ logr.Logger, sub *submission) {
+	req := sub.req
+	// canceled by the caller or when the gateway stops
+	reqCtx, cancel := context.WithCancel(sub.ctx)
+	defer cancel()
+	stop := context.AfterFunc(ctx, cancel)
+	defer stop()
 	resp := &workload.ClientResponse{}
 	defer func() {
 		resp.ID = req.ID
-		g.responseChan <- resp
+		sub.out <- resp
 	}()
+	if req.Deadline == 0 {
+		req.Deadline = workload.DeadlineAt(time.Now().Add(g.requestTimeout))
+	}
 	reqBytes, err := json.Marshal(req)
 	if err != nil {
 		resp.Status = workload.FAIL_MARSHAL
@@ -66,57 +161,123 @@ func (g *Gateway) handleRequest(ctx context.Context, _ logr.Logger, req *workloa
 	start := time.Now()
 	// schedule
 	decision := g.arbiter.Schedule(req)
-	defer g.arbiter.Finish(resp)
-	var postURL string
-	switch decision {
-	case arbiter.ToCompute:
-		postURL = workload.ComputeServiceURL
-		// logger.V(1).Info(fmt.Sprintf("type %d -> compute", req.TypeID))
-	case arbiter.ToStorage:
-		postURL = workload.StoragePushdownServiceURL
-		// logger.V(1).Info(fmt.Sprintf("type %d -> storage", req.TypeID))
-	default:
+	defer func() {
+		g.arbiter.Finish(resp)
+	}()
+	if decision != arbiter.ToCompute && decision != arbiter.ToStorage {
 		resp.Status = workload.FAIL_SCHEDULE
 		resp.Result = "invalid arbiter decision"
 		return
 	}
+	for attempts := 1; ; attempts++ {
+		var code, tier int
+		resp, code, tier = g.send(reqCtx, req, reqBytes, decision, start)
+		resp.Attempts, resp.Tier = attempts, tierName(tier)
+		policy := g.retry[retryKey(code)]
+		if resp.Status == workload.SUCCESS || policy == nil || attempts >= policy.MaxAttempts || !mayRetry(req, code) {
+			return
+		}
+		backoff := policy.backoff(attempts)
+		if policy.Fallback {
+			decision = arbiter.ToCompute + arbiter.ToStorage - decision
+		} else {
+			// the same server asked to be left alone for a while
+			backoff = max(backoff, time.Duration(resp.RetryAfterSecs*float64(time.Second)))
+		}
+		if remaining, _ := req.Deadline.Remaining(); remaining <= backoff {
+			return
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-reqCtx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// attempt sends req to the tier of decision once. It returns the response
+// along with the http status code, or 0 if no response was received.
+func (g *Gateway) attempt(ctx context.Context, req *workload.ClientRequest, reqBytes []byte, decision int, start time.Time) (*workload.ClientResponse, int) {
+	resp := &workload.ClientResponse{}
+	postURL := g.computeURL
+	if decision == arbiter.ToStorage {
+		postURL = g.pushdownURL(req)
+	}
 	// post
-	postCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
-	defer cancel()
+	deadline, _ := req.Deadline.Time()
+	postCtx, cancelPost := context.WithDeadline(ctx, deadline)
+	defer cancelPost()
 	httpReq, err := http.NewRequestWithContext(postCtx, http.MethodPost, postURL, bytes.NewReader(reqBytes))
 	if err != nil {
 		resp.Status = workload.FAIL_SEND
 		resp.Result = err.Error()
-		return
+		return resp, 0
 	}
-	// httpResp, err := http.Post(postURL, "application/json", bytes.NewReader(reqBytes))
 	httpReq.Header.Set("Content-Type", "application/json")
-	httpResp, err := http.DefaultClient.Do(httpReq)
+	httpResp, err := g.client.Do(httpReq)
 	if err != nil {
 		resp.Status = workload.FAIL_SEND
+		if errors.Is(err, context.DeadlineExceeded) {
+			resp.Status = workload.FAIL_DEADLINE
+			resp.Latency = time.Since(start)
+		}
 		resp.Result = err.Error()
-		return
+		if postCtx.Err() != nil {
+			// expired or canceled, not worth a retry either way
+			return resp, workload.DeadlineExceededCode
+		}
+		return resp, 0
 	}
 	defer httpResp.Body.Close()
+	code := httpResp.StatusCode
 	// decode
-	if httpResp.StatusCode != http.StatusOK {
+	if code == http.StatusTooManyRequests {
+		resp.Status = workload.FAIL_OVERLOADED
+		resp.RetryAfterSecs, _ = strconv.ParseFloat(httpResp.Header.Get("Retry-After"), 64)
+		resp.QueueDepth, _ = strconv.Atoi(httpResp.Header.Get(workload.QueueDepthHeader))
+		msg, _ := io.ReadAll(httpResp.Body)
+		resp.Result = strings.TrimSpace(string(msg))
+		resp.Latency = time.Since(start)
+		return resp, code
+	}
+	if code == workload.DeadlineExceededCode {
+		resp.Status = workload.FAIL_DEADLINE
+		msg, _ := io.ReadAll(httpResp.Body)
+		resp.Result = strings.TrimSpace(string(msg))
+		resp.Latency = time.Since(start)
+		return resp, code
+	}
+	if code != http.StatusOK {
 		resp.Status = workload.FAIL_EXECUTE
 		if msg, err := io.ReadAll(httpResp.Body); err != nil {
 			resp.Result = fmt.Sprintf("request failed with status: %v | failed to read response body: %v", resp.Status, err)
 		} else {
 			resp.Result = fmt.Sprintf("request failed with status: %v | %v", resp.Status, string(msg))
 		}
-		return
+		return resp, code
 	}
 	if err := json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
 		resp.Status = workload.FAIL_UNMARSHAL
 		resp.Result = err.Error()
-		return
+		return resp, code
 	}
 	resp.Status = workload.SUCCESS
 	resp.Latency = time.Since(start)
-	// if resp.ComputeTimeSecs <= 0 || resp.StorageTimeSecs <= 0 {
-	// 	resp.Status = workload.FAIL_UNMARSHAL
-	// 	resp.Result = "invalid response: zero compute or storage time: " + resp.Result
-	// }
+	return resp, code
+}
+
+func tierName(decision int) string {
+	if decision == arbiter.ToStorage {
+		return workload.TierStorage
+	}
+	return workload.TierCompute
+}
+
+// pushdownURL picks the storage replica owning the data the request touches.
+// Keys owned by other replicas are fetched by the storage server itself.
+func (g *Gateway) pushdownURL(req *workload.ClientRequest) string {
+	keys := req.Keys()
+	return g.storageShards.Endpoint(g.storageShards.Primary(keys)) + workload.StoragePushdownPath
 }
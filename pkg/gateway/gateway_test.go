@@ -0,0 +1,268 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tomquartz/pyxis-k8s/pkg/gateway/arbiter"
+	"github.com/tomquartz/pyxis-k8s/pkg/workload"
+)
+
+// fixedArbiter sends every request to the same tier.
+type fixedArbiter int
+
+func (a fixedArbiter) Run(ctx context.Context)                  {}
+func (a fixedArbiter) Schedule(req *workload.ClientRequest) int { return int(a) }
+func (a fixedArbiter) Finish(resp *workload.ClientResponse)     {}
+
+// fakeTier stands in for the compute service or a storage replica. reply
+// answers the call-th request it got, counting from 1.
+type fakeTier struct {
+	*httptest.Server
+	calls atomic.Int32
+}
+
+func newFakeTier(t *testing.T, reply func(call int32, w http.ResponseWriter, r *http.Request)) *fakeTier {
+	f := &fakeTier{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reply(f.calls.Add(1), w, r)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// succeed replies with result after delay, or gives up once the request is
+// canceled.
+func succeed(result string, delay time.Duration) func(int32, http.ResponseWriter, *http.Request) {
+	return func(_ int32, w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		json.NewEncoder(w).Encode(&workload.ClientResponse{Result: result})
+	}
+}
+
+// failFirst fails the first n calls with code and succeeds afterwards.
+func failFirst(n int32, code int, retryAfter string) func(int32, http.ResponseWriter, *http.Request) {
+	return func(call int32, w http.ResponseWriter, r *http.Request) {
+		if call <= n {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.Header().Set(workload.QueueDepthHeader, "7")
+			http.Error(w, "try again", code)
+			return
+		}
+		json.NewEncoder(w).Encode(&workload.ClientResponse{Result: "ok"})
+	}
+}
+
+// startGateway runs a gateway scheduling everything to compute until the
+// test ends.
+func startGateway(t *testing.T, compute, storage *fakeTier, retry RetryConfig, profiles []workload.TaskProfile) *Gateway {
+	g := NewGateway(&GatewayConfig{
+		MaxOut:             4,
+		Arbiter:            fixedArbiter(arbiter.ToCompute),
+		ComputeURL:         compute.URL,
+		StorageEndpoints:   []string{storage.URL},
+		RequestTimeoutSecs: 5,
+		Retry:              retry,
+		TaskProfiles:       profiles,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	go g.Run(ctx)
+	t.Cleanup(cancel)
+	return g
+}
+
+func submit(t *testing.T, g *Gateway, req *workload.ClientRequest) *workload.ClientResponse {
+	resp, err := g.Submit(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func readRequest(id string) *workload.ClientRequest {
+	return &workload.ClientRequest{ID: id, Function: workload.FuncDefault}
+}
+
+func writeRequest(t *testing.T, id string, idempotent bool) *workload.ClientRequest {
+	req, err := workload.NewClientRequest(id, 0, workload.FuncScript, &workload.ScriptFuncRequest{
+		Source:      `put(key(0), "v")`,
+		StorageKeys: []string{"k"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Idempotent = idempotent
+	return req
+}
+
+func TestRetryOverloadedAfterRetryAfter(t *testing.T) {
+	compute := newFakeTier(t, failFirst(1, http.StatusTooManyRequests, "0.3"))
+	storage := newFakeTier(t, succeed("storage", 0))
+	g := startGateway(t, compute, storage, RetryConfig{
+		"429": {MaxAttempts: 3, BackoffSecs: 0.001},
+	}, nil)
+	start := time.Now()
+	resp := submit(t, g, readRequest("r"))
+	if resp.Status != workload.SUCCESS || resp.Attempts != 2 || resp.Tier != workload.TierCompute {
+		t.Fatalf("got status %d after %d attempts on %s: %s", resp.Status, resp.Attempts, resp.Tier, resp.Result)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("retried after %v, before Retry-After", elapsed)
+	}
+	if n := storage.calls.Load(); n != 0 {
+		t.Errorf("storage got %d attempts", n)
+	}
+}
+
+func TestRetryOverloadedGivesUp(t *testing.T) {
+	compute := newFakeTier(t, failFirst(10, http.StatusTooManyRequests, "0"))
+	storage := newFakeTier(t, succeed("storage", 0))
+	g := startGateway(t, compute, storage, RetryConfig{
+		"429": {MaxAttempts: 2, BackoffSecs: 0.001},
+	}, nil)
+	resp := submit(t, g, readRequest("r"))
+	if resp.Status != workload.FAIL_OVERLOADED || resp.Attempts != 2 || resp.QueueDepth != 7 {
+		t.Errorf("got status %d after %d attempts with queue depth %d", resp.Status, resp.Attempts, resp.QueueDepth)
+	}
+}
+
+func TestRetryFallback(t *testing.T) {
+	compute := newFakeTier(t, failFirst(10, http.StatusServiceUnavailable, "10"))
+	storage := newFakeTier(t, succeed("storage", 0))
+	g := startGateway(t, compute, storage, RetryConfig{
+		"503": {MaxAttempts: 2, BackoffSecs: 0.001, Fallback: true},
+	}, nil)
+	start := time.Now()
+	resp := submit(t, g, readRequest("r"))
+	if resp.Status != workload.SUCCESS || resp.Result != "storage" || resp.Tier != workload.TierStorage || resp.Attempts != 2 {
+		t.Fatalf("got status %d after %d attempts on %s: %s", resp.Status, resp.Attempts, resp.Tier, resp.Result)
+	}
+	// the fallback does not wait for the Retry-After of the other tier
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("fell back after %v", elapsed)
+	}
+	if n := compute.calls.Load(); n != 1 {
+		t.Errorf("compute got %d attempts", n)
+	}
+}
+
+func TestRetryOnlyRepeatable(t *testing.T) {
+	retry := RetryConfig{
+		"429": {MaxAttempts: 2, BackoffSecs: 0.001},
+		"503": {MaxAttempts: 2, BackoffSecs: 0.001},
+	}
+	for _, c := range []struct {
+		name     string
+		req      func() *workload.ClientRequest
+		code     int
+		attempts int
+	}{
+		{"read", func() *workload.ClientRequest { return readRequest("r") }, http.StatusServiceUnavailable, 2},
+		{"write", func() *workload.ClientRequest { return writeRequest(t, "w", false) }, http.StatusServiceUnavailable, 1},
+		{"idempotent write", func() *workload.ClientRequest { return writeRequest(t, "w", true) }, http.StatusServiceUnavailable, 2},
+		// rejected before it ran
+		{"overloaded write", func() *workload.ClientRequest { return writeRequest(t, "w", false) }, http.StatusTooManyRequests, 2},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			compute := newFakeTier(t, failFirst(1, c.code, ""))
+			storage := newFakeTier(t, succeed("storage", 0))
+			g := startGateway(t, compute, storage, retry, nil)
+			resp := submit(t, g, c.req())
+			if resp.Attempts != c.attempts || compute.calls.Load() != int32(c.attempts) {
+				t.Errorf("got %d attempts, %d calls, expected %d", resp.Attempts, compute.calls.Load(), c.attempts)
+			}
+			if succeeded := resp.Status == workload.SUCCESS; succeeded != (c.attempts == 2) {
+				t.Errorf("got status %d: %s", resp.Status, resp.Result)
+			}
+		})
+	}
+}
+
+func TestHedgeWinner(t *testing.T) {
+	for _, c := range []struct {
+		name         string
+		policy       workload.HedgePolicy
+		computeDelay time.Duration
+		write        bool
+		tier         string
+		hedged       bool
+	}{
+		{"race", workload.HedgePolicy{Race: true}, time.Second, false, workload.TierStorage, true},
+		{"slow scheduled tier", workload.HedgePolicy{DelaySecs: 0.05}, time.Second, false, workload.TierStorage, true},
+		{"fast scheduled tier", workload.HedgePolicy{DelaySecs: 1}, 0, false, workload.TierCompute, false},
+		{"write", workload.HedgePolicy{Race: true}, 200 * time.Millisecond, true, workload.TierCompute, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			compute := newFakeTier(t, succeed(workload.TierCompute, c.computeDelay))
+			storage := newFakeTier(t, succeed(workload.TierStorage, 0))
+			policy := c.policy
+			g := startGateway(t, compute, storage, nil, []workload.TaskProfile{{TypeID: 0, Hedge: &policy}})
+			req := readRequest("r")
+			if c.write {
+				req = writeRequest(t, "w", false)
+			}
+			resp := submit(t, g, req)
+			if resp.Status != workload.SUCCESS || resp.Tier != c.tier || resp.Result != c.tier || resp.Hedged != c.hedged {
+				t.Errorf("got status %d from %s (%s), hedged %v", resp.Status, resp.Tier, resp.Result, resp.Hedged)
+			}
+			if n := storage.calls.Load(); (n > 0) != c.hedged {
+				t.Errorf("storage got %d attempts", n)
+			}
+		})
+	}
+}
+
+// The canceled loser of a race still counts as taking at least as long as it
+// ran, so slow tiers do not look fast.
+func TestHedgeRecordsLoserLatency(t *testing.T) {
+	compute := newFakeTier(t, succeed(workload.TierCompute, time.Second))
+	storage := newFakeTier(t, succeed(workload.TierStorage, 100*time.Millisecond))
+	g := startGateway(t, compute, storage, nil, []workload.TaskProfile{{TypeID: 0, Hedge: &workload.HedgePolicy{Race: true}}})
+	resp := submit(t, g, readRequest("r"))
+	if resp.Tier != workload.TierStorage {
+		t.Fatalf("got %s from %s", resp.Result, resp.Tier)
+	}
+	for decision, name := range []string{workload.TierCompute, workload.TierStorage} {
+		g.latencies.mu.Lock()
+		ring := g.latencies.samples[latencyKey{0, decision}]
+		g.latencies.mu.Unlock()
+		if ring == nil || len(ring.buf) != 1 || ring.buf[0] < 100*time.Millisecond {
+			t.Errorf("%s latencies: %+v", name, ring)
+		}
+	}
+}
+
+func TestLatencyPercentile(t *testing.T) {
+	tracker := newLatencyTracker()
+	for i := 1; i < minLatencySamples; i++ {
+		tracker.record(0, arbiter.ToCompute, time.Duration(i)*time.Millisecond)
+	}
+	if _, ok := tracker.percentile(0, arbiter.ToCompute, 50); ok {
+		t.Error("trusted too few latencies")
+	}
+	// the window keeps the latest latencyWindow samples, all 1s
+	for i := 0; i < latencyWindow; i++ {
+		tracker.record(0, arbiter.ToCompute, time.Second)
+	}
+	if p, ok := tracker.percentile(0, arbiter.ToCompute, 50); !ok || p != time.Second {
+		t.Errorf("got median %v, %v", p, ok)
+	}
+	tracker.record(0, arbiter.ToCompute, 2*time.Second)
+	if p, _ := tracker.percentile(0, arbiter.ToCompute, 99.9); p != 2*time.Second {
+		t.Errorf("got p99.9 %v", p)
+	}
+	if _, ok := tracker.percentile(0, arbiter.ToStorage, 50); ok {
+		t.Error("tiers share latencies")
+	}
+}
@@ -0,0 +1,166 @@
+package gateway
+
+import (
+	"context"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/tomquartz/pyxis-k8s/pkg/gateway/arbiter"
+	"github.com/tomquartz/pyxis-k8s/pkg/workload"
+)
+
+const (
+	// latencies kept per task type and tier
+	latencyWindow = 256
+	// latencies seen before the percentile is trusted
+	minLatencySamples = 20
+)
+
+// latencyTracker keeps the latencies of the last successful attempts of every
+// task type on either tier, and how long the attempts that lost a hedge race
+// had run when they were canceled.
+type latencyTracker struct {
+	mu      sync.Mutex
+	samples map[latencyKey]*latencyRing
+}
+
+type latencyKey struct {
+	typeID   int
+	decision int
+}
+
+type latencyRing struct {
+	buf  []time.Duration
+	next int
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{samples: map[latencyKey]*latencyRing{}}
+}
+
+func (t *latencyTracker) record(typeID, decision int, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := latencyKey{typeID, decision}
+	ring := t.samples[key]
+	if ring == nil {
+		ring = &latencyRing{}
+		t.samples[key] = ring
+	}
+	if len(ring.buf) < latencyWindow {
+		ring.buf = append(ring.buf, d)
+		return
+	}
+	ring.buf[ring.next] = d
+	ring.next = (ring.next + 1) % latencyWindow
+}
+
+// percentile returns the p-th percentile latency, or false if too few were seen.
+func (t *latencyTracker) percentile(typeID, decision int, p float64) (time.Duration, bool) {
+	t.mu.Lock()
+	ring := t.samples[latencyKey{typeID, decision}]
+	if ring == nil || len(ring.buf) < minLatencySamples {
+		t.mu.Unlock()
+		return 0, false
+	}
+	sorted := slices.Clone(ring.buf)
+	t.mu.Unlock()
+	slices.Sort(sorted)
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	return sorted[max(i, 0)], true
+}
+
+// hedgeDelay returns how long the request waits for the scheduled tier before
+// it is also sent to the other one.
+func (g *Gateway) hedgeDelay(policy *workload.HedgePolicy, typeID, decision int) time.Duration {
+	if policy.Race {
+		return 0
+	}
+	delay := time.Duration(policy.DelaySecs * float64(time.Second))
+	if policy.Percentile > 0 {
+		if p, ok := g.latencies.percentile(typeID, decision, policy.Percentile); ok {
+			delay = max(delay, p)
+		}
+	}
+	return delay
+}
+
+type hedgeResult struct {
+	resp     *workload.ClientResponse
+	code     int
+	decision int
+}
+
+// send sends req to the tier of decision and, if its type has a hedge policy
+// and it is repeatable, to the other tier as well. It returns the first success, or the last failure
+// if neither attempt succeeded, along with the tier it came from. The losing
+// attempt is canceled.
+func (g *Gateway) send(ctx context.Context, req *workload.ClientRequest, reqBytes []byte, decision int, start time.Time) (*workload.ClientResponse, int, int) {
+	var policy *workload.HedgePolicy
+	if req.TypeID >= 0 && req.TypeID < len(g.hedge) {
+		policy = g.hedge[req.TypeID]
+	}
+	if policy == nil || !req.Repeatable() {
+		sent := time.Now()
+		resp, code := g.attempt(ctx, req, reqBytes, decision, start)
+		if resp.Status == workload.SUCCESS {
+			g.latencies.record(req.TypeID, decision, time.Since(sent))
+		}
+		return resp, code, decision
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan hedgeResult, 2)
+	// by decision, zero once the attempt returned
+	var sent [2]time.Time
+	launch := func(decision int) {
+		sent[decision] = time.Now()
+		go func() {
+			resp, code := g.attempt(ctx, req, reqBytes, decision, start)
+			results <- hedgeResult{resp, code, decision}
+		}()
+	}
+	launch(decision)
+	pending := 1
+	var hedgeTimer <-chan time.Time
+	if delay := g.hedgeDelay(policy, req.TypeID, decision); delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		hedgeTimer = timer.C
+	} else {
+		launch(arbiter.ToCompute + arbiter.ToStorage - decision)
+		pending++
+	}
+	hedged := pending == 2
+	// a failure before the hedge fired is left to the retry policies
+	var last hedgeResult
+	for pending > 0 {
+		select {
+		case <-hedgeTimer:
+			hedgeTimer = nil
+			launch(arbiter.ToCompute + arbiter.ToStorage - decision)
+			pending++
+			hedged = true
+			continue
+		case last = <-results:
+			pending--
+		}
+		elapsed := time.Since(sent[last.decision])
+		sent[last.decision] = time.Time{}
+		if last.resp.Status == workload.SUCCESS {
+			g.latencies.record(req.TypeID, last.decision, elapsed)
+			break
+		}
+	}
+	// the loser would have taken at least as long as it ran, leaving it out
+	// would bias the percentile low and hedge ever more requests
+	for d, t := range sent {
+		if !t.IsZero() {
+			g.latencies.record(req.TypeID, d, time.Since(t))
+		}
+	}
+	last.resp.Hedged = hedged
+	return last.resp, last.code, last.decision
+}
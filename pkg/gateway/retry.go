@@ -0,0 +1,78 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tomquartz/pyxis-k8s/pkg/workload"
+)
+
+// RetrySend is the key of the policy for attempts that got no response.
+const RetrySend = "send"
+
+// RetryPolicy retries the attempts of a request that failed the same way.
+type RetryPolicy struct {
+	// attempts of a request including the first one
+	MaxAttempts int `json:"maxAttempts"`
+	// wait before the first retry, doubled for every further one up to
+	// MaxBackoffSecs if set
+	BackoffSecs    float64 `json:"backoffSecs"`
+	MaxBackoffSecs float64 `json:"maxBackoffSecs,omitempty"`
+	// retry on the other tier instead of the one that failed, without waiting
+	// for its Retry-After
+	Fallback bool `json:"fallback,omitempty"`
+}
+
+// RetryConfig maps the http status codes of failed attempts, or RetrySend, to
+// how the request is retried. Other failures are not retried, and no request
+// is retried past its deadline. A failed attempt may still have run, so only
+// repeatable requests are retried (see workload.ClientRequest.Repeatable),
+// except for those rejected with 429 by admission control before running.
+type RetryConfig map[string]*RetryPolicy
+
+// ParseRetryConfig decodes and validates a json RetryConfig.
+func ParseRetryConfig(data []byte) (RetryConfig, error) {
+	cfg := RetryConfig{}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal retry config: %v", err)
+	}
+	for key, policy := range cfg {
+		if code, err := strconv.Atoi(key); key != RetrySend && (err != nil || code < 400 || code > 599) {
+			return nil, fmt.Errorf("retry policy for %q: expected an http error status or %q", key, RetrySend)
+		}
+		if policy == nil || policy.MaxAttempts < 1 {
+			return nil, fmt.Errorf("retry policy for %s: maxAttempts must be at least 1", key)
+		}
+		if policy.BackoffSecs < 0 || policy.MaxBackoffSecs < 0 {
+			return nil, fmt.Errorf("retry policy for %s: backoff must not be negative", key)
+		}
+	}
+	return cfg, nil
+}
+
+// mayRetry reports whether req may be sent again after an attempt failed with
+// code without running it twice.
+func mayRetry(req *workload.ClientRequest, code int) bool {
+	return code == http.StatusTooManyRequests || req.Repeatable()
+}
+
+func retryKey(code int) string {
+	if code == 0 {
+		return RetrySend
+	}
+	return strconv.Itoa(code)
+}
+
+// backoff returns the wait before the retry following attempt, jittered so
+// that requests failing together do not retry together.
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	secs := p.BackoffSecs * float64(uint(1)<<min(attempt-1, 30))
+	if p.MaxBackoffSecs > 0 {
+		secs = min(secs, p.MaxBackoffSecs)
+	}
+	return time.Duration(secs * (0.5 + rand.Float64()/2) * float64(time.Second))
+}
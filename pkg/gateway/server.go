@@ -0,0 +1,124 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tomquartz/pyxis-k8s/pkg/drain"
+	"github.com/tomquartz/pyxis-k8s/pkg/stats"
+	"github.com/tomquartz/pyxis-k8s/pkg/workload"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+type ServerConfig struct {
+	// number of task types the arbiter schedules, requests of other types
+	// are rejected
+	TaskTypes int
+	// nil for the default drain timeouts
+	Drain      *drain.Config
+	ListenAddr string
+}
+
+// Server exposes a gateway over http. Callers post a ClientRequest and get
+// its ClientResponse back once the request was served by compute or storage.
+type Server struct {
+	gateway    *Gateway
+	taskTypes  int
+	stats      *stats.Recorder
+	tracker    drain.Tracker
+	drainCfg   *drain.Config
+	listenAddr string
+	mux        *http.ServeMux
+}
+
+func NewServer(gw *Gateway, cfg *ServerConfig) *Server {
+	s := &Server{
+		gateway:    gw,
+		taskTypes:  cfg.TaskTypes,
+		stats:      stats.NewRecorder(0),
+		drainCfg:   cfg.Drain,
+		listenAddr: cfg.ListenAddr,
+		mux:        http.NewServeMux(),
+	}
+	if s.listenAddr == "" {
+		s.listenAddr = workload.GatewayListenPort
+	}
+	s.mux.HandleFunc("/", s.tracker.Wrap(s.Serve))
+	s.mux.HandleFunc(workload.StatsPath, s.ServeStats)
+	s.mux.HandleFunc(workload.ReadyPath, s.tracker.ServeReady)
+	return s
+}
+
+// Handler serves the endpoints of the gateway server.
+func (s *Server) Handler() http.Handler {
+	return s.mux
+}
+
+// Serve replies with the ClientResponse of the posted request, whose status
+// tells whether it succeeded. Requests the gateway cannot schedule are
+// rejected with 400.
+func (s *Server) Serve(w http.ResponseWriter, r *http.Request) {
+	req := &workload.ClientRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, fmt.Sprintf("failed to decode request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.TypeID < 0 || req.TypeID >= s.taskTypes {
+		http.Error(w, fmt.Sprintf("unknown task type %d, expected [0, %d)", req.TypeID, s.taskTypes), http.StatusBadRequest)
+		return
+	}
+	if err := req.Prepare(); err != nil {
+		http.Error(w, err.Error(), workload.FunctionErrorCode(err))
+		return
+	}
+	s.stats.Begin()
+	start := time.Now()
+	// the request is canceled if the caller goes away
+	resp, err := s.gateway.Submit(r.Context(), req)
+	if err != nil {
+		s.stats.Done(req.TaskType(), time.Since(start), true)
+		return
+	}
+	s.stats.Done(req.TaskType(), time.Since(start), resp.Status != workload.SUCCESS)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// ServeStats replies with the latency of the requests finished over the last
+// window=<secs>. Busy workers are the requests in flight.
+func (s *Server) ServeStats(w http.ResponseWriter, r *http.Request) {
+	window, _ := strconv.ParseFloat(r.URL.Query().Get("window"), 64)
+	snap := s.stats.Snapshot(time.Duration(window * float64(time.Second)))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snap)
+}
+
+func (s *Server) Run(ctx context.Context) {
+	ln, err := net.Listen("tcp", s.listenAddr)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Failed to listen", "addr", s.listenAddr)
+		return
+	}
+	s.RunListener(ctx, ln)
+}
+
+// RunListener runs the server on ln until ctx is done and the server drained.
+func (s *Server) RunListener(ctx context.Context, ln net.Listener) {
+	logger := log.FromContext(ctx)
+	// the gateway outlives ctx until the requests in flight are answered
+	gwCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+	go s.gateway.Run(gwCtx)
+
+	logger.Info("Starting gateway server", "addr", ln.Addr(), "taskTypes", s.taskTypes)
+	srv := &http.Server{Handler: s.mux}
+	if err := s.tracker.Serve(ctx, logger, srv, ln, s.drainCfg); err != nil && err != http.ErrServerClosed {
+		logger.Error(err, "Failed to run gateway server")
+	}
+	logger.Info("Gateway server stopped")
+}
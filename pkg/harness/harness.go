@@ -0,0 +1,172 @@
+package harness
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/tomquartz/pyxis-k8s/pkg/compute"
+	"github.com/tomquartz/pyxis-k8s/pkg/drain"
+	"github.com/tomquartz/pyxis-k8s/pkg/gateway"
+	"github.com/tomquartz/pyxis-k8s/pkg/gateway/arbiter"
+	"github.com/tomquartz/pyxis-k8s/pkg/storage"
+	"github.com/tomquartz/pyxis-k8s/pkg/workload"
+)
+
+const (
+	DefaultStorageWorkers = 4
+	DefaultComputeWorkers = 4
+)
+
+type Config struct {
+	// number of storage replicas to shard keys across, at least 1
+	StorageShards  int
+	StorageWorkers int
+	ComputeWorkers int
+	// storage engine, empty for the map engine
+	Engine string
+	// keys cached by the compute server, 0 to disable the cache
+	CacheEntries int
+	// protocol of kv requests from compute to storage, empty for http
+	Protocol string
+	// shared by all servers and gateways, nil for a fresh client
+	Client *http.Client
+	// deadline of the requests of gateways, 0 for the default
+	RequestTimeoutSecs float64
+	// nil for gateways that do not retry
+	Retry gateway.RetryConfig
+}
+
+// Cluster runs a compute server and sharded storage servers on ephemeral
+// localhost ports of the current process, so that the whole client, gateway,
+// compute and storage path can run without kubernetes.
+type Cluster struct {
+	ComputeURL       string
+	StorageEndpoints []string
+	// binary protocol addresses of the storage servers
+	StorageWireAddrs []string
+	Client           *http.Client
+	Compute          *compute.ComputeServer
+	Storage          []*storage.StorageServer
+	servers          sync.WaitGroup
+	requestTimeout   float64
+	retry            gateway.RetryConfig
+}
+
+// Start runs the servers until ctx is done. Wait returns once they drained.
+func Start(ctx context.Context, cfg *Config) (*Cluster, error) {
+	c := &Cluster{Client: cfg.Client, requestTimeout: cfg.RequestTimeoutSecs, retry: cfg.Retry}
+	if c.Client == nil {
+		c.Client = &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 64}}
+	}
+	nShards := max(cfg.StorageShards, 1)
+	// listen first so that every server knows the addresses of the others
+	listeners := make([]net.Listener, 0, nShards+1)
+	closeAll := func() {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	}
+	for i := 0; i < nShards+1; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("failed to listen: %v", err)
+		}
+		listeners = append(listeners, ln)
+	}
+	for _, ln := range listeners[:nShards] {
+		c.StorageEndpoints = append(c.StorageEndpoints, "http://"+ln.Addr().String())
+	}
+	c.ComputeURL = "http://" + listeners[nShards].Addr().String()
+
+	// nothing in front of the servers waits for readiness
+	drainCfg := &drain.Config{UnreadyDelaySecs: 0}
+	storageWorkers := cfg.StorageWorkers
+	if storageWorkers <= 0 {
+		storageWorkers = DefaultStorageWorkers
+	}
+	for i := 0; i < nShards; i++ {
+		storageCfg := &storage.StorageConfig{
+			NumWorkers: storageWorkers,
+			Engine:     cfg.Engine,
+			ShardID:    i,
+			Client:     c.Client,
+			Drain:      drainCfg,
+			WireAddr:   "127.0.0.1:0",
+		}
+		if storageCfg.Engine == "" {
+			storageCfg.Engine = storage.EngineMap
+		}
+		if nShards > 1 {
+			storageCfg.ShardEndpoints = c.StorageEndpoints
+		}
+		s, err := storage.NewStorageServer(storageCfg)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("failed to create storage server %d: %v", i, err)
+		}
+		wireAddr, err := s.ListenWire()
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		c.Storage = append(c.Storage, s)
+		c.StorageWireAddrs = append(c.StorageWireAddrs, wireAddr.String())
+	}
+	computeWorkers := cfg.ComputeWorkers
+	if computeWorkers <= 0 {
+		computeWorkers = DefaultComputeWorkers
+	}
+	computeCfg := &compute.ComputeConfig{
+		NumWorkers:       computeWorkers,
+		StorageEndpoints: c.StorageEndpoints,
+		StorageWireAddrs: c.StorageWireAddrs,
+		Protocol:         cfg.Protocol,
+		Client:           c.Client,
+		Drain:            drainCfg,
+	}
+	if cfg.CacheEntries > 0 {
+		computeCfg.Cache = &compute.CacheConfig{MaxEntries: cfg.CacheEntries, AdvertiseURL: c.ComputeURL}
+	}
+	var err error
+	if c.Compute, err = compute.NewComputeServer(computeCfg); err != nil {
+		closeAll()
+		return nil, fmt.Errorf("failed to create compute server: %v", err)
+	}
+
+	for i, s := range c.Storage {
+		c.run(func() { s.RunListener(ctx, listeners[i]) })
+	}
+	c.run(func() { c.Compute.RunListener(ctx, listeners[nShards]) })
+	return c, nil
+}
+
+func (c *Cluster) run(fn func()) {
+	c.servers.Add(1)
+	go func() {
+		defer c.servers.Done()
+		fn()
+	}()
+}
+
+// Gateway creates a gateway that sends requests to the cluster, hedged as the
+// task profiles say.
+func (c *Cluster) Gateway(maxout int, arb arbiter.Arbiter, profiles []workload.TaskProfile) *gateway.Gateway {
+	return gateway.NewGateway(&gateway.GatewayConfig{
+		MaxOut:             maxout,
+		Arbiter:            arb,
+		ComputeURL:         c.ComputeURL,
+		StorageEndpoints:   c.StorageEndpoints,
+		Client:             c.Client,
+		RequestTimeoutSecs: c.requestTimeout,
+		Retry:              c.retry,
+		TaskProfiles:       profiles,
+	})
+}
+
+func (c *Cluster) Wait() {
+	c.servers.Wait()
+}
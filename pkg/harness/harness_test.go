@@ -0,0 +1,73 @@
+package harness
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/tomquartz/pyxis-k8s/pkg/gateway/arbiter"
+	"github.com/tomquartz/pyxis-k8s/pkg/workload"
+)
+
+// fixedArbiter sends every request to the same tier.
+type fixedArbiter int
+
+func (a fixedArbiter) Run(ctx context.Context)                  {}
+func (a fixedArbiter) Schedule(req *workload.ClientRequest) int { return int(a) }
+func (a fixedArbiter) Finish(resp *workload.ClientResponse)     {}
+
+// A value written through one tier is read back through the other, with keys
+// sharded across two storage servers.
+func TestClusterRoundTrip(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cluster, err := Start(ctx, &Config{StorageShards: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cancel()
+		cluster.Wait()
+	}()
+	gateways := map[int]interface {
+		Submit(context.Context, *workload.ClientRequest) (*workload.ClientResponse, error)
+	}{}
+	for _, tier := range []int{arbiter.ToCompute, arbiter.ToStorage} {
+		gw := cluster.Gateway(4, fixedArbiter(tier), nil)
+		go gw.Run(ctx)
+		gateways[tier] = gw
+	}
+	run := func(tier int, id, src, key string, params map[string]interface{}) string {
+		req, err := workload.NewClientRequest(id, 0, workload.FuncScript, &workload.ScriptFuncRequest{
+			Source:      src,
+			StorageKeys: []string{key},
+			Params:      params,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := gateways[tier].Submit(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status != workload.SUCCESS {
+			t.Fatalf("%s failed with status %d: %s", id, resp.Status, resp.Result)
+		}
+		want := workload.TierCompute
+		if tier == arbiter.ToStorage {
+			want = workload.TierStorage
+		}
+		if resp.Tier != want {
+			t.Errorf("%s ran on the %s tier, expected %s", id, resp.Tier, want)
+		}
+		return resp.Result
+	}
+	for i, tiers := range [][2]int{{arbiter.ToCompute, arbiter.ToStorage}, {arbiter.ToStorage, arbiter.ToCompute}} {
+		for j := 0; j < 4; j++ {
+			key, value := fmt.Sprintf("key-%d", j), fmt.Sprintf("v%d-%d", i, j)
+			run(tiers[0], "put-"+key, `put(key(0), v)`, key, map[string]interface{}{"v": value})
+			if got := run(tiers[1], "get-"+key, `return get(key(0))`, key, nil); got != value {
+				t.Errorf("read %q from %s, expected %q", got, key, value)
+			}
+		}
+	}
+}
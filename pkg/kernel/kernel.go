@@ -0,0 +1,110 @@
+package kernel
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// batches of units timed for calibration, the fastest one counts
+	calibrationBatches = 5
+	calibrationBatch   = 4 * time.Millisecond
+)
+
+// Kernel burns cpu in units of fixed work. The time of a unit is calibrated
+// once per process, so that a kernel asked to compute for d runs the units
+// that take d on an idle core and takes longer when the cpu is contended.
+type Kernel struct {
+	Name string
+	// newUnit returns a unit of work with its own scratch space
+	newUnit func() func()
+	// units with their scratch space are reused across runs
+	units    sync.Pool
+	once     sync.Once
+	unitTime time.Duration
+}
+
+var kernels = make(map[string]*Kernel)
+
+func register(name string, newUnit func() func()) {
+	k := &Kernel{Name: name, newUnit: newUnit}
+	k.units.New = func() interface{} { return newUnit() }
+	kernels[name] = k
+}
+
+// Names returns the names of the kernels in order.
+func Names() []string {
+	names := make([]string, 0, len(kernels))
+	for name := range kernels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func Lookup(name string) (*Kernel, error) {
+	k, ok := kernels[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown kernel %q, kernels: %s", name, strings.Join(Names(), ", "))
+	}
+	return k, nil
+}
+
+// Work returns the function that computes for a duration with the named
+// kernel, or time.Sleep if name is empty or unknown.
+func Work(name string) func(time.Duration) {
+	k, ok := kernels[name]
+	if !ok {
+		return time.Sleep
+	}
+	return k.Run
+}
+
+// Calibrate times every kernel. Servers call it on start so that the first
+// requests neither wait for nor skew the calibration.
+func Calibrate() {
+	for _, k := range kernels {
+		k.UnitTime()
+	}
+}
+
+// UnitTime returns the calibrated time of a unit of work.
+func (k *Kernel) UnitTime() time.Duration {
+	k.once.Do(k.calibrate)
+	return k.unitTime
+}
+
+func (k *Kernel) calibrate() {
+	unit := k.newUnit()
+	unit()
+	for i := 0; i < calibrationBatches; i++ {
+		n := 0
+		start := time.Now()
+		for time.Since(start) < calibrationBatch {
+			unit()
+			n++
+		}
+		if t := time.Since(start) / time.Duration(n); i == 0 || t < k.unitTime {
+			k.unitTime = t
+		}
+	}
+	k.unitTime = max(k.unitTime, time.Nanosecond)
+}
+
+// Run runs the units of work that take d on an idle core, at least one if d
+// is positive.
+func (k *Kernel) Run(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	unitTime := k.UnitTime()
+	n := max((d+unitTime/2)/unitTime, 1)
+	unit := k.units.Get().(func())
+	defer k.units.Put(unit)
+	for i := time.Duration(0); i < n; i++ {
+		unit()
+	}
+}
@@ -0,0 +1,102 @@
+package kernel
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"math/rand"
+	"regexp"
+	"sort"
+)
+
+const (
+	KernelHash     = "hash"
+	KernelCompress = "compress"
+	KernelSort     = "sort"
+	KernelMatMul   = "matmul"
+	KernelRegex    = "regex"
+)
+
+// inputs shared by all units, read-only
+var (
+	// text with repetitions, so that compression and matching have work to do
+	text    []byte
+	numbers []int
+	matrix  []float64
+	pattern = regexp.MustCompile(`[a-z]+[0-9]{2,}@[a-z]+\.(com|org)`)
+)
+
+// sizes of the units, small enough that short tasks are not overrun by much
+const (
+	textBytes     = 16 << 10
+	compressBytes = 4 << 10
+	regexBytes    = 512
+	numNumbers    = 1024
+	matrixDim     = 32
+)
+
+func init() {
+	rng := rand.New(rand.NewSource(1))
+	words := []string{"pyxis", "compute", "storage", "pushdown", "kv", "shard", "replica", "cache"}
+	var b bytes.Buffer
+	for b.Len() < textBytes {
+		b.WriteString(words[rng.Intn(len(words))])
+		switch rng.Intn(8) {
+		case 0:
+			b.WriteString("42@example.com ")
+		case 1:
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(' ')
+		}
+	}
+	text = b.Bytes()[:textBytes]
+	numbers = rng.Perm(numNumbers)
+	matrix = make([]float64, matrixDim*matrixDim)
+	for i := range matrix {
+		matrix[i] = rng.Float64()
+	}
+
+	register(KernelHash, func() func() {
+		return func() {
+			sha256.Sum256(text)
+		}
+	})
+	register(KernelCompress, func() func() {
+		var out bytes.Buffer
+		w, _ := flate.NewWriter(&out, flate.DefaultCompression)
+		return func() {
+			out.Reset()
+			w.Reset(&out)
+			w.Write(text[:compressBytes])
+			w.Close()
+		}
+	})
+	register(KernelSort, func() func() {
+		scratch := make([]int, len(numbers))
+		return func() {
+			copy(scratch, numbers)
+			sort.Ints(scratch)
+		}
+	})
+	register(KernelMatMul, func() func() {
+		product := make([]float64, len(matrix))
+		return func() {
+			const n = matrixDim
+			for i := 0; i < n; i++ {
+				for j := 0; j < n; j++ {
+					sum := 0.0
+					for k := 0; k < n; k++ {
+						sum += matrix[i*n+k] * matrix[k*n+j]
+					}
+					product[i*n+j] = sum
+				}
+			}
+		}
+	})
+	register(KernelRegex, func() func() {
+		return func() {
+			pattern.FindAllIndex(text[:regexBytes], -1)
+		}
+	})
+}
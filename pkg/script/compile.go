@@ -0,0 +1,442 @@
+package script
+
+import "fmt"
+
+type opcode uint8
+
+const (
+	opConst opcode = iota // push consts[arg]
+	opLoad                // push slots[arg]
+	opStore               // pop into slots[arg]
+	opPop
+	opAdd
+	opSub
+	opMul
+	opDiv
+	opMod
+	opEq
+	opNe
+	opLt
+	opLe
+	opGt
+	opGe
+	opNeg
+	opNot
+	opJump      // to arg
+	opJumpFalse // pop and jump to arg if falsy
+	opCall      // builtins[arg] with its arguments on the stack
+	opReturn    // pop the result
+)
+
+type instr struct {
+	op   opcode
+	arg  int32
+	line int32
+}
+
+var keywords = map[string]bool{
+	"let": true, "if": true, "else": true, "while": true, "break": true,
+	"continue": true, "return": true, "nil": true, "true": true, "false": true,
+}
+
+var binaryPrec = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3,
+	"<": 4, "<=": 4, ">": 4, ">=": 4,
+	"+": 5, "-": 5,
+	"*": 6, "/": 6, "%": 6,
+}
+
+var binaryOps = map[string]opcode{
+	"==": opEq, "!=": opNe, "<": opLt, "<=": opLe, ">": opGt, ">=": opGe,
+	"+": opAdd, "-": opSub, "*": opMul, "/": opDiv, "%": opMod,
+}
+
+// compiler parses the token stream and emits code in a single pass. Errors
+// are raised as panics of *Error and recovered by compile.
+type compiler struct {
+	toks   []token
+	pos    int
+	code   []instr
+	consts []value
+	// variable slots of the enclosing blocks, innermost last
+	scopes   []map[string]int
+	nslots   int
+	maxSlots int
+	loops    []*loop
+	depth    int
+}
+
+type loop struct {
+	start  int
+	breaks []int
+}
+
+func compile(toks []token, params []string) (prog *Program, err error) {
+	c := &compiler{toks: toks, scopes: []map[string]int{{}}}
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			err = e
+		}
+	}()
+	for _, name := range params {
+		if !isName(name) || keywords[name] || builtinIndex[name] != nil {
+			return nil, fmt.Errorf("invalid param name %q", name)
+		}
+		if _, ok := c.scopes[0][name]; ok {
+			return nil, fmt.Errorf("duplicate param %s", name)
+		}
+		c.declare(name)
+	}
+	for c.peek().kind != tokEOF {
+		c.statement()
+	}
+	c.emitConst(value{}, c.peek().line)
+	c.emit(opReturn, 0, c.peek().line)
+	return &Program{code: c.code, consts: c.consts, params: params, nslots: c.maxSlots}, nil
+}
+
+func isName(s string) bool {
+	if s == "" || isDigit(s[0]) {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isLetter(s[i]) && !isDigit(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *compiler) fail(line int, format string, args ...interface{}) {
+	panic(errorf(line, format, args...))
+}
+
+func (c *compiler) peek() token {
+	return c.toks[c.pos]
+}
+
+func (c *compiler) next() token {
+	t := c.toks[c.pos]
+	if t.kind != tokEOF {
+		c.pos++
+	}
+	return t
+}
+
+func (c *compiler) isPunct(text string) bool {
+	t := c.peek()
+	return t.kind == tokPunct && t.text == text
+}
+
+func (c *compiler) isKeyword(text string) bool {
+	t := c.peek()
+	return t.kind == tokIdent && t.text == text
+}
+
+func (c *compiler) accept(text string) bool {
+	if c.isPunct(text) {
+		c.next()
+		return true
+	}
+	return false
+}
+
+func (c *compiler) expect(text string) {
+	if !c.accept(text) {
+		t := c.peek()
+		c.fail(t.line, "expected %s, found %s", text, describe(t))
+	}
+}
+
+func describe(t token) string {
+	switch t.kind {
+	case tokEOF:
+		return "end of input"
+	case tokInt:
+		return fmt.Sprint(t.num)
+	case tokString:
+		return fmt.Sprintf("%q", t.text)
+	}
+	return t.text
+}
+
+// name reads the name of a variable.
+func (c *compiler) name() token {
+	t := c.next()
+	if t.kind != tokIdent || keywords[t.text] || builtinIndex[t.text] != nil {
+		c.fail(t.line, "expected a variable name, found %s", describe(t))
+	}
+	return t
+}
+
+func (c *compiler) enter(line int) {
+	c.depth++
+	if c.depth > maxDepth {
+		c.fail(line, "nesting deeper than %d", maxDepth)
+	}
+}
+
+func (c *compiler) leave() {
+	c.depth--
+}
+
+func (c *compiler) emit(op opcode, arg int, line int) int {
+	c.code = append(c.code, instr{op: op, arg: int32(arg), line: int32(line)})
+	return len(c.code) - 1
+}
+
+func (c *compiler) emitConst(v value, line int) {
+	c.consts = append(c.consts, v)
+	c.emit(opConst, len(c.consts)-1, line)
+}
+
+// patch points the jump at pc to the next instruction.
+func (c *compiler) patch(pc int) {
+	c.code[pc].arg = int32(len(c.code))
+}
+
+func (c *compiler) declare(name string) int {
+	slot := c.nslots
+	c.scopes[len(c.scopes)-1][name] = slot
+	c.nslots++
+	c.maxSlots = max(c.maxSlots, c.nslots)
+	return slot
+}
+
+func (c *compiler) lookup(t token) int {
+	for i := len(c.scopes) - 1; i >= 0; i-- {
+		if slot, ok := c.scopes[i][t.text]; ok {
+			return slot
+		}
+	}
+	c.fail(t.line, "undefined variable %s", t.text)
+	return 0
+}
+
+func (c *compiler) statement() {
+	t := c.peek()
+	c.enter(t.line)
+	defer c.leave()
+	switch {
+	case c.isKeyword("let"):
+		c.next()
+		name := c.name()
+		if _, ok := c.scopes[len(c.scopes)-1][name.text]; ok {
+			c.fail(name.line, "%s redeclared in this block", name.text)
+		}
+		c.expect("=")
+		c.expr()
+		// declared after its value so that it may shadow an outer variable
+		c.emit(opStore, c.declare(name.text), name.line)
+	case c.isKeyword("if"):
+		c.next()
+		c.ifStatement()
+	case c.isKeyword("while"):
+		c.next()
+		l := &loop{start: len(c.code)}
+		c.expr()
+		exit := c.emit(opJumpFalse, 0, t.line)
+		c.loops = append(c.loops, l)
+		c.block()
+		c.loops = c.loops[:len(c.loops)-1]
+		c.emit(opJump, l.start, t.line)
+		c.patch(exit)
+		for _, pc := range l.breaks {
+			c.patch(pc)
+		}
+	case c.isKeyword("break"), c.isKeyword("continue"):
+		c.next()
+		if len(c.loops) == 0 {
+			c.fail(t.line, "%s outside of a loop", t.text)
+		}
+		l := c.loops[len(c.loops)-1]
+		if t.text == "break" {
+			l.breaks = append(l.breaks, c.emit(opJump, 0, t.line))
+		} else {
+			c.emit(opJump, l.start, t.line)
+		}
+	case c.isKeyword("return"):
+		c.next()
+		if next := c.peek(); next.kind == tokEOF || next.line != t.line || c.isPunct("}") || c.isPunct(";") {
+			c.emitConst(value{}, t.line)
+		} else {
+			c.expr()
+		}
+		c.emit(opReturn, 0, t.line)
+	case t.kind == tokIdent && c.toks[c.pos+1].kind == tokPunct && c.toks[c.pos+1].text == "=":
+		name := c.name()
+		slot := c.lookup(name)
+		c.next()
+		c.expr()
+		c.emit(opStore, slot, name.line)
+	default:
+		c.expr()
+		c.emit(opPop, 0, t.line)
+	}
+	c.accept(";")
+}
+
+func (c *compiler) ifStatement() {
+	line := c.peek().line
+	c.expr()
+	skip := c.emit(opJumpFalse, 0, line)
+	c.block()
+	if !c.isKeyword("else") {
+		c.patch(skip)
+		return
+	}
+	c.next()
+	end := c.emit(opJump, 0, line)
+	c.patch(skip)
+	if c.isKeyword("if") {
+		c.next()
+		c.ifStatement()
+	} else {
+		c.block()
+	}
+	c.patch(end)
+}
+
+func (c *compiler) block() {
+	c.expect("{")
+	c.scopes = append(c.scopes, map[string]int{})
+	base := c.nslots
+	for !c.isPunct("}") {
+		if c.peek().kind == tokEOF {
+			c.fail(c.peek().line, "expected }, found end of input")
+		}
+		c.statement()
+	}
+	c.next()
+	// slots of the block are reused by later blocks
+	c.scopes = c.scopes[:len(c.scopes)-1]
+	c.nslots = base
+}
+
+func (c *compiler) expr() {
+	c.binary(1)
+}
+
+func (c *compiler) binary(minPrec int) {
+	c.enter(c.peek().line)
+	defer c.leave()
+	c.unary()
+	for {
+		t := c.peek()
+		prec, ok := binaryPrec[t.text]
+		if t.kind != tokPunct || !ok || prec < minPrec {
+			return
+		}
+		c.next()
+		line := t.line
+		switch t.text {
+		case "&&":
+			// a && b is 1 if both are truthy and 0 otherwise
+			falses := []int{c.emit(opJumpFalse, 0, line)}
+			c.binary(prec + 1)
+			falses = append(falses, c.emit(opJumpFalse, 0, line))
+			c.emitConst(intValue(1), line)
+			end := c.emit(opJump, 0, line)
+			for _, pc := range falses {
+				c.patch(pc)
+			}
+			c.emitConst(intValue(0), line)
+			c.patch(end)
+		case "||":
+			// a || b is !(!a && !b)
+			c.emit(opNot, 0, line)
+			falses := []int{c.emit(opJumpFalse, 0, line)}
+			c.binary(prec + 1)
+			c.emit(opNot, 0, line)
+			falses = append(falses, c.emit(opJumpFalse, 0, line))
+			c.emitConst(intValue(0), line)
+			end := c.emit(opJump, 0, line)
+			for _, pc := range falses {
+				c.patch(pc)
+			}
+			c.emitConst(intValue(1), line)
+			c.patch(end)
+		default:
+			c.binary(prec + 1)
+			c.emit(binaryOps[t.text], 0, line)
+		}
+	}
+}
+
+func (c *compiler) unary() {
+	t := c.peek()
+	if c.accept("-") || c.accept("!") {
+		c.enter(t.line)
+		defer c.leave()
+		c.unary()
+		if t.text == "-" {
+			c.emit(opNeg, 0, t.line)
+		} else {
+			c.emit(opNot, 0, t.line)
+		}
+		return
+	}
+	c.primary()
+}
+
+func (c *compiler) primary() {
+	t := c.next()
+	switch t.kind {
+	case tokInt:
+		c.emitConst(intValue(t.num), t.line)
+	case tokString:
+		c.emitConst(strValue(t.text), t.line)
+	case tokIdent:
+		switch t.text {
+		case "nil":
+			c.emitConst(value{}, t.line)
+		case "true":
+			c.emitConst(intValue(1), t.line)
+		case "false":
+			c.emitConst(intValue(0), t.line)
+		default:
+			if c.isPunct("(") {
+				c.call(t)
+				return
+			}
+			c.pos--
+			c.emit(opLoad, c.lookup(c.name()), t.line)
+		}
+	case tokPunct:
+		if t.text == "(" {
+			c.expr()
+			c.expect(")")
+			return
+		}
+		fallthrough
+	default:
+		c.fail(t.line, "unexpected %s", describe(t))
+	}
+}
+
+func (c *compiler) call(fn token) {
+	b := builtinIndex[fn.text]
+	if b == nil {
+		c.fail(fn.line, "undefined function %s", fn.text)
+	}
+	c.expect("(")
+	argc := 0
+	for !c.isPunct(")") {
+		if argc > 0 {
+			c.expect(",")
+		}
+		c.expr()
+		argc++
+	}
+	c.next()
+	if argc != b.argc {
+		c.fail(fn.line, "%s expects %d arguments, got %d", fn.text, b.argc, argc)
+	}
+	c.emit(opCall, b.index, fn.line)
+}
@@ -0,0 +1,153 @@
+package script
+
+import (
+	"fmt"
+	"math"
+)
+
+// Limits bound the work of a single run so that a bad program cannot hold a
+// server's worker.
+type Limits struct {
+	// instructions executed
+	Fuel int64
+	// bytes of strings built by the program, including values read
+	AllocBytes int64
+	// kv reads and writes
+	KVOps int
+}
+
+var DefaultLimits = Limits{
+	Fuel:       1_000_000,
+	AllocBytes: 16 << 20,
+	KVOps:      1000,
+}
+
+// orDefault replaces zero limits with the defaults.
+func (l Limits) orDefault() Limits {
+	if l.Fuel <= 0 {
+		l.Fuel = DefaultLimits.Fuel
+	}
+	if l.AllocBytes <= 0 {
+		l.AllocBytes = DefaultLimits.AllocBytes
+	}
+	if l.KVOps <= 0 {
+		l.KVOps = DefaultLimits.KVOps
+	}
+	return l
+}
+
+const (
+	MaxSourceBytes = 64 << 10
+	// nesting depth of blocks and expressions
+	maxDepth = 64
+	// instructions between calls to Host.Yield
+	yieldInterval = 1024
+)
+
+// Host is the kv store a program runs against.
+type Host interface {
+	// Get returns found false for a missing key.
+	Get(key string) (value string, found bool, err error)
+	Put(key, value string) error
+	// Yield is called periodically to let the host serve other work while a
+	// long program runs.
+	Yield()
+}
+
+// Error is a compile or runtime error of a program. Failures of the host are
+// returned as is.
+type Error struct {
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+func errorf(line int, format string, args ...interface{}) *Error {
+	return &Error{Line: line, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Program is a compiled script. It is immutable and may be run concurrently.
+type Program struct {
+	code   []instr
+	consts []value
+	// slots of the parameters and of all local variables
+	params []string
+	nslots int
+}
+
+// Writes reports whether the program may put keys.
+func (p *Program) Writes() bool {
+	put := int32(builtinIndex["put"].index)
+	for _, in := range p.code {
+		if in.op == opCall && in.arg == put {
+			return true
+		}
+	}
+	return false
+}
+
+// Compile compiles src with the given parameters declared as variables.
+func Compile(src string, params []string) (*Program, error) {
+	if len(src) > MaxSourceBytes {
+		return nil, fmt.Errorf("source of %d bytes exceeds the limit of %d", len(src), MaxSourceBytes)
+	}
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	return compile(toks, params)
+}
+
+// Run runs p with keys and params as its inputs and returns the value it
+// returns as a string. Params may be strings or integers, and parameters
+// missing from params are nil. Zero limits are the defaults.
+func (p *Program) Run(host Host, keys []string, params map[string]interface{}, limits Limits) (string, error) {
+	m := &machine{
+		prog:   p,
+		host:   host,
+		keys:   keys,
+		slots:  make([]value, p.nslots),
+		limits: limits.orDefault(),
+	}
+	for i, name := range p.params {
+		v, err := toValue(params[name])
+		if err != nil {
+			return "", fmt.Errorf("param %s: %v", name, err)
+		}
+		m.slots[i] = v
+	}
+	result, err := m.run()
+	if err != nil {
+		return "", err
+	}
+	return result.String(), nil
+}
+
+// toValue converts a param, including a number decoded from json.
+func toValue(x interface{}) (value, error) {
+	switch x := x.(type) {
+	case nil:
+		return value{}, nil
+	case string:
+		return strValue(x), nil
+	case int:
+		return intValue(int64(x)), nil
+	case int64:
+		return intValue(x), nil
+	case float64:
+		if x != math.Trunc(x) || math.Abs(x) > 1<<53 {
+			return value{}, fmt.Errorf("%v is not an integer", x)
+		}
+		return intValue(int64(x)), nil
+	}
+	return value{}, fmt.Errorf("unsupported type %T", x)
+}
+
+// CheckParam reports whether x can be passed as a param.
+func CheckParam(x interface{}) error {
+	_, err := toValue(x)
+	return err
+}
@@ -0,0 +1,277 @@
+package script
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// mapHost is an in-memory Host.
+type mapHost struct {
+	kv     map[string]string
+	yields int
+	err    error
+}
+
+func newMapHost() *mapHost {
+	return &mapHost{kv: make(map[string]string)}
+}
+
+func (h *mapHost) Get(key string) (string, bool, error) {
+	if h.err != nil {
+		return "", false, h.err
+	}
+	v, ok := h.kv[key]
+	return v, ok, nil
+}
+
+func (h *mapHost) Put(key, value string) error {
+	if h.err != nil {
+		return h.err
+	}
+	h.kv[key] = value
+	return nil
+}
+
+func (h *mapHost) Yield() {
+	h.yields++
+}
+
+func run(t *testing.T, src string, host Host, keys []string, params map[string]interface{}, limits Limits) (string, error) {
+	t.Helper()
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	prog, err := Compile(src, names)
+	if err != nil {
+		t.Fatalf("failed to compile %q: %v", src, err)
+	}
+	return prog.Run(host, keys, params, limits)
+}
+
+func TestRun(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		src    string
+		params map[string]interface{}
+		want   string
+	}{
+		{"empty program", ``, nil, ""},
+		{"arithmetic", `return 1 + 2 * 3 - 8 / 4 % 3`, nil, "5"},
+		{"parentheses and negation", `return -(1 + 2) * 2`, nil, "-6"},
+		{"string concatenation", `return "a" + 1 + "b"`, nil, "a1b"},
+		{"comparisons", `return str(1 < 2) + str("a" >= "b") + str(1 == 1) + str("1" != 1)`, nil, "1011"},
+		{"logic short-circuits", `return false && int("x") || true`, nil, "1"},
+		{"nil", `return nil == nil`, nil, "1"},
+		{"variables and shadowing", `let x = 1; if true { let x = 2; x = x + 1 }; return x`, nil, "1"},
+		{"assignment to outer variable", `let x = 1; if true { x = 5 }; return x`, nil, "5"},
+		{"if else chain", `let x = 2; if x == 1 { return "a" } else if x == 2 { return "b" } else { return "c" }`, nil, "b"},
+		{"while with break and continue", `
+			let i = 0
+			let sum = 0
+			while true {
+				i = i + 1
+				if i > 10 { break }
+				if i % 2 == 0 { continue }
+				sum = sum + i
+			}
+			return sum`, nil, "25"},
+		{"builtins", `return str(len("hello")) + substr("hello", 1, 3) + str(index("hello", "l")) + str(int("42") + 1)`, nil, "5el243"},
+		{"params", `return name + ":" + str(n * 2)`, map[string]interface{}{"name": "x", "n": float64(21)}, "x:42"},
+		{"nil param", `return p == nil`, map[string]interface{}{"p": nil}, "1"},
+		{"comments", "# leading\nreturn 1 # trailing", nil, "1"},
+		{"escapes", `return "a\"b\\c\td"`, nil, "a\"b\\c\td"},
+	} {
+		got, err := run(t, tc.src, newMapHost(), nil, tc.params, Limits{})
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		} else if got != tc.want {
+			t.Errorf("%s: returned %q, expected %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRunKV(t *testing.T) {
+	host := newMapHost()
+	host.kv["a"] = "1"
+	src := `
+		let i = 0
+		while i < nkeys() {
+			let v = get(key(i))
+			if v == nil { v = "0" }
+			put(key(i), int(v) + 1)
+			i = i + 1
+		}
+		return get("a") + get("b")`
+	got, err := run(t, src, host, []string{"a", "b"}, nil, Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "21" || host.kv["a"] != "2" || host.kv["b"] != "1" {
+		t.Errorf("returned %q with %v, expected the keys incremented", got, host.kv)
+	}
+}
+
+func TestHostErrorIsReturnedAsIs(t *testing.T) {
+	hostErr := errors.New("unavailable")
+	host := newMapHost()
+	host.err = hostErr
+	_, err := run(t, `get("a")`, host, nil, nil, Limits{})
+	var scriptErr *Error
+	if !errors.Is(err, hostErr) || errors.As(err, &scriptErr) {
+		t.Errorf("got %v, expected the host error rather than a script error", err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		src    string
+		limits Limits
+		msg    string
+	}{
+		{"fuel", `while true {}`, Limits{Fuel: 10000}, "out of fuel"},
+		{"fuel of a bounded loop", `let i = 0; while i < 10 { i = i + 1 }`, Limits{Fuel: 20}, "out of fuel"},
+		{"alloc", `let s = "x"; while true { s = s + s }`, Limits{AllocBytes: 1 << 10}, "allocated more than 1024 bytes"},
+		{"alloc of values read", `put("a", "0123456789"); get("a")`, Limits{AllocBytes: 5}, "allocated more than 5 bytes"},
+		{"kv ops", `let i = 0; while true { put("k" + i, i); i = i + 1 }`, Limits{KVOps: 3}, "more than 3 kv operations"},
+		{"kv reads", `get("a"); get("b")`, Limits{KVOps: 1}, "more than 1 kv operations"},
+	} {
+		_, err := run(t, tc.src, newMapHost(), nil, nil, tc.limits)
+		var scriptErr *Error
+		if !errors.As(err, &scriptErr) || !strings.Contains(err.Error(), tc.msg) {
+			t.Errorf("%s: got %v, expected a script error containing %q", tc.name, err, tc.msg)
+		}
+	}
+}
+
+func TestDefaultLimits(t *testing.T) {
+	host := newMapHost()
+	_, err := run(t, `while true {}`, host, nil, nil, Limits{})
+	if err == nil || !strings.Contains(err.Error(), "out of fuel after 1000000 instructions") {
+		t.Errorf("got %v, expected the default fuel to run out", err)
+	}
+	if host.yields != int(DefaultLimits.Fuel/yieldInterval) {
+		t.Errorf("yielded %d times, expected every %d instructions", host.yields, yieldInterval)
+	}
+}
+
+func TestRuntimeErrors(t *testing.T) {
+	for _, tc := range []struct {
+		src  string
+		msg  string
+		line int
+	}{
+		{`return 1 / 0`, "division by zero", 1},
+		{"\nreturn 1 % 0", "division by zero", 2},
+		{`return 1 - "a"`, "arithmetic on int and string", 1},
+		{`return nil + 1`, "cannot add nil and int", 1},
+		{`return 1 < "a"`, "cannot compare int and string", 1},
+		{`return -"a"`, "cannot negate string", 1},
+		{`return int("x")`, `int: "x" is not an integer`, 1},
+		{`return key(0)`, "key: index 0 out of range of 0 keys", 1},
+		{`return substr("abc", 2, 1)`, "out of bounds", 1},
+		{`put("a", nil)`, "cannot put nil", 1},
+		{`get(1)`, "expected a string, got int", 1},
+	} {
+		_, err := run(t, tc.src, newMapHost(), nil, nil, Limits{})
+		var scriptErr *Error
+		if !errors.As(err, &scriptErr) || !strings.Contains(scriptErr.Msg, tc.msg) || scriptErr.Line != tc.line {
+			t.Errorf("%q: got %v, expected %q on line %d", tc.src, err, tc.msg, tc.line)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, tc := range []struct {
+		src    string
+		params []string
+		msg    string
+	}{
+		{`let = 1`, nil, "expected a variable name"},
+		{`let x = 1; let x = 2`, nil, "x redeclared in this block"},
+		{`return y`, nil, "undefined variable y"},
+		{`foo(1)`, nil, "undefined function foo"},
+		{`get()`, nil, "get expects 1 arguments, got 0"},
+		{`if true { 1`, nil, "expected }, found end of input"},
+		{`(1 + 2`, nil, "expected ), found end of input"},
+		{`break`, nil, "break outside of a loop"},
+		{`return 1 +`, nil, "unexpected end of input"},
+		{`let x = @`, nil, "unexpected character '@'"},
+		{`return "abc`, nil, "unterminated string"},
+		{`return "a\q"`, nil, "invalid escape"},
+		{`return 99999999999999999999`, nil, "invalid integer"},
+		{`let while = 1`, nil, "expected a variable name"},
+		{strings.Repeat("(", maxDepth+1) + "1" + strings.Repeat(")", maxDepth+1), nil, "nesting deeper than"},
+		{`return 1`, []string{"get"}, `invalid param name "get"`},
+		{`return 1`, []string{"a", "a"}, "duplicate param a"},
+		{`return 1`, []string{"1a"}, `invalid param name "1a"`},
+		{strings.Repeat(" ", MaxSourceBytes+1), nil, "exceeds the limit"},
+	} {
+		_, err := Compile(tc.src, tc.params)
+		if err == nil || !strings.Contains(err.Error(), tc.msg) {
+			name := tc.src
+			if len(name) > 40 {
+				name = name[:40] + "..."
+			}
+			t.Errorf("%q: got %v, expected an error containing %q", name, err, tc.msg)
+		}
+	}
+}
+
+func TestCompileErrorLine(t *testing.T) {
+	_, err := Compile("let x = 1\n\nreturn x +", nil)
+	var scriptErr *Error
+	if !errors.As(err, &scriptErr) || scriptErr.Line != 3 {
+		t.Errorf("got %v, expected an error on line 3", err)
+	}
+}
+
+func TestParams(t *testing.T) {
+	prog, err := Compile(`return p == nil`, []string{"p"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := prog.Run(newMapHost(), nil, nil, Limits{}); err != nil || got != "1" {
+		t.Errorf("returned %q, %v for a missing param, expected it to be nil", got, err)
+	}
+	if _, err := prog.Run(newMapHost(), nil, map[string]interface{}{"p": 0.5}, Limits{}); err == nil {
+		t.Error("ran with a fractional param")
+	}
+	for _, x := range []interface{}{"s", 1, int64(2), float64(3), nil} {
+		if err := CheckParam(x); err != nil {
+			t.Errorf("rejected param %v: %v", x, err)
+		}
+	}
+	for _, x := range []interface{}{1.5, float64(1 << 60), true, []string{}} {
+		if err := CheckParam(x); err == nil {
+			t.Errorf("accepted param %v", x)
+		}
+	}
+}
+
+// A program is immutable and runs concurrently.
+func TestRunConcurrently(t *testing.T) {
+	prog, err := Compile(`let i = 0; let s = ""; while i < n { s = s + "x"; i = i + 1 }; return len(s)`, []string{"n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		go func(n int) {
+			got, err := prog.Run(newMapHost(), nil, map[string]interface{}{"n": n}, Limits{})
+			if err == nil && got != strconv.Itoa(n) {
+				err = fmt.Errorf("returned %s, expected %d", got, n)
+			}
+			errs <- err
+		}(i * 10)
+	}
+	for i := 0; i < 8; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
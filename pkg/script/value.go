@@ -0,0 +1,70 @@
+package script
+
+import "strconv"
+
+type valueKind uint8
+
+const (
+	kindNil valueKind = iota
+	kindInt
+	kindString
+)
+
+// value is nil, a 64-bit integer or a string. Conditions and comparisons
+// produce the integers 1 and 0.
+type value struct {
+	kind valueKind
+	i    int64
+	s    string
+}
+
+func intValue(i int64) value {
+	return value{kind: kindInt, i: i}
+}
+
+func strValue(s string) value {
+	return value{kind: kindString, s: s}
+}
+
+func boolValue(b bool) value {
+	if b {
+		return intValue(1)
+	}
+	return intValue(0)
+}
+
+// truthy is false for nil, 0 and "".
+func (v value) truthy() bool {
+	switch v.kind {
+	case kindInt:
+		return v.i != 0
+	case kindString:
+		return v.s != ""
+	}
+	return false
+}
+
+func (v value) equal(o value) bool {
+	return v.kind == o.kind && v.i == o.i && v.s == o.s
+}
+
+// String returns "" for nil.
+func (v value) String() string {
+	switch v.kind {
+	case kindInt:
+		return strconv.FormatInt(v.i, 10)
+	case kindString:
+		return v.s
+	}
+	return ""
+}
+
+func (v value) typeName() string {
+	switch v.kind {
+	case kindInt:
+		return "int"
+	case kindString:
+		return "string"
+	}
+	return "nil"
+}
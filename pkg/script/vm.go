@@ -0,0 +1,349 @@
+package script
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type builtin struct {
+	name  string
+	argc  int
+	index int
+	fn    func(m *machine, args []value) (value, error)
+}
+
+// builtins are the only functions available to programs.
+var builtins = []*builtin{
+	// get(key) returns the value of key or nil if it is missing
+	{name: "get", argc: 1, fn: builtinGet},
+	// put(key, value) stores a string or an integer
+	{name: "put", argc: 2, fn: builtinPut},
+	// key(i) returns the i-th key of the request
+	{name: "key", argc: 1, fn: builtinKey},
+	{name: "nkeys", argc: 0, fn: func(m *machine, args []value) (value, error) {
+		return intValue(int64(len(m.keys))), nil
+	}},
+	// int(x) parses a string
+	{name: "int", argc: 1, fn: builtinInt},
+	// str(x) formats an integer, nil is ""
+	{name: "str", argc: 1, fn: builtinStr},
+	{name: "len", argc: 1, fn: builtinLen},
+	// substr(s, start, end) returns s[start:end]
+	{name: "substr", argc: 3, fn: builtinSubstr},
+	// index(s, sub) returns the first index of sub in s or -1
+	{name: "index", argc: 2, fn: builtinFind},
+}
+
+var builtinIndex = func() map[string]*builtin {
+	index := make(map[string]*builtin, len(builtins))
+	for i, b := range builtins {
+		b.index = i
+		index[b.name] = b
+	}
+	return index
+}()
+
+// hostError marks a failure of the host, which is not the program's fault.
+type hostError struct {
+	err error
+}
+
+func (e hostError) Error() string {
+	return e.err.Error()
+}
+
+type machine struct {
+	prog   *Program
+	host   Host
+	keys   []string
+	slots  []value
+	stack  []value
+	limits Limits
+	fuel   int64
+	alloc  int64
+	kvOps  int
+}
+
+func (m *machine) run() (value, error) {
+	code, consts := m.prog.code, m.prog.consts
+	for pc := 0; ; {
+		in := code[pc]
+		pc++
+		m.fuel++
+		if m.fuel > m.limits.Fuel {
+			return value{}, errorf(int(in.line), "out of fuel after %d instructions", m.limits.Fuel)
+		}
+		if m.fuel%yieldInterval == 0 {
+			m.host.Yield()
+		}
+		switch in.op {
+		case opConst:
+			m.push(consts[in.arg])
+		case opLoad:
+			m.push(m.slots[in.arg])
+		case opStore:
+			m.slots[in.arg] = m.pop()
+		case opPop:
+			m.pop()
+		case opJump:
+			pc = int(in.arg)
+		case opJumpFalse:
+			if !m.pop().truthy() {
+				pc = int(in.arg)
+			}
+		case opNot:
+			m.push(boolValue(!m.pop().truthy()))
+		case opNeg:
+			v := m.pop()
+			if v.kind != kindInt {
+				return value{}, errorf(int(in.line), "cannot negate %s", v.typeName())
+			}
+			m.push(intValue(-v.i))
+		case opCall:
+			b := builtins[in.arg]
+			args := m.stack[len(m.stack)-b.argc:]
+			result, err := b.fn(m, args)
+			if err != nil {
+				var he hostError
+				if errors.As(err, &he) {
+					return value{}, fmt.Errorf("line %d: %w", in.line, he.err)
+				}
+				return value{}, errorf(int(in.line), "%s: %v", b.name, err)
+			}
+			m.stack = m.stack[:len(m.stack)-b.argc]
+			m.push(result)
+		case opReturn:
+			return m.pop(), nil
+		default:
+			b := m.pop()
+			a := m.pop()
+			result, err := m.binary(in.op, a, b)
+			if err != nil {
+				return value{}, errorf(int(in.line), "%v", err)
+			}
+			m.push(result)
+		}
+	}
+}
+
+func (m *machine) push(v value) {
+	m.stack = append(m.stack, v)
+}
+
+func (m *machine) pop() value {
+	v := m.stack[len(m.stack)-1]
+	m.stack = m.stack[:len(m.stack)-1]
+	return v
+}
+
+// allocate charges n bytes of new strings.
+func (m *machine) allocate(n int) error {
+	m.alloc += int64(n)
+	if m.alloc > m.limits.AllocBytes {
+		return fmt.Errorf("allocated more than %d bytes", m.limits.AllocBytes)
+	}
+	return nil
+}
+
+func (m *machine) kvOp() error {
+	m.kvOps++
+	if m.kvOps > m.limits.KVOps {
+		return fmt.Errorf("more than %d kv operations", m.limits.KVOps)
+	}
+	return nil
+}
+
+func (m *machine) binary(op opcode, a, b value) (value, error) {
+	switch op {
+	case opEq:
+		return boolValue(a.equal(b)), nil
+	case opNe:
+		return boolValue(!a.equal(b)), nil
+	case opLt, opLe, opGt, opGe:
+		var cmp int
+		switch {
+		case a.kind == kindInt && b.kind == kindInt:
+			cmp = compareInts(a.i, b.i)
+		case a.kind == kindString && b.kind == kindString:
+			cmp = strings.Compare(a.s, b.s)
+		default:
+			return value{}, fmt.Errorf("cannot compare %s and %s", a.typeName(), b.typeName())
+		}
+		switch op {
+		case opLt:
+			return boolValue(cmp < 0), nil
+		case opLe:
+			return boolValue(cmp <= 0), nil
+		case opGt:
+			return boolValue(cmp > 0), nil
+		}
+		return boolValue(cmp >= 0), nil
+	case opAdd:
+		if a.kind == kindNil || b.kind == kindNil {
+			return value{}, fmt.Errorf("cannot add %s and %s", a.typeName(), b.typeName())
+		}
+		if a.kind == kindString || b.kind == kindString {
+			s := a.String() + b.String()
+			if err := m.allocate(len(s)); err != nil {
+				return value{}, err
+			}
+			return strValue(s), nil
+		}
+		return intValue(a.i + b.i), nil
+	}
+	if a.kind != kindInt || b.kind != kindInt {
+		return value{}, fmt.Errorf("arithmetic on %s and %s", a.typeName(), b.typeName())
+	}
+	switch op {
+	case opSub:
+		return intValue(a.i - b.i), nil
+	case opMul:
+		return intValue(a.i * b.i), nil
+	}
+	if b.i == 0 {
+		return value{}, fmt.Errorf("division by zero")
+	}
+	if op == opDiv {
+		return intValue(a.i / b.i), nil
+	}
+	return intValue(a.i % b.i), nil
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func expectString(v value) (string, error) {
+	if v.kind != kindString {
+		return "", fmt.Errorf("expected a string, got %s", v.typeName())
+	}
+	return v.s, nil
+}
+
+func expectInt(v value) (int64, error) {
+	if v.kind != kindInt {
+		return 0, fmt.Errorf("expected an int, got %s", v.typeName())
+	}
+	return v.i, nil
+}
+
+func builtinGet(m *machine, args []value) (value, error) {
+	key, err := expectString(args[0])
+	if err != nil {
+		return value{}, err
+	}
+	if err := m.kvOp(); err != nil {
+		return value{}, err
+	}
+	v, found, err := m.host.Get(key)
+	if err != nil {
+		return value{}, hostError{err}
+	}
+	if !found {
+		return value{}, nil
+	}
+	if err := m.allocate(len(v)); err != nil {
+		return value{}, err
+	}
+	return strValue(v), nil
+}
+
+func builtinPut(m *machine, args []value) (value, error) {
+	key, err := expectString(args[0])
+	if err != nil {
+		return value{}, err
+	}
+	if args[1].kind == kindNil {
+		return value{}, fmt.Errorf("cannot put nil")
+	}
+	if err := m.kvOp(); err != nil {
+		return value{}, err
+	}
+	if err := m.host.Put(key, args[1].String()); err != nil {
+		return value{}, hostError{err}
+	}
+	return value{}, nil
+}
+
+func builtinKey(m *machine, args []value) (value, error) {
+	i, err := expectInt(args[0])
+	if err != nil {
+		return value{}, err
+	}
+	if i < 0 || i >= int64(len(m.keys)) {
+		return value{}, fmt.Errorf("index %d out of range of %d keys", i, len(m.keys))
+	}
+	return strValue(m.keys[i]), nil
+}
+
+func builtinInt(m *machine, args []value) (value, error) {
+	switch v := args[0]; v.kind {
+	case kindInt:
+		return v, nil
+	case kindString:
+		i, err := strconv.ParseInt(v.s, 10, 64)
+		if err != nil {
+			return value{}, fmt.Errorf("%q is not an integer", v.s)
+		}
+		return intValue(i), nil
+	}
+	return value{}, fmt.Errorf("cannot convert nil")
+}
+
+func builtinStr(m *machine, args []value) (value, error) {
+	if args[0].kind == kindString {
+		return args[0], nil
+	}
+	s := args[0].String()
+	if err := m.allocate(len(s)); err != nil {
+		return value{}, err
+	}
+	return strValue(s), nil
+}
+
+func builtinLen(m *machine, args []value) (value, error) {
+	s, err := expectString(args[0])
+	if err != nil {
+		return value{}, err
+	}
+	return intValue(int64(len(s))), nil
+}
+
+func builtinSubstr(m *machine, args []value) (value, error) {
+	s, err := expectString(args[0])
+	if err != nil {
+		return value{}, err
+	}
+	start, err := expectInt(args[1])
+	if err != nil {
+		return value{}, err
+	}
+	end, err := expectInt(args[2])
+	if err != nil {
+		return value{}, err
+	}
+	if start < 0 || end < start || end > int64(len(s)) {
+		return value{}, fmt.Errorf("range [%d:%d] out of bounds of length %d", start, end, len(s))
+	}
+	return strValue(s[start:end]), nil
+}
+
+func builtinFind(m *machine, args []value) (value, error) {
+	s, err := expectString(args[0])
+	if err != nil {
+		return value{}, err
+	}
+	sub, err := expectString(args[1])
+	if err != nil {
+		return value{}, err
+	}
+	return intValue(int64(strings.Index(s, sub))), nil
+}
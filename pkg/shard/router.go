@@ -0,0 +1,279 @@
+package shard
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tomquartz/pyxis-k8s/pkg/wire"
+	"github.com/tomquartz/pyxis-k8s/pkg/workload"
+)
+
+// Router sends kv requests to the storage replicas owning their keys. For
+// replicated shards it sticks to the group member that last answered and
+// moves on to the next one when it fails.
+type Router struct {
+	shards *Map
+	groups [][]string
+	active []int32
+	client *http.Client
+	// set to send kv requests over the binary protocol
+	wire      *wire.Client
+	wireAddrs map[string]string
+}
+
+// client may be nil for http.DefaultClient
+func NewRouter(shards *Map, client *http.Client) *Router {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	groups := make([][]string, shards.Len())
+	for i := range groups {
+		groups[i] = shards.Group(i)
+	}
+	return &Router{
+		shards: shards,
+		groups: groups,
+		active: make([]int32, shards.Len()),
+		client: client,
+	}
+}
+
+// UseWire sends kv requests over the binary protocol. Scans keep using http.
+// wireAddrs lists the protocol addresses of the replicas in the layout of the
+// endpoints of the shard map.
+func (r *Router) UseWire(wireAddrs []string, client *wire.Client) error {
+	if len(wireAddrs) != len(r.groups) {
+		return fmt.Errorf("got %d wire addresses for %d shards", len(wireAddrs), len(r.groups))
+	}
+	r.wireAddrs = make(map[string]string)
+	for i, group := range r.groups {
+		addrs := strings.Split(wireAddrs[i], GroupSeparator)
+		if len(addrs) != len(group) {
+			return fmt.Errorf("got %d wire addresses for the %d replicas of shard %d", len(addrs), len(group), i)
+		}
+		for j, endpoint := range group {
+			r.wireAddrs[endpoint] = addrs[j]
+		}
+	}
+	r.wire = client
+	return nil
+}
+
+func (r *Router) Shards() *Map {
+	return r.shards
+}
+
+// Do splits req per shard, sends the parts concurrently and merges the
+// responses back into the order of req.Keys. Atomic batches must not be split.
+func (r *Router) Do(req *workload.StorageRequest) (*workload.StorageResponse, error) {
+	groups := r.shards.Split(req.Keys)
+	if req.Atomic && len(groups) > 1 {
+		return nil, fmt.Errorf("atomic batch spans %d shards", len(groups))
+	}
+	if len(groups) == 1 {
+		for shard := range groups {
+			return r.Send(shard, req, false)
+		}
+	}
+	resp := &workload.StorageResponse{ID: req.ID}
+	partResps := make(map[int]*workload.StorageResponse, len(groups))
+	errs := make(map[int]error)
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for shard, idxs := range groups {
+		wg.Add(1)
+		go func(shard int, idxs []int) {
+			defer wg.Done()
+			part := req.Subset(fmt.Sprintf("%s-s%d", req.ID, shard), idxs)
+			partResp, err := r.Send(shard, part, false)
+			mu.Lock()
+			defer mu.Unlock()
+			partResps[shard] = partResp
+			errs[shard] = err
+		}(shard, idxs)
+	}
+	wg.Wait()
+	for shard, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("shard %d: %w", shard, err)
+		}
+	}
+	n := len(req.Keys)
+	resp.Keys, resp.Values = make([]string, n), make([]string, n)
+	resp.Found, resp.Applied = make([]bool, n), make([]bool, n)
+	for shard, idxs := range groups {
+		partResp := partResps[shard]
+		if partResp.Len() != len(idxs) {
+			return nil, fmt.Errorf("shard %d returned %d entries for %d keys", shard, partResp.Len(), len(idxs))
+		}
+		for j, i := range idxs {
+			resp.Keys[i] = partResp.Keys[j]
+			resp.Values[i] = partResp.Values[j]
+			resp.Found[i] = partResp.Found[j]
+			resp.Applied[i] = partResp.Applied[j]
+		}
+	}
+	return resp, nil
+}
+
+// Send posts req to a single shard. Forwarded requests are served by the
+// receiving replica without further routing. Requests past their deadline are
+// not sent.
+func (r *Router) Send(shard int, req *workload.StorageRequest, forwarded bool) (*workload.StorageResponse, error) {
+	if err := req.Deadline.Check(); err != nil {
+		return nil, err
+	}
+	if r.wire != nil {
+		var resp *workload.StorageResponse
+		err := r.failover(shard, func(endpoint string) (bool, error) {
+			var err error
+			resp, err = r.wire.Do(r.wireAddrs[endpoint], req, forwarded)
+			return wireRetry(err), err
+		})
+		return resp, err
+	}
+	reqJson, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode kv req: %v", err)
+	}
+	var resp *workload.StorageResponse
+	err = r.failover(shard, func(endpoint string) (bool, error) {
+		var retry bool
+		resp, retry, err = r.send(endpoint, reqJson, forwarded, req.Deadline)
+		return retry, err
+	})
+	return resp, err
+}
+
+// Scan runs req on a single shard and returns its entries in key order along
+// with the token to continue from, which is empty once the shard is exhausted.
+func (r *Router) Scan(shard int, req *workload.ScanRequest) ([]workload.ScanEntry, string, error) {
+	reqJson, err := json.Marshal(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to encode scan req: %v", err)
+	}
+	var entries []workload.ScanEntry
+	var next string
+	err = r.failover(shard, func(endpoint string) (bool, error) {
+		httpResp, retry, err := r.post(endpoint+workload.StorageScanPath, reqJson, true, 0)
+		if err != nil {
+			return retry, err
+		}
+		defer httpResp.Body.Close()
+		entries, next = entries[:0], ""
+		dec := json.NewDecoder(httpResp.Body)
+		for {
+			entry := workload.ScanEntry{}
+			if err := dec.Decode(&entry); err != nil {
+				return false, fmt.Errorf("failed to decode scan resp: %v", err)
+			}
+			if entry.Last {
+				if entry.Error != "" {
+					return false, fmt.Errorf("scan failed: %s", entry.Error)
+				}
+				next = entry.Next
+				return false, nil
+			}
+			entries = append(entries, entry)
+		}
+	})
+	return entries, next, err
+}
+
+// failover calls fn on the members of the replication group of shard, starting
+// from the one that last succeeded, until it succeeds or asks not to retry.
+func (r *Router) failover(shard int, fn func(endpoint string) (bool, error)) error {
+	group := r.groups[shard]
+	start := int(atomic.LoadInt32(&r.active[shard]))
+	for attempt := 0; ; attempt++ {
+		i := (start + attempt) % len(group)
+		retry, err := fn(group[i])
+		if err == nil {
+			if i != start {
+				atomic.StoreInt32(&r.active[shard], int32(i))
+			}
+			return nil
+		}
+		if !retry || attempt == len(group)-1 {
+			return err
+		}
+	}
+}
+
+// wireRetry retries connection failures and replicas that are not the primary,
+// like post does for http.
+func wireRetry(err error) bool {
+	var statusErr *wire.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code == http.StatusServiceUnavailable
+	}
+	return err != nil && !errors.Is(err, workload.ErrDeadlineExceeded)
+}
+
+// send reports whether another member of the replication group should be
+// tried, which is the case when the endpoint is down or not the primary.
+func (r *Router) send(endpoint string, reqJson []byte, forwarded bool, deadline workload.Deadline) (*workload.StorageResponse, bool, error) {
+	httpResp, retry, err := r.post(endpoint+workload.StorageKVPath, reqJson, forwarded, deadline)
+	if err != nil {
+		return nil, retry, err
+	}
+	defer httpResp.Body.Close()
+	resp := &workload.StorageResponse{}
+	if err := json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+		return nil, false, fmt.Errorf("failed to decode kv resp: %v", err)
+	}
+	return resp, false, nil
+}
+
+// post gives up at deadline unless it is 0. Failed requests are returned as a
+// wire.StatusError like over the binary protocol.
+func (r *Router) post(url string, reqJson []byte, forwarded bool, deadline workload.Deadline) (*http.Response, bool, error) {
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if t, ok := deadline.Time(); ok {
+		ctx, cancel = context.WithDeadline(ctx, t)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(reqJson))
+	if err != nil {
+		cancel()
+		return nil, false, fmt.Errorf("failed to create req: %v", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if forwarded {
+		httpReq.Header.Set(workload.StorageForwardedHeader, "true")
+	}
+	httpResp, err := r.client.Do(httpReq)
+	if err != nil {
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, false, fmt.Errorf("failed to post req: %w", workload.ErrDeadlineExceeded)
+		}
+		return nil, true, fmt.Errorf("failed to post req: %v", err)
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		defer cancel()
+		defer httpResp.Body.Close()
+		msg, _ := io.ReadAll(httpResp.Body)
+		return nil, httpResp.StatusCode == http.StatusServiceUnavailable, &wire.StatusError{Code: httpResp.StatusCode, Msg: string(msg)}
+	}
+	httpResp.Body = &cancelOnClose{ReadCloser: httpResp.Body, cancel: cancel}
+	return httpResp, false, nil
+}
+
+// cancelOnClose releases the context of a response once its body is read.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,212 @@
+package shard
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tomquartz/pyxis-k8s/pkg/wire"
+	"github.com/tomquartz/pyxis-k8s/pkg/workload"
+)
+
+// fakeReplica answers kv requests with values naming itself and the key, and
+// scans with its entries. It fails every request with status while set.
+type fakeReplica struct {
+	name      string
+	mu        sync.Mutex
+	status    int
+	keys      []string
+	forwarded bool
+	entries   []workload.ScanEntry
+}
+
+func (f *fakeReplica) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.status != 0 {
+		http.Error(w, "unavailable", f.status)
+		return
+	}
+	f.forwarded = r.Header.Get(workload.StorageForwardedHeader) != ""
+	switch r.URL.Path {
+	case workload.StorageKVPath:
+		req := &workload.StorageRequest{}
+		json.NewDecoder(r.Body).Decode(req)
+		f.keys = append(f.keys, req.Keys...)
+		resp := &workload.StorageResponse{ID: req.ID, Keys: req.Keys}
+		for _, key := range req.Keys {
+			resp.Values = append(resp.Values, f.name+":"+key)
+			resp.Found = append(resp.Found, true)
+			resp.Applied = append(resp.Applied, false)
+		}
+		json.NewEncoder(w).Encode(resp)
+	case workload.StorageScanPath:
+		enc := json.NewEncoder(w)
+		for i := range f.entries {
+			enc.Encode(&f.entries[i])
+		}
+	}
+}
+
+func (f *fakeReplica) set(status int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status = status
+}
+
+func (f *fakeReplica) served() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.keys
+}
+
+// startReplicas serves every fake replica and returns their base URLs.
+func startReplicas(t *testing.T, replicas ...*fakeReplica) []string {
+	urls := make([]string, len(replicas))
+	for i, f := range replicas {
+		srv := httptest.NewServer(f)
+		t.Cleanup(srv.Close)
+		urls[i] = srv.URL
+	}
+	return urls
+}
+
+func TestRouterDo(t *testing.T) {
+	replicas := []*fakeReplica{{name: "s0"}, {name: "s1"}, {name: "s2"}}
+	r := NewRouter(NewMap(startReplicas(t, replicas...), DefaultVirtualNodes), nil)
+	req := &workload.StorageRequest{ID: "get"}
+	for i := 0; i < 30; i++ {
+		req.Keys = append(req.Keys, fmt.Sprintf("key-%d", i))
+	}
+	resp, err := r.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Len() != len(req.Keys) {
+		t.Fatalf("got %d entries for %d keys", resp.Len(), len(req.Keys))
+	}
+	for i, key := range req.Keys {
+		owner := r.Shards().Owner(key)
+		if want := fmt.Sprintf("s%d:%s", owner, key); resp.Keys[i] != key || resp.Values[i] != want {
+			t.Errorf("entry %d is %s=%s, expected %s from its owner", i, resp.Keys[i], resp.Values[i], want)
+		}
+	}
+	for shard, f := range replicas {
+		for _, key := range f.served() {
+			if owner := r.Shards().Owner(key); owner != shard {
+				t.Errorf("shard %d was sent %s owned by shard %d", shard, key, owner)
+			}
+		}
+		if f.forwarded {
+			t.Errorf("shard %d got a forwarded request from a client", shard)
+		}
+	}
+
+	atomic := &workload.StorageRequest{ID: "batch", Keys: req.Keys, Atomic: true}
+	if _, err := r.Do(atomic); err == nil {
+		t.Error("expected an atomic batch spanning shards to be rejected")
+	}
+}
+
+func TestRouterSendForwardsAndChecksDeadline(t *testing.T) {
+	f := &fakeReplica{name: "s0"}
+	r := NewRouter(NewMap(startReplicas(t, f), 0), nil)
+	if _, err := r.Send(0, &workload.StorageRequest{ID: "get", Keys: []string{"k"}}, true); err != nil {
+		t.Fatal(err)
+	}
+	if !f.forwarded {
+		t.Error("expected the forwarded header set")
+	}
+	expired := &workload.StorageRequest{ID: "late", Keys: []string{"late"}, Deadline: workload.DeadlineAt(time.Now().Add(-time.Second))}
+	if _, err := r.Send(0, expired, false); !errors.Is(err, workload.ErrDeadlineExceeded) {
+		t.Errorf("got %v for a request past its deadline, expected %v", err, workload.ErrDeadlineExceeded)
+	}
+	if keys := f.served(); len(keys) != 1 {
+		t.Errorf("replica was sent %v, expected the request past its deadline not sent", keys)
+	}
+}
+
+func TestRouterFailover(t *testing.T) {
+	primary, backup := &fakeReplica{name: "primary"}, &fakeReplica{name: "backup"}
+	urls := startReplicas(t, primary, backup)
+	// a replica that is down, then one that is not the primary
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	group := strings.Join([]string{down.URL, urls[1], urls[0]}, GroupSeparator)
+	r := NewRouter(NewMap([]string{group}, 0), nil)
+	backup.set(http.StatusServiceUnavailable)
+
+	get := func(key string) (*workload.StorageResponse, error) {
+		return r.Send(0, &workload.StorageRequest{ID: key, Keys: []string{key}}, false)
+	}
+	resp, err := get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Values[0] != "primary:a" {
+		t.Errorf("got %s, expected the primary to answer", resp.Values[0])
+	}
+	// sticks to the member that answered
+	backup.set(0)
+	if resp, err := get("b"); err != nil || resp.Values[0] != "primary:b" {
+		t.Errorf("got %v, %v, expected the primary that answered last", resp, err)
+	}
+	if keys := backup.served(); len(keys) != 0 {
+		t.Errorf("backup served %v after the primary was found", keys)
+	}
+
+	// moves on once the primary fails, wrapping around the group
+	primary.set(http.StatusServiceUnavailable)
+	if resp, err := get("c"); err != nil || resp.Values[0] != "backup:c" {
+		t.Errorf("got %v, %v, expected the backup to take over", resp, err)
+	}
+
+	// other failures are not retried on other members
+	backup.set(http.StatusBadRequest)
+	primary.set(0)
+	_, err = get("d")
+	var statusErr *wire.StatusError
+	if !errors.As(err, &statusErr) || statusErr.Code != http.StatusBadRequest {
+		t.Errorf("got %v, expected the bad request of the backup", err)
+	}
+	if keys := primary.served(); len(keys) != 2 {
+		t.Errorf("primary served %v, expected no retry of a bad request", keys)
+	}
+
+	backup.set(http.StatusServiceUnavailable)
+	primary.set(http.StatusServiceUnavailable)
+	if _, err := get("e"); err == nil {
+		t.Error("expected an error once every member failed")
+	}
+}
+
+func TestRouterScan(t *testing.T) {
+	f := &fakeReplica{name: "s0", entries: []workload.ScanEntry{
+		{Key: "a", Value: "1"},
+		{Key: "b", Value: "2"},
+		{Last: true, Next: "token"},
+	}}
+	r := NewRouter(NewMap(startReplicas(t, f), 0), nil)
+	entries, next, err := r.Scan(0, &workload.ScanRequest{ID: "scan"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[1].Key != "b" || next != "token" || !f.forwarded {
+		t.Errorf("got %v up to %q, expected two entries and the token from a forwarded scan", entries, next)
+	}
+
+	f.entries = []workload.ScanEntry{{Key: "a", Value: "1"}, {Last: true, Error: "disk on fire"}}
+	if _, _, err := r.Scan(0, &workload.ScanRequest{ID: "scan"}); err == nil || !strings.Contains(err.Error(), "disk on fire") {
+		t.Errorf("got %v, expected the error of the last line", err)
+	}
+	f.entries = []workload.ScanEntry{{Key: "a", Value: "1"}}
+	if _, _, err := r.Scan(0, &workload.ScanRequest{ID: "scan"}); err == nil {
+		t.Error("expected an error for a scan response cut off before its last line")
+	}
+}
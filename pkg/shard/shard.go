@@ -0,0 +1,110 @@
+package shard
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+)
+
+const (
+	DefaultVirtualNodes = 128
+	GroupSeparator      = "|"
+)
+
+// Map assigns keys to storage replicas with consistent hashing. The endpoint
+// of a replicated shard lists the base URLs of its replication group
+// separated by GroupSeparator.
+type Map struct {
+	endpoints []string
+	hashes    []uint32
+	owners    []int
+}
+
+func NewMap(endpoints []string, vnodes int) *Map {
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+	m := &Map{endpoints: endpoints}
+	type point struct {
+		hash  uint32
+		owner int
+	}
+	points := make([]point, 0, len(endpoints)*vnodes)
+	for i := range endpoints {
+		for v := 0; v < vnodes; v++ {
+			// hash by shard index so that the ring does not depend on addresses
+			points = append(points, point{hash: hashKey(fmt.Sprintf("shard-%d-%d", i, v)), owner: i})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+	for _, p := range points {
+		m.hashes = append(m.hashes, p.hash)
+		m.owners = append(m.owners, p.owner)
+	}
+	return m
+}
+
+// hashKey is fnv-1a followed by the murmur3 finalizer, since raw fnv
+// clusters badly on keys that only differ in a numeric suffix.
+func hashKey(key string) uint32 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return uint32(x)
+}
+
+func (m *Map) Len() int {
+	return len(m.endpoints)
+}
+
+// Endpoint returns the initial primary of the shard.
+func (m *Map) Endpoint(shard int) string {
+	return m.Group(shard)[0]
+}
+
+func (m *Map) Group(shard int) []string {
+	return strings.Split(m.endpoints[shard], GroupSeparator)
+}
+
+func (m *Map) Owner(key string) int {
+	if len(m.endpoints) == 1 {
+		return 0
+	}
+	h := hashKey(key)
+	i := sort.Search(len(m.hashes), func(i int) bool { return m.hashes[i] >= h })
+	if i == len(m.hashes) {
+		i = 0
+	}
+	return m.owners[i]
+}
+
+// Split groups the indexes of keys by owner shard, preserving their order.
+func (m *Map) Split(keys []string) map[int][]int {
+	groups := make(map[int][]int)
+	for i, key := range keys {
+		owner := m.Owner(key)
+		groups[owner] = append(groups[owner], i)
+	}
+	return groups
+}
+
+// Primary returns the shard owning most of keys, which is where a function
+// over them should run.
+func (m *Map) Primary(keys []string) int {
+	counts := make([]int, len(m.endpoints))
+	best := 0
+	for _, key := range keys {
+		owner := m.Owner(key)
+		counts[owner]++
+		if counts[owner] > counts[best] {
+			best = owner
+		}
+	}
+	return best
+}
@@ -0,0 +1,84 @@
+package shard
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestMapOwner(t *testing.T) {
+	const nKeys = 30000
+	m := NewMap([]string{"a", "b", "c"}, DefaultVirtualNodes)
+	counts := make([]int, m.Len())
+	for i := 0; i < nKeys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		owner := m.Owner(key)
+		if owner != m.Owner(key) {
+			t.Fatalf("%s has no stable owner", key)
+		}
+		counts[owner]++
+	}
+	for shard, n := range counts {
+		if n < nKeys/5 {
+			t.Errorf("shard %d owns %d of %d keys, expected about a third", shard, n, nKeys)
+		}
+	}
+
+	// the ring depends on the number of shards, not on their addresses
+	other := NewMap([]string{"x|y", "z", "w"}, DefaultVirtualNodes)
+	grown := NewMap([]string{"a", "b", "c", "d"}, DefaultVirtualNodes)
+	moved := 0
+	for i := 0; i < nKeys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if other.Owner(key) != m.Owner(key) {
+			t.Fatalf("%s owned by %d and %d by maps of the same size", key, m.Owner(key), other.Owner(key))
+		}
+		if owner := grown.Owner(key); owner != m.Owner(key) {
+			if owner != 3 {
+				t.Fatalf("%s moved from shard %d to %d when adding shard 3", key, m.Owner(key), owner)
+			}
+			moved++
+		}
+	}
+	if moved < nKeys/6 || moved > nKeys/3 {
+		t.Errorf("%d of %d keys moved to the added shard, expected about a quarter", moved, nKeys)
+	}
+
+	if single := NewMap([]string{"a"}, 0); single.Owner("key") != 0 {
+		t.Error("expected the only shard to own every key")
+	}
+}
+
+func TestMapSplitAndPrimary(t *testing.T) {
+	m := NewMap([]string{"a", "b", "c"}, DefaultVirtualNodes)
+	keys := make([]string, 20)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	seen := 0
+	for shard, idxs := range m.Split(keys) {
+		for j, i := range idxs {
+			if m.Owner(keys[i]) != shard || j > 0 && idxs[j-1] >= i {
+				t.Fatalf("split %v for shard %d is not the keys it owns in order", idxs, shard)
+			}
+		}
+		seen += len(idxs)
+	}
+	if seen != len(keys) {
+		t.Errorf("split %d of %d keys", seen, len(keys))
+	}
+
+	var mostly []string
+	for _, key := range keys {
+		if m.Owner(key) == 2 {
+			mostly = append(mostly, key, key)
+		}
+	}
+	mostly = append(mostly, keys[0])
+	if primary := m.Primary(mostly); primary != 2 {
+		t.Errorf("primary is %d, expected 2, which owns most keys", primary)
+	}
+	if group := NewMap([]string{"a|b|c"}, 0).Group(0); !reflect.DeepEqual(group, []string{"a", "b", "c"}) {
+		t.Errorf("group %v, expected the members of the replicated shard", group)
+	}
+}
@@ -0,0 +1,158 @@
+package stats
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultWindow  = 60 * time.Second
+	BucketInterval = time.Second
+	// service time samples kept per request type and bucket
+	maxBucketSamples = 256
+)
+
+// Snapshot is the load of a server as reported by its /stats endpoint.
+type Snapshot struct {
+	QueueLength int     `json:"queueLength"`
+	Workers     int     `json:"workers"`
+	BusyWorkers int     `json:"busyWorkers"`
+	WindowSecs  float64 `json:"windowSecs"`
+	// totals over the window
+	Served int64                 `json:"served"`
+	Errors int64                 `json:"errors"`
+	Types  map[string]*TypeStats `json:"types"`
+}
+
+type TypeStats struct {
+	Served int64 `json:"served"`
+	Errors int64 `json:"errors"`
+	// service time percentiles
+	P50Secs float64 `json:"p50Secs"`
+	P90Secs float64 `json:"p90Secs"`
+	P99Secs float64 `json:"p99Secs"`
+	MaxSecs float64 `json:"maxSecs"`
+}
+
+type typeBucket struct {
+	served  int64
+	errors  int64
+	max     time.Duration
+	samples []time.Duration
+}
+
+type bucket struct {
+	start time.Time
+	types map[string]*typeBucket
+}
+
+// Recorder counts busy workers and keeps the service times of finished
+// requests in per-second buckets covering a sliding window.
+type Recorder struct {
+	mu      sync.Mutex
+	workers int
+	busy    int64
+	buckets []bucket
+	rng     *rand.Rand
+}
+
+func NewRecorder(workers int) *Recorder {
+	return &Recorder{
+		workers: workers,
+		buckets: make([]bucket, int(DefaultWindow/BucketInterval)),
+		rng:     rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+// Begin marks a worker busy until the matching Done.
+func (r *Recorder) Begin() {
+	atomic.AddInt64(&r.busy, 1)
+}
+
+func (r *Recorder) Done(typ string, serviceTime time.Duration, failed bool) {
+	atomic.AddInt64(&r.busy, -1)
+	r.Record(typ, serviceTime, failed)
+}
+
+// Record adds a finished request without changing the busy workers.
+func (r *Recorder) Record(typ string, serviceTime time.Duration, failed bool) {
+	now := time.Now()
+	start := now.Truncate(BucketInterval)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b := &r.buckets[int(start.Unix())%len(r.buckets)]
+	if !b.start.Equal(start) {
+		b.start = start
+		b.types = make(map[string]*typeBucket)
+	}
+	tb, ok := b.types[typ]
+	if !ok {
+		tb = &typeBucket{}
+		b.types[typ] = tb
+	}
+	tb.served++
+	if failed {
+		tb.errors++
+	}
+	tb.max = max(tb.max, serviceTime)
+	// reservoir sampling keeps a uniform sample of the bucket
+	if len(tb.samples) < maxBucketSamples {
+		tb.samples = append(tb.samples, serviceTime)
+	} else if i := r.rng.Int63n(tb.served); i < maxBucketSamples {
+		tb.samples[i] = serviceTime
+	}
+}
+
+// Snapshot summarizes the requests finished within window, which is capped at
+// DefaultWindow. The queue length is left to the caller.
+func (r *Recorder) Snapshot(window time.Duration) *Snapshot {
+	if window <= 0 || window > DefaultWindow {
+		window = DefaultWindow
+	}
+	snap := &Snapshot{
+		Workers:     r.workers,
+		BusyWorkers: int(atomic.LoadInt64(&r.busy)),
+		WindowSecs:  window.Seconds(),
+		Types:       make(map[string]*TypeStats),
+	}
+	cutoff := time.Now().Truncate(BucketInterval).Add(-window + BucketInterval)
+	samples := make(map[string][]time.Duration)
+	r.mu.Lock()
+	for _, b := range r.buckets {
+		if b.start.Before(cutoff) {
+			continue
+		}
+		for typ, tb := range b.types {
+			ts, ok := snap.Types[typ]
+			if !ok {
+				ts = &TypeStats{}
+				snap.Types[typ] = ts
+			}
+			ts.Served += tb.served
+			ts.Errors += tb.errors
+			ts.MaxSecs = max(ts.MaxSecs, tb.max.Seconds())
+			samples[typ] = append(samples[typ], tb.samples...)
+		}
+	}
+	r.mu.Unlock()
+	for typ, ts := range snap.Types {
+		snap.Served += ts.Served
+		snap.Errors += ts.Errors
+		s := samples[typ]
+		sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+		ts.P50Secs = percentile(s, 0.5)
+		ts.P90Secs = percentile(s, 0.9)
+		ts.P99Secs = percentile(s, 0.99)
+	}
+	return snap
+}
+
+func percentile(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(p*float64(len(sorted)-1))].Seconds()
+}
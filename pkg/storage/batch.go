@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tomquartz/pyxis-k8s/pkg/workload"
+)
+
+const kvLockStripes = 256
+
+// keyLocks isolates kv operations from each other. Single-key operations hold
+// the stripe of their key and atomic batches hold the stripes of all their
+// keys, so point reads see a batch either entirely or not at all.
+type keyLocks struct {
+	stripes [kvLockStripes]sync.RWMutex
+}
+
+// lock acquires the stripes of keys in ascending order and returns the
+// function releasing them.
+func (l *keyLocks) lock(keys []string, write bool) func() {
+	idxs := stripeIndexes(keys, kvLockStripes)
+	for _, i := range idxs {
+		if write {
+			l.stripes[i].Lock()
+		} else {
+			l.stripes[i].RLock()
+		}
+	}
+	return func() {
+		for _, i := range idxs {
+			if write {
+				l.stripes[i].Unlock()
+			} else {
+				l.stripes[i].RUnlock()
+			}
+		}
+	}
+}
+
+// stripeIndexes returns the distinct stripes of keys in ascending order, the
+// order in which to lock them.
+func stripeIndexes(keys []string, n int) []int {
+	idxs := make([]int, 0, len(keys))
+	seen := make(map[int]bool, len(keys))
+	for _, key := range keys {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		i := int(h.Sum32() % uint32(n))
+		if !seen[i] {
+			seen[i] = true
+			idxs = append(idxs, i)
+		}
+	}
+	sort.Ints(idxs)
+	return idxs
+}
+
+// lockStripes locks the stripes of keys in ascending order and returns the
+// function releasing them.
+func lockStripes(stripes []sync.Mutex, keys []string) func() {
+	idxs := stripeIndexes(keys, len(stripes))
+	for _, i := range idxs {
+		stripes[i].Lock()
+	}
+	return func() {
+		for _, i := range idxs {
+			stripes[i].Unlock()
+		}
+	}
+}
+
+// mutation is the change of one key by a batch: walOpPut with the new value or
+// walOpDelete.
+type mutation struct {
+	Op      byte    `json:"op"`
+	Key     string  `json:"key"`
+	Value   string  `json:"value,omitempty"`
+	TTLSecs float64 `json:"ttlSecs,omitempty"`
+}
+
+// BatchFunc computes the mutations of a batch from the current values of its
+// keys. The keys of the mutations must be distinct.
+type BatchFunc func(get func(key string) (string, bool)) ([]mutation, error)
+
+// batchView stages the mutations of a batch over the store, so that later
+// operations of the batch see earlier ones. Only the last mutation of each key
+// is kept.
+type batchView struct {
+	get  func(key string) (string, bool)
+	muts []mutation
+	idx  map[string]int
+}
+
+func newBatchView(get func(key string) (string, bool)) *batchView {
+	return &batchView{get: get, idx: make(map[string]int)}
+}
+
+func (v *batchView) Get(key string) (string, bool) {
+	if i, ok := v.idx[key]; ok {
+		return v.muts[i].Value, v.muts[i].Op == walOpPut
+	}
+	return v.get(key)
+}
+
+func (v *batchView) set(m mutation) {
+	if i, ok := v.idx[m.Key]; ok {
+		v.muts[i] = m
+		return
+	}
+	v.idx[m.Key] = len(v.muts)
+	v.muts = append(v.muts, m)
+}
+
+// applyBatch applies the operations of req in order. The mutations of all
+// operations are computed first and then written, logged and replicated as a
+// single unit, so a failing operation leaves the store unchanged. The caller
+// must hold the locks of all keys of req.
+func (w *StorageWorker) applyBatch(req *workload.StorageRequest) ([]*kvResult, error) {
+	results := make([]*kvResult, len(req.Keys))
+	if !req.HasWrites() {
+		for i, key := range req.Keys {
+			time.Sleep(KVAccessTimeSimulated)
+			res := &kvResult{}
+			res.value, res.found = w.get(key)
+			results[i] = res
+		}
+		return results, nil
+	}
+	err := w.update(req.Keys, func(get func(string) (string, bool)) ([]mutation, error) {
+		view := newBatchView(get)
+		for i, key := range req.Keys {
+			time.Sleep(KVAccessTimeSimulated)
+			res, err := applyKV(view, req, i)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %w", req.Op(i), key, err)
+			}
+			results[i] = res
+		}
+		return view.muts, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/tomquartz/pyxis-k8s/pkg/drain"
+	"github.com/tomquartz/pyxis-k8s/pkg/workload"
+)
+
+// startServer runs a storage server on an ephemeral port until the test ends
+// and returns it with its base URL.
+func startServer(t *testing.T, cfg *StorageConfig) (*StorageServer, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return startServerOn(t, cfg, ln)
+}
+
+// startServerOn is startServer for a listener opened beforehand, for servers
+// that need to know the addresses of each other.
+func startServerOn(t *testing.T, cfg *StorageConfig, ln net.Listener) (*StorageServer, string) {
+	cfg.Drain = &drain.Config{TimeoutSecs: 1}
+	s, err := NewStorageServer(cfg)
+	if err != nil {
+		ln.Close()
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.RunListener(ctx, ln)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return s, "http://" + ln.Addr().String()
+}
+
+func postKV(url string, req *workload.StorageRequest) (*workload.StorageResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpResp, err := http.Post(url+workload.StorageKVPath, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("storage replied %d", httpResp.StatusCode)
+	}
+	resp := &workload.StorageResponse{}
+	return resp, json.NewDecoder(httpResp.Body).Decode(resp)
+}
+
+// Writers put the same value to both keys in one batch, over http and from
+// pushdown functions, so readers must never see them differ.
+func TestAtomicBatchIsolation(t *testing.T) {
+	s, url := startServer(t, &StorageConfig{
+		NumWorkers: 8,
+		Engine:     EngineSharded,
+		Durable:    &DurableConfig{Dir: t.TempDir()},
+	})
+	keys := []string{"a", "b"}
+	if _, err := postKV(url, &workload.StorageRequest{ID: "init", Keys: keys, Values: []string{"0", "0"}, Atomic: true}); err != nil {
+		t.Fatal(err)
+	}
+	const writes = 50
+	var writers, readers sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		writers.Add(1)
+		go func(i int) {
+			defer writers.Done()
+			env := &pushdownEnv{worker: NewStorageWorker(i, s), req: &workload.ClientRequest{}}
+			for j := 0; j < writes; j++ {
+				v := fmt.Sprintf("%d-%d", i, j)
+				var err error
+				if i%2 == 0 {
+					_, err = postKV(url, &workload.StorageRequest{ID: v, Keys: keys, Values: []string{v, v}, Atomic: true})
+				} else {
+					err = env.Put(keys, []string{v, v})
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	check := func(values []string) bool {
+		if len(values) != 2 || values[0] != values[1] {
+			t.Errorf("read a partial batch: %v", values)
+			return false
+		}
+		return true
+	}
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func(i int) {
+			defer readers.Done()
+			env := &pushdownEnv{worker: NewStorageWorker(i, s), req: &workload.ClientRequest{}}
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if i%2 == 0 {
+					resp, err := postKV(url, &workload.StorageRequest{ID: "read", Keys: keys, Atomic: true})
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if !check(resp.Values) {
+						return
+					}
+				} else {
+					values, _, err := env.Get(keys)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if !check(values) {
+						return
+					}
+				}
+			}
+		}(i)
+	}
+	writers.Wait()
+	close(stop)
+	readers.Wait()
+}
+
+func TestAtomicBatchFailureLeavesStoreUnchanged(t *testing.T) {
+	_, url := startServer(t, &StorageConfig{NumWorkers: 1, Engine: EngineMap})
+	if _, err := postKV(url, &workload.StorageRequest{ID: "init", Keys: []string{"n"}, Values: []string{"x"}}); err != nil {
+		t.Fatal(err)
+	}
+	// the increment of a non-integer fails after the put of a
+	_, err := postKV(url, &workload.StorageRequest{
+		ID:     "batch",
+		Keys:   []string{"a", "n"},
+		Values: []string{"v", "1"},
+		Ops:    []string{workload.OpPut, workload.OpIncr},
+		Atomic: true,
+	})
+	if err == nil {
+		t.Fatal("expected the batch to fail")
+	}
+	resp, err := postKV(url, &workload.StorageRequest{ID: "read", Keys: []string{"a", "n"}, Atomic: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Found[0] || resp.Values[1] != "x" {
+		t.Errorf("failed batch left a=%q (found %v), n=%q", resp.Values[0], resp.Found[0], resp.Values[1])
+	}
+}
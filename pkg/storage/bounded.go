@@ -0,0 +1,491 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const ExpirySweepInterval = time.Second
+
+const boundedLockStripes = 256
+
+const DefaultNamespaceSeparator = ":"
+
+type MemoryConfig struct {
+	// 0 for no limit
+	LimitBytes int64
+	Policy     string
+	// the namespace of a key is its part before the first separator
+	NamespaceSeparator string
+}
+
+type MemoryStats struct {
+	UsedBytes  int64 `json:"usedBytes"`
+	LimitBytes int64 `json:"limitBytes"`
+	Keys       int64 `json:"keys"`
+	Evicted    int64 `json:"evicted"`
+	Expired    int64 `json:"expired"`
+	// only filled in on request
+	Groups map[string]*MemoryUsage `json:"groups,omitempty"`
+}
+
+type MemoryUsage struct {
+	Entries int64 `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+}
+
+func (u *MemoryUsage) add(entries, bytes int64) {
+	u.Entries += entries
+	u.Bytes += bytes
+}
+
+// TTLEngine is implemented by engines that can expire keys.
+type TTLEngine interface {
+	PutTTL(key, value string, ttl time.Duration) error
+	// 0 if key does not expire
+	TTL(key string) time.Duration
+}
+
+func alignedSize(n int) int64 {
+	return int64((n + StorageKVEntryAlignSizeBytes - 1) / StorageKVEntryAlignSizeBytes * StorageKVEntryAlignSizeBytes)
+}
+
+func entrySize(key, value string) int64 {
+	return alignedSize(len(key)) + alignedSize(len(value))
+}
+
+// BoundedEngine accounts the aligned memory usage of the wrapped engine,
+// evicts keys once the limit is exceeded and expires keys with a TTL.
+// Usage is tracked incrementally in total and per namespace. Expiry deadlines
+// survive recovery if the wrapped engine persists them.
+type BoundedEngine struct {
+	Engine
+	limit     int64
+	separator string
+	// serialize the mutations of a key; without a limit nothing is evicted,
+	// so mutations of different stripes run concurrently
+	stripes [boundedLockStripes]sync.Mutex
+	// serializes all mutations under a limit and guards the policy
+	mu         sync.Mutex
+	policy     EvictionPolicy
+	used       int64
+	entries    int64
+	nsMu       sync.Mutex
+	namespaces map[string]*MemoryUsage
+	expMu      sync.RWMutex
+	expiry     map[string]time.Time
+	nExpiry    int64
+	evicted    int64
+	expired    int64
+	// called with the lock of the key held whenever it is written or removed
+	onChange func(key string)
+}
+
+var _ Engine = &BoundedEngine{}
+var _ TTLEngine = &BoundedEngine{}
+
+func NewBoundedEngine(engine Engine, cfg *MemoryConfig) (*BoundedEngine, error) {
+	b := &BoundedEngine{
+		Engine:     engine,
+		limit:      cfg.LimitBytes,
+		separator:  cfg.NamespaceSeparator,
+		namespaces: make(map[string]*MemoryUsage),
+		expiry:     make(map[string]time.Time),
+	}
+	if b.separator == "" {
+		b.separator = DefaultNamespaceSeparator
+	}
+	if b.limit > 0 {
+		policy, err := NewEvictionPolicy(cfg.Policy)
+		if err != nil {
+			return nil, err
+		}
+		b.policy = policy
+	}
+	// account for recovered data
+	engine.Scan("", "", func(k, v string) bool {
+		b.account(k, 1, entrySize(k, v))
+		if b.policy != nil {
+			b.policy.Add(k)
+		}
+		return true
+	})
+	if persisted, ok := engine.(walEngine); ok {
+		for k, deadline := range persisted.Expiry() {
+			b.setExpiry(k, deadline)
+		}
+	}
+	return b, nil
+}
+
+// lock serializes the mutations of keys and returns the function releasing
+// them. Evictions may remove any key, so under a limit all mutations are
+// serialized.
+func (b *BoundedEngine) lock(keys ...string) func() {
+	if b.policy != nil {
+		b.mu.Lock()
+		return b.mu.Unlock
+	}
+	return lockStripes(b.stripes[:], keys)
+}
+
+// OnChange registers fn to be called on every change of a key, including
+// evictions and expiry. fn must not block and must be set before the engine is
+// shared.
+func (b *BoundedEngine) OnChange(fn func(key string)) {
+	b.onChange = fn
+}
+
+func (b *BoundedEngine) Get(key string) (string, bool) {
+	if b.isExpired(key) {
+		b.expire(key)
+		return "", false
+	}
+	value, ok := b.Engine.Get(key)
+	if ok && b.policy != nil {
+		b.mu.Lock()
+		b.policy.Access(key)
+		b.mu.Unlock()
+	}
+	return value, ok
+}
+
+func (b *BoundedEngine) Put(key, value string) error {
+	return b.PutTTL(key, value, 0)
+}
+
+func (b *BoundedEngine) PutTTL(key, value string, ttl time.Duration) error {
+	return b.ApplyBatch([]mutation{{Op: walOpPut, Key: key, Value: value, TTLSecs: ttl.Seconds()}})
+}
+
+// Apply atomically applies the mutations fn computes from the current values
+// of keys. Expired keys read as missing.
+func (b *BoundedEngine) Apply(keys []string, fn BatchFunc) error {
+	defer b.lock(keys...)()
+	for _, key := range keys {
+		if b.isExpired(key) {
+			if err := b.deleteLocked(key); err != nil {
+				return err
+			}
+			atomic.AddInt64(&b.expired, 1)
+		}
+	}
+	muts, err := fn(b.Engine.Get)
+	if err != nil {
+		return err
+	}
+	return b.applyLocked(muts)
+}
+
+// ApplyBatch applies muts as one unit, which the wrapped engine logs as a
+// single record if it is durable. The keys of muts must be distinct.
+func (b *BoundedEngine) ApplyBatch(muts []mutation) error {
+	keys := make([]string, len(muts))
+	for i, m := range muts {
+		keys[i] = m.Key
+	}
+	defer b.lock(keys...)()
+	return b.applyLocked(muts)
+}
+
+func (b *BoundedEngine) applyLocked(muts []mutation) error {
+	var delta int64
+	// the size of the current entry of each key, 0 if it has none
+	oldSizes := make(map[string]int64, len(muts))
+	for _, m := range muts {
+		if old, ok := b.Engine.Get(m.Key); ok {
+			oldSizes[m.Key] = entrySize(m.Key, old)
+			delta -= oldSizes[m.Key]
+		}
+		if m.Op != walOpPut {
+			continue
+		}
+		size := entrySize(m.Key, m.Value)
+		if b.limit > 0 && size > b.limit {
+			return fmt.Errorf("entry of %d bytes exceeds the memory limit of %d bytes", size, b.limit)
+		}
+		delta += size
+	}
+	for b.policy != nil && atomic.LoadInt64(&b.used)+delta > b.limit {
+		victim, ok := b.policy.Victim()
+		if !ok {
+			break
+		}
+		if err := b.deleteLocked(victim); err != nil {
+			return err
+		}
+		atomic.AddInt64(&b.evicted, 1)
+		if size, ok := oldSizes[victim]; ok {
+			delta += size
+			delete(oldSizes, victim)
+		}
+	}
+	now := time.Now()
+	entries := make([]walEntry, 0, len(muts))
+	deadlines := make([]time.Time, len(muts))
+	for i, m := range muts {
+		if _, found := oldSizes[m.Key]; m.Op == walOpDelete && !found {
+			continue
+		}
+		entry := walEntry{op: m.Op, key: m.Key, value: m.Value}
+		if m.Op == walOpPut && m.TTLSecs > 0 {
+			deadlines[i] = now.Add(time.Duration(m.TTLSecs * float64(time.Second)))
+			entry.expiry = deadlines[i].UnixNano()
+		}
+		entries = append(entries, entry)
+	}
+	if err := b.write(entries); err != nil {
+		return err
+	}
+	for i, m := range muts {
+		oldSize, found := oldSizes[m.Key]
+		if m.Op == walOpDelete && !found {
+			continue
+		}
+		if b.onChange != nil {
+			b.onChange(m.Key)
+		}
+		if m.Op == walOpDelete {
+			b.account(m.Key, -1, -oldSize)
+			if b.policy != nil {
+				b.policy.Remove(m.Key)
+			}
+			b.clearExpiry(m.Key)
+			continue
+		}
+		newEntries := int64(1)
+		if found {
+			newEntries = 0
+		}
+		b.account(m.Key, newEntries, entrySize(m.Key, m.Value)-oldSize)
+		if b.policy != nil {
+			b.policy.Add(m.Key)
+		}
+		if !deadlines[i].IsZero() {
+			b.setExpiry(m.Key, deadlines[i])
+		} else {
+			b.clearExpiry(m.Key)
+		}
+	}
+	return nil
+}
+
+// write applies entries to the wrapped engine, as a single record if it
+// logs them.
+func (b *BoundedEngine) write(entries []walEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	if persisted, ok := b.Engine.(walEngine); ok {
+		return persisted.ApplyBatch(entries)
+	}
+	for _, e := range entries {
+		var err error
+		if e.op == walOpDelete {
+			_, err = b.Engine.Delete(e.key)
+		} else {
+			err = b.Engine.Put(e.key, e.value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *BoundedEngine) Delete(key string) (bool, error) {
+	defer b.lock(key)()
+	if _, ok := b.Engine.Get(key); !ok {
+		return false, nil
+	}
+	return true, b.deleteLocked(key)
+}
+
+func (b *BoundedEngine) deleteLocked(key string) error {
+	value, ok := b.Engine.Get(key)
+	if !ok {
+		return nil
+	}
+	if _, err := b.Engine.Delete(key); err != nil {
+		return err
+	}
+	if b.onChange != nil {
+		b.onChange(key)
+	}
+	b.account(key, -1, -entrySize(key, value))
+	if b.policy != nil {
+		b.policy.Remove(key)
+	}
+	b.clearExpiry(key)
+	return nil
+}
+
+func (b *BoundedEngine) account(key string, entries, bytes int64) {
+	atomic.AddInt64(&b.used, bytes)
+	atomic.AddInt64(&b.entries, entries)
+	b.nsMu.Lock()
+	defer b.nsMu.Unlock()
+	ns := b.namespace(key)
+	usage, ok := b.namespaces[ns]
+	if !ok {
+		usage = &MemoryUsage{}
+		b.namespaces[ns] = usage
+	}
+	usage.add(entries, bytes)
+	if usage.Entries == 0 {
+		delete(b.namespaces, ns)
+	}
+}
+
+func (b *BoundedEngine) namespace(key string) string {
+	if i := strings.Index(key, b.separator); i >= 0 {
+		return key[:i]
+	}
+	return ""
+}
+
+func (b *BoundedEngine) Scan(start, end string, fn func(key, value string) bool) {
+	if atomic.LoadInt64(&b.nExpiry) == 0 {
+		b.Engine.Scan(start, end, fn)
+		return
+	}
+	now := time.Now()
+	b.Engine.Scan(start, end, func(k, v string) bool {
+		b.expMu.RLock()
+		deadline, ok := b.expiry[k]
+		b.expMu.RUnlock()
+		if ok && now.After(deadline) {
+			return true
+		}
+		return fn(k, v)
+	})
+}
+
+func (b *BoundedEngine) setExpiry(key string, deadline time.Time) {
+	b.expMu.Lock()
+	defer b.expMu.Unlock()
+	if _, ok := b.expiry[key]; !ok {
+		atomic.AddInt64(&b.nExpiry, 1)
+	}
+	b.expiry[key] = deadline
+}
+
+func (b *BoundedEngine) clearExpiry(key string) {
+	if atomic.LoadInt64(&b.nExpiry) == 0 {
+		return
+	}
+	b.expMu.Lock()
+	defer b.expMu.Unlock()
+	if _, ok := b.expiry[key]; ok {
+		delete(b.expiry, key)
+		atomic.AddInt64(&b.nExpiry, -1)
+	}
+}
+
+// TTL returns the time left until key expires, or 0 if it does not expire.
+func (b *BoundedEngine) TTL(key string) time.Duration {
+	if atomic.LoadInt64(&b.nExpiry) == 0 {
+		return 0
+	}
+	b.expMu.RLock()
+	defer b.expMu.RUnlock()
+	if deadline, ok := b.expiry[key]; ok {
+		return max(time.Until(deadline), time.Nanosecond)
+	}
+	return 0
+}
+
+func (b *BoundedEngine) isExpired(key string) bool {
+	if atomic.LoadInt64(&b.nExpiry) == 0 {
+		return false
+	}
+	b.expMu.RLock()
+	defer b.expMu.RUnlock()
+	deadline, ok := b.expiry[key]
+	return ok && time.Now().After(deadline)
+}
+
+func (b *BoundedEngine) expire(key string) {
+	defer b.lock(key)()
+	// the key may have been rewritten since it was found expired
+	if !b.isExpired(key) {
+		return
+	}
+	if err := b.deleteLocked(key); err == nil {
+		atomic.AddInt64(&b.expired, 1)
+	}
+}
+
+// Run removes expired keys that are not read again.
+func (b *BoundedEngine) Run(ctx context.Context) {
+	ticker := time.NewTicker(ExpirySweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		now := time.Now()
+		var expired []string
+		b.expMu.RLock()
+		for k, deadline := range b.expiry {
+			if now.After(deadline) {
+				expired = append(expired, k)
+			}
+		}
+		b.expMu.RUnlock()
+		for _, k := range expired {
+			b.expire(k)
+		}
+	}
+}
+
+func (b *BoundedEngine) Size() int {
+	return int(atomic.LoadInt64(&b.entries))
+}
+
+func (b *BoundedEngine) Stats() *MemoryStats {
+	return &MemoryStats{
+		UsedBytes:  atomic.LoadInt64(&b.used),
+		LimitBytes: b.limit,
+		Keys:       atomic.LoadInt64(&b.entries),
+		Evicted:    atomic.LoadInt64(&b.evicted),
+		Expired:    atomic.LoadInt64(&b.expired),
+	}
+}
+
+// NamespaceUsage returns a copy of the per-namespace usage.
+func (b *BoundedEngine) NamespaceUsage() map[string]*MemoryUsage {
+	b.nsMu.Lock()
+	defer b.nsMu.Unlock()
+	groups := make(map[string]*MemoryUsage, len(b.namespaces))
+	for ns, usage := range b.namespaces {
+		groups[ns] = &MemoryUsage{Entries: usage.Entries, Bytes: usage.Bytes}
+	}
+	return groups
+}
+
+// PrefixUsage scans the keys with the given prefix, grouped by namespace if
+// byNamespace is set and under the prefix itself otherwise.
+func (b *BoundedEngine) PrefixUsage(prefix string, byNamespace bool) map[string]*MemoryUsage {
+	groups := make(map[string]*MemoryUsage)
+	b.Scan(prefix, prefixEnd(prefix), func(k, v string) bool {
+		group := prefix
+		if byNamespace {
+			group = b.namespace(k)
+		}
+		usage, ok := groups[group]
+		if !ok {
+			usage = &MemoryUsage{}
+			groups[group] = usage
+		}
+		usage.add(1, entrySize(k, v))
+		return true
+	})
+	return groups
+}
@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tomquartz/pyxis-k8s/pkg/workload"
+)
+
+func openDurableBounded(t *testing.T, dir string) (*DurableEngine, *BoundedEngine) {
+	durable, err := NewDurableEngine(NewShardedEngine(8), &DurableConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bounded, err := NewBoundedEngine(durable, &MemoryConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return durable, bounded
+}
+
+func TestBoundedExpiryRecovered(t *testing.T) {
+	for _, snapshot := range []bool{false, true} {
+		dir := t.TempDir()
+		durable, bounded := openDurableBounded(t, dir)
+		if err := bounded.PutTTL("short", "v", 200*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		if err := bounded.PutTTL("long", "v", time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		// a later put without a ttl clears the expiry
+		bounded.PutTTL("cleared", "v", time.Hour)
+		bounded.Put("cleared", "v2")
+		if snapshot {
+			if err := durable.Snapshot(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		durable.Close()
+
+		durable, bounded = openDurableBounded(t, dir)
+		if ttl := bounded.TTL("long"); ttl <= 0 || ttl > time.Hour {
+			t.Errorf("snapshot=%v: recovered ttl %v, expected up to an hour", snapshot, ttl)
+		}
+		if ttl := bounded.TTL("cleared"); ttl != 0 {
+			t.Errorf("snapshot=%v: recovered ttl %v of a key put without one", snapshot, ttl)
+		}
+		time.Sleep(300 * time.Millisecond)
+		if _, ok := bounded.Get("short"); ok {
+			t.Errorf("snapshot=%v: key did not expire after recovery", snapshot)
+		}
+		durable.Close()
+	}
+}
+
+func TestReplicaJoinTransfersTTL(t *testing.T) {
+	primaryEngine, err := NewBoundedEngine(NewMapEngine(), &MemoryConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	primaryEngine.PutTTL("a", "v", time.Hour)
+	primaryEngine.Put("b", "v")
+	primary := NewReplica(&ReplicationConfig{Self: 0, FailoverTimeoutSecs: 1}, primaryEngine)
+	primary.promote()
+	mux := http.NewServeMux()
+	mux.HandleFunc(workload.StorageReplicationJoinPath, primary.ServeJoin)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	backupEngine, err := NewBoundedEngine(NewMapEngine(), &MemoryConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup := NewReplica(&ReplicationConfig{Peers: []string{srv.URL, ""}, Self: 1, FailoverTimeoutSecs: 1}, backupEngine)
+	if err := backup.join(0); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := backupEngine.TTL("a"); ttl <= 0 || ttl > time.Hour {
+		t.Errorf("transferred ttl %v, expected up to an hour", ttl)
+	}
+	if ttl := backupEngine.TTL("b"); ttl != 0 {
+		t.Errorf("transferred ttl %v of a key without one", ttl)
+	}
+}
+
+func TestBoundedEvictsToLimit(t *testing.T) {
+	// every entry takes 128 aligned bytes, so 4 of them fit
+	const limit = 4 * 128
+	for _, tc := range []struct {
+		policy string
+		// "put k" or "get k"
+		ops []string
+		// nil to only check the number of keys
+		resident []string
+	}{
+		{EvictionLRU, []string{"put a", "put b", "put c", "put d", "put e", "put f"}, []string{"c", "d", "e", "f"}},
+		{EvictionLRU, []string{"put a", "put b", "put c", "put d", "get a", "put e"}, []string{"a", "c", "d", "e"}},
+		{EvictionLRU, []string{"put a", "put b", "put c", "put d", "put a", "put e", "put f"}, []string{"a", "d", "e", "f"}},
+		{EvictionLFU, []string{"put a", "put b", "put c", "put d", "get a", "get b", "get d", "put e", "put f"}, []string{"a", "b", "d", "f"}},
+		{EvictionLFU, []string{"put a", "put b", "put c", "put d", "get a", "get a", "get b", "get c", "get d", "put e"}, []string{"a", "c", "d", "e"}},
+		{EvictionRandom, []string{"put a", "put b", "put c", "put d", "put e", "put f", "put g"}, nil},
+	} {
+		b, err := NewBoundedEngine(NewMapEngine(), &MemoryConfig{LimitBytes: limit, Policy: tc.policy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		puts := 0
+		for _, op := range tc.ops {
+			name, key, _ := strings.Cut(op, " ")
+			if name == "get" {
+				b.Get(key)
+				continue
+			}
+			if _, ok := b.Engine.Get(key); !ok {
+				puts++
+			}
+			if err := b.Put(key, "v"); err != nil {
+				t.Fatalf("%s %v: %v", tc.policy, tc.ops, err)
+			}
+			if used := b.Stats().UsedBytes; used > limit {
+				t.Fatalf("%s %v: %d bytes used after %s, over the limit of %d", tc.policy, tc.ops, used, op, limit)
+			}
+		}
+		stats := b.Stats()
+		if stats.Keys != 4 || stats.UsedBytes != limit || int(stats.Evicted) != puts-4 {
+			t.Errorf("%s %v: %d keys in %d bytes with %d evicted, expected 4 in %d with %d evicted",
+				tc.policy, tc.ops, stats.Keys, stats.UsedBytes, stats.Evicted, limit, puts-4)
+		}
+		for _, key := range tc.resident {
+			if _, ok := b.Engine.Get(key); !ok {
+				t.Errorf("%s %v: %s was evicted", tc.policy, tc.ops, key)
+			}
+		}
+	}
+}
+
+func TestBoundedBatchEviction(t *testing.T) {
+	b, err := NewBoundedEngine(NewMapEngine(), &MemoryConfig{LimitBytes: 4 * 128, Policy: EvictionLRU})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b", "c", "d"} {
+		b.Put(k, "v")
+	}
+	// growing d to two aligned blocks and adding e needs room for two entries
+	err = b.ApplyBatch([]mutation{
+		{Op: walOpPut, Key: "d", Value: strings.Repeat("v", 65)},
+		{Op: walOpPut, Key: "e", Value: "v"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := b.Stats()
+	if stats.Keys != 3 || stats.UsedBytes != 448 || stats.Evicted != 2 {
+		t.Errorf("%d keys in %d bytes with %d evicted, expected 3 in 448 with 2 evicted", stats.Keys, stats.UsedBytes, stats.Evicted)
+	}
+	for _, k := range []string{"c", "d", "e"} {
+		if _, ok := b.Get(k); !ok {
+			t.Errorf("%s was evicted", k)
+		}
+	}
+}
+
+func TestBoundedRejectsEntryOverLimit(t *testing.T) {
+	for _, policy := range []string{EvictionLRU, EvictionLFU, EvictionRandom} {
+		b, err := NewBoundedEngine(NewMapEngine(), &MemoryConfig{LimitBytes: 4 * 128, Policy: policy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Put("a", "v")
+		if err := b.Put("big", strings.Repeat("v", 4*128)); err == nil {
+			t.Errorf("%s: expected an error for an entry over the limit", policy)
+		}
+		err = b.ApplyBatch([]mutation{{Op: walOpPut, Key: "b", Value: "v"}, {Op: walOpPut, Key: "big", Value: strings.Repeat("v", 4*128)}})
+		if err == nil {
+			t.Errorf("%s: expected an error for a batch with an entry over the limit", policy)
+		}
+		stats := b.Stats()
+		if _, ok := b.Get("a"); !ok || stats.Keys != 1 || stats.Evicted != 0 {
+			t.Errorf("%s: %d keys with %d evicted after rejecting, expected the store unchanged", policy, stats.Keys, stats.Evicted)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const durableLockStripes = 256
+
+// DurableEngine logs every mutation to a WAL before applying it to the
+// wrapped in-memory engine, and periodically compacts the log into a snapshot.
+// Keys put with an expiry keep it across restarts.
+type DurableEngine struct {
+	Engine
+	wal *WAL
+	cfg *DurableConfig
+	// of the keys that expire, snapshotted along with the values
+	expMu  sync.Mutex
+	expiry map[string]time.Time
+	// writers hold the read side; snapshots take the write side to get a
+	// state that matches a segment boundary
+	snapshotMu      sync.RWMutex
+	stripes         [durableLockStripes]sync.Mutex
+	snapshotTrigger chan struct{}
+	logger          logr.Logger
+}
+
+var _ Engine = &DurableEngine{}
+var _ walEngine = &DurableEngine{}
+
+// walEngine is implemented by engines that log batches of mutations as one
+// unit and persist the expiry of keys, which the engine expiring them
+// recovers from Expiry.
+type walEngine interface {
+	ApplyBatch(entries []walEntry) error
+	Expiry() map[string]time.Time
+}
+
+func NewDurableEngine(engine Engine, cfg *DurableConfig) (*DurableEngine, error) {
+	expiry := make(map[string]time.Time)
+	wal, err := OpenWAL(cfg, engine, expiry)
+	if err != nil {
+		return nil, err
+	}
+	return &DurableEngine{
+		Engine:          engine,
+		wal:             wal,
+		cfg:             cfg,
+		expiry:          expiry,
+		snapshotTrigger: make(chan struct{}, 1),
+	}, nil
+}
+
+func (e *DurableEngine) stripe(key string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &e.stripes[h.Sum32()%durableLockStripes]
+}
+
+func (e *DurableEngine) Put(key, value string) error {
+	return e.ApplyBatch([]walEntry{{op: walOpPut, key: key, value: value}})
+}
+
+// ApplyBatch logs entries as a single record and then applies them, so that
+// recovery restores either all of them or none. Puts with a zero expiry do not
+// expire. Keys are not removed at their expiry.
+func (e *DurableEngine) ApplyBatch(entries []walEntry) error {
+	e.snapshotMu.RLock()
+	defer e.snapshotMu.RUnlock()
+	keys := make([]string, len(entries))
+	for i, entry := range entries {
+		keys[i] = entry.key
+	}
+	defer lockStripes(e.stripes[:], keys)()
+	if err := e.wal.Append(entries...); err != nil {
+		return err
+	}
+	e.maybeTriggerSnapshot()
+	for _, entry := range entries {
+		var err error
+		if entry.op == walOpDelete {
+			e.setExpiry(entry.key, time.Time{})
+			_, err = e.Engine.Delete(entry.key)
+		} else {
+			var expiry time.Time
+			if entry.expiry != 0 {
+				expiry = time.Unix(0, entry.expiry)
+			}
+			e.setExpiry(entry.key, expiry)
+			err = e.Engine.Put(entry.key, entry.value)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to apply logged batch: %v", err)
+		}
+	}
+	return nil
+}
+
+func (e *DurableEngine) setExpiry(key string, expiry time.Time) {
+	e.expMu.Lock()
+	defer e.expMu.Unlock()
+	if expiry.IsZero() {
+		delete(e.expiry, key)
+	} else {
+		e.expiry[key] = expiry
+	}
+}
+
+// Expiry returns a copy of the expiry of the keys that expire.
+func (e *DurableEngine) Expiry() map[string]time.Time {
+	e.expMu.Lock()
+	defer e.expMu.Unlock()
+	expiry := make(map[string]time.Time, len(e.expiry))
+	for k, t := range e.expiry {
+		expiry[k] = t
+	}
+	return expiry
+}
+
+func (e *DurableEngine) Delete(key string) (bool, error) {
+	e.snapshotMu.RLock()
+	defer e.snapshotMu.RUnlock()
+	mu := e.stripe(key)
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := e.Engine.Get(key); !ok {
+		return false, nil
+	}
+	if err := e.wal.Append(walEntry{op: walOpDelete, key: key}); err != nil {
+		return false, err
+	}
+	e.setExpiry(key, time.Time{})
+	e.maybeTriggerSnapshot()
+	return e.Engine.Delete(key)
+}
+
+func (e *DurableEngine) maybeTriggerSnapshot() {
+	if e.cfg.CompactThreshold > 0 && e.wal.Entries() >= e.cfg.CompactThreshold {
+		select {
+		case e.snapshotTrigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (e *DurableEngine) Run(ctx context.Context) {
+	e.logger = log.FromContext(ctx)
+	var tick <-chan time.Time
+	if e.cfg.SnapshotIntervalSecs > 0 {
+		ticker := time.NewTicker(time.Duration(e.cfg.SnapshotIntervalSecs * float64(time.Second)))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+		case <-e.snapshotTrigger:
+		case <-ctx.Done():
+			return
+		}
+		if err := e.Snapshot(); err != nil {
+			e.logger.Error(err, "Failed to snapshot storage")
+		}
+	}
+}
+
+func (e *DurableEngine) Snapshot() error {
+	e.snapshotMu.Lock()
+	kv := make(map[string]string, e.Engine.Size())
+	e.Engine.Scan("", "", func(k, v string) bool {
+		kv[k] = v
+		return true
+	})
+	expiry := e.Expiry()
+	seq, err := e.wal.Rotate()
+	e.snapshotMu.Unlock()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	if err := e.wal.Compact(kv, expiry, seq); err != nil {
+		return err
+	}
+	e.logger.V(1).Info("Snapshot finished", "seq", seq, "keys", len(kv), "elapsed", time.Since(start))
+	return nil
+}
+
+func (e *DurableEngine) Close() error {
+	return e.wal.Close()
+}
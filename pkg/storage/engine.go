@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const (
+	EngineMap      = "map"
+	EngineSharded  = "sharded"
+	EngineSkiplist = "skiplist"
+)
+
+// Engine is the key-value store behind the storage workers.
+// Implementations must be safe for concurrent use.
+type Engine interface {
+	Get(key string) (string, bool)
+	Put(key, value string) error
+	Delete(key string) (bool, error)
+	// Scan visits keys in [start, end) in ascending order until fn returns false.
+	// An empty end means no upper bound. fn must not call back into the engine.
+	Scan(start, end string, fn func(key, value string) bool)
+	Size() int
+}
+
+func NewEngine(name string, nShards int) (Engine, error) {
+	switch name {
+	case EngineMap:
+		return NewMapEngine(), nil
+	case EngineSharded:
+		return NewShardedEngine(nShards), nil
+	case EngineSkiplist:
+		return NewSkiplistEngine(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage engine: %s", name)
+	}
+}
+
+// prefixEnd returns the smallest key greater than all keys with the prefix,
+// or "" if there is none.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+func inRange(key, start, end string) bool {
+	return key >= start && (end == "" || key < end)
+}
+
+type MapEngine struct {
+	mu sync.RWMutex
+	kv map[string]string
+}
+
+var _ Engine = &MapEngine{}
+
+func NewMapEngine() *MapEngine {
+	return &MapEngine{kv: make(map[string]string)}
+}
+
+func (e *MapEngine) Get(key string) (string, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	value, ok := e.kv[key]
+	return value, ok
+}
+
+func (e *MapEngine) Put(key, value string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.kv[key] = value
+	return nil
+}
+
+func (e *MapEngine) Delete(key string) (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, ok := e.kv[key]
+	delete(e.kv, key)
+	return ok, nil
+}
+
+func (e *MapEngine) Scan(start, end string, fn func(key, value string) bool) {
+	e.mu.RLock()
+	keys := make([]string, 0)
+	values := make(map[string]string)
+	for k, v := range e.kv {
+		if inRange(k, start, end) {
+			keys = append(keys, k)
+			values[k] = v
+		}
+	}
+	e.mu.RUnlock()
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !fn(k, values[k]) {
+			return
+		}
+	}
+}
+
+func (e *MapEngine) Size() int {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return len(e.kv)
+}
@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+type engineCase struct {
+	name string
+	new  func(t *testing.T) Engine
+}
+
+// engineCases lists every engine and every wrapper around an unordered and an
+// ordered engine.
+func engineCases() []engineCase {
+	cases := []engineCase{
+		{EngineMap, func(*testing.T) Engine { return NewMapEngine() }},
+		{EngineSharded, func(*testing.T) Engine { return NewShardedEngine(8) }},
+		{EngineSkiplist, func(*testing.T) Engine { return NewSkiplistEngine() }},
+		{"indexed-sharded", func(*testing.T) Engine { return NewIndexedEngine(NewShardedEngine(8)) }},
+	}
+	for _, inner := range []string{EngineSharded, EngineSkiplist} {
+		inner := inner
+		base := func(t *testing.T) Engine {
+			e, err := NewEngine(inner, 8)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return e
+		}
+		cases = append(cases,
+			engineCase{"durable-" + inner, func(t *testing.T) Engine {
+				e, err := NewDurableEngine(base(t), &DurableConfig{Dir: t.TempDir()})
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { e.Close() })
+				return e
+			}},
+			engineCase{"bounded-" + inner, func(t *testing.T) Engine {
+				e, err := NewBoundedEngine(base(t), &MemoryConfig{LimitBytes: 1 << 30, Policy: EvictionLRU})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return e
+			}},
+			engineCase{"unlimited-" + inner, func(t *testing.T) Engine {
+				e, err := NewBoundedEngine(base(t), &MemoryConfig{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return e
+			}},
+		)
+	}
+	return cases
+}
+
+func TestEngineConformance(t *testing.T) {
+	for _, tc := range engineCases() {
+		t.Run(tc.name, func(t *testing.T) {
+			e := tc.new(t)
+			if _, ok := e.Get("a"); ok {
+				t.Fatal("found a key in an empty engine")
+			}
+			for _, k := range []string{"c", "a", "b", "ab", "d"} {
+				if err := e.Put(k, "v-"+k); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := e.Put("a", "v-a2"); err != nil {
+				t.Fatal(err)
+			}
+			if v, ok := e.Get("a"); !ok || v != "v-a2" {
+				t.Errorf("Get(a) = %q, %v, expected the overwritten value", v, ok)
+			}
+			if n := e.Size(); n != 5 {
+				t.Errorf("Size() = %d, expected 5", n)
+			}
+			if ok, err := e.Delete("d"); !ok || err != nil {
+				t.Errorf("Delete(d) = %v, %v", ok, err)
+			}
+			if ok, _ := e.Delete("d"); ok {
+				t.Error("deleted a missing key")
+			}
+			for _, scan := range []struct {
+				start, end string
+				want       []string
+			}{
+				{"", "", []string{"a", "ab", "b", "c"}},
+				{"a", "b", []string{"a", "ab"}},
+				{"ab", "", []string{"ab", "b", "c"}},
+				{"a", prefixEnd("a"), []string{"a", "ab"}},
+				{"x", "", nil},
+			} {
+				var got []string
+				e.Scan(scan.start, scan.end, func(k, v string) bool {
+					if v != "v-"+k && k != "a" {
+						t.Errorf("Scan visited %s=%q", k, v)
+					}
+					got = append(got, k)
+					return true
+				})
+				if fmt.Sprint(got) != fmt.Sprint(scan.want) {
+					t.Errorf("Scan(%q, %q) = %v, expected %v", scan.start, scan.end, got, scan.want)
+				}
+			}
+			var first []string
+			e.Scan("", "", func(k, _ string) bool {
+				first = append(first, k)
+				return false
+			})
+			if len(first) != 1 {
+				t.Errorf("Scan went on after fn returned false: %v", first)
+			}
+		})
+	}
+}
+
+// Every writer owns its keys, as the workers lock keys before writing them.
+func TestEngineConcurrent(t *testing.T) {
+	const writers, keys, rounds = 8, 64, 20
+	for _, tc := range engineCases() {
+		t.Run(tc.name, func(t *testing.T) {
+			e := tc.new(t)
+			var wg sync.WaitGroup
+			for w := 0; w < writers; w++ {
+				wg.Add(2)
+				go func(w int) {
+					defer wg.Done()
+					for r := 0; r < rounds; r++ {
+						for i := 0; i < keys; i++ {
+							k := fmt.Sprintf("w%d-k%03d", w, i)
+							if err := e.Put(k, fmt.Sprint(r)); err != nil {
+								t.Error(err)
+								return
+							}
+							if i%3 == 0 {
+								if _, err := e.Delete(k); err != nil {
+									t.Error(err)
+									return
+								}
+							}
+						}
+					}
+				}(w)
+				go func(w int) {
+					defer wg.Done()
+					for r := 0; r < rounds; r++ {
+						for i := 0; i < keys; i++ {
+							e.Get(fmt.Sprintf("w%d-k%03d", (w+1)%writers, i))
+						}
+						prev := ""
+						e.Scan("", "", func(k, _ string) bool {
+							if k <= prev {
+								t.Errorf("Scan out of order: %q after %q", k, prev)
+							}
+							prev = k
+							return true
+						})
+						e.Size()
+					}
+				}(w)
+			}
+			wg.Wait()
+			want := writers * (keys - (keys+2)/3)
+			if n := e.Size(); n != want {
+				t.Errorf("Size() = %d, expected %d", n, want)
+			}
+			for w := 0; w < writers; w++ {
+				for i := 0; i < keys; i++ {
+					v, ok := e.Get(fmt.Sprintf("w%d-k%03d", w, i))
+					if deleted := i%3 == 0; ok == deleted || (ok && v != fmt.Sprint(rounds-1)) {
+						t.Errorf("w%d-k%03d = %q, %v after the last round", w, i, v, ok)
+					}
+				}
+			}
+		})
+	}
+}
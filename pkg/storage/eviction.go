@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+	"math/rand"
+)
+
+const (
+	EvictionLRU    = "lru"
+	EvictionLFU    = "lfu"
+	EvictionRandom = "random"
+)
+
+// EvictionPolicy tracks the resident keys of a bounded engine and picks the
+// next one to evict. Implementations are not safe for concurrent use.
+type EvictionPolicy interface {
+	Add(key string)
+	Access(key string)
+	Remove(key string)
+	Victim() (string, bool)
+}
+
+func NewEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch name {
+	case EvictionLRU:
+		return NewLRUPolicy(), nil
+	case EvictionLFU:
+		return NewLFUPolicy(), nil
+	case EvictionRandom:
+		return NewRandomPolicy(), nil
+	default:
+		return nil, fmt.Errorf("unknown eviction policy: %s", name)
+	}
+}
+
+type LRUPolicy struct {
+	order *list.List
+	elems map[string]*list.Element
+}
+
+func NewLRUPolicy() *LRUPolicy {
+	return &LRUPolicy{order: list.New(), elems: make(map[string]*list.Element)}
+}
+
+func (p *LRUPolicy) Add(key string) {
+	if e, ok := p.elems[key]; ok {
+		p.order.MoveToFront(e)
+		return
+	}
+	p.elems[key] = p.order.PushFront(key)
+}
+
+func (p *LRUPolicy) Access(key string) {
+	if e, ok := p.elems[key]; ok {
+		p.order.MoveToFront(e)
+	}
+}
+
+func (p *LRUPolicy) Remove(key string) {
+	if e, ok := p.elems[key]; ok {
+		p.order.Remove(e)
+		delete(p.elems, key)
+	}
+}
+
+func (p *LRUPolicy) Victim() (string, bool) {
+	e := p.order.Back()
+	if e == nil {
+		return "", false
+	}
+	return e.Value.(string), true
+}
+
+type lfuEntry struct {
+	key   string
+	freq  int
+	tick  uint64
+	index int
+}
+
+type lfuHeap []*lfuEntry
+
+func (h lfuHeap) Len() int { return len(h) }
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].freq != h[j].freq {
+		return h[i].freq < h[j].freq
+	}
+	return h[i].tick < h[j].tick
+}
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *lfuHeap) Push(x interface{}) {
+	e := x.(*lfuEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// LFUPolicy evicts the least frequently used key, breaking ties by recency.
+type LFUPolicy struct {
+	heap    lfuHeap
+	entries map[string]*lfuEntry
+	tick    uint64
+}
+
+func NewLFUPolicy() *LFUPolicy {
+	return &LFUPolicy{entries: make(map[string]*lfuEntry)}
+}
+
+func (p *LFUPolicy) Add(key string) {
+	if _, ok := p.entries[key]; ok {
+		p.Access(key)
+		return
+	}
+	p.tick++
+	e := &lfuEntry{key: key, freq: 1, tick: p.tick}
+	p.entries[key] = e
+	heap.Push(&p.heap, e)
+}
+
+func (p *LFUPolicy) Access(key string) {
+	if e, ok := p.entries[key]; ok {
+		p.tick++
+		e.freq++
+		e.tick = p.tick
+		heap.Fix(&p.heap, e.index)
+	}
+}
+
+func (p *LFUPolicy) Remove(key string) {
+	if e, ok := p.entries[key]; ok {
+		heap.Remove(&p.heap, e.index)
+		delete(p.entries, key)
+	}
+}
+
+func (p *LFUPolicy) Victim() (string, bool) {
+	if len(p.heap) == 0 {
+		return "", false
+	}
+	return p.heap[0].key, true
+}
+
+type RandomPolicy struct {
+	keys  []string
+	index map[string]int
+}
+
+func NewRandomPolicy() *RandomPolicy {
+	return &RandomPolicy{index: make(map[string]int)}
+}
+
+func (p *RandomPolicy) Add(key string) {
+	if _, ok := p.index[key]; ok {
+		return
+	}
+	p.index[key] = len(p.keys)
+	p.keys = append(p.keys, key)
+}
+
+func (p *RandomPolicy) Access(key string) {}
+
+func (p *RandomPolicy) Remove(key string) {
+	i, ok := p.index[key]
+	if !ok {
+		return
+	}
+	last := p.keys[len(p.keys)-1]
+	p.keys[i] = last
+	p.index[last] = i
+	p.keys = p.keys[:len(p.keys)-1]
+	delete(p.index, key)
+}
+
+func (p *RandomPolicy) Victim() (string, bool) {
+	if len(p.keys) == 0 {
+		return "", false
+	}
+	return p.keys[rand.Intn(len(p.keys))], true
+}
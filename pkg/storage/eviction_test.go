@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+)
+
+// runPolicy applies ops of the form "add k", "access k" and "remove k".
+func runPolicy(t *testing.T, p EvictionPolicy, ops []string) {
+	for _, op := range ops {
+		name, key, _ := strings.Cut(op, " ")
+		switch name {
+		case "add":
+			p.Add(key)
+		case "access":
+			p.Access(key)
+		case "remove":
+			p.Remove(key)
+		default:
+			t.Fatalf("unknown op %q", op)
+		}
+	}
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	for _, tc := range []struct {
+		policy string
+		name   string
+		ops    []string
+		// empty if there is none
+		victim string
+	}{
+		{EvictionLRU, "empty", nil, ""},
+		{EvictionLRU, "oldest", []string{"add a", "add b", "add c"}, "a"},
+		{EvictionLRU, "access refreshes", []string{"add a", "add b", "add c", "access a"}, "b"},
+		{EvictionLRU, "add again refreshes", []string{"add a", "add b", "add a"}, "b"},
+		{EvictionLRU, "access of a missing key", []string{"add a", "access x", "add b"}, "a"},
+		{EvictionLRU, "removed", []string{"add a", "add b", "remove a"}, "b"},
+		{EvictionLRU, "all removed", []string{"add a", "remove a", "remove x"}, ""},
+		{EvictionLFU, "empty", nil, ""},
+		{EvictionLFU, "least frequent", []string{"add a", "add b", "access a", "access b", "access a", "add c", "access c"}, "b"},
+		{EvictionLFU, "ties by recency", []string{"add a", "add b", "add c"}, "a"},
+		{EvictionLFU, "tie after access", []string{"add a", "add b", "access a", "access b"}, "a"},
+		{EvictionLFU, "add again counts", []string{"add a", "add b", "add a"}, "b"},
+		{EvictionLFU, "removed", []string{"add a", "add b", "access b", "remove a"}, "b"},
+		{EvictionLFU, "all removed", []string{"add a", "remove a"}, ""},
+		{EvictionRandom, "empty", nil, ""},
+		{EvictionRandom, "single", []string{"add a", "add b", "remove a", "access b"}, "b"},
+		{EvictionRandom, "all removed", []string{"add a", "add a", "remove a"}, ""},
+	} {
+		p, err := NewEvictionPolicy(tc.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		runPolicy(t, p, tc.ops)
+		victim, ok := p.Victim()
+		if victim != tc.victim || ok != (tc.victim != "") {
+			t.Errorf("%s %s: victim %q, %v, expected %q", tc.policy, tc.name, victim, ok, tc.victim)
+		}
+	}
+	if _, err := NewEvictionPolicy("fifo"); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+}
+
+func TestRandomPolicyPicksResidentKeys(t *testing.T) {
+	p := NewRandomPolicy()
+	runPolicy(t, p, []string{"add a", "add b", "add c", "add d", "remove b"})
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		victim, ok := p.Victim()
+		if !ok || victim == "b" || victim > "d" {
+			t.Fatalf("victim %q, %v, expected one of a, c and d", victim, ok)
+		}
+		seen[victim] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("picked %d distinct victims in 1000 draws, expected 3", len(seen))
+	}
+}
@@ -0,0 +1,58 @@
+package storage
+
+const indexScanBatchSize = 256
+
+// IndexedEngine keeps the keys of an unordered engine in a skiplist so that
+// scans walk the range in order instead of collecting and sorting it.
+// Callers must not write the same key concurrently.
+type IndexedEngine struct {
+	Engine
+	index *SkiplistEngine
+}
+
+var _ Engine = &IndexedEngine{}
+
+func NewIndexedEngine(engine Engine) *IndexedEngine {
+	e := &IndexedEngine{Engine: engine, index: NewSkiplistEngine()}
+	engine.Scan("", "", func(k, _ string) bool {
+		e.index.Put(k, "")
+		return true
+	})
+	return e
+}
+
+func (e *IndexedEngine) Put(key, value string) error {
+	if err := e.Engine.Put(key, value); err != nil {
+		return err
+	}
+	return e.index.Put(key, "")
+}
+
+func (e *IndexedEngine) Delete(key string) (bool, error) {
+	ok, err := e.Engine.Delete(key)
+	if ok {
+		e.index.Delete(key)
+	}
+	return ok, err
+}
+
+// Scan reads the index in batches so that neither lock is held while fn runs.
+func (e *IndexedEngine) Scan(start, end string, fn func(key, value string) bool) {
+	keys := make([]string, 0, indexScanBatchSize)
+	for {
+		keys = keys[:0]
+		e.index.Scan(start, end, func(k, _ string) bool {
+			keys = append(keys, k)
+			return len(keys) < indexScanBatchSize
+		})
+		for _, k := range keys {
+			if v, ok := e.Engine.Get(k); ok && !fn(k, v) {
+				return
+			}
+		}
+		if len(keys) < indexScanBatchSize {
+			return
+		}
+		start = keys[len(keys)-1] + "\x00"
+	}
+}
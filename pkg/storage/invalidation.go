@@ -0,0 +1,250 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/tomquartz/pyxis-k8s/pkg/workload"
+)
+
+const (
+	// changed keys buffered per subscriber before it is dropped
+	invalidationQueueSize = 4096
+	invalidationBatchSize = 256
+	invalidationTimeout   = 2 * time.Second
+)
+
+type subscriber struct {
+	url     string
+	session int64
+	keys    chan string
+	// closed once invalidations may have been lost
+	dropped  chan struct{}
+	dropOnce sync.Once
+}
+
+func (s *subscriber) drop() {
+	s.dropOnce.Do(func() { close(s.dropped) })
+}
+
+// invalidator sends the keys changed on this replica to the compute servers
+// caching them. Delivery is asynchronous, so caches may serve a key for a
+// short while after it changed. A subscriber that falls behind or cannot be
+// reached is dropped, and its next subscription gets a new session, which
+// tells it to flush its cache.
+type invalidator struct {
+	mu     sync.RWMutex
+	logger logr.Logger
+	client *http.Client
+	subs   map[string]*subscriber
+	// sessions start at the startup time to differ across restarts
+	nextSession int64
+	stop        chan struct{}
+	// hosts and networks allowed to subscribe, none to only allow
+	// subscribers to register their own address
+	allowedHosts map[string]bool
+	allowedNets  []*net.IPNet
+}
+
+// newInvalidator parses allowed, a list of host names, IPs and CIDRs.
+func newInvalidator(client *http.Client, allowed []string) (*invalidator, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	v := &invalidator{
+		logger:       logr.Discard(),
+		client:       client,
+		subs:         make(map[string]*subscriber),
+		nextSession:  time.Now().UnixNano(),
+		stop:         make(chan struct{}),
+		allowedHosts: make(map[string]bool),
+	}
+	for _, host := range allowed {
+		if !strings.Contains(host, "/") {
+			v.allowedHosts[strings.ToLower(host)] = true
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subscriber network %q: %v", host, err)
+		}
+		v.allowedNets = append(v.allowedNets, ipNet)
+	}
+	return v, nil
+}
+
+// checkSubscriber rejects subscriber URLs that are not plain http base URLs
+// of an allowed host, as the replica posts invalidations to them. Without an
+// allowlist the host must resolve to remoteAddr, the address the subscription
+// came from.
+func (v *invalidator) checkSubscriber(ctx context.Context, rawURL, remoteAddr string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid subscriber url: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("subscriber url must be http or https, got %q", u.Scheme)
+	}
+	if u.Hostname() == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" || u.Path != "" && u.Path != "/" {
+		return fmt.Errorf("subscriber url must be a base url, got %q", rawURL)
+	}
+	host := strings.ToLower(u.Hostname())
+	if len(v.allowedHosts) > 0 || len(v.allowedNets) > 0 {
+		if v.allowedHosts[host] {
+			return nil
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			for _, ipNet := range v.allowedNets {
+				if ipNet.Contains(ip) {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("subscriber host %s is not allowed", host)
+	}
+	remoteHost, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return fmt.Errorf("invalid remote address %q: %v", remoteAddr, err)
+	}
+	remote := net.ParseIP(remoteHost)
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		ctx, cancel := context.WithTimeout(ctx, invalidationTimeout)
+		defer cancel()
+		if ips, err = net.DefaultResolver.LookupIP(ctx, "ip", host); err != nil {
+			return fmt.Errorf("failed to resolve subscriber host: %v", err)
+		}
+	}
+	for _, ip := range ips {
+		if ip.Equal(remote) {
+			return nil
+		}
+	}
+	return fmt.Errorf("subscriber host %s does not match the address %s it subscribed from", host, remoteHost)
+}
+
+// subscribe returns the session of url, starting a new one if it has none or
+// it was dropped.
+func (v *invalidator) subscribe(url string) int64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if sub, ok := v.subs[url]; ok {
+		select {
+		case <-sub.dropped:
+		default:
+			return sub.session
+		}
+	}
+	v.nextSession++
+	sub := &subscriber{
+		url:     url,
+		session: v.nextSession,
+		keys:    make(chan string, invalidationQueueSize),
+		dropped: make(chan struct{}),
+	}
+	v.subs[url] = sub
+	go v.deliver(sub)
+	v.logger.Info("Compute server subscribed to invalidations", "url", url, "session", sub.session)
+	return sub.session
+}
+
+// changed must not block as it is called with the engine locked.
+func (v *invalidator) changed(key string) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	for _, sub := range v.subs {
+		select {
+		case sub.keys <- key:
+		default:
+			sub.drop()
+		}
+	}
+}
+
+func (v *invalidator) deliver(sub *subscriber) {
+	defer func() {
+		v.mu.Lock()
+		if v.subs[sub.url] == sub {
+			delete(v.subs, sub.url)
+		}
+		v.mu.Unlock()
+	}()
+	for {
+		var key string
+		select {
+		case key = <-sub.keys:
+		case <-sub.dropped:
+			v.logger.Info("Dropped invalidation subscriber", "url", sub.url, "session", sub.session)
+			return
+		case <-v.stop:
+			return
+		}
+		keys := []string{key}
+	batch:
+		for len(keys) < invalidationBatchSize {
+			select {
+			case key = <-sub.keys:
+				keys = append(keys, key)
+			default:
+				break batch
+			}
+		}
+		if err := v.send(sub.url, keys); err != nil {
+			v.logger.Error(err, "Failed to send invalidations", "url", sub.url, "keys", len(keys))
+			sub.drop()
+		}
+	}
+}
+
+func (v *invalidator) send(url string, keys []string) error {
+	reqJson, err := json.Marshal(&workload.Invalidation{Keys: keys})
+	if err != nil {
+		return fmt.Errorf("failed to marshal invalidation: %v", err)
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, url+workload.ComputeInvalidatePath, bytes.NewReader(reqJson))
+	if err != nil {
+		return fmt.Errorf("failed to create req: %v", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	client := *v.client
+	client.Timeout = invalidationTimeout
+	httpResp, err := client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to post invalidation: %v", err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(httpResp.Body)
+		return fmt.Errorf("invalidation failed with status %d: %s", httpResp.StatusCode, string(msg))
+	}
+	return nil
+}
+
+func (v *invalidator) close() {
+	close(v.stop)
+}
+
+func (s *StorageServer) ServeSubscribe(w http.ResponseWriter, r *http.Request) {
+	sub := &workload.InvalidationSubscription{}
+	if err := json.NewDecoder(r.Body).Decode(sub); err != nil {
+		http.Error(w, fmt.Sprintf("failed to decode request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := s.invalidator.checkSubscriber(r.Context(), sub.URL, r.RemoteAddr); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	sub.Session = s.invalidator.subscribe(sub.URL)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sub)
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/tomquartz/pyxis-k8s/pkg/workload"
+)
+
+var errInvalidOp = errors.New("invalid kv operation")
+
+type kvResult struct {
+	value   string
+	found   bool
+	applied bool
+}
+
+// applyKV executes the i-th operation of req against view.
+func applyKV(view *batchView, req *workload.StorageRequest, i int) (*kvResult, error) {
+	key := req.Keys[i]
+	value, _ := req.Value(i)
+	res := &kvResult{}
+	op := req.Op(i)
+	old, found := view.Get(key)
+	if op == workload.OpGet {
+		res.value, res.found = old, found
+		return res, nil
+	}
+	put := mutation{Op: walOpPut, Key: key, Value: value, TTLSecs: req.TTL(i).Seconds()}
+	res.found = found
+	switch op {
+	case workload.OpPut:
+		res.applied = true
+		view.set(put)
+	case workload.OpDelete:
+		res.applied = found
+		if found {
+			view.set(mutation{Op: walOpDelete, Key: key})
+		}
+	case workload.OpPutIfAbsent:
+		res.value = old
+		if !found {
+			res.value, res.applied = value, true
+			view.set(put)
+		}
+	case workload.OpCAS:
+		res.value = old
+		if found && old == req.Expected[i] {
+			res.value, res.applied = value, true
+			view.set(put)
+		}
+	case workload.OpIncr:
+		next, err := increment(old, found, value)
+		if err != nil {
+			return nil, err
+		}
+		res.value, res.applied = next, true
+		put.Value = next
+		view.set(put)
+	default:
+		return nil, fmt.Errorf("%w: unknown op %q", errInvalidOp, op)
+	}
+	return res, nil
+}
+
+func increment(old string, found bool, delta string) (string, error) {
+	n, d := int64(0), int64(1)
+	var err error
+	if found {
+		if n, err = strconv.ParseInt(old, 10, 64); err != nil {
+			return "", fmt.Errorf("%w: value %q is not an integer", errInvalidOp, old)
+		}
+	}
+	if delta != "" {
+		if d, err = strconv.ParseInt(delta, 10, 64); err != nil {
+			return "", fmt.Errorf("%w: delta %q is not an integer", errInvalidOp, delta)
+		}
+	}
+	return strconv.FormatInt(n+d, 10), nil
+}
+
+// update atomically applies the mutations computed by fn over keys.
+func (w *StorageWorker) update(keys []string, fn BatchFunc) error {
+	if w.server.replica != nil {
+		return w.server.replica.Apply(keys, fn)
+	}
+	return w.server.bounded.Apply(keys, fn)
+}
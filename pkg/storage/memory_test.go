@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// rescan computes the usage of b from scratch.
+func rescan(b *BoundedEngine) (*MemoryUsage, map[string]*MemoryUsage) {
+	total, groups := &MemoryUsage{}, make(map[string]*MemoryUsage)
+	b.Engine.Scan("", "", func(k, v string) bool {
+		total.add(1, entrySize(k, v))
+		ns := b.namespace(k)
+		if groups[ns] == nil {
+			groups[ns] = &MemoryUsage{}
+		}
+		groups[ns].add(1, entrySize(k, v))
+		return true
+	})
+	return total, groups
+}
+
+func TestMemoryAccountingMatchesRescan(t *testing.T) {
+	for _, limit := range []int64{0, 40 * 128} {
+		b, err := NewBoundedEngine(NewMapEngine(), &MemoryConfig{LimitBytes: limit, Policy: EvictionLRU})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rng := rand.New(rand.NewSource(1))
+		key := func() string {
+			return fmt.Sprintf("%s%d", []string{"users:", "orders:", "orders:eu:", "plain"}[rng.Intn(4)], rng.Intn(30))
+		}
+		for i := 0; i < 2000; i++ {
+			value := strings.Repeat("v", rng.Intn(200))
+			switch op := rng.Intn(10); {
+			case op < 5:
+				// puts of new keys and overwrites with values of other sizes
+				err = b.Put(key(), value)
+			case op < 8:
+				// deletes of present and missing keys
+				_, err = b.Delete(key())
+			default:
+				muts := []mutation{{Op: walOpPut, Key: key(), Value: value}}
+				if k := key(); k != muts[0].Key {
+					muts = append(muts, mutation{Op: walOpDelete, Key: k})
+				}
+				err = b.ApplyBatch(muts)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i%100 != 0 {
+				continue
+			}
+			total, groups := rescan(b)
+			stats := b.Stats()
+			if stats.Keys != total.Entries || stats.UsedBytes != total.Bytes || int64(b.Size()) != total.Entries {
+				t.Fatalf("limit %d, after %d ops: accounted %d keys in %d bytes, rescan found %d in %d",
+					limit, i+1, stats.Keys, stats.UsedBytes, total.Entries, total.Bytes)
+			}
+			if usage := b.NamespaceUsage(); !reflect.DeepEqual(usage, groups) {
+				t.Fatalf("limit %d, after %d ops: namespace usage %v, rescan found %v", limit, i+1, usage, groups)
+			}
+			if limit > 0 && stats.UsedBytes > limit {
+				t.Fatalf("limit %d, after %d ops: %d bytes used", limit, i+1, stats.UsedBytes)
+			}
+		}
+	}
+}
+
+func TestServeMemoryUsageQuery(t *testing.T) {
+	s, err := NewStorageServer(&StorageConfig{NumWorkers: 1, Engine: EngineMap})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 128 bytes per entry
+	for _, k := range []string{"users:1", "users:2", "orders:1", "plain"} {
+		s.bounded.Put(k, "v")
+	}
+	query := func(q string) string {
+		w := httptest.NewRecorder()
+		s.ServeMemoryUsageQuery(w, httptest.NewRequest("GET", "/memory-usage"+q, nil))
+		return w.Body.String()
+	}
+	queryJSON := func(q string) *MemoryStats {
+		stats := &MemoryStats{}
+		if err := json.Unmarshal([]byte(query(q)), stats); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+		return stats
+	}
+	for q, want := range map[string]string{
+		"":                       "512\n",
+		"?prefix=users:":         "256\n",
+		"?prefix=users:&group=x": "256\n",
+		"?prefix=none":           "0\n",
+		"?prefix=":               "512\n",
+		"?group=namespace":       "512\n",
+	} {
+		if got := query(q); got != want {
+			t.Errorf("%s: got %q, expected %q", q, got, want)
+		}
+	}
+
+	stats := queryJSON("?format=json")
+	if stats.UsedBytes != 512 || stats.Keys != 4 || stats.Groups != nil {
+		t.Errorf("got %+v, expected 4 keys in 512 bytes without groups", stats)
+	}
+	for q, want := range map[string]map[string]*MemoryUsage{
+		"?group=namespace&format=json": {
+			"users":  {Entries: 2, Bytes: 256},
+			"orders": {Entries: 1, Bytes: 128},
+			"":       {Entries: 1, Bytes: 128},
+		},
+		"?prefix=users:&format=json": {
+			"users:": {Entries: 2, Bytes: 256},
+		},
+		"?prefix=o&group=namespace&format=json": {
+			"orders": {Entries: 1, Bytes: 128},
+		},
+	} {
+		stats := queryJSON(q)
+		if !reflect.DeepEqual(stats.Groups, want) {
+			t.Errorf("%s: groups %v, expected %v", q, stats.Groups, want)
+		}
+		if stats.UsedBytes != 512 {
+			t.Errorf("%s: used %d bytes, expected the total of 512", q, stats.UsedBytes)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const DefaultPushdownQuantum = 5 * time.Millisecond
+
+type PushdownConfig struct {
+	// length of the slices pushdown functions run in, 0 to run them to completion
+	QuantumSecs float64
+	// fraction of the total worker time pushdown functions may use, 0 for no cap
+	CPUCap float64
+}
+
+func validatePushdownConfig(cfg *PushdownConfig) error {
+	if cfg.QuantumSecs < 0 {
+		return fmt.Errorf("pushdown quantum must not be negative")
+	}
+	if cfg.CPUCap < 0 || cfg.CPUCap > 1 {
+		return fmt.Errorf("pushdown cpu cap must be within [0, 1]")
+	}
+	return nil
+}
+
+// cpuLimiter is a token bucket of worker time. It refills at the capped share
+// of all workers and may go into debt by one slice.
+type cpuLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // worker-seconds per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newCPULimiter returns nil if pushdown is not capped.
+func newCPULimiter(share float64, nWorkers int, quantum time.Duration) *cpuLimiter {
+	if share <= 0 || share >= 1 {
+		return nil
+	}
+	rate := share * float64(nWorkers)
+	burst := max(rate*quantum.Seconds(), DefaultPushdownQuantum.Seconds())
+	return &cpuLimiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// take charges d if there is budget left and otherwise returns how long to
+// wait until there is. The nil limiter of uncapped pushdown never waits.
+func (l *cpuLimiter) take(d time.Duration) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.burst)
+	l.last = now
+	if l.tokens <= 0 {
+		return time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.tokens -= d.Seconds()
+	return 0
+}
+
+// runSliced runs work for total worker time in slices of the pushdown quantum.
+// Between slices, and while pushdown is over its cpu cap, the worker serves
+// waiting kv requests so that a long function does not hold it exclusively.
+// It stops early once check fails.
+func (w *StorageWorker) runSliced(logger logr.Logger, total time.Duration, work func(time.Duration), check func() error) {
+	quantum := w.server.pushdownQuantum
+	for total > 0 && check() == nil {
+		slice := min(total, DefaultPushdownQuantum)
+		if quantum > 0 {
+			slice = min(total, quantum)
+		}
+		for {
+			wait := w.server.pushdownCPU.take(slice)
+			if wait <= 0 {
+				break
+			}
+			if !w.yield(logger) {
+				if quantum > 0 {
+					wait = min(wait, quantum)
+				}
+				time.Sleep(wait)
+				w.server.sched.throttled(wait)
+			}
+		}
+		work(slice)
+		total -= slice
+		if total > 0 && quantum > 0 {
+			w.yield(logger)
+		}
+	}
+}
+
+// yield serves kv requests waiting for a worker for up to one quantum and
+// reports whether it served any.
+func (w *StorageWorker) yield(logger logr.Logger) bool {
+	start := time.Now()
+	served := false
+	for time.Since(start) < max(w.server.pushdownQuantum, DefaultPushdownQuantum) {
+		q := w.server.sched.tryTake(ClassKV)
+		if q == nil {
+			break
+		}
+		reqStart := time.Now()
+		w.HandleRequest(logger, q.req)
+		elapsed := time.Since(reqStart)
+		w.server.sched.done(q, elapsed)
+		w.server.stats.Record(requestType(q.req), elapsed, requestFailed(q.req))
+		w.yielded += elapsed
+		served = true
+	}
+	return served
+}
@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/tomquartz/pyxis-k8s/pkg/workload"
+)
+
+func TestNewCPULimiter(t *testing.T) {
+	for _, c := range []struct {
+		share    float64
+		nWorkers int
+		quantum  time.Duration
+		capped   bool
+		rate     float64
+		burst    float64
+	}{
+		{0, 4, time.Millisecond, false, 0, 0},
+		{1, 4, time.Millisecond, false, 0, 0},
+		{0.5, 4, 10 * time.Millisecond, true, 2, 0.02},
+		// the burst covers at least one slice of the default quantum
+		{0.25, 2, time.Millisecond, true, 0.5, DefaultPushdownQuantum.Seconds()},
+		{0.25, 2, 0, true, 0.5, DefaultPushdownQuantum.Seconds()},
+	} {
+		l := newCPULimiter(c.share, c.nWorkers, c.quantum)
+		if (l != nil) != c.capped {
+			t.Errorf("share %v: got limiter %v", c.share, l)
+			continue
+		}
+		if l != nil && (l.rate != c.rate || l.burst != c.burst || l.tokens != c.burst) {
+			t.Errorf("share %v of %d workers: got rate %v, burst %v, tokens %v", c.share, c.nWorkers, l.rate, l.burst, l.tokens)
+		}
+	}
+}
+
+func TestCPULimiterTake(t *testing.T) {
+	var uncapped *cpuLimiter
+	if wait := uncapped.take(time.Hour); wait != 0 {
+		t.Errorf("nil limiter waits %v", wait)
+	}
+
+	// one worker-second per second with a burst of 10ms
+	l := newCPULimiter(0.5, 2, 10*time.Millisecond)
+	slice := 10 * time.Millisecond
+	if wait := l.take(slice); wait != 0 {
+		t.Fatalf("full bucket waits %v", wait)
+	}
+	// goes into debt by one slice
+	if wait := l.take(slice); wait != 0 {
+		t.Fatalf("empty bucket waits %v before going into debt", wait)
+	}
+	wait := l.take(slice)
+	if wait <= 9*time.Millisecond || wait > slice {
+		t.Fatalf("waits %v in debt of one slice, expected about %v", wait, slice)
+	}
+	// refills at the rate but no further than the burst
+	l.mu.Lock()
+	l.last = l.last.Add(-time.Second)
+	l.mu.Unlock()
+	if wait := l.take(slice); wait != 0 {
+		t.Fatalf("refilled bucket waits %v", wait)
+	}
+	if wait := l.take(slice); wait != 0 {
+		t.Fatalf("refilled bucket waits %v before going into debt", wait)
+	}
+	if wait := l.take(slice); wait == 0 {
+		t.Error("bucket refilled past its burst")
+	}
+}
+
+func newPreemptServer(t *testing.T, pushdown *PushdownConfig) (*StorageServer, *StorageWorker) {
+	s, err := NewStorageServer(&StorageConfig{NumWorkers: 2, Engine: EngineMap, Pushdown: pushdown})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, NewStorageWorker(1, s)
+}
+
+// queueGets queues n kv requests for the workers of s, whose replies nobody
+// reads.
+func queueGets(s *StorageServer, n int) {
+	for i := 0; i < n; i++ {
+		req := (&workload.StorageRequest{ID: "get", Keys: []string{"k"}}).SetResponseWriter(nil)
+		go func() {
+			for range req.Done() {
+			}
+		}()
+		s.sched.push(req)
+	}
+}
+
+func TestRunSlicedQuantum(t *testing.T) {
+	ms := time.Millisecond
+	for _, c := range []struct {
+		name    string
+		quantum time.Duration
+		total   time.Duration
+		slices  []time.Duration
+		// kv requests served before each slice
+		served []int64
+	}{
+		{"quantum", 10 * ms, 25 * ms, []time.Duration{10 * ms, 10 * ms, 5 * ms}, []int64{0, 3, 3}},
+		{"single slice", 10 * ms, 10 * ms, []time.Duration{10 * ms}, []int64{0}},
+		// run to completion, still charged to the cpu cap in default slices
+		{"no quantum", 0, 12 * ms, []time.Duration{5 * ms, 5 * ms, 2 * ms}, []int64{0, 0, 0}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			s, w := newPreemptServer(t, &PushdownConfig{QuantumSecs: c.quantum.Seconds()})
+			queueGets(s, 3)
+			var ran []time.Duration
+			var served []int64
+			w.runSliced(logr.Discard(), c.total, func(d time.Duration) {
+				ran = append(ran, d)
+				served = append(served, s.sched.stats()[classNames[ClassKV]].Served)
+			}, func() error { return nil })
+			if !slices.Equal(ran, c.slices) || !slices.Equal(served, c.served) {
+				t.Errorf("ran slices %v after serving %v kv requests, expected %v after %v", ran, served, c.slices, c.served)
+			}
+		})
+	}
+}
+
+func TestRunSlicedStopsOnCheck(t *testing.T) {
+	_, w := newPreemptServer(t, nil)
+	n := 0
+	w.runSliced(logr.Discard(), time.Second, func(time.Duration) { n++ }, func() error {
+		if n == 2 {
+			return errors.New("canceled")
+		}
+		return nil
+	})
+	if n != 2 {
+		t.Errorf("ran %d slices, expected 2", n)
+	}
+}
+
+// Pushdown over its cpu cap waits for the bucket to refill.
+func TestRunSlicedCPUCap(t *testing.T) {
+	ms := time.Millisecond
+	for _, c := range []struct {
+		name      string
+		cap       float64
+		throttled bool
+	}{
+		{"uncapped", 0, false},
+		{"capped", 0.5, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			// one worker-second per second with a burst of one slice
+			s, w := newPreemptServer(t, &PushdownConfig{QuantumSecs: 0.01, CPUCap: c.cap})
+			start := time.Now()
+			n := 0
+			w.runSliced(logr.Discard(), 50*ms, func(time.Duration) {
+				n++
+			}, func() error { return nil })
+			elapsed := time.Since(start)
+			throttled := s.sched.stats()[classNames[ClassPushdown]].ThrottledSecs
+			if n != 5 || (throttled > 0) != c.throttled {
+				t.Errorf("ran %d slices, throttled for %vs", n, throttled)
+			}
+			// the bucket starts with one slice and goes into debt by another
+			if c.cap > 0 && elapsed < 25*ms {
+				t.Errorf("ran 50ms of work at half of two workers in %v", elapsed)
+			}
+			if c.cap == 0 && elapsed > 25*ms {
+				t.Errorf("uncapped pushdown took %v", elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,544 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/tomquartz/pyxis-k8s/pkg/workload"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	RolePrimary = "primary"
+	RoleBackup  = "backup"
+)
+
+const replicationLockStripes = 256
+
+var errNotPrimary = errors.New("storage replica is not the primary")
+
+type ReplicationConfig struct {
+	// base URLs of the replica group in promotion order
+	Peers []string
+	Self  int
+	// serve reads (kv gets and pushdown) on backups
+	BackupReads         bool
+	FailoverTimeoutSecs float64
+}
+
+type ReplicationStatus struct {
+	Role    string `json:"role"`
+	Epoch   int64  `json:"epoch"`
+	Primary int    `json:"primary"`
+	Backups []int  `json:"backups"`
+	// sequence number of the last replicated update applied
+	Seq int64 `json:"seq"`
+	// on backups, the backups of the primary as last seen and whether this
+	// replica got its state
+	View   []int `json:"view,omitempty"`
+	Joined bool  `json:"joined,omitempty"`
+}
+
+type replicateRequest struct {
+	Epoch int64 `json:"epoch"`
+	From  int   `json:"from"`
+	Seq   int64 `json:"seq"`
+	// backups of the primary when the update was sent
+	View []int `json:"view"`
+	// mutations of one batch, applied all or none
+	Ops []mutation `json:"ops"`
+}
+
+type joinRequest struct {
+	Peer int `json:"peer"`
+}
+
+type joinResponse struct {
+	Epoch  int64    `json:"epoch"`
+	Seq    int64    `json:"seq"`
+	View   []int    `json:"view"`
+	Keys   []string `json:"keys"`
+	Values []string `json:"values"`
+	// time left until each key expires, 0 if it does not
+	TTLSecs []float64 `json:"ttlSecs,omitempty"`
+}
+
+// Replica implements primary-backup replication of an engine. The primary
+// applies each update locally and acknowledges it only after every backup
+// in its view confirmed it. Backups that fail to confirm are dropped from the
+// view and have to rejoin with a full state transfer. Only members of the view
+// may take over from the primary, as only they have every acknowledged update.
+type Replica struct {
+	cfg    *ReplicationConfig
+	engine Engine
+	client *http.Client
+	logger logr.Logger
+	// writers hold the read side; view changes and joins take the write side
+	mu      sync.RWMutex
+	role    string
+	epoch   int64
+	primary int
+	backups map[int]bool
+	joined  bool
+	// the backups of the primary as last seen by a backup
+	view    []int
+	seq     int64
+	stripes [replicationLockStripes]sync.Mutex
+	// held by a backup while it installs a state transfer
+	syncMu sync.Mutex
+	// the kv locks of the server, held by backups while applying a batch so
+	// that backup reads do not see it partially
+	locks *keyLocks
+}
+
+func NewReplica(cfg *ReplicationConfig, engine Engine) *Replica {
+	return &Replica{
+		cfg:     cfg,
+		engine:  engine,
+		client:  &http.Client{Timeout: time.Duration(cfg.FailoverTimeoutSecs * float64(time.Second))},
+		role:    RoleBackup,
+		primary: -1,
+		backups: make(map[int]bool),
+	}
+}
+
+func (r *Replica) Status() *ReplicationStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	st := &ReplicationStatus{Role: r.role, Epoch: r.epoch, Primary: r.primary, Seq: atomic.LoadInt64(&r.seq)}
+	st.Backups = r.backupList()
+	if r.role == RoleBackup {
+		st.View, st.Joined = r.view, r.joined
+	}
+	return st
+}
+
+// backupList must be called with mu held.
+func (r *Replica) backupList() []int {
+	var backups []int
+	for b := range r.backups {
+		backups = append(backups, b)
+	}
+	sort.Ints(backups)
+	return backups
+}
+
+// CheckServe reports whether this replica may serve a request.
+func (r *Replica) CheckServe(write bool) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.role == RolePrimary || !write && r.cfg.BackupReads {
+		return nil
+	}
+	return errNotPrimary
+}
+
+// Apply atomically applies the mutations fn computes from the current values
+// of keys on the primary and replicates them as a single update.
+func (r *Replica) Apply(keys []string, fn BatchFunc) error {
+	failed, err := r.applyAndReplicate(keys, fn)
+	if len(failed) > 0 {
+		r.mu.Lock()
+		for _, b := range failed {
+			delete(r.backups, b)
+		}
+		r.mu.Unlock()
+	}
+	return err
+}
+
+// applyAndReplicate holds the stripes of keys across the local update and the
+// replication round so that backups see the writes of a key in order.
+func (r *Replica) applyAndReplicate(keys []string, fn BatchFunc) ([]int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.role != RolePrimary {
+		return nil, errNotPrimary
+	}
+	defer lockStripes(r.stripes[:], keys)()
+	muts, err := fn(r.engine.Get)
+	if err != nil || len(muts) == 0 {
+		return nil, err
+	}
+	if err := applyMutations(r.engine, muts); err != nil {
+		return nil, err
+	}
+	req := &replicateRequest{Epoch: r.epoch, From: r.cfg.Self, Seq: atomic.AddInt64(&r.seq, 1), View: r.backupList(), Ops: muts}
+	var failed []int
+	var failedMu sync.Mutex
+	wg := sync.WaitGroup{}
+	for b := range r.backups {
+		wg.Add(1)
+		go func(b int) {
+			defer wg.Done()
+			if err := r.post(b, workload.StorageReplicatePath, req, nil); err != nil {
+				r.logger.Error(err, "Dropping backup", "peer", b)
+				failedMu.Lock()
+				failed = append(failed, b)
+				failedMu.Unlock()
+			}
+		}(b)
+	}
+	wg.Wait()
+	return failed, nil
+}
+
+// applyMutations applies muts to engine as one unit if it supports batches.
+func applyMutations(engine Engine, muts []mutation) error {
+	if bounded, ok := engine.(*BoundedEngine); ok {
+		return bounded.ApplyBatch(muts)
+	}
+	for _, m := range muts {
+		if err := applyOp(engine, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyOp(engine Engine, op mutation) error {
+	switch op.Op {
+	case walOpPut:
+		if ttlEngine, ok := engine.(TTLEngine); ok && op.TTLSecs > 0 {
+			return ttlEngine.PutTTL(op.Key, op.Value, time.Duration(op.TTLSecs*float64(time.Second)))
+		}
+		return engine.Put(op.Key, op.Value)
+	case walOpDelete:
+		_, err := engine.Delete(op.Key)
+		return err
+	default:
+		return fmt.Errorf("unknown replicated op: %d", op.Op)
+	}
+}
+
+func (r *Replica) post(peer int, path string, req, resp interface{}) error {
+	reqJson, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpResp, err := r.client.Post(r.cfg.Peers[peer]+path, "application/json", bytes.NewReader(reqJson))
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(httpResp.Body)
+		return fmt.Errorf("peer %d replied %d: %s", peer, httpResp.StatusCode, string(msg))
+	}
+	if resp == nil {
+		return nil
+	}
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
+
+func (r *Replica) peerStatus(peer int) (*ReplicationStatus, error) {
+	httpResp, err := r.client.Get(r.cfg.Peers[peer] + workload.StorageReplicationStatusPath)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	st := &ReplicationStatus{}
+	if err := json.NewDecoder(httpResp.Body).Decode(st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (r *Replica) ServeReplicate(w http.ResponseWriter, req *http.Request) {
+	repReq := &replicateRequest{}
+	if err := json.NewDecoder(req.Body).Decode(repReq); err != nil {
+		http.Error(w, fmt.Sprintf("failed to decode request: %v", err), http.StatusBadRequest)
+		return
+	}
+	r.mu.Lock()
+	if repReq.Epoch < r.epoch {
+		r.mu.Unlock()
+		http.Error(w, fmt.Sprintf("stale epoch %d < %d", repReq.Epoch, r.epoch), http.StatusConflict)
+		return
+	}
+	if repReq.Epoch > r.epoch || r.role == RolePrimary {
+		r.becomeBackup(repReq.Epoch, repReq.From)
+	}
+	r.mu.Unlock()
+	r.syncMu.Lock()
+	defer r.syncMu.Unlock()
+	if err := r.applyReplicated(repReq.Ops); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if repReq.Epoch == r.epoch {
+		r.view = repReq.View
+		if repReq.Seq > atomic.LoadInt64(&r.seq) {
+			atomic.StoreInt64(&r.seq, repReq.Seq)
+		}
+	}
+}
+
+func (r *Replica) applyReplicated(muts []mutation) error {
+	if r.locks != nil {
+		keys := make([]string, len(muts))
+		for i, m := range muts {
+			keys[i] = m.Key
+		}
+		defer r.locks.lock(keys, true)()
+	}
+	return applyMutations(r.engine, muts)
+}
+
+// ServeJoin adds a backup to the view and transfers the full state to it.
+func (r *Replica) ServeJoin(w http.ResponseWriter, req *http.Request) {
+	joinReq := &joinRequest{}
+	if err := json.NewDecoder(req.Body).Decode(joinReq); err != nil {
+		http.Error(w, fmt.Sprintf("failed to decode request: %v", err), http.StatusBadRequest)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.role != RolePrimary {
+		http.Error(w, errNotPrimary.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	resp := &joinResponse{Epoch: r.epoch, Seq: atomic.LoadInt64(&r.seq)}
+	ttlEngine, _ := r.engine.(TTLEngine)
+	r.engine.Scan("", "", func(k, v string) bool {
+		resp.Keys = append(resp.Keys, k)
+		resp.Values = append(resp.Values, v)
+		if ttlEngine != nil {
+			resp.TTLSecs = append(resp.TTLSecs, ttlEngine.TTL(k).Seconds())
+		}
+		return true
+	})
+	r.backups[joinReq.Peer] = true
+	resp.View = r.backupList()
+	r.logger.Info("Backup joined", "peer", joinReq.Peer, "keys", len(resp.Keys))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (r *Replica) ServeStatus(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.Status())
+}
+
+func (r *Replica) ServePromote(w http.ResponseWriter, req *http.Request) {
+	r.promote()
+	r.ServeStatus(w, req)
+}
+
+func (r *Replica) promote() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.role == RolePrimary {
+		return
+	}
+	r.role = RolePrimary
+	r.epoch++
+	r.primary = r.cfg.Self
+	r.backups = make(map[int]bool)
+	r.logger.Info("Promoted to primary", "epoch", r.epoch)
+}
+
+// becomeBackup must be called with mu held.
+func (r *Replica) becomeBackup(epoch int64, primary int) {
+	if r.role == RolePrimary {
+		r.logger.Info("Demoted to backup", "epoch", epoch, "primary", primary)
+	}
+	r.role = RoleBackup
+	r.epoch = epoch
+	r.primary = primary
+	r.backups = make(map[int]bool)
+	r.joined = false
+	r.view = nil
+}
+
+// join registers with the primary and replaces the local state with its
+// snapshot. Replicated writes arriving meanwhile wait on syncMu and are
+// applied on top of the snapshot.
+func (r *Replica) join(primary int) error {
+	r.syncMu.Lock()
+	defer r.syncMu.Unlock()
+	resp := &joinResponse{}
+	if err := r.post(primary, workload.StorageReplicationJoinPath, &joinRequest{Peer: r.cfg.Self}, resp); err != nil {
+		return err
+	}
+	snapshot := make(map[string]bool, len(resp.Keys))
+	for i, k := range resp.Keys {
+		snapshot[k] = true
+		op := mutation{Op: walOpPut, Key: k, Value: resp.Values[i]}
+		if i < len(resp.TTLSecs) {
+			op.TTLSecs = resp.TTLSecs[i]
+		}
+		if err := applyOp(r.engine, op); err != nil {
+			return err
+		}
+	}
+	var stale []string
+	r.engine.Scan("", "", func(k, v string) bool {
+		if !snapshot[k] {
+			stale = append(stale, k)
+		}
+		return true
+	})
+	for _, k := range stale {
+		if _, err := r.engine.Delete(k); err != nil {
+			return err
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if resp.Epoch >= r.epoch {
+		r.role = RoleBackup
+		r.epoch = resp.Epoch
+		r.primary = primary
+		r.joined = true
+		r.view = resp.View
+		atomic.StoreInt64(&r.seq, resp.Seq)
+	}
+	r.logger.Info("Joined primary", "primary", primary, "epoch", resp.Epoch, "keys", len(resp.Keys))
+	return nil
+}
+
+// Run monitors the primary from a backup and takes over when it has been
+// unreachable for the failover timeout. The live member of the last view that
+// applied the most updates is promoted; the others join it.
+func (r *Replica) Run(ctx context.Context) {
+	r.logger = log.FromContext(ctx).WithValues("peer", r.cfg.Self)
+	timeout := time.Duration(r.cfg.FailoverTimeoutSecs * float64(time.Second))
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	lastSeen := time.Now()
+	if r.cfg.Self == 0 {
+		// nobody may be primary yet, so do not wait for a timeout to elect one
+		lastSeen = time.Time{}
+	}
+	for {
+		r.monitor(timeout, &lastSeen)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *Replica) monitor(timeout time.Duration, lastSeen *time.Time) {
+	st := r.Status()
+	// find the primary with the highest epoch among the other peers
+	primary, primaryStatus := -1, (*ReplicationStatus)(nil)
+	alive := map[int]*ReplicationStatus{r.cfg.Self: st}
+	for peer := range r.cfg.Peers {
+		if peer == r.cfg.Self {
+			continue
+		}
+		pst, err := r.peerStatus(peer)
+		if err != nil {
+			continue
+		}
+		alive[peer] = pst
+		if pst.Role == RolePrimary && pst.Epoch >= st.Epoch && (primaryStatus == nil || pst.Epoch > primaryStatus.Epoch) {
+			primary, primaryStatus = peer, pst
+		}
+	}
+	if st.Role == RolePrimary {
+		if primaryStatus != nil && primaryStatus.Epoch > st.Epoch {
+			r.mu.Lock()
+			r.becomeBackup(primaryStatus.Epoch, primary)
+			r.mu.Unlock()
+		}
+		return
+	}
+	if primary >= 0 {
+		*lastSeen = time.Now()
+		r.mu.Lock()
+		if r.epoch == primaryStatus.Epoch && r.primary == primary {
+			r.view = primaryStatus.Backups
+		}
+		r.mu.Unlock()
+		if st.Primary != primary || !r.isJoined() || !containsInt(primaryStatus.Backups, r.cfg.Self) {
+			if err := r.join(primary); err != nil {
+				r.logger.Error(err, "Failed to join primary", "primary", primary)
+			}
+		}
+		return
+	}
+	if time.Since(*lastSeen) < timeout {
+		return
+	}
+	candidate := promotionCandidate(alive)
+	if candidate < 0 {
+		r.logger.Info("No live member of the last view to take over from the primary")
+		return
+	}
+	// otherwise wait for the candidate to promote itself
+	if candidate == r.cfg.Self {
+		r.promote()
+	}
+}
+
+// promotionCandidate picks the live peer to take over from an unreachable
+// primary: the member of the latest view that applied the most updates, ties
+// going to the lowest index. Before there ever was a primary, the live peer
+// with the lowest index is picked. It returns -1 if no member of the view is
+// live, since promoting another peer could lose acknowledged updates.
+func promotionCandidate(alive map[int]*ReplicationStatus) int {
+	var latest *ReplicationStatus
+	lowest := -1
+	for peer, st := range alive {
+		if latest == nil || st.Epoch > latest.Epoch || st.Epoch == latest.Epoch && st.Seq > latest.Seq {
+			latest = st
+		}
+		if lowest < 0 || peer < lowest {
+			lowest = peer
+		}
+	}
+	if latest == nil || latest.Epoch == 0 {
+		return lowest
+	}
+	candidate := -1
+	for peer, st := range alive {
+		if st.Epoch != latest.Epoch || !st.Joined || !containsInt(latest.View, peer) {
+			continue
+		}
+		if candidate < 0 || st.Seq > alive[candidate].Seq || st.Seq == alive[candidate].Seq && peer < candidate {
+			candidate = peer
+		}
+	}
+	return candidate
+}
+
+func validateReplicationConfig(cfg *ReplicationConfig) error {
+	if cfg.Self < 0 || cfg.Self >= len(cfg.Peers) {
+		return fmt.Errorf("replica index %d must be within [0, %d)", cfg.Self, len(cfg.Peers))
+	}
+	if cfg.FailoverTimeoutSecs <= 0 {
+		return fmt.Errorf("failover timeout must be positive")
+	}
+	return nil
+}
+
+func (r *Replica) isJoined() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.joined
+}
+
+func containsInt(s []int, x int) bool {
+	for _, v := range s {
+		if v == x {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestPromotionCandidate(t *testing.T) {
+	backup := func(epoch, seq int64, view ...int) *ReplicationStatus {
+		return &ReplicationStatus{Role: RoleBackup, Epoch: epoch, Seq: seq, View: view, Joined: true}
+	}
+	for _, tc := range []struct {
+		name  string
+		alive map[int]*ReplicationStatus
+		want  int
+	}{
+		{"bootstrap picks the lowest index", map[int]*ReplicationStatus{1: {}, 2: {}}, 1},
+		{"most updates wins", map[int]*ReplicationStatus{1: backup(1, 5, 1, 2), 2: backup(1, 7, 1, 2)}, 2},
+		{"ties go to the lowest index", map[int]*ReplicationStatus{2: backup(1, 7, 1, 2), 1: backup(1, 7, 1, 2)}, 1},
+		{
+			"dropped backup is not promoted",
+			map[int]*ReplicationStatus{1: backup(1, 4, 1, 2), 2: backup(1, 9, 2)},
+			2,
+		},
+		{
+			"no live member of the view",
+			map[int]*ReplicationStatus{1: backup(1, 4, 1, 2), 3: {Role: RoleBackup, Epoch: 1, Seq: 9, View: []int{2}}},
+			-1,
+		},
+		{
+			"backup that never joined is not promoted",
+			map[int]*ReplicationStatus{1: {Role: RoleBackup, Epoch: 1, Seq: 9, View: []int{1, 2}}, 2: backup(1, 3, 1, 2)},
+			2,
+		},
+		{"stale epoch is not promoted", map[int]*ReplicationStatus{1: backup(1, 9, 1, 2), 2: backup(2, 1, 2)}, 2},
+	} {
+		if got := promotionCandidate(tc.alive); got != tc.want {
+			t.Errorf("%s: promoted %d, expected %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestReplicaSendsBatchAsOneUpdate(t *testing.T) {
+	var mu sync.Mutex
+	var updates []*replicateRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		repReq := &replicateRequest{}
+		json.NewDecoder(req.Body).Decode(repReq)
+		mu.Lock()
+		updates = append(updates, repReq)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+	engine, err := NewBoundedEngine(NewMapEngine(), &MemoryConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary := NewReplica(&ReplicationConfig{Peers: []string{"", srv.URL}, Self: 0, FailoverTimeoutSecs: 1}, engine)
+	primary.promote()
+	primary.backups[1] = true
+	err = primary.Apply([]string{"a", "b"}, func(func(string) (string, bool)) ([]mutation, error) {
+		return []mutation{{Op: walOpPut, Key: "a", Value: "1"}, {Op: walOpPut, Key: "b", Value: "1"}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 1 || len(updates[0].Ops) != 2 {
+		t.Fatalf("replicated %d updates, expected the batch as one", len(updates))
+	}
+	if engine.Size() != 2 {
+		t.Errorf("applied %d keys locally, expected 2", engine.Size())
+	}
+}
@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/tomquartz/pyxis-k8s/pkg/workload"
+)
+
+const (
+	DefaultScanLimit = 1000
+	MaxScanLimit     = 10000
+	// entries read from the engine between two flushes of the response
+	scanChunkSize = 256
+)
+
+// scanRange resolves the prefix and continuation token of req into the range
+// [start, end) left to scan.
+func scanRange(req *workload.ScanRequest) (string, string, error) {
+	start, end := req.Start, req.End
+	if req.Prefix != "" {
+		if start != "" || end != "" {
+			return "", "", fmt.Errorf("prefix cannot be combined with start or end")
+		}
+		start, end = req.Prefix, prefixEnd(req.Prefix)
+	}
+	if req.Token != "" {
+		next, err := base64.RawURLEncoding.DecodeString(req.Token)
+		if err != nil || string(next) < start {
+			return "", "", fmt.Errorf("invalid continuation token")
+		}
+		start = string(next)
+	}
+	if end != "" && start > end {
+		return "", "", fmt.Errorf("start %q is after end %q", start, end)
+	}
+	return start, end, nil
+}
+
+func scanLimit(req *workload.ScanRequest) (int, error) {
+	switch {
+	case req.Limit < 0 || req.Limit > MaxScanLimit:
+		return 0, fmt.Errorf("limit must be within [0, %d]", MaxScanLimit)
+	case req.Limit == 0:
+		return DefaultScanLimit, nil
+	default:
+		return req.Limit, nil
+	}
+}
+
+func scanToken(next string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(next))
+}
+
+// ServeScan streams the entries of a key range as newline-delimited JSON.
+// Unless the request was forwarded, the range is gathered from all shards by
+// the handler, so that workers only ever wait for the local engine.
+func (s *StorageServer) ServeScan(w http.ResponseWriter, r *http.Request) {
+	req := &workload.ScanRequest{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	req.SetResponseWriter(w)
+	if err != nil {
+		req.Error(fmt.Errorf("failed to decode request: %v", err), http.StatusBadRequest)
+		return
+	}
+	start, end, err := scanRange(req)
+	if err != nil {
+		req.Error(err, http.StatusBadRequest)
+		return
+	}
+	limit, err := scanLimit(req)
+	if err != nil {
+		req.Error(err, http.StatusBadRequest)
+		return
+	}
+	if err := s.checkServe(false); err != nil {
+		req.Error(err, http.StatusServiceUnavailable)
+		return
+	}
+	req.Forwarded = s.router == nil || r.Header.Get(workload.StorageForwardedHeader) != ""
+	if !req.Forwarded {
+		s.logger.V(1).Info("server gathering scan from all shards", "id", req.ID, "start", start, "end", end, "limit", limit)
+		entries, next, err := s.scanShards(req.ID, start, end, limit)
+		enc := scanEncoder(req)
+		if err == nil {
+			for i := range entries {
+				if err = enc.Encode(&entries[i]); err != nil {
+					break
+				}
+			}
+		}
+		s.finishScan(enc, req, next, err)
+		return
+	}
+	s.sched.push(req)
+	<-req.Done()
+}
+
+func (w *StorageWorker) HandleScan(logger logr.Logger, req *workload.ScanRequest) {
+	defer req.Close()
+	start, end, _ := scanRange(req)
+	limit, _ := scanLimit(req)
+	logger.V(1).Info("worker processing scan request", "id", req.ID, "start", start, "end", end, "limit", limit)
+	enc := scanEncoder(req)
+	flusher, _ := req.ResponseWriter.(http.Flusher)
+	next, err := w.streamScan(start, end, limit, func(entries []workload.ScanEntry) error {
+		for i := range entries {
+			if err := enc.Encode(&entries[i]); err != nil {
+				return err
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	w.server.finishScan(enc, req, next, err)
+	logger.V(1).Info("worker finished scan request", "request", req.ID)
+}
+
+func scanEncoder(req *workload.ScanRequest) *json.Encoder {
+	req.ResponseWriter.Header().Set("Content-Type", "application/x-ndjson")
+	return json.NewEncoder(req.ResponseWriter)
+}
+
+// finishScan writes the last line of a scan response.
+func (s *StorageServer) finishScan(enc *json.Encoder, req *workload.ScanRequest, next string, err error) {
+	last := &workload.ScanEntry{Last: true}
+	if err != nil {
+		s.logger.Error(err, "failed to scan", "request", req.ID)
+		last.Error = err.Error()
+		req.Fail()
+	} else if next != "" {
+		last.Next = scanToken(next)
+	}
+	if err := enc.Encode(last); err != nil {
+		s.logger.Error(err, "failed to reply", "request", req.ID)
+	}
+}
+
+// streamScan reads the local entries of [start, end) in a single pass and hands
+// them to emit in chunks, so that the engine is not locked while the response
+// is written. It returns the key to continue from if limit was reached before
+// the end of the range.
+func (w *StorageWorker) streamScan(start, end string, limit int, emit func([]workload.ScanEntry) error) (string, error) {
+	time.Sleep(KVAccessTimeSimulated)
+	entries := make([]workload.ScanEntry, 0, min(limit+1, scanChunkSize))
+	w.server.engine.Scan(start, end, func(k, v string) bool {
+		entries = append(entries, workload.ScanEntry{Key: k, Value: v})
+		return len(entries) <= limit
+	})
+	next := ""
+	if len(entries) > limit {
+		next = entries[limit].Key
+		entries = entries[:limit]
+	}
+	for len(entries) > 0 {
+		n := min(len(entries), scanChunkSize)
+		if err := emit(entries[:n]); err != nil {
+			return "", err
+		}
+		entries = entries[n:]
+	}
+	return next, nil
+}
+
+// scanShards gathers up to limit entries of [start, end) from every shard,
+// including this one, and merges them in key order.
+func (s *StorageServer) scanShards(id, start, end string, limit int) ([]workload.ScanEntry, string, error) {
+	nShards := s.router.Shards().Len()
+	parts := make([][]workload.ScanEntry, nShards)
+	more := make([]bool, nShards)
+	errs := make([]error, nShards)
+	wg := sync.WaitGroup{}
+	for shard := 0; shard < nShards; shard++ {
+		wg.Add(1)
+		go func(shard int) {
+			defer wg.Done()
+			var next string
+			req := &workload.ScanRequest{ID: fmt.Sprintf("%s-s%d", id, shard), Start: start, End: end, Limit: limit}
+			parts[shard], next, errs[shard] = s.router.Scan(shard, req)
+			more[shard] = next != ""
+		}(shard)
+	}
+	wg.Wait()
+	var entries []workload.ScanEntry
+	hasMore := false
+	for shard := range parts {
+		if errs[shard] != nil {
+			return nil, "", fmt.Errorf("shard %d: %v", shard, errs[shard])
+		}
+		entries = append(entries, parts[shard]...)
+		hasMore = hasMore || more[shard]
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	if len(entries) > limit {
+		entries, hasMore = entries[:limit], true
+	}
+	if !hasMore || len(entries) == 0 {
+		return entries, "", nil
+	}
+	return entries, entries[len(entries)-1].Key + "\x00", nil
+}
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tomquartz/pyxis-k8s/pkg/workload"
+)
+
+// startShards runs n storage servers sharding keys between them and returns
+// their base URLs.
+func startShards(t *testing.T, n int, workers int) []string {
+	listeners := make([]net.Listener, n)
+	endpoints := make([]string, n)
+	for i := range listeners {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[i], endpoints[i] = ln, "http://"+ln.Addr().String()
+	}
+	for i, ln := range listeners {
+		startServerOn(t, &StorageConfig{NumWorkers: workers, Engine: EngineMap, ShardID: i, ShardEndpoints: endpoints}, ln)
+	}
+	return endpoints
+}
+
+func postScan(client *http.Client, url string, req *workload.ScanRequest) ([]workload.ScanEntry, string, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, "", err
+	}
+	httpResp, err := client.Post(url+workload.StorageScanPath, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, "", err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("storage replied %d", httpResp.StatusCode)
+	}
+	var entries []workload.ScanEntry
+	dec := json.NewDecoder(httpResp.Body)
+	for {
+		entry := workload.ScanEntry{}
+		if err := dec.Decode(&entry); err != nil {
+			return nil, "", err
+		}
+		if entry.Last {
+			if entry.Error != "" {
+				return nil, "", fmt.Errorf("scan failed: %s", entry.Error)
+			}
+			return entries, entry.Next, nil
+		}
+		entries = append(entries, entry)
+	}
+}
+
+func putKeys(t *testing.T, url string, n int) {
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("k%04d", i)
+		if _, err := postKV(url, &workload.StorageRequest{ID: key, Keys: []string{key}, Values: []string{"v"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestScanPages(t *testing.T) {
+	_, url := startServer(t, &StorageConfig{NumWorkers: 2, Engine: EngineMap})
+	putKeys(t, url, 700)
+	for _, limit := range []int{7, scanChunkSize, 300, 700, MaxScanLimit} {
+		var keys []string
+		req := &workload.ScanRequest{ID: "scan", Prefix: "k", Limit: limit}
+		for pages := 0; ; pages++ {
+			entries, next, err := postScan(http.DefaultClient, url, req)
+			if err != nil {
+				t.Fatalf("limit %d: %v", limit, err)
+			}
+			if len(entries) > limit || next != "" && len(entries) != limit {
+				t.Fatalf("limit %d: got %d entries with token %q", limit, len(entries), next)
+			}
+			for _, e := range entries {
+				keys = append(keys, e.Key)
+			}
+			if next == "" {
+				break
+			}
+			req.Token = next
+		}
+		if len(keys) != 700 {
+			t.Fatalf("limit %d: scanned %d keys, expected 700", limit, len(keys))
+		}
+		for i, k := range keys {
+			if want := fmt.Sprintf("k%04d", i); k != want {
+				t.Fatalf("limit %d: key %d is %s, expected %s", limit, i, k, want)
+			}
+		}
+	}
+}
+
+// Every worker of both shards is busy with a scan that gathers from the other
+// shard, which must not wait for the workers of this one.
+func TestScanAcrossShardsWithBusyWorkers(t *testing.T) {
+	const workers = 2
+	endpoints := startShards(t, 2, workers)
+	putKeys(t, endpoints[0], 100)
+	client := &http.Client{Timeout: 10 * time.Second}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4*workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			entries, next, err := postScan(client, endpoints[i%2], &workload.ScanRequest{ID: fmt.Sprintf("scan-%d", i), Limit: 60})
+			if err != nil {
+				t.Errorf("scan %d: %v", i, err)
+				return
+			}
+			if len(entries) != 60 || next == "" {
+				t.Errorf("scan %d: got %d entries up to %q, expected 60 and a token", i, len(entries), next)
+				return
+			}
+			for j, e := range entries {
+				if want := fmt.Sprintf("k%04d", j); e.Key != want {
+					t.Errorf("scan %d: key %d is %s, expected %s", i, j, e.Key, want)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
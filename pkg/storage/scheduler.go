@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tomquartz/pyxis-k8s/pkg/workload"
+)
+
+// request classes with separate queues
+const (
+	ClassKV = iota
+	ClassPushdown
+	numClasses
+)
+
+var classNames = [numClasses]string{"kv", "pushdown"}
+
+const (
+	DefaultKVWeight       = 4
+	DefaultPushdownWeight = 1
+	// worker time granted per unit of weight in every round
+	schedulerQuantum = time.Millisecond
+	// weight of the latest sample in the service time estimate
+	serviceTimeAlpha = 0.1
+)
+
+type SchedulerConfig struct {
+	// relative shares of worker time the classes get when both are backlogged
+	KVWeight       int
+	PushdownWeight int
+	// number of workers that serve kv requests only
+	ReservedKVWorkers int
+}
+
+// ClassStats describes the queue of a request class.
+type ClassStats struct {
+	Weight         int     `json:"weight"`
+	Depth          int     `json:"depth"`
+	Served         int64   `json:"served"`
+	AvgWaitSecs    float64 `json:"avgWaitSecs"`
+	MaxWaitSecs    float64 `json:"maxWaitSecs"`
+	AvgServiceSecs float64 `json:"avgServiceSecs"`
+	// kv requests served by workers in between the slices of pushdown functions
+	Yielded int64 `json:"yielded,omitempty"`
+	// worker time pushdown functions spent waiting for the cpu cap
+	ThrottledSecs float64 `json:"throttledSecs,omitempty"`
+}
+
+type queuedRequest struct {
+	req      interface{}
+	class    int
+	enqueued time.Time
+	// service time charged to the class when the request was picked up
+	estimate time.Duration
+}
+
+type classQueue struct {
+	queue   *list.List
+	weight  int
+	deficit time.Duration
+	// moving average of the service time, charged up front
+	serviceTime time.Duration
+	served      int64
+	waitSum     time.Duration
+	maxWait     time.Duration
+	yielded     int64
+	throttled   time.Duration
+}
+
+// scheduler shares the storage workers between the request classes with
+// deficit round robin. A class is charged the service time of its requests,
+// estimated when a request is picked up and corrected when it finishes, so
+// that long pushdown functions cannot starve cheap kv lookups.
+type scheduler struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	classes [numClasses]*classQueue
+	// class served by the current round
+	cursor int
+	closed bool
+}
+
+func newScheduler(cfg *SchedulerConfig) *scheduler {
+	s := &scheduler{}
+	s.cond = sync.NewCond(&s.mu)
+	weights := [numClasses]int{cfg.KVWeight, cfg.PushdownWeight}
+	for i := range s.classes {
+		s.classes[i] = &classQueue{queue: list.New(), weight: weights[i]}
+	}
+	return s
+}
+
+func validateSchedulerConfig(cfg *SchedulerConfig, nWorkers int) error {
+	if cfg.KVWeight <= 0 || cfg.PushdownWeight <= 0 {
+		return fmt.Errorf("class weights must be positive")
+	}
+	if cfg.ReservedKVWorkers < 0 || cfg.ReservedKVWorkers >= nWorkers {
+		return fmt.Errorf("reserved kv workers must be within [0, %d)", nWorkers)
+	}
+	return nil
+}
+
+// Point lookups are kv requests, scans count as pushdown work.
+func requestClass(req interface{}) int {
+	if _, ok := req.(*workload.StorageRequest); ok {
+		return ClassKV
+	}
+	return ClassPushdown
+}
+
+func (s *scheduler) push(req interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	class := requestClass(req)
+	s.classes[class].queue.PushBack(&queuedRequest{req: req, class: class, enqueued: time.Now()})
+	s.cond.Broadcast()
+}
+
+// pop blocks until there is a request for the worker and returns nil once the
+// scheduler is closed and the queues the worker serves are drained.
+func (s *scheduler) pop(kvOnly bool) *queuedRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		var q *queuedRequest
+		if kvOnly {
+			q = s.take(ClassKV)
+		} else {
+			q = s.next()
+		}
+		if q != nil {
+			return q
+		}
+		// nothing wakes kv-only workers when the other classes drain
+		if s.closed && (kvOnly || s.empty()) {
+			return nil
+		}
+		s.cond.Wait()
+	}
+}
+
+// next picks a request by deficit round robin. It must be called with mu held.
+func (s *scheduler) next() *queuedRequest {
+	if s.empty() {
+		return nil
+	}
+	for {
+		for i := 0; i < numClasses; i++ {
+			c := s.classes[s.cursor]
+			if c.queue.Len() > 0 && c.deficit > 0 {
+				return s.take(s.cursor)
+			}
+			s.cursor = (s.cursor + 1) % numClasses
+		}
+		// every backlogged class has used up its share, skip ahead to the
+		// first round in which one of them is in credit again
+		rounds := time.Duration(-1)
+		for _, c := range s.classes {
+			if c.queue.Len() > 0 {
+				quantum := time.Duration(c.weight) * schedulerQuantum
+				if r := -c.deficit/quantum + 1; rounds < 0 || r < rounds {
+					rounds = r
+				}
+			}
+		}
+		for _, c := range s.classes {
+			if c.queue.Len() > 0 {
+				c.deficit += rounds * time.Duration(c.weight) * schedulerQuantum
+			}
+		}
+	}
+}
+
+// take dequeues the oldest request of class. It must be called with mu held.
+func (s *scheduler) take(class int) *queuedRequest {
+	c := s.classes[class]
+	e := c.queue.Front()
+	if e == nil {
+		return nil
+	}
+	c.queue.Remove(e)
+	q := e.Value.(*queuedRequest)
+	wait := time.Since(q.enqueued)
+	c.waitSum += wait
+	c.maxWait = max(c.maxWait, wait)
+	c.served++
+	q.estimate = max(c.serviceTime, time.Microsecond)
+	c.deficit -= q.estimate
+	if c.queue.Len() == 0 && c.deficit > 0 {
+		// idle classes do not bank credit
+		c.deficit = 0
+	}
+	return q
+}
+
+// tryTake dequeues a request of class for a worker yielding from a pushdown
+// function, or returns nil if none is waiting.
+func (s *scheduler) tryTake(class int) *queuedRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.take(class)
+	if q != nil {
+		s.classes[class].yielded++
+	}
+	return q
+}
+
+func (s *scheduler) throttled(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.classes[ClassPushdown].throttled += d
+}
+
+// done corrects the charge of a finished request by its actual service time.
+func (s *scheduler) done(q *queuedRequest, serviceTime time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.classes[q.class]
+	c.deficit -= serviceTime - q.estimate
+	if c.serviceTime == 0 {
+		c.serviceTime = serviceTime
+	} else {
+		c.serviceTime += time.Duration(serviceTimeAlpha * float64(serviceTime-c.serviceTime))
+	}
+}
+
+func (s *scheduler) empty() bool {
+	for _, c := range s.classes {
+		if c.queue.Len() > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *scheduler) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.cond.Broadcast()
+}
+
+func (s *scheduler) stats() map[string]*ClassStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make(map[string]*ClassStats, numClasses)
+	for i, c := range s.classes {
+		st := &ClassStats{
+			Weight:         c.weight,
+			Depth:          c.queue.Len(),
+			Served:         c.served,
+			MaxWaitSecs:    c.maxWait.Seconds(),
+			AvgServiceSecs: c.serviceTime.Seconds(),
+			Yielded:        c.yielded,
+			ThrottledSecs:  c.throttled.Seconds(),
+		}
+		if c.served > 0 {
+			st.AvgWaitSecs = c.waitSum.Seconds() / float64(c.served)
+		}
+		stats[classNames[i]] = st
+	}
+	return stats
+}
@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tomquartz/pyxis-k8s/pkg/drain"
+	"github.com/tomquartz/pyxis-k8s/pkg/workload"
+)
+
+func TestSchedulerCloseReleasesKVOnlyWorkers(t *testing.T) {
+	s := newScheduler(&SchedulerConfig{KVWeight: 1, PushdownWeight: 1})
+	popped := make(chan *queuedRequest)
+	go func() { popped <- s.pop(true) }()
+	s.push(&workload.StorageRequest{ID: "get"})
+	if q := <-popped; q == nil || q.class != ClassKV {
+		t.Fatalf("kv-only worker popped %v, expected the kv request", q)
+	}
+
+	go func() { popped <- s.pop(true) }()
+	s.push(&workload.ClientRequest{ID: "pushdown"})
+	s.close()
+	select {
+	case q := <-popped:
+		if q != nil {
+			t.Fatalf("kv-only worker popped a %s request after close", classNames[q.class])
+		}
+	case <-time.After(time.Second):
+		t.Fatal("kv-only worker still waiting after close with only pushdown work queued")
+	}
+	if q := s.pop(false); q == nil || q.class != ClassPushdown {
+		t.Fatalf("worker popped %v, expected the queued pushdown request", q)
+	}
+	if q := s.pop(false); q != nil {
+		t.Fatalf("worker popped %v from a closed and drained scheduler", q)
+	}
+}
+
+// blockingWriter holds up the worker writing a response until released.
+type blockingWriter struct {
+	http.ResponseWriter
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(b []byte) (int, error) {
+	<-w.release
+	return w.ResponseWriter.Write(b)
+}
+
+// A pushdown request is still queued when the scheduler closes, and the
+// reserved kv worker must not keep the server from stopping once it is served.
+func TestShutdownWithReservedKVWorkers(t *testing.T) {
+	s, err := NewStorageServer(&StorageConfig{
+		NumWorkers: 2,
+		Engine:     EngineMap,
+		Scheduler:  &SchedulerConfig{KVWeight: DefaultKVWeight, PushdownWeight: DefaultPushdownWeight, ReservedKVWorkers: 1},
+		Drain:      &drain.Config{TimeoutSecs: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		s.RunListener(ctx, ln)
+		close(stopped)
+	}()
+
+	// keep the only general worker busy with a scan
+	w := &blockingWriter{ResponseWriter: httptest.NewRecorder(), release: make(chan struct{})}
+	scan := (&workload.ScanRequest{ID: "scan", Forwarded: true}).SetResponseWriter(w)
+	s.sched.push(scan)
+	for s.sched.stats()[classNames[ClassPushdown]].Served == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	pushdown := (&workload.ClientRequest{ID: "pushdown", Function: workload.FuncDefault}).SetResponseWriter(httptest.NewRecorder())
+	s.sched.push(pushdown)
+	cancel()
+	for {
+		s.sched.mu.Lock()
+		closed := s.sched.closed
+		s.sched.mu.Unlock()
+		if closed {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(w.release)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop")
+	}
+	if depth := s.sched.stats()[classNames[ClassPushdown]].Depth; depth != 0 {
+		t.Errorf("%d pushdown requests left in the queue", depth)
+	}
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+const DefaultEngineShards = 64
+
+type engineShard struct {
+	mu sync.RWMutex
+	kv map[string]string
+}
+
+// ShardedEngine stripes keys across independently locked maps.
+type ShardedEngine struct {
+	shards []*engineShard
+}
+
+var _ Engine = &ShardedEngine{}
+
+func NewShardedEngine(nShards int) *ShardedEngine {
+	if nShards <= 0 {
+		nShards = DefaultEngineShards
+	}
+	shards := make([]*engineShard, nShards)
+	for i := range shards {
+		shards[i] = &engineShard{kv: make(map[string]string)}
+	}
+	return &ShardedEngine{shards: shards}
+}
+
+func (e *ShardedEngine) shard(key string) *engineShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return e.shards[h.Sum32()%uint32(len(e.shards))]
+}
+
+func (e *ShardedEngine) Get(key string) (string, bool) {
+	s := e.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, ok := s.kv[key]
+	return value, ok
+}
+
+func (e *ShardedEngine) Put(key, value string) error {
+	s := e.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kv[key] = value
+	return nil
+}
+
+func (e *ShardedEngine) Delete(key string) (bool, error) {
+	s := e.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.kv[key]
+	delete(s.kv, key)
+	return ok, nil
+}
+
+// Scan is not atomic across shards.
+func (e *ShardedEngine) Scan(start, end string, fn func(key, value string) bool) {
+	keys := make([]string, 0)
+	values := make(map[string]string)
+	for _, s := range e.shards {
+		s.mu.RLock()
+		for k, v := range s.kv {
+			if inRange(k, start, end) {
+				keys = append(keys, k)
+				values[k] = v
+			}
+		}
+		s.mu.RUnlock()
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !fn(k, values[k]) {
+			return
+		}
+	}
+}
+
+func (e *ShardedEngine) Size() int {
+	n := 0
+	for _, s := range e.shards {
+		s.mu.RLock()
+		n += len(s.kv)
+		s.mu.RUnlock()
+	}
+	return n
+}
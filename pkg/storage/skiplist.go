@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"math/rand"
+	"sync"
+)
+
+const (
+	skiplistMaxLevel = 24
+	skiplistP        = 0.25
+)
+
+type skiplistNode struct {
+	key   string
+	value string
+	next  []*skiplistNode
+}
+
+// SkiplistEngine keeps keys ordered so that range scans do not need to sort.
+type SkiplistEngine struct {
+	mu    sync.RWMutex
+	head  *skiplistNode
+	level int
+	size  int
+	rng   *rand.Rand
+}
+
+var _ Engine = &SkiplistEngine{}
+
+func NewSkiplistEngine() *SkiplistEngine {
+	return &SkiplistEngine{
+		head:  &skiplistNode{next: make([]*skiplistNode, skiplistMaxLevel)},
+		level: 1,
+		rng:   rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+func (e *SkiplistEngine) randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && e.rng.Float64() < skiplistP {
+		level++
+	}
+	return level
+}
+
+// findGE returns the first node with key >= key and fills prev with the
+// rightmost node before it on every level.
+func (e *SkiplistEngine) findGE(key string, prev []*skiplistNode) *skiplistNode {
+	x := e.head
+	for i := e.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		if prev != nil {
+			prev[i] = x
+		}
+	}
+	return x.next[0]
+}
+
+func (e *SkiplistEngine) Get(key string) (string, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if x := e.findGE(key, nil); x != nil && x.key == key {
+		return x.value, true
+	}
+	return "", false
+}
+
+func (e *SkiplistEngine) Put(key, value string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	prev := make([]*skiplistNode, skiplistMaxLevel)
+	if x := e.findGE(key, prev); x != nil && x.key == key {
+		x.value = value
+		return nil
+	}
+	level := e.randomLevel()
+	for i := e.level; i < level; i++ {
+		prev[i] = e.head
+	}
+	if level > e.level {
+		e.level = level
+	}
+	x := &skiplistNode{key: key, value: value, next: make([]*skiplistNode, level)}
+	for i := 0; i < level; i++ {
+		x.next[i] = prev[i].next[i]
+		prev[i].next[i] = x
+	}
+	e.size++
+	return nil
+}
+
+func (e *SkiplistEngine) Delete(key string) (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	prev := make([]*skiplistNode, skiplistMaxLevel)
+	x := e.findGE(key, prev)
+	if x == nil || x.key != key {
+		return false, nil
+	}
+	for i := 0; i < len(x.next); i++ {
+		prev[i].next[i] = x.next[i]
+	}
+	for e.level > 1 && e.head.next[e.level-1] == nil {
+		e.level--
+	}
+	e.size--
+	return true, nil
+}
+
+func (e *SkiplistEngine) Scan(start, end string, fn func(key, value string) bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for x := e.findGE(start, nil); x != nil && inRange(x.key, start, end); x = x.next[0] {
+		if !fn(x.key, x.value) {
+			return
+		}
+	}
+}
+
+func (e *SkiplistEngine) Size() int {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.size
+}
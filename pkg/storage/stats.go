@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tomquartz/pyxis-k8s/pkg/stats"
+	"github.com/tomquartz/pyxis-k8s/pkg/workload"
+)
+
+// StorageStats is the reply of the stats endpoint.
+type StorageStats struct {
+	*stats.Snapshot
+	Queues map[string]*ClassStats `json:"queues"`
+	// pushdown requests rejected by admission control since startup
+	Rejected int64 `json:"rejected"`
+}
+
+// ServeStats replies with the load of the server over the last window=<secs>.
+func (s *StorageServer) ServeStats(w http.ResponseWriter, r *http.Request) {
+	window, _ := strconv.ParseFloat(r.URL.Query().Get("window"), 64)
+	resp := &StorageStats{
+		Snapshot: s.stats.Snapshot(time.Duration(window * float64(time.Second))),
+		Queues:   s.sched.stats(),
+		Rejected: s.admission.Rejected(),
+	}
+	for _, c := range resp.Queues {
+		resp.QueueLength += c.Depth
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// requestType names the kind of a request in stats.
+func requestType(req interface{}) string {
+	switch req := req.(type) {
+	case *workload.StorageRequest:
+		if len(req.Keys) > 1 {
+			return "kv-batch"
+		}
+		return "kv-" + strings.ToLower(req.Op(0))
+	case *workload.ScanRequest:
+		return "scan"
+	case *workload.ClientRequest:
+		return req.TaskType()
+	default:
+		return "unknown"
+	}
+}
+
+func requestFailed(req interface{}) bool {
+	switch req := req.(type) {
+	case *workload.StorageRequest:
+		return req.Failed()
+	case *workload.ScanRequest:
+		return req.Failed()
+	case *workload.ClientRequest:
+		return req.Failed()
+	default:
+		return true
+	}
+}
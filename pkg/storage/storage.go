@@ -3,36 +3,220 @@ package storage
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"sync"
 	"time"
 
 	"github.com/go-logr/logr"
+	"github.com/tomquartz/pyxis-k8s/pkg/admission"
+	"github.com/tomquartz/pyxis-k8s/pkg/drain"
+	"github.com/tomquartz/pyxis-k8s/pkg/kernel"
+	"github.com/tomquartz/pyxis-k8s/pkg/shard"
+	"github.com/tomquartz/pyxis-k8s/pkg/stats"
+	"github.com/tomquartz/pyxis-k8s/pkg/wire"
 	"github.com/tomquartz/pyxis-k8s/pkg/workload"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
 const (
-	StorageServerChanSize        = 256
 	StorageKVEntryAlignSizeBytes = 64
 	KVAccessTimeSimulated        = 10 * time.Microsecond
 )
 
+type StorageConfig struct {
+	NumWorkers int
+	Engine     string
+	// only used by the sharded engine
+	NumShards int
+	// index the keys of the map and sharded engines so that scans walk them
+	// in order rather than sorting every scanned range, at the cost of a
+	// second copy of the keys updated on every write
+	ScanIndex bool
+	// nil for a volatile in-memory store
+	Durable *DurableConfig
+	// base URLs of all storage replicas in shard order, nil if this is the
+	// only one
+	ShardEndpoints []string
+	ShardID        int
+	// used to forward requests to other shards, nil for http.DefaultClient
+	Client *http.Client
+	// nil if the store is not replicated
+	Replication *ReplicationConfig
+	// nil for unbounded memory
+	Memory *MemoryConfig
+	// host names, IPs and CIDRs of the compute servers that may subscribe to
+	// invalidations, nil to only let them subscribe their own address
+	SubscriberHosts []string
+	// limits the queue of pushdown requests, nil for no limit
+	Admission *admission.Config
+	// nil for the default class weights and no reserved kv workers
+	Scheduler *SchedulerConfig
+	// nil to slice pushdown functions by the default quantum without a cpu cap
+	Pushdown *PushdownConfig
+	// nil for the default drain timeouts
+	Drain      *drain.Config
+	ListenAddr string
+	// address of the binary kv protocol, empty to serve http only
+	WireAddr string
+}
+
 type StorageServer struct {
 	logger     logr.Logger
-	workerChan chan interface{}
+	sched      *scheduler
 	nWorkers   int
-	mu         sync.Mutex
-	kv         map[string]string
+	reservedKV int
+	// pushdown functions yield to kv requests after every quantum
+	pushdownQuantum time.Duration
+	pushdownCPU     *cpuLimiter
+	engine          Engine
+	router          *shard.Router
+	shardID         int
+	replica         *Replica
+	durable         *DurableEngine
+	bounded         *BoundedEngine
+	locks           keyLocks
+	admission       *admission.Controller
+	stats           *stats.Recorder
+	tracker         drain.Tracker
+	drainCfg        *drain.Config
+	listenAddr      string
+	mux             *http.ServeMux
+	invalidator     *invalidator
+	wireAddr        string
+	wireLn          net.Listener
 }
 
-func NewStorageServer(nWorkers int) *StorageServer {
-	return &StorageServer{
-		workerChan: make(chan interface{}, StorageServerChanSize),
-		nWorkers:   nWorkers,
-		kv:         make(map[string]string),
+func NewStorageServer(cfg *StorageConfig) (*StorageServer, error) {
+	s := &StorageServer{
+		nWorkers:   cfg.NumWorkers,
+		shardID:    cfg.ShardID,
+		admission:  admission.NewController(cfg.Admission),
+		stats:      stats.NewRecorder(cfg.NumWorkers),
+		drainCfg:   cfg.Drain,
+		listenAddr: cfg.ListenAddr,
+		mux:        http.NewServeMux(),
+		wireAddr:   cfg.WireAddr,
+	}
+	if len(cfg.ShardEndpoints) > 1 {
+		if cfg.ShardID < 0 || cfg.ShardID >= len(cfg.ShardEndpoints) {
+			return nil, fmt.Errorf("shard id %d must be within [0, %d)", cfg.ShardID, len(cfg.ShardEndpoints))
+		}
+		s.router = shard.NewRouter(shard.NewMap(cfg.ShardEndpoints, shard.DefaultVirtualNodes), cfg.Client)
+	}
+	schedCfg := cfg.Scheduler
+	if schedCfg == nil {
+		schedCfg = &SchedulerConfig{KVWeight: DefaultKVWeight, PushdownWeight: DefaultPushdownWeight}
+	}
+	if err := validateSchedulerConfig(schedCfg, cfg.NumWorkers); err != nil {
+		return nil, err
+	}
+	s.sched = newScheduler(schedCfg)
+	s.reservedKV = schedCfg.ReservedKVWorkers
+	pushdownCfg := cfg.Pushdown
+	if pushdownCfg == nil {
+		pushdownCfg = &PushdownConfig{QuantumSecs: DefaultPushdownQuantum.Seconds()}
+	}
+	if err := validatePushdownConfig(pushdownCfg); err != nil {
+		return nil, err
+	}
+	s.pushdownQuantum = time.Duration(pushdownCfg.QuantumSecs * float64(time.Second))
+	s.pushdownCPU = newCPULimiter(pushdownCfg.CPUCap, cfg.NumWorkers, s.pushdownQuantum)
+	engine, err := NewEngine(cfg.Engine, cfg.NumShards)
+	if err != nil {
+		return nil, err
+	}
+	if _, ordered := engine.(*SkiplistEngine); !ordered && cfg.ScanIndex {
+		engine = NewIndexedEngine(engine)
 	}
+	if cfg.Durable != nil {
+		if s.durable, err = NewDurableEngine(engine, cfg.Durable); err != nil {
+			return nil, fmt.Errorf("failed to recover from %s: %v", cfg.Durable.Dir, err)
+		}
+		engine = s.durable
+	}
+	memCfg := cfg.Memory
+	if memCfg == nil {
+		memCfg = &MemoryConfig{}
+	}
+	if s.bounded, err = NewBoundedEngine(engine, memCfg); err != nil {
+		return nil, err
+	}
+	s.engine = s.bounded
+	if s.invalidator, err = newInvalidator(cfg.Client, cfg.SubscriberHosts); err != nil {
+		return nil, err
+	}
+	s.bounded.OnChange(s.invalidator.changed)
+	if cfg.Replication != nil {
+		if err := validateReplicationConfig(cfg.Replication); err != nil {
+			return nil, err
+		}
+		s.replica = NewReplica(cfg.Replication, s.engine)
+		s.replica.locks = &s.locks
+	}
+	if s.listenAddr == "" {
+		s.listenAddr = workload.StorageListenPort
+	}
+	s.mux.HandleFunc(workload.StorageKVPath, s.tracker.Wrap(s.ServeKV))
+	s.mux.HandleFunc(workload.StorageScanPath, s.tracker.Wrap(s.ServeScan))
+	s.mux.HandleFunc(workload.StoragePushdownPath, s.tracker.Wrap(s.ServePushdown))
+	s.mux.HandleFunc(workload.StorageMemoryUsageMetricPath, s.ServeMemoryUsageQuery)
+	s.mux.HandleFunc(workload.StorageQueueStatsPath, s.ServeQueueStats)
+	s.mux.HandleFunc(workload.StatsPath, s.ServeStats)
+	s.mux.HandleFunc(workload.ReadyPath, s.tracker.ServeReady)
+	s.mux.HandleFunc(workload.StorageSubscribePath, s.ServeSubscribe)
+	if s.replica != nil {
+		s.mux.HandleFunc(workload.StorageReplicatePath, s.replica.ServeReplicate)
+		s.mux.HandleFunc(workload.StorageReplicationJoinPath, s.replica.ServeJoin)
+		s.mux.HandleFunc(workload.StorageReplicationStatusPath, s.replica.ServeStatus)
+		s.mux.HandleFunc(workload.StoragePromotePath, s.replica.ServePromote)
+	}
+	// before serving, so that load does not skew the kernels
+	kernel.Calibrate()
+	return s, nil
+}
+
+// ListenWire opens the listener of the binary protocol ahead of Run, so that
+// the caller learns its address when listening on an ephemeral port.
+func (s *StorageServer) ListenWire() (net.Addr, error) {
+	if s.wireLn == nil {
+		ln, err := net.Listen("tcp", s.wireAddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s: %v", s.wireAddr, err)
+		}
+		s.wireLn = ln
+	}
+	return s.wireLn.Addr(), nil
+}
+
+// serveWire serves kv requests of the binary protocol like ServeKV.
+func (s *StorageServer) serveWire(req *workload.StorageRequest, forwarded bool) (*workload.StorageResponse, int, error) {
+	if !s.tracker.Enter() {
+		return nil, http.StatusServiceUnavailable, fmt.Errorf("server is shutting down")
+	}
+	defer s.tracker.Leave()
+	return s.doKV(req, forwarded)
+}
+
+// Handler serves the endpoints of the storage server.
+func (s *StorageServer) Handler() http.Handler {
+	return s.mux
+}
+
+func (s *StorageServer) checkServe(write bool) error {
+	if s.replica == nil {
+		return nil
+	}
+	return s.replica.CheckServe(write)
+}
+
+func (s *StorageServer) owner(key string) int {
+	if s.router == nil {
+		return s.shardID
+	}
+	return s.router.Shards().Owner(key)
 }
 
 func (s *StorageServer) ServeKV(w http.ResponseWriter, r *http.Request) {
@@ -43,103 +227,325 @@ func (s *StorageServer) ServeKV(w http.ResponseWriter, r *http.Request) {
 		kvReq.Error(fmt.Errorf("failed to decode request: %v", err), http.StatusBadRequest)
 		return
 	}
+	forwarded := r.Header.Get(workload.StorageForwardedHeader) != ""
+	kvResp, code, err := s.doKV(kvReq, forwarded)
+	if err != nil {
+		kvReq.Error(err, code)
+		return
+	}
+	if err := kvReq.Reply(kvResp); err != nil {
+		s.logger.Error(err, "server failed to reply", "request", kvReq.ID)
+	}
+}
+
+// doKV runs a kv request and returns the status code of its error. Keys owned
+// by other replicas are forwarded to them unless this request was already
+// forwarded.
+func (s *StorageServer) doKV(kvReq *workload.StorageRequest, forwarded bool) (*workload.StorageResponse, int, error) {
+	if err := kvReq.Validate(); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if err := kvReq.Deadline.Check(); err != nil {
+		return nil, workload.DeadlineExceededCode, err
+	}
+	if err := s.checkServe(kvReq.HasWrites()); err != nil {
+		return nil, http.StatusServiceUnavailable, err
+	}
+	if kvReq.Atomic {
+		return s.doBatch(kvReq, forwarded)
+	}
+	local := make([]int, 0, len(kvReq.Keys))
+	remote := make(map[int][]int)
+	for i, key := range kvReq.Keys {
+		if owner := s.owner(key); forwarded || owner == s.shardID {
+			local = append(local, i)
+		} else {
+			remote[owner] = append(remote[owner], i)
+		}
+	}
 	workerResps := make([]*workload.StorageResponse, len(kvReq.Keys))
 	wg := sync.WaitGroup{}
-	wg.Add(len(kvReq.Keys))
-	for i := range kvReq.Keys {
+	wg.Add(len(local) + len(remote))
+	for _, i := range local {
 		go func(i int) {
 			defer wg.Done()
-			req := &workload.StorageRequest{ID: fmt.Sprintf("%s-%d", kvReq.ID, i), Keys: []string{kvReq.Keys[i]}}
-			if len(kvReq.Values) > i {
-				req.Values = []string{kvReq.Values[i]}
-			}
+			req := kvReq.Subset(fmt.Sprintf("%s-%d", kvReq.ID, i), []int{i})
 			req.SetResponseWriter(nil)
-			s.workerChan <- req
+			s.sched.push(req)
 			workerResps[i] = <-req.Done()
 		}(i)
 	}
+	for owner, idxs := range remote {
+		go func(owner int, idxs []int) {
+			defer wg.Done()
+			s.forwardKV(kvReq, owner, idxs, workerResps)
+		}(owner, idxs)
+	}
 	wg.Wait()
 	kvResp := &workload.StorageResponse{ID: kvReq.ID}
 	for _, r := range workerResps {
 		if r.Error != nil {
-			kvReq.Error(r.Error, http.StatusInternalServerError)
-			break
+			return nil, kvErrorCode(r.Error), r.Error
 		}
-		kvResp.Keys = append(kvResp.Keys, r.Keys...)
-		kvResp.Values = append(kvResp.Values, r.Values...)
+		kvResp.Append(r)
 	}
-	if err := kvReq.Reply(kvResp); err != nil {
-		s.logger.Error(err, "server failed to reply", "request", kvReq.ID)
+	return kvResp, http.StatusOK, nil
+}
+
+func kvErrorCode(err error) int {
+	if errors.Is(err, errInvalidOp) {
+		return http.StatusBadRequest
+	}
+	if errors.Is(err, workload.ErrDeadlineExceeded) {
+		return workload.DeadlineExceededCode
+	}
+	return http.StatusInternalServerError
+}
+
+// doBatch runs an atomic batch on a single worker of the owning shard.
+func (s *StorageServer) doBatch(kvReq *workload.StorageRequest, forwarded bool) (*workload.StorageResponse, int, error) {
+	owner := s.shardID
+	if !forwarded && len(kvReq.Keys) > 0 {
+		owner = s.owner(kvReq.Keys[0])
+		for _, key := range kvReq.Keys[1:] {
+			if s.owner(key) != owner {
+				return nil, http.StatusBadRequest, fmt.Errorf("atomic batch spans multiple shards")
+			}
+		}
+	}
+	var resp *workload.StorageResponse
+	if owner == s.shardID {
+		req := *kvReq
+		req.ResponseWriter = nil
+		req.SetResponseWriter(nil)
+		s.sched.push(&req)
+		resp = <-req.Done()
+	} else {
+		var err error
+		if resp, err = s.router.Send(owner, kvReq, true); err != nil {
+			resp = &workload.StorageResponse{Error: err}
+		}
+	}
+	if resp.Error != nil {
+		return nil, kvErrorCode(resp.Error), resp.Error
+	}
+	return resp, http.StatusOK, nil
+}
+
+// forwardKV sends the keys at idxs to their owner and fills in the per-key responses.
+func (s *StorageServer) forwardKV(kvReq *workload.StorageRequest, owner int, idxs []int, workerResps []*workload.StorageResponse) {
+	req := kvReq.Subset(fmt.Sprintf("%s-s%d", kvReq.ID, owner), idxs)
+	resp, err := s.router.Send(owner, req, true)
+	if err == nil && resp.Len() != len(idxs) {
+		err = fmt.Errorf("shard %d returned %d entries for %d keys", owner, resp.Len(), len(idxs))
+	}
+	for j, i := range idxs {
+		if err != nil {
+			workerResps[i] = &workload.StorageResponse{ID: req.ID, Error: err}
+		} else {
+			workerResps[i] = resp.Entry(j)
+		}
 	}
 }
 
 func (s *StorageServer) ServePushdown(w http.ResponseWriter, r *http.Request) {
 	req := &workload.ClientRequest{}
 	err := json.NewDecoder(r.Body).Decode(req)
-	req = req.SetResponseWriter(w)
+	req = req.SetResponseWriter(w).SetContext(r.Context())
 	if err != nil {
 		req.Error(fmt.Errorf("server failed to decode request: %v", err), http.StatusBadRequest)
 		return
 	}
-	s.workerChan <- req
-	<-req.Done()
+	if err := req.Prepare(); err != nil {
+		req.Error(err, workload.FunctionErrorCode(err))
+		return
+	}
+	if err := req.Check(); err != nil {
+		req.Error(err, workload.FunctionErrorCode(err))
+		return
+	}
+	if err := s.checkServe(false); err != nil {
+		req.Error(err, http.StatusServiceUnavailable)
+		return
+	}
+	s.admission.Submit(req, func(<-chan time.Time) bool {
+		s.sched.push(req)
+		return true
+	})
 }
 
+// ServeQueueStats replies with the queue depth, wait and service times of
+// every request class.
+func (s *StorageServer) ServeQueueStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.sched.stats())
+}
+
+// ServeMemoryUsageQuery replies with the aligned memory usage in bytes. With
+// format=json it replies with the full stats, optionally broken down by
+// namespace (group=namespace) and restricted to keys with a prefix (prefix=).
 func (s *StorageServer) ServeMemoryUsageQuery(w http.ResponseWriter, r *http.Request) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	roundUpMemoryUsage := func(u int) int {
-		return (u + StorageKVEntryAlignSizeBytes - 1) / StorageKVEntryAlignSizeBytes * StorageKVEntryAlignSizeBytes
+	query := r.URL.Query()
+	prefix, hasPrefix := query.Get("prefix"), query.Has("prefix")
+	byNamespace := query.Get("group") == "namespace"
+	stats := s.bounded.Stats()
+	if hasPrefix {
+		stats.Groups = s.bounded.PrefixUsage(prefix, byNamespace)
+	} else if byNamespace {
+		stats.Groups = s.bounded.NamespaceUsage()
 	}
-	total := 0
-	for k, v := range s.kv {
-		total += roundUpMemoryUsage(len(k))
-		total += roundUpMemoryUsage(len(v))
+	if query.Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+		return
+	}
+	total := stats.UsedBytes
+	if hasPrefix {
+		total = 0
+		for _, usage := range stats.Groups {
+			total += usage.Bytes
+		}
 	}
 	fmt.Fprintf(w, "%d\n", total)
 }
 
 func (s *StorageServer) Run(ctx context.Context) {
+	ln, err := net.Listen("tcp", s.listenAddr)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Failed to listen", "addr", s.listenAddr)
+		return
+	}
+	s.RunListener(ctx, ln)
+}
+
+// RunListener runs the server on ln until ctx is done and the server drained.
+func (s *StorageServer) RunListener(ctx context.Context, ln net.Listener) {
 	logger := log.FromContext(ctx)
 	s.logger = logger
+	s.invalidator.logger = logger
+	if s.wireAddr != "" {
+		if _, err := s.ListenWire(); err != nil {
+			logger.Error(err, "Failed to listen for the binary protocol")
+			ln.Close()
+			return
+		}
+	}
+	workers := sync.WaitGroup{}
 	for i := 0; i < s.nWorkers; i++ {
 		w := NewStorageWorker(i, s)
-		go w.Run(ctx)
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			w.Run(ctx)
+		}()
+	}
+	// background loops keep running while the server drains
+	bgCtx, cancelBg := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelBg()
+
+	if s.durable != nil {
+		go s.durable.Run(bgCtx)
+		defer s.durable.Close()
+	}
+	go s.bounded.Run(bgCtx)
+
+	if s.replica != nil {
+		go s.replica.Run(bgCtx)
 	}
-	defer close(s.workerChan)
 
-	logger.Info("Starting storage server", "nWorkers", s.nWorkers)
-	http.HandleFunc(workload.StorageKVPath, s.ServeKV)
-	http.HandleFunc(workload.StoragePushdownPath, s.ServePushdown)
-	http.HandleFunc(workload.StorageMemoryUsageMetricPath, s.ServeMemoryUsageQuery)
-	if err := http.ListenAndServe(workload.StorageListenPort, nil); err != http.ErrServerClosed {
+	logger.Info("Starting storage server", "nWorkers", s.nWorkers, "reservedKV", s.reservedKV, "keys", s.engine.Size(), "shard", s.shardID, "addr", ln.Addr())
+	var wireSrv *wire.Server
+	if s.wireLn != nil {
+		logger.Info("Serving binary kv protocol", "addr", s.wireLn.Addr())
+		wireSrv = wire.NewServer(s.serveWire, logger)
+		go func() {
+			if err := wireSrv.Serve(s.wireLn); err != nil && !errors.Is(err, net.ErrClosed) {
+				logger.Error(err, "Failed to serve binary kv protocol")
+			}
+		}()
+	}
+	srv := &http.Server{Handler: s.mux}
+	if err := s.tracker.Serve(ctx, logger, srv, ln, s.drainCfg); err != nil && err != http.ErrServerClosed {
 		logger.Error(err, "Failed to run storage server")
-	} else {
-		logger.Info("Storage server stopped")
 	}
+	if wireSrv != nil {
+		wireSrv.Close()
+	}
+	s.sched.close()
+	workers.Wait()
+	s.invalidator.close()
+	logger.Info("Storage server stopped")
 }
 
 type StorageWorker struct {
 	id     int
-	input  chan interface{}
+	kvOnly bool
 	server *StorageServer
+	// time spent on kv requests while yielding from the current request
+	yielded time.Duration
 }
 
+// The first workers are reserved for kv requests.
 func NewStorageWorker(id int, server *StorageServer) *StorageWorker {
-	return &StorageWorker{id: id, input: server.workerChan, server: server}
+	return &StorageWorker{id: id, kvOnly: id < server.reservedKV, server: server}
 }
 
 func (w *StorageWorker) Run(ctx context.Context) {
 	logger := log.FromContext(ctx).WithValues("id", w.id)
-	for req := range w.input {
-		w.HandleRequest(logger, req)
+	for {
+		q := w.server.sched.pop(w.kvOnly)
+		if q == nil {
+			return
+		}
+		if req, ok := q.req.(*workload.ClientRequest); ok && !w.server.admission.Start(req) {
+			logger.V(1).Info("skipping rejected request", "request", req.ID)
+			w.server.sched.done(q, 0)
+			continue
+		}
+		if dropExpired(q.req) {
+			logger.V(1).Info("dropping expired or canceled request", "type", requestType(q.req))
+			w.server.sched.done(q, 0)
+			continue
+		}
+		w.server.stats.Begin()
+		start := time.Now()
+		w.yielded = 0
+		w.HandleRequest(logger, q.req)
+		serviceTime := time.Since(start) - w.yielded
+		w.server.sched.done(q, serviceTime)
+		w.server.stats.Done(requestType(q.req), serviceTime, requestFailed(q.req))
+	}
+}
+
+// dropExpired fails req if its deadline passed while it was queued, or the
+// caller of a pushdown request went away.
+func dropExpired(req interface{}) bool {
+	switch req := req.(type) {
+	case *workload.StorageRequest:
+		if !req.Deadline.Expired() {
+			return false
+		}
+		req.Error(fmt.Errorf("dequeued request: %w", workload.ErrDeadlineExceeded), workload.DeadlineExceededCode)
+		req.Close()
+	case *workload.ClientRequest:
+		err := req.Check()
+		if err == nil {
+			return false
+		}
+		req.Error(fmt.Errorf("dequeued request: %w", err), workload.FunctionErrorCode(err))
+		req.Close()
+	default:
+		return false
 	}
+	return true
 }
 
 func (w *StorageWorker) HandleRequest(logger logr.Logger, req interface{}) {
 	switch req := req.(type) {
 	case *workload.StorageRequest:
 		w.HandleKV(logger, req)
+	case *workload.ScanRequest:
+		w.HandleScan(logger, req)
 	case *workload.ClientRequest:
 		w.HandlePushdown(logger, req)
 	default:
@@ -149,22 +555,25 @@ func (w *StorageWorker) HandleRequest(logger logr.Logger, req interface{}) {
 
 func (w *StorageWorker) HandleKV(logger logr.Logger, req *workload.StorageRequest) {
 	defer req.Close()
-	if len(req.Keys) != 1 {
+	if len(req.Keys) != 1 && !req.Atomic {
 		panic("internal error: multiple keys sent to worker")
 	}
-	logger.V(1).Info("worker processing kv request", "id", req.ID, "key", req.Keys[0])
+	logger.V(1).Info("worker processing kv request", "id", req.ID, "keys", len(req.Keys), "op", req.Op(0))
+	unlock := w.server.locks.lock(req.Keys, req.HasWrites())
+	results, err := w.applyBatch(req)
+	unlock()
+	if err != nil {
+		req.Error(fmt.Errorf("failed to apply kv request: %w", err), http.StatusInternalServerError)
+		return
+	}
 	resp := &workload.StorageResponse{ID: req.ID}
-	time.Sleep(KVAccessTimeSimulated)
-	if len(req.Values) > 0 {
-		w.put(req.Keys[0], req.Values[0])
-	} else {
-		key := req.Keys[0]
-		value, ok := w.get(key)
-		if !ok {
-			value = "N/A"
-		}
-		resp.Keys = []string{key}
-		resp.Values = []string{value}
+	for i, res := range results {
+		resp.Append(&workload.StorageResponse{
+			Keys:    []string{req.Keys[i]},
+			Values:  []string{res.value},
+			Found:   []bool{res.found},
+			Applied: []bool{res.applied},
+		})
 	}
 	if err := req.Reply(resp); err != nil {
 		logger.Error(err, "worker failed to reply", "request", req.ID)
@@ -177,79 +586,158 @@ func (w *StorageWorker) HandlePushdown(logger logr.Logger, req *workload.ClientR
 		panic("missing response writer")
 	}
 	defer req.Close()
-	logger.V(1).Info("worker processing pushdown request", "request", req.ID)
-
-	if req.DefaultFuncRequest != nil {
-		w.HandleDefaultFunc(logger, req)
-	} else if req.PointerChasingFuncRequest != nil {
-		w.HandlePointerChasing(logger, req)
-	} else {
-		req.Error(fmt.Errorf("unknown request"), http.StatusBadRequest)
+	logger.V(1).Info("worker processing pushdown request", "request", req.ID, "function", req.Function)
+	resp, err := req.Invoke(&pushdownEnv{worker: w, logger: logger, req: req, lastYield: time.Now()})
+	if err != nil {
+		req.Error(err, workload.FunctionErrorCode(err))
+		return
 	}
+	if err := req.Reply(resp); err != nil {
+		logger.Error(err, "worker failed to reply", "request", req.ID)
+	}
+	logger.V(1).Info("worker finished pushdown request", "request", req.ID)
 }
 
-func (w *StorageWorker) HandleDefaultFunc(logger logr.Logger, req *workload.ClientRequest) {
-	// kv accesses
-	kvStartTime := time.Now()
-	for range req.StorageKeys {
-		time.Sleep(KVAccessTimeSimulated)
-	}
-	kvTime := time.Since(kvStartTime)
+func (w *StorageWorker) get(key string) (string, bool) {
+	return w.server.engine.Get(key)
+}
 
-	// compute
-	computeStartTime := time.Now()
-	time.Sleep(time.Duration(req.ComputeSecs * float64(time.Second)))
-	computeTime := time.Since(computeStartTime)
+// pushdownEnv runs functions next to the data. Keys owned by other replicas
+// are fetched from them, and compute yields to kv requests between slices.
+type pushdownEnv struct {
+	worker *StorageWorker
+	logger logr.Logger
+	// checked before every kv access
+	req       *workload.ClientRequest
+	lastYield time.Time
+}
 
-	// reply
-	resp := &workload.ClientResponse{
-		ID:              req.ID,
-		StorageTimeSecs: kvTime.Seconds(),
-		ComputeTimeSecs: computeTime.Seconds(),
+func (e *pushdownEnv) Get(keys []string) ([]string, []bool, error) {
+	if err := e.req.Check(); err != nil {
+		return nil, nil, err
 	}
-	if err := req.Reply(resp); err != nil {
-		logger.Error(err, "failed to reply", "request", req.ID)
+	defer e.excludeFromCPU(time.Now())
+	s := e.worker.server
+	values, found := make([]string, len(keys)), make([]bool, len(keys))
+	var local []int
+	var localKeys []string
+	remote := make(map[int][]int)
+	for i, key := range keys {
+		if owner := s.owner(key); owner == s.shardID {
+			local = append(local, i)
+			localKeys = append(localKeys, key)
+		} else {
+			remote[owner] = append(remote[owner], i)
+		}
 	}
-	logger.V(1).Info("worker finished pushdown default func", "request", req.ID)
-}
-
-func (w *StorageWorker) HandlePointerChasing(logger logr.Logger, req *workload.ClientRequest) {
-	// kv accesses
-	kvStartTime := time.Now()
-	key := req.PointerChasingFuncRequest.InitialKey
-	for i := 0; i < req.PointerChasingFuncRequest.NumHops; i++ {
-		logger.Info(fmt.Sprintf("Hop #%d: accessing %s", i, key))
+	// read the local keys under their kv locks so that atomic batches are
+	// seen entirely or not at all
+	unlock := s.locks.lock(localKeys, false)
+	for _, i := range local {
 		time.Sleep(KVAccessTimeSimulated)
-		if next, ok := w.get(key); ok {
-			key = next
-		} else {
-			break
+		values[i], found[i] = e.worker.get(keys[i])
+	}
+	unlock()
+	for owner, idxs := range remote {
+		kvReq := &workload.StorageRequest{ID: fmt.Sprintf("%s-s%d", e.req.ID, owner), Deadline: e.req.Deadline}
+		for _, i := range idxs {
+			kvReq.Keys = append(kvReq.Keys, keys[i])
+		}
+		resp, err := s.router.Send(owner, kvReq, true)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to fetch remote keys: %w", err)
+		}
+		if resp.Len() != len(idxs) {
+			return nil, nil, fmt.Errorf("shard %d returned %d entries for %d keys", owner, resp.Len(), len(idxs))
+		}
+		for j, i := range idxs {
+			values[i], found[i] = resp.Values[j], resp.Found[j]
 		}
 	}
-	kvTime := time.Since(kvStartTime)
-	logger.Info(fmt.Sprintf("Pointer chasing stopped at %s", key))
+	return values, found, nil
+}
 
-	// reply
-	resp := &workload.ClientResponse{
-		ID:              req.ID,
-		Result:          key,
-		StorageTimeSecs: kvTime.Seconds(),
+func (e *pushdownEnv) Put(keys, values []string) error {
+	if err := e.req.Check(); err != nil {
+		return err
 	}
-	if err := req.Reply(resp); err != nil {
-		logger.Error(err, "worker failed to reply", "request", req.ID)
+	defer e.excludeFromCPU(time.Now())
+	s := e.worker.server
+	if err := s.checkServe(true); err != nil {
+		return err
+	}
+	var localKeys []string
+	view := newBatchView(nil)
+	remote := make(map[int]*workload.StorageRequest)
+	for i, key := range keys {
+		owner := s.owner(key)
+		if owner != s.shardID {
+			kvReq, ok := remote[owner]
+			if !ok {
+				kvReq = &workload.StorageRequest{ID: fmt.Sprintf("%s-s%d", e.req.ID, owner), Deadline: e.req.Deadline}
+				remote[owner] = kvReq
+			}
+			kvReq.Keys = append(kvReq.Keys, key)
+			kvReq.Values = append(kvReq.Values, values[i])
+			continue
+		}
+		localKeys = append(localKeys, key)
+		view.set(mutation{Op: walOpPut, Key: key, Value: values[i]})
 	}
-	logger.V(1).Info("worker finished pushdown pointer chasing func", "request", req.ID)
+	if len(localKeys) > 0 {
+		// the local keys are put as one batch
+		unlock := s.locks.lock(localKeys, true)
+		err := e.worker.update(localKeys, func(func(string) (string, bool)) ([]mutation, error) {
+			time.Sleep(time.Duration(len(localKeys)) * KVAccessTimeSimulated)
+			return view.muts, nil
+		})
+		unlock()
+		if err != nil {
+			return fmt.Errorf("failed to put local keys: %v", err)
+		}
+	}
+	for owner, kvReq := range remote {
+		if _, err := s.router.Send(owner, kvReq, true); err != nil {
+			return fmt.Errorf("failed to put remote keys: %w", err)
+		}
+	}
+	return nil
 }
 
-func (w *StorageWorker) put(key, value string) {
-	w.server.mu.Lock()
-	defer w.server.mu.Unlock()
-	w.server.kv[key] = value
+func (e *pushdownEnv) Compute(name string, d time.Duration) {
+	e.worker.runSliced(e.logger, d, kernel.Work(name), e.req.Check)
 }
 
-func (w *StorageWorker) get(key string) (string, bool) {
-	w.server.mu.Lock()
-	defer w.server.mu.Unlock()
-	value, ok := w.server.kv[key]
-	return value, ok
+// Yield charges the time the function ran on the cpu since the last call to
+// the pushdown cpu cap, and serves waiting kv requests once per quantum like
+// runSliced.
+func (e *pushdownEnv) Yield() {
+	s := e.worker.server
+	ran := time.Since(e.lastYield)
+	if s.pushdownCPU == nil && (s.pushdownQuantum == 0 || ran < s.pushdownQuantum) {
+		return
+	}
+	for {
+		wait := s.pushdownCPU.take(ran)
+		if wait <= 0 {
+			break
+		}
+		if !e.worker.yield(e.logger) {
+			if s.pushdownQuantum > 0 {
+				wait = min(wait, s.pushdownQuantum)
+			}
+			time.Sleep(wait)
+			s.sched.throttled(wait)
+		}
+	}
+	if s.pushdownQuantum > 0 && ran >= s.pushdownQuantum {
+		e.worker.yield(e.logger)
+	}
+	e.lastYield = time.Now()
+}
+
+// excludeFromCPU leaves the time since start, spent on kv accesses, out of the cpu
+// time of the function.
+func (e *pushdownEnv) excludeFromCPU(start time.Time) {
+	e.lastYield = e.lastYield.Add(time.Since(start))
 }
@@ -0,0 +1,15 @@
+package storage
+
+import "testing"
+
+func TestShardIDOutOfRange(t *testing.T) {
+	endpoints := []string{"http://a", "http://b"}
+	for _, id := range []int{-1, 2} {
+		if _, err := NewStorageServer(&StorageConfig{NumWorkers: 1, Engine: EngineMap, ShardID: id, ShardEndpoints: endpoints}); err == nil {
+			t.Errorf("expected an error for shard id %d of %d shards", id, len(endpoints))
+		}
+	}
+	if _, err := NewStorageServer(&StorageConfig{NumWorkers: 1, Engine: EngineMap, ShardID: 1, ShardEndpoints: endpoints}); err != nil {
+		t.Error(err)
+	}
+}
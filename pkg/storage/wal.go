@@ -0,0 +1,437 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	walOpPut byte = iota + 1
+	walOpDelete
+	// only in the log, a put followed by the expiry of the key
+	walOpPutExpiring
+	// only in the log, a record of several entries applied all or none
+	walOpBatch
+)
+
+const (
+	walFilePrefix    = "wal-"
+	walFileSuffix    = ".log"
+	snapshotFileName = "snapshot"
+	walHeaderSize    = 8 // crc32 + payload length
+	// larger lengths in a header can only come from a torn or corrupt record
+	walMaxRecordSize = 64 << 20
+)
+
+var errWALCorrupted = errors.New("corrupted wal record")
+
+type DurableConfig struct {
+	Dir                  string
+	SnapshotIntervalSecs float64
+	CompactThreshold     int
+	Fsync                bool
+}
+
+// WAL is an append-only log of kv mutations split into numbered segments.
+// A snapshot with sequence number N covers every segment before wal-N.
+type WAL struct {
+	mu      sync.Mutex
+	cfg     *DurableConfig
+	seq     uint64
+	file    *os.File
+	writer  *bufio.Writer
+	entries int
+}
+
+// OpenWAL replays the latest snapshot and all later log segments into kv and
+// the expiry of the recovered keys into expiry, then opens the newest segment
+// for appending. A nil expiry drops the expiry of the keys.
+func OpenWAL(cfg *DurableConfig, kv Engine, expiry map[string]time.Time) (*WAL, error) {
+	if expiry == nil {
+		expiry = make(map[string]time.Time)
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create data dir: %v", err)
+	}
+	snapSeq, err := loadSnapshot(filepath.Join(cfg.Dir, snapshotFileName), kv, expiry)
+	if err != nil {
+		return nil, err
+	}
+	segments, err := listSegments(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	w := &WAL{cfg: cfg, seq: snapSeq}
+	for _, seq := range segments {
+		if seq < snapSeq {
+			continue
+		}
+		n, err := replaySegment(w.segmentPath(seq), kv, expiry)
+		if err != nil {
+			return nil, err
+		}
+		w.seq = seq
+		w.entries = n
+	}
+	if err := w.openSegment(w.seq); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *WAL) segmentPath(seq uint64) string {
+	return filepath.Join(w.cfg.Dir, fmt.Sprintf("%s%020d%s", walFilePrefix, seq, walFileSuffix))
+}
+
+func (w *WAL) openSegment(seq uint64) error {
+	f, err := os.OpenFile(w.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open wal segment: %v", err)
+	}
+	w.seq = seq
+	w.file = f
+	w.writer = bufio.NewWriter(f)
+	return nil
+}
+
+// Append logs entries as one record, so that recovery replays all of them or
+// none.
+func (w *WAL) Append(entries ...walEntry) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := writeRecord(w.writer, entries...); err != nil {
+		return err
+	}
+	if err := w.writer.Flush(); err != nil {
+		return err
+	}
+	if w.cfg.Fsync {
+		if err := w.file.Sync(); err != nil {
+			return err
+		}
+	}
+	w.entries++
+	return nil
+}
+
+// Entries returns the number of records in the active segment.
+func (w *WAL) Entries() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.entries
+}
+
+// Rotate seals the active segment and starts a new one. The returned
+// sequence number is the one a snapshot of the current state should carry.
+func (w *WAL) Rotate() (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.closeSegment(); err != nil {
+		return 0, err
+	}
+	w.entries = 0
+	if err := w.openSegment(w.seq + 1); err != nil {
+		return 0, err
+	}
+	return w.seq, nil
+}
+
+// Compact writes kv with the expiry of its keys as the snapshot for seq and
+// removes the segments it covers.
+func (w *WAL) Compact(kv map[string]string, expiry map[string]time.Time, seq uint64) error {
+	path := filepath.Join(w.cfg.Dir, snapshotFileName)
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %v", err)
+	}
+	bw := bufio.NewWriter(f)
+	err = binary.Write(bw, binary.LittleEndian, seq)
+	for k, v := range kv {
+		if err != nil {
+			break
+		}
+		e := walEntry{op: walOpPut, key: k, value: v}
+		if deadline, ok := expiry[k]; ok {
+			e.expiry = deadline.UnixNano()
+		}
+		err = writeRecord(bw, e)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write snapshot: %v", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to install snapshot: %v", err)
+	}
+	segments, err := listSegments(w.cfg.Dir)
+	if err != nil {
+		return err
+	}
+	for _, s := range segments {
+		if s < seq {
+			os.Remove(w.segmentPath(s))
+		}
+	}
+	return nil
+}
+
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.closeSegment()
+}
+
+func (w *WAL) closeSegment() error {
+	if w.file == nil {
+		return nil
+	}
+	if err := w.writer.Flush(); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+func listSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list data dir: %v", err)
+	}
+	var segments []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, walFilePrefix) || !strings.HasSuffix(name, walFileSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, walFilePrefix), walFileSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, seq)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+func loadSnapshot(path string, kv Engine, expiry map[string]time.Time) (uint64, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to open snapshot: %v", err)
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	var seq uint64
+	if err := binary.Read(br, binary.LittleEndian, &seq); err != nil {
+		return 0, fmt.Errorf("failed to read snapshot header: %v", err)
+	}
+	for {
+		entries, _, err := readRecord(br)
+		if err == io.EOF {
+			return seq, nil
+		} else if err != nil {
+			return 0, fmt.Errorf("failed to read snapshot: %v", err)
+		}
+		for _, e := range entries {
+			if err := replayEntry(kv, expiry, e); err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+// replaySegment applies all intact records of a segment to kv. A torn record
+// at the tail is the result of a crash mid-append and is truncated away, along
+// with all entries of a torn batch.
+func replaySegment(path string, kv Engine, expiry map[string]time.Time) (int, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open wal segment: %v", err)
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	n := 0
+	offset := int64(0)
+	for {
+		entries, size, err := readRecord(br)
+		if err == io.EOF {
+			return n, nil
+		} else if err == io.ErrUnexpectedEOF || err == errWALCorrupted {
+			return n, f.Truncate(offset)
+		} else if err != nil {
+			return n, fmt.Errorf("failed to replay wal segment: %v", err)
+		}
+		for _, e := range entries {
+			if err := replayEntry(kv, expiry, e); err != nil {
+				return n, err
+			}
+		}
+		offset += int64(size)
+		n++
+	}
+}
+
+// walEntry is a mutation of one key. Puts with an expiry carry it as unix
+// nanoseconds.
+type walEntry struct {
+	op     byte
+	key    string
+	value  string
+	expiry int64
+}
+
+func appendEntry(payload []byte, e walEntry) []byte {
+	op := e.op
+	if op == walOpPut && e.expiry != 0 {
+		op = walOpPutExpiring
+	}
+	payload = append(payload, op)
+	payload = binary.AppendUvarint(payload, uint64(len(e.key)))
+	payload = append(payload, e.key...)
+	payload = binary.AppendUvarint(payload, uint64(len(e.value)))
+	payload = append(payload, e.value...)
+	if op == walOpPutExpiring {
+		payload = binary.AppendVarint(payload, e.expiry)
+	}
+	return payload
+}
+
+func writeRecord(w io.Writer, entries ...walEntry) error {
+	var payload []byte
+	if len(entries) == 1 {
+		payload = appendEntry(payload, entries[0])
+	} else {
+		payload = append(payload, walOpBatch)
+		payload = binary.AppendUvarint(payload, uint64(len(entries)))
+		for _, e := range entries {
+			payload = appendEntry(payload, e)
+		}
+	}
+	if len(payload) > walMaxRecordSize {
+		return fmt.Errorf("wal record of %d bytes exceeds the limit of %d bytes", len(payload), walMaxRecordSize)
+	}
+	var header [walHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[0:4], crc32.ChecksumIEEE(payload))
+	binary.LittleEndian.PutUint32(header[4:8], uint32(len(payload)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// readRecord returns the entries of the next record and the size of the record.
+func readRecord(r io.Reader) ([]walEntry, int, error) {
+	var header [walHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, 0, err
+	}
+	size := binary.LittleEndian.Uint32(header[4:8])
+	if size > walMaxRecordSize {
+		return nil, 0, errWALCorrupted
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err == io.EOF {
+		return nil, 0, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[0:4]) || len(payload) == 0 {
+		return nil, 0, errWALCorrupted
+	}
+	n, rest := uint64(1), payload
+	if payload[0] == walOpBatch {
+		var sz int
+		if n, sz = binary.Uvarint(payload[1:]); sz <= 0 || n > uint64(len(payload)) {
+			return nil, 0, errWALCorrupted
+		}
+		rest = payload[1+sz:]
+	}
+	entries := make([]walEntry, n)
+	for i := range entries {
+		var ok bool
+		if entries[i], rest, ok = readEntry(rest); !ok {
+			return nil, 0, errWALCorrupted
+		}
+	}
+	if len(rest) > 0 {
+		return nil, 0, errWALCorrupted
+	}
+	return entries, walHeaderSize + len(payload), nil
+}
+
+func readEntry(b []byte) (walEntry, []byte, bool) {
+	if len(b) == 0 {
+		return walEntry{}, nil, false
+	}
+	e := walEntry{op: b[0]}
+	if e.op != walOpPut && e.op != walOpDelete && e.op != walOpPutExpiring {
+		return walEntry{}, nil, false
+	}
+	var ok bool
+	if e.key, b, ok = readUvarintString(b[1:]); !ok {
+		return walEntry{}, nil, false
+	}
+	if e.value, b, ok = readUvarintString(b); !ok {
+		return walEntry{}, nil, false
+	}
+	if e.op == walOpPutExpiring {
+		expiry, n := binary.Varint(b)
+		if n <= 0 {
+			return walEntry{}, nil, false
+		}
+		e.op, e.expiry, b = walOpPut, expiry, b[n:]
+	}
+	return e, b, true
+}
+
+// replayEntry applies e to kv and tracks the expiry of its key in expiry.
+func replayEntry(kv Engine, expiry map[string]time.Time, e walEntry) error {
+	switch e.op {
+	case walOpPut:
+		delete(expiry, e.key)
+		if e.expiry != 0 {
+			expiry[e.key] = time.Unix(0, e.expiry)
+		}
+		return kv.Put(e.key, e.value)
+	case walOpDelete:
+		delete(expiry, e.key)
+		_, err := kv.Delete(e.key)
+		return err
+	}
+	return errWALCorrupted
+}
+
+func readUvarintString(b []byte) (string, []byte, bool) {
+	n, sz := binary.Uvarint(b)
+	if sz <= 0 || uint64(len(b)-sz) < n {
+		return "", nil, false
+	}
+	return string(b[sz : sz+int(n)]), b[sz+int(n):], true
+}
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWALTruncatesOversizedRecord(t *testing.T) {
+	cfg := &DurableConfig{Dir: t.TempDir()}
+	wal, err := OpenWAL(cfg, NewMapEngine(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b"} {
+		if err := wal.Append(walEntry{op: walOpPut, key: k, value: "v"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := wal.segmentPath(wal.seq)
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a torn header claiming a 4 GiB record
+	var header [walHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[4:8], 1<<32-1)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(header[:])
+	f.Close()
+
+	kv := NewMapEngine()
+	wal, err = OpenWAL(cfg, kv, nil)
+	if err != nil {
+		t.Fatalf("failed to recover: %v", err)
+	}
+	defer wal.Close()
+	if kv.Size() != 2 {
+		t.Errorf("recovered %d keys, expected 2", kv.Size())
+	}
+	if after, _ := os.Stat(path); after.Size() != info.Size() {
+		t.Errorf("segment is %d bytes after recovery, expected the torn tail truncated to %d", after.Size(), info.Size())
+	}
+}
+
+func TestWALRejectsOversizedAppend(t *testing.T) {
+	wal, err := OpenWAL(&DurableConfig{Dir: t.TempDir()}, NewMapEngine(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	if err := wal.Append(walEntry{op: walOpPut, key: "k", value: string(make([]byte, walMaxRecordSize))}); err == nil {
+		t.Error("expected an error for a record over the size limit")
+	}
+}
+
+func TestWALReplaysBatchAllOrNone(t *testing.T) {
+	cfg := &DurableConfig{Dir: t.TempDir()}
+	wal, err := OpenWAL(cfg, NewMapEngine(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Append(walEntry{op: walOpPut, key: "a", value: "v"}); err != nil {
+		t.Fatal(err)
+	}
+	path := wal.segmentPath(wal.seq)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := []walEntry{
+		{op: walOpPut, key: "b", value: "v"},
+		{op: walOpDelete, key: "a"},
+		{op: walOpPut, key: "c", value: "v", expiry: 1},
+	}
+	if err := wal.Append(batch...); err != nil {
+		t.Fatal(err)
+	}
+	wal.Close()
+
+	kv, expiry := NewMapEngine(), make(map[string]time.Time)
+	wal, err = OpenWAL(cfg, kv, expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.Close()
+	if _, ok := kv.Get("a"); ok || kv.Size() != 2 || len(expiry) != 1 {
+		t.Errorf("replayed %d keys with %d expiring, expected the whole batch applied", kv.Size(), len(expiry))
+	}
+
+	// a crash in the middle of appending the batch
+	full, _ := os.Stat(path)
+	if err := os.Truncate(path, full.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+	kv = NewMapEngine()
+	wal, err = OpenWAL(cfg, kv, nil)
+	if err != nil {
+		t.Fatalf("failed to recover: %v", err)
+	}
+	defer wal.Close()
+	if _, ok := kv.Get("a"); !ok || kv.Size() != 1 {
+		t.Errorf("replayed %d keys of a torn batch, expected only the record before it", kv.Size())
+	}
+	if after, _ := os.Stat(path); after.Size() != info.Size() {
+		t.Errorf("segment is %d bytes after recovery, expected the torn batch truncated to %d", after.Size(), info.Size())
+	}
+}
@@ -0,0 +1,112 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tomquartz/pyxis-k8s/pkg/workload"
+)
+
+func benchRequest(nKeys int) (*workload.StorageRequest, *workload.StorageResponse) {
+	req := &workload.StorageRequest{ID: "bench"}
+	resp := &workload.StorageResponse{ID: "bench"}
+	for i := 0; i < nKeys; i++ {
+		key := fmt.Sprintf("user:%08d", i)
+		req.Keys = append(req.Keys, key)
+		resp.Keys = append(resp.Keys, key)
+		resp.Values = append(resp.Values, strings.Repeat("v", 64))
+		resp.Found = append(resp.Found, true)
+	}
+	return req, resp
+}
+
+// BenchmarkCodec encodes and decodes a multi-get and its response as json and
+// in the binary protocol.
+func BenchmarkCodec(b *testing.B) {
+	for _, nKeys := range []int{1, 16} {
+		req, resp := benchRequest(nKeys)
+		b.Run(fmt.Sprintf("json/keys=%d", nKeys), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				reqJson, _ := json.Marshal(req)
+				if err := json.Unmarshal(reqJson, &workload.StorageRequest{}); err != nil {
+					b.Fatal(err)
+				}
+				respJson, _ := json.Marshal(resp)
+				if err := json.Unmarshal(respJson, &workload.StorageResponse{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("wire/keys=%d", nKeys), func(b *testing.B) {
+			b.ReportAllocs()
+			var buf []byte
+			for i := 0; i < b.N; i++ {
+				buf = AppendRequest(buf[:0], req, false)
+				if _, _, err := DecodeRequest(buf); err != nil {
+					b.Fatal(err)
+				}
+				buf = AppendResponse(buf[:0], resp, http.StatusOK, nil)
+				if _, err := DecodeResponse(buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkRoundTrip sends a multi-get over loopback, as json over http and in
+// the binary protocol, from parallel callers.
+func BenchmarkRoundTrip(b *testing.B) {
+	req, resp := benchRequest(16)
+	b.Run("json", func(b *testing.B) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := json.NewDecoder(r.Body).Decode(&workload.StorageRequest{}); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(resp)
+		}))
+		defer srv.Close()
+		client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 64}}
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				reqJson, _ := json.Marshal(req)
+				httpResp, err := client.Post(srv.URL, "application/json", bytes.NewReader(reqJson))
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				err = json.NewDecoder(httpResp.Body).Decode(&workload.StorageResponse{})
+				httpResp.Body.Close()
+				if err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+	b.Run("wire", func(b *testing.B) {
+		addr := startServer(b)
+		client := NewClient(0, 0)
+		defer client.Close()
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if _, err := client.Do(addr, req, false); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
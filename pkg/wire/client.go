@@ -0,0 +1,243 @@
+package wire
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tomquartz/pyxis-k8s/pkg/workload"
+)
+
+const (
+	DefaultConnsPerAddr = 2
+	DefaultTimeout      = 10 * time.Second
+	dialTimeout         = 2 * time.Second
+)
+
+var errConnClosed = errors.New("wire connection closed")
+
+// Client sends kv requests over a few persistent connections per storage
+// replica. Requests are pipelined on a connection and their responses matched
+// by tag, so concurrent callers do not wait for each other.
+type Client struct {
+	connsPerAddr int
+	timeout      time.Duration
+	mu           sync.Mutex
+	pools        map[string]*pool
+	closed       bool
+	tag          uint64
+}
+
+type pool struct {
+	mu    sync.Mutex
+	conns []*conn
+	next  int
+}
+
+// connsPerAddr and timeout may be 0 for the defaults.
+func NewClient(connsPerAddr int, timeout time.Duration) *Client {
+	if connsPerAddr <= 0 {
+		connsPerAddr = DefaultConnsPerAddr
+	}
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &Client{
+		connsPerAddr: connsPerAddr,
+		timeout:      timeout,
+		pools:        make(map[string]*pool),
+	}
+}
+
+// Do sends req to the replica listening on addr. Failures of the connection
+// are returned as is and failed requests as a StatusError. Do gives up at the
+// deadline of req if it is sooner than the timeout of the client.
+func (c *Client) Do(addr string, req *workload.StorageRequest, forwarded bool) (*workload.StorageResponse, error) {
+	timeout, expires := c.timeout, false
+	if remaining, ok := req.Deadline.Remaining(); ok && remaining < timeout {
+		if remaining <= 0 {
+			return nil, workload.ErrDeadlineExceeded
+		}
+		timeout, expires = remaining, true
+	}
+	cn, err := c.conn(addr)
+	if err != nil {
+		return nil, err
+	}
+	tag := atomic.AddUint64(&c.tag, 1)
+	results := cn.register(tag)
+	if results == nil {
+		return nil, cn.broken()
+	}
+	// a short deadline must not fail the write, which breaks the connection
+	if err := cn.send(tag, AppendRequest(nil, req, forwarded), c.timeout); err != nil {
+		cn.unregister(tag)
+		return nil, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case res := <-results:
+		if res.err != nil {
+			return nil, res.err
+		}
+		return DecodeResponse(res.payload)
+	case <-timer.C:
+		cn.unregister(tag)
+		if expires {
+			return nil, fmt.Errorf("kv req to %s: %w", addr, workload.ErrDeadlineExceeded)
+		}
+		return nil, fmt.Errorf("kv req to %s timed out after %v", addr, timeout)
+	}
+}
+
+// conn picks the connections of addr in turn and redials broken ones.
+func (c *Client) conn(addr string) (*conn, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, errConnClosed
+	}
+	p, ok := c.pools[addr]
+	if !ok {
+		p = &pool{conns: make([]*conn, c.connsPerAddr)}
+		c.pools[addr] = p
+	}
+	c.mu.Unlock()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	i := p.next
+	p.next = (p.next + 1) % len(p.conns)
+	if cn := p.conns[i]; cn != nil && cn.broken() == nil {
+		return cn, nil
+	}
+	nc, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s: %v", addr, err)
+	}
+	cn := newConn(nc)
+	p.conns[i] = cn
+	return cn, nil
+}
+
+// Close closes every connection and fails the requests waiting on them.
+func (c *Client) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, p := range c.pools {
+		p.mu.Lock()
+		for _, cn := range p.conns {
+			if cn != nil {
+				cn.fail(errConnClosed)
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+type result struct {
+	payload []byte
+	err     error
+}
+
+type conn struct {
+	nc  net.Conn
+	wmu sync.Mutex
+	w   *bufio.Writer
+	// guards pending and err
+	mu      sync.Mutex
+	pending map[uint64]chan result
+	err     error
+}
+
+func newConn(nc net.Conn) *conn {
+	cn := &conn{
+		nc:      nc,
+		w:       bufio.NewWriter(nc),
+		pending: make(map[uint64]chan result),
+	}
+	go cn.readLoop()
+	return cn
+}
+
+func (cn *conn) broken() error {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	return cn.err
+}
+
+// register returns nil if the connection is broken.
+func (cn *conn) register(tag uint64) chan result {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	if cn.err != nil {
+		return nil
+	}
+	results := make(chan result, 1)
+	cn.pending[tag] = results
+	return results
+}
+
+func (cn *conn) unregister(tag uint64) {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	delete(cn.pending, tag)
+}
+
+func (cn *conn) send(tag uint64, payload []byte, timeout time.Duration) error {
+	cn.wmu.Lock()
+	defer cn.wmu.Unlock()
+	cn.nc.SetWriteDeadline(time.Now().Add(timeout))
+	if err := writeFrame(cn.w, tag, frameRequest, payload); err != nil {
+		// nothing was written for an oversized frame
+		if !errors.Is(err, errFrameTooLarge) {
+			cn.fail(fmt.Errorf("failed to send kv req: %v", err))
+		}
+		return err
+	}
+	return nil
+}
+
+func (cn *conn) readLoop() {
+	r := bufio.NewReader(cn.nc)
+	for {
+		tag, kind, payload, err := readFrame(r)
+		if err != nil && !errors.Is(err, errFrameTooLarge) {
+			cn.fail(fmt.Errorf("failed to read kv resp: %v", err))
+			return
+		}
+		if kind != frameResponse {
+			cn.fail(fmt.Errorf("unexpected frame kind %d", kind))
+			return
+		}
+		cn.mu.Lock()
+		results, ok := cn.pending[tag]
+		delete(cn.pending, tag)
+		cn.mu.Unlock()
+		// the caller may have timed out
+		if ok {
+			results <- result{payload: payload, err: err}
+		}
+	}
+}
+
+// fail closes the connection and fails every request waiting on it.
+func (cn *conn) fail(err error) {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	if cn.err != nil {
+		return
+	}
+	cn.err = err
+	cn.nc.Close()
+	for tag, results := range cn.pending {
+		results <- result{err: err}
+		delete(cn.pending, tag)
+	}
+}
@@ -0,0 +1,320 @@
+package wire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+
+	"github.com/tomquartz/pyxis-k8s/pkg/workload"
+)
+
+// A frame is the length of the rest of the frame as a big-endian uint32,
+// followed by the tag matching a response to its request as a uint64, the
+// frame kind and the payload. Strings are prefixed with their uvarint length
+// and lists with their uvarint count.
+const (
+	MaxFrameSize = 64 << 20
+	lengthSize   = 4
+	headerSize   = 8 + 1
+)
+
+const (
+	frameRequest byte = iota + 1
+	frameResponse
+)
+
+const (
+	flagForwarded byte = 1 << iota
+	flagAtomic
+	// the request ends with its deadline as a big-endian uint64
+	flagDeadline
+)
+
+// errFrameTooLarge fails the request or response of a single frame, which is
+// skipped without breaking the connection.
+var errFrameTooLarge = errors.New("frame exceeds the size limit")
+
+func writeFrame(w *bufio.Writer, tag uint64, kind byte, payload []byte) error {
+	if headerSize+len(payload) > MaxFrameSize {
+		return fmt.Errorf("%w: %d bytes over %d", errFrameTooLarge, headerSize+len(payload), MaxFrameSize)
+	}
+	var header [lengthSize + headerSize]byte
+	binary.BigEndian.PutUint32(header[:], uint32(headerSize+len(payload)))
+	binary.BigEndian.PutUint64(header[lengthSize:], tag)
+	header[lengthSize+8] = kind
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// readFrame returns errFrameTooLarge along with the tag and kind of a frame
+// over the limit, whose payload it discards.
+func readFrame(r *bufio.Reader) (tag uint64, kind byte, payload []byte, err error) {
+	var length [lengthSize]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return 0, 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n < headerSize {
+		return 0, 0, nil, fmt.Errorf("invalid frame length %d", n)
+	}
+	if n > MaxFrameSize {
+		var header [headerSize]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return 0, 0, nil, err
+		}
+		if _, err := r.Discard(int(n - headerSize)); err != nil {
+			return 0, 0, nil, err
+		}
+		return binary.BigEndian.Uint64(header[:]), header[8], nil, fmt.Errorf("%w: %d bytes over %d", errFrameTooLarge, n, MaxFrameSize)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return 0, 0, nil, err
+	}
+	return binary.BigEndian.Uint64(frame), frame[8], frame[headerSize:], nil
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendStrings(b []byte, ss []string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(ss)))
+	for _, s := range ss {
+		b = appendString(b, s)
+	}
+	return b
+}
+
+func appendBools(b []byte, bs []bool) []byte {
+	b = binary.AppendUvarint(b, uint64(len(bs)))
+	for _, v := range bs {
+		if v {
+			b = append(b, 1)
+		} else {
+			b = append(b, 0)
+		}
+	}
+	return b
+}
+
+func appendFloats(b []byte, fs []float64) []byte {
+	b = binary.AppendUvarint(b, uint64(len(fs)))
+	for _, f := range fs {
+		b = binary.BigEndian.AppendUint64(b, math.Float64bits(f))
+	}
+	return b
+}
+
+// decoder reads the fields of a payload and keeps the first error.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) fail(what string) {
+	if d.err == nil {
+		d.err = fmt.Errorf("truncated %s", what)
+	}
+	d.b = nil
+}
+
+func (d *decoder) byte() byte {
+	if len(d.b) < 1 {
+		d.fail("byte")
+		return 0
+	}
+	v := d.b[0]
+	d.b = d.b[1:]
+	return v
+}
+
+func (d *decoder) uint64() uint64 {
+	if len(d.b) < 8 {
+		d.fail("uint64")
+		return 0
+	}
+	v := binary.BigEndian.Uint64(d.b)
+	d.b = d.b[8:]
+	return v
+}
+
+func (d *decoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.fail("uvarint")
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+// count reads a list length, which cannot exceed the bytes left as every
+// element takes at least one.
+func (d *decoder) count() int {
+	n := d.uvarint()
+	if n > uint64(len(d.b)) {
+		d.fail("list")
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) string() string {
+	n := d.count()
+	s := string(d.b[:n])
+	d.b = d.b[n:]
+	return s
+}
+
+func (d *decoder) strings() []string {
+	n := d.count()
+	if n == 0 {
+		return nil
+	}
+	ss := make([]string, n)
+	for i := range ss {
+		ss[i] = d.string()
+	}
+	return ss
+}
+
+func (d *decoder) bools() []bool {
+	n := d.count()
+	if n == 0 {
+		return nil
+	}
+	bs := make([]bool, n)
+	for i := range bs {
+		bs[i] = d.byte() != 0
+	}
+	return bs
+}
+
+func (d *decoder) floats() []float64 {
+	n := d.count()
+	if n == 0 {
+		return nil
+	}
+	if len(d.b) < 8*n {
+		d.fail("float list")
+		return nil
+	}
+	fs := make([]float64, n)
+	for i := range fs {
+		fs[i] = math.Float64frombits(binary.BigEndian.Uint64(d.b[8*i:]))
+	}
+	d.b = d.b[8*n:]
+	return fs
+}
+
+func AppendRequest(b []byte, req *workload.StorageRequest, forwarded bool) []byte {
+	var flags byte
+	if forwarded {
+		flags |= flagForwarded
+	}
+	if req.Atomic {
+		flags |= flagAtomic
+	}
+	start := len(b)
+	b = append(b, flags)
+	b = appendString(b, req.ID)
+	b = appendStrings(b, req.Keys)
+	b = appendStrings(b, req.Values)
+	b = appendStrings(b, req.Ops)
+	b = appendStrings(b, req.Expected)
+	b = appendFloats(b, req.TTLSecs)
+	if req.Deadline != 0 {
+		b[start] |= flagDeadline
+		b = binary.BigEndian.AppendUint64(b, uint64(req.Deadline))
+	}
+	return b
+}
+
+func DecodeRequest(payload []byte) (*workload.StorageRequest, bool, error) {
+	d := &decoder{b: payload}
+	flags := d.byte()
+	req := &workload.StorageRequest{
+		ID:       d.string(),
+		Keys:     d.strings(),
+		Values:   d.strings(),
+		Ops:      d.strings(),
+		Expected: d.strings(),
+		TTLSecs:  d.floats(),
+		Atomic:   flags&flagAtomic != 0,
+	}
+	if flags&flagDeadline != 0 {
+		req.Deadline = workload.Deadline(d.uint64())
+	}
+	if d.err != nil {
+		return nil, false, fmt.Errorf("failed to decode request: %v", d.err)
+	}
+	return req, flags&flagForwarded != 0, nil
+}
+
+// AppendResponse encodes resp, or the error with its http status code.
+func AppendResponse(b []byte, resp *workload.StorageResponse, code int, err error) []byte {
+	if err != nil {
+		b = binary.AppendUvarint(b, uint64(code))
+		return appendString(b, err.Error())
+	}
+	b = binary.AppendUvarint(b, http.StatusOK)
+	b = appendString(b, resp.ID)
+	b = appendStrings(b, resp.Keys)
+	b = appendStrings(b, resp.Values)
+	b = appendBools(b, resp.Found)
+	return appendBools(b, resp.Applied)
+}
+
+// DecodeResponse returns a StatusError for failed requests.
+func DecodeResponse(payload []byte) (*workload.StorageResponse, error) {
+	d := &decoder{b: payload}
+	code := int(d.uvarint())
+	if code != http.StatusOK {
+		msg := d.string()
+		if d.err != nil {
+			return nil, fmt.Errorf("failed to decode response: %v", d.err)
+		}
+		return nil, &StatusError{Code: code, Msg: msg}
+	}
+	resp := &workload.StorageResponse{
+		ID:      d.string(),
+		Keys:    d.strings(),
+		Values:  d.strings(),
+		Found:   d.bools(),
+		Applied: d.bools(),
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("failed to decode response: %v", d.err)
+	}
+	return resp, nil
+}
+
+// StatusError is a request the storage server failed with the http status
+// code it would have replied with.
+type StatusError struct {
+	Code int
+	Msg  string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("req failed with status %d: %s", e.Code, e.Msg)
+}
+
+// Unwrap lets errors.Is tell expired requests.
+func (e *StatusError) Unwrap() error {
+	if e.Code == workload.DeadlineExceededCode {
+		return workload.ErrDeadlineExceeded
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package wire
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tomquartz/pyxis-k8s/pkg/workload"
+)
+
+func TestRequestRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		req       *workload.StorageRequest
+		forwarded bool
+	}{
+		{"get", &workload.StorageRequest{ID: "1", Keys: []string{"a"}}, false},
+		{"empty", &workload.StorageRequest{}, false},
+		{
+			"all fields",
+			&workload.StorageRequest{
+				ID:       "2",
+				Keys:     []string{"a", "b", "c"},
+				Values:   []string{"x", "", strings.Repeat("y", 300)},
+				Ops:      []string{workload.OpPut, workload.OpCAS, workload.OpIncr},
+				Expected: []string{"", "old", ""},
+				TTLSecs:  []float64{0, 1.5, 60},
+				Atomic:   true,
+				Deadline: workload.DeadlineAt(time.Now().Add(time.Second)),
+			},
+			true,
+		},
+	} {
+		req, forwarded, err := DecodeRequest(AppendRequest(nil, tc.req, tc.forwarded))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(req, tc.req) || forwarded != tc.forwarded {
+			t.Errorf("%s: decoded %+v (forwarded %v), expected %+v (forwarded %v)", tc.name, req, forwarded, tc.req, tc.forwarded)
+		}
+	}
+}
+
+func TestResponseRoundTrip(t *testing.T) {
+	want := &workload.StorageResponse{
+		ID:      "1",
+		Keys:    []string{"a", "b"},
+		Values:  []string{"x", ""},
+		Found:   []bool{true, false},
+		Applied: []bool{false, true},
+	}
+	resp, err := DecodeResponse(AppendResponse(nil, want, http.StatusOK, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(resp, want) {
+		t.Errorf("decoded %+v, expected %+v", resp, want)
+	}
+
+	_, err = DecodeResponse(AppendResponse(nil, nil, workload.DeadlineExceededCode, errors.New("late")))
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.Code != workload.DeadlineExceededCode || statusErr.Msg != "late" {
+		t.Errorf("decoded error %v, expected a status error", err)
+	}
+	if !errors.Is(err, workload.ErrDeadlineExceeded) {
+		t.Errorf("decoded error %v does not match the expired deadline", err)
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	req := AppendRequest(nil, &workload.StorageRequest{ID: "1", Keys: []string{"a", "b"}, Values: []string{"x", "y"}}, false)
+	resp := AppendResponse(nil, &workload.StorageResponse{ID: "1", Keys: []string{"a"}, Values: []string{"x"}, Found: []bool{true}}, http.StatusOK, nil)
+	for n := 0; n < len(req); n++ {
+		if _, _, err := DecodeRequest(req[:n]); err == nil {
+			t.Errorf("decoded a request truncated to %d of %d bytes", n, len(req))
+		}
+	}
+	for n := 0; n < len(resp); n++ {
+		if _, err := DecodeResponse(resp[:n]); err == nil {
+			t.Errorf("decoded a response truncated to %d of %d bytes", n, len(resp))
+		}
+	}
+	// a list longer than the payload must not allocate for it
+	if _, _, err := DecodeRequest([]byte{0, 0, 0xff, 0xff, 0xff, 0xff, 0x0f}); err == nil {
+		t.Error("decoded a request with a bogus list length")
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if err := writeFrame(w, 7, frameRequest, []byte("payload")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFrame(w, 8, frameResponse, nil); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(&buf)
+	for _, want := range []struct {
+		tag     uint64
+		kind    byte
+		payload string
+	}{{7, frameRequest, "payload"}, {8, frameResponse, ""}} {
+		tag, kind, payload, err := readFrame(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tag != want.tag || kind != want.kind || string(payload) != want.payload {
+			t.Errorf("read frame %d/%d %q, expected %d/%d %q", tag, kind, payload, want.tag, want.kind, want.payload)
+		}
+	}
+}
+
+func TestOversizedFrameIsSkipped(t *testing.T) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if err := writeFrame(w, 1, frameRequest, make([]byte, MaxFrameSize)); !errors.Is(err, errFrameTooLarge) {
+		t.Errorf("wrote an oversized frame: %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("wrote %d bytes of an oversized frame", buf.Len())
+	}
+	// an oversized frame from a peer without the limit, followed by a valid one
+	raw := binary.BigEndian.AppendUint32(nil, MaxFrameSize+headerSize+1)
+	raw = append(raw, 0, 0, 0, 0, 0, 0, 0, 3, frameRequest)
+	raw = append(raw, make([]byte, MaxFrameSize+1)...)
+	buf.Write(raw)
+	writeFrame(w, 4, frameRequest, []byte("next"))
+
+	r := bufio.NewReader(&buf)
+	tag, kind, _, err := readFrame(r)
+	if !errors.Is(err, errFrameTooLarge) || tag != 3 || kind != frameRequest {
+		t.Errorf("read oversized frame %d/%d: %v, expected its tag with errFrameTooLarge", tag, kind, err)
+	}
+	tag, _, payload, err := readFrame(r)
+	if err != nil || tag != 4 || string(payload) != "next" {
+		t.Errorf("read frame %d %q after the oversized one: %v", tag, payload, err)
+	}
+}
@@ -0,0 +1,140 @@
+package wire
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/go-logr/logr"
+	"github.com/tomquartz/pyxis-k8s/pkg/workload"
+)
+
+// Handler serves a decoded kv request and returns the http status code of its
+// error.
+type Handler func(req *workload.StorageRequest, forwarded bool) (*workload.StorageResponse, int, error)
+
+// Server serves kv requests over the binary protocol. Requests on the same
+// connection are handled concurrently and answered in completion order.
+type Server struct {
+	handler Handler
+	logger  logr.Logger
+	mu      sync.Mutex
+	ln      net.Listener
+	conns   map[net.Conn]struct{}
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+func NewServer(handler Handler, logger logr.Logger) *Server {
+	return &Server{
+		handler: handler,
+		logger:  logger,
+		conns:   make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve accepts connections on ln until Close.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return net.ErrClosed
+	}
+	s.ln = ln
+	s.mu.Unlock()
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed || errors.Is(err, net.ErrClosed) {
+				return net.ErrClosed
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			nc.Close()
+			return net.ErrClosed
+		}
+		s.conns[nc] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serveConn(nc)
+	}
+}
+
+func (s *Server) serveConn(nc net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, nc)
+		s.mu.Unlock()
+		nc.Close()
+	}()
+	r := bufio.NewReader(nc)
+	w := bufio.NewWriter(nc)
+	wmu := sync.Mutex{}
+	handlers := sync.WaitGroup{}
+	defer handlers.Wait()
+	for {
+		tag, kind, payload, readErr := readFrame(r)
+		if readErr != nil && !errors.Is(readErr, errFrameTooLarge) {
+			return
+		}
+		if kind != frameRequest {
+			s.logger.Error(nil, "Unexpected wire frame", "kind", kind, "remote", nc.RemoteAddr())
+			return
+		}
+		handlers.Add(1)
+		go func() {
+			defer handlers.Done()
+			var out []byte
+			if readErr != nil {
+				out = AppendResponse(nil, nil, http.StatusRequestEntityTooLarge, readErr)
+			} else if req, forwarded, err := DecodeRequest(payload); err != nil {
+				out = AppendResponse(nil, nil, http.StatusBadRequest, err)
+			} else {
+				resp, code, err := s.handler(req, forwarded)
+				out = AppendResponse(nil, resp, code, err)
+			}
+			wmu.Lock()
+			defer wmu.Unlock()
+			err := writeFrame(w, tag, frameResponse, out)
+			if errors.Is(err, errFrameTooLarge) {
+				// fail only this request
+				out = AppendResponse(nil, nil, http.StatusInternalServerError, err)
+				err = writeFrame(w, tag, frameResponse, out)
+			}
+			if err != nil {
+				// the read loop notices the broken connection
+				nc.Close()
+			}
+		}()
+	}
+}
+
+// Close stops accepting connections and closes the open ones once their
+// running requests are answered.
+func (s *Server) Close() {
+	s.mu.Lock()
+	s.closed = true
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	for nc := range s.conns {
+		// unblocks the read loops, handlers still write their responses
+		if tc, ok := nc.(*net.TCPConn); ok {
+			tc.CloseRead()
+		} else {
+			nc.Close()
+		}
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
@@ -0,0 +1,118 @@
+package wire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/tomquartz/pyxis-k8s/pkg/workload"
+)
+
+// startServer serves requests by echoing their keys and values, and replies
+// with a value over the frame limit for the key "huge".
+func startServer(t testing.TB) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(func(req *workload.StorageRequest, forwarded bool) (*workload.StorageResponse, int, error) {
+		resp := &workload.StorageResponse{ID: req.ID, Keys: req.Keys, Values: req.Values}
+		if len(req.Keys) > 0 && req.Keys[0] == "huge" {
+			resp.Values = []string{strings.Repeat("x", MaxFrameSize)}
+		}
+		return resp, http.StatusOK, nil
+	}, logr.Discard())
+	go srv.Serve(ln)
+	t.Cleanup(srv.Close)
+	return ln.Addr().String()
+}
+
+func TestClientServerRoundTrip(t *testing.T) {
+	addr := startServer(t)
+	client := NewClient(1, 0)
+	defer client.Close()
+	req := &workload.StorageRequest{ID: "1", Keys: []string{"a", "b"}, Values: []string{"x", "y"}}
+	resp, err := client.Do(addr, req, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID != "1" || len(resp.Values) != 2 || resp.Values[1] != "y" {
+		t.Errorf("got %+v, expected the request echoed", resp)
+	}
+}
+
+// An oversized request or response fails only itself, and the connection
+// keeps serving the others.
+func TestOversizedFramesKeepConnection(t *testing.T) {
+	addr := startServer(t)
+	client := NewClient(1, 0)
+	defer client.Close()
+	ok := func() {
+		t.Helper()
+		if _, err := client.Do(addr, &workload.StorageRequest{ID: "ok", Keys: []string{"a"}}, false); err != nil {
+			t.Fatalf("request after an oversized frame failed: %v", err)
+		}
+	}
+	ok()
+	cn := client.pools[addr].conns[0]
+
+	_, err := client.Do(addr, &workload.StorageRequest{ID: "big", Keys: []string{"a"}, Values: []string{strings.Repeat("x", MaxFrameSize)}}, false)
+	if !errors.Is(err, errFrameTooLarge) {
+		t.Errorf("sent an oversized request: %v", err)
+	}
+	ok()
+
+	_, err = client.Do(addr, &workload.StorageRequest{ID: "huge", Keys: []string{"huge"}}, false)
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.Code != http.StatusInternalServerError {
+		t.Errorf("got %v for an oversized response, expected a status error", err)
+	}
+	ok()
+	if client.pools[addr].conns[0] != cn {
+		t.Error("the connection was redialed after an oversized frame")
+	}
+}
+
+func TestServerSkipsOversizedRequest(t *testing.T) {
+	addr := startServer(t)
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	w := bufio.NewWriter(nc)
+	// a frame over the limit from a client that does not check it
+	frame := binary.BigEndian.AppendUint32(nil, MaxFrameSize+headerSize)
+	frame = binary.BigEndian.AppendUint64(frame, 1)
+	frame = append(frame, frameRequest)
+	w.Write(frame)
+	w.Write(make([]byte, MaxFrameSize))
+	if err := writeFrame(w, 2, frameRequest, AppendRequest(nil, &workload.StorageRequest{ID: "2", Keys: []string{"a"}}, false)); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(nc)
+	codes := make(map[uint64]int)
+	for i := 0; i < 2; i++ {
+		tag, _, payload, err := readFrame(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		codes[tag] = http.StatusOK
+		if _, err := DecodeResponse(payload); err != nil {
+			var statusErr *StatusError
+			if !errors.As(err, &statusErr) {
+				t.Fatal(err)
+			}
+			codes[tag] = statusErr.Code
+		}
+	}
+	if codes[1] != http.StatusRequestEntityTooLarge || codes[2] != http.StatusOK {
+		t.Errorf("got status codes %v, expected 413 for the oversized request and 200 for the next", codes)
+	}
+}
@@ -0,0 +1,55 @@
+package workload
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// ErrDeadlineExceeded is returned for requests whose deadline passed before
+// they were served. Servers reply with DeadlineExceededCode.
+var ErrDeadlineExceeded = errors.New("deadline exceeded")
+
+const DeadlineExceededCode = http.StatusGatewayTimeout
+
+// ErrCanceled is returned for requests whose caller went away, such as the
+// losing attempt of a hedged request.
+var ErrCanceled = errors.New("request canceled")
+
+// Deadline is the unix time in nanoseconds by which a request must be served,
+// 0 for none. It is absolute, so that it holds across hops without adding up
+// the time spent in queues.
+type Deadline int64
+
+func DeadlineAt(t time.Time) Deadline {
+	return Deadline(t.UnixNano())
+}
+
+func (d Deadline) Time() (time.Time, bool) {
+	if d == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(d)), true
+}
+
+// Remaining returns the time left until d, or false if there is no deadline.
+func (d Deadline) Remaining() (time.Duration, bool) {
+	t, ok := d.Time()
+	if !ok {
+		return 0, false
+	}
+	return time.Until(t), true
+}
+
+func (d Deadline) Expired() bool {
+	remaining, ok := d.Remaining()
+	return ok && remaining <= 0
+}
+
+// Check returns ErrDeadlineExceeded once d has passed.
+func (d Deadline) Check() error {
+	if d.Expired() {
+		return ErrDeadlineExceeded
+	}
+	return nil
+}
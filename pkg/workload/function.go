@@ -0,0 +1,161 @@
+package workload
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUnknownFunction = errors.New("unknown function")
+	ErrInvalidArgs     = errors.New("invalid function arguments")
+	// the function itself failed, e.g. a script ran out of fuel
+	ErrFunctionFailed = errors.New("function failed")
+)
+
+// KV reads and writes keys for a function. Compute servers access them on
+// storage and storage servers locally where they own them.
+type KV interface {
+	Get(keys []string) (values []string, found []bool, err error)
+	Put(keys, values []string) error
+}
+
+// Env is what a function runs against on either server.
+type Env interface {
+	KV
+	// Compute runs the named cpu kernel of pkg/kernel for d, or sleeps for d
+	// if kernel is empty. Storage servers slice it to yield to kv requests.
+	Compute(kernel string, d time.Duration)
+	// Yield is called periodically by functions that run on the cpu
+	// themselves, so that storage servers can serve kv requests meanwhile.
+	Yield()
+}
+
+// Args are the decoded arguments of a function call. Their json fields are
+// the argument schema of the function. Arguments with a ReadOnly() bool method
+// that returns true mark calls that do not write, which the gateway may send
+// more than once.
+type Args interface {
+	// Keys returns the keys the function reads first. Pushdown goes to the
+	// storage replica owning them.
+	Keys() []string
+}
+
+// Function is a registered function that runs the same code on compute and on
+// storage.
+type Function struct {
+	Name    string
+	newArgs func() Args
+	run     func(env Env, args Args) (string, error)
+}
+
+// registered from init functions only, so lookups need no lock
+var functions = make(map[string]*Function)
+
+// Register adds a function whose json arguments decode into A. Arguments with
+// a Validate() error method are validated after decoding. Register panics if
+// the name is taken and must be called from init.
+func Register[A any, PA interface {
+	*A
+	Args
+}](name string, run func(env Env, args PA) (string, error)) {
+	if _, ok := functions[name]; ok {
+		panic(fmt.Sprintf("function %s registered twice", name))
+	}
+	functions[name] = &Function{
+		Name:    name,
+		newArgs: func() Args { return PA(new(A)) },
+		run: func(env Env, args Args) (string, error) {
+			return run(env, args.(PA))
+		},
+	}
+}
+
+// Functions returns the names of the registered functions in order.
+func Functions() []string {
+	names := make([]string, 0, len(functions))
+	for name := range functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func LookupFunction(name string) (*Function, error) {
+	fn, ok := functions[name]
+	if !ok {
+		return nil, fmt.Errorf("%w %q, registered functions: %s", ErrUnknownFunction, name, strings.Join(Functions(), ", "))
+	}
+	return fn, nil
+}
+
+// Decode rejects unknown argument fields.
+func (f *Function) Decode(raw json.RawMessage) (Args, error) {
+	args := f.newArgs()
+	if len(raw) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(args); err != nil {
+			return nil, fmt.Errorf("%w of %s: %v", ErrInvalidArgs, f.Name, err)
+		}
+	}
+	if v, ok := args.(interface{ Validate() error }); ok {
+		if err := v.Validate(); err != nil {
+			return nil, fmt.Errorf("%w of %s: %v", ErrInvalidArgs, f.Name, err)
+		}
+	}
+	return args, nil
+}
+
+// FunctionErrorCode returns the http status code of a failed function call.
+func FunctionErrorCode(err error) int {
+	if errors.Is(err, ErrUnknownFunction) || errors.Is(err, ErrInvalidArgs) {
+		return http.StatusBadRequest
+	}
+	if errors.Is(err, ErrFunctionFailed) {
+		return http.StatusUnprocessableEntity
+	}
+	if errors.Is(err, ErrDeadlineExceeded) {
+		return DeadlineExceededCode
+	}
+	if errors.Is(err, ErrCanceled) {
+		// nobody reads the reply
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// meteredEnv measures the time of a call spent on kv accesses and yielded to
+// other requests. The rest is compute.
+type meteredEnv struct {
+	env       Env
+	kvTime    time.Duration
+	yieldTime time.Duration
+}
+
+func (m *meteredEnv) Get(keys []string) ([]string, []bool, error) {
+	start := time.Now()
+	defer func() { m.kvTime += time.Since(start) }()
+	return m.env.Get(keys)
+}
+
+func (m *meteredEnv) Put(keys, values []string) error {
+	start := time.Now()
+	defer func() { m.kvTime += time.Since(start) }()
+	return m.env.Put(keys, values)
+}
+
+func (m *meteredEnv) Compute(kernel string, d time.Duration) {
+	m.env.Compute(kernel, d)
+}
+
+func (m *meteredEnv) Yield() {
+	start := time.Now()
+	defer func() { m.yieldTime += time.Since(start) }()
+	m.env.Yield()
+}
@@ -0,0 +1,184 @@
+package workload
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/tomquartz/pyxis-k8s/pkg/kernel"
+	"github.com/tomquartz/pyxis-k8s/pkg/script"
+)
+
+// built-in functions
+const (
+	FuncDefault        = "default"
+	FuncPointerChasing = "pointer-chasing"
+	FuncScript         = "script"
+)
+
+func init() {
+	Register(FuncDefault, runDefaultFunc)
+	Register(FuncPointerChasing, runPointerChasing)
+	Register(FuncScript, runScript)
+}
+
+// DefaultFuncRequest reads a set of keys and then computes.
+type DefaultFuncRequest struct {
+	StorageKeys []string `json:"storageKeys"`
+	ComputeSecs float64  `json:"computeSecs"`
+	// cpu kernel to compute with, empty to sleep
+	Kernel string `json:"kernel,omitempty"`
+}
+
+func (a *DefaultFuncRequest) Keys() []string {
+	return a.StorageKeys
+}
+
+func (a *DefaultFuncRequest) ReadOnly() bool {
+	return true
+}
+
+func (a *DefaultFuncRequest) Validate() error {
+	if a.ComputeSecs < 0 {
+		return fmt.Errorf("computeSecs must not be negative")
+	}
+	if a.Kernel != "" {
+		if _, err := kernel.Lookup(a.Kernel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runDefaultFunc(env Env, args *DefaultFuncRequest) (string, error) {
+	if len(args.StorageKeys) > 0 {
+		if _, _, err := env.Get(args.StorageKeys); err != nil {
+			return "", err
+		}
+	}
+	env.Compute(args.Kernel, time.Duration(args.ComputeSecs*float64(time.Second)))
+	return "", nil
+}
+
+// PointerChasingFuncRequest follows the chain of keys stored as values and
+// returns the last key reached.
+type PointerChasingFuncRequest struct {
+	InitialKey string `json:"initialKey"`
+	NumHops    int    `json:"numHops"`
+}
+
+func (a *PointerChasingFuncRequest) Keys() []string {
+	return []string{a.InitialKey}
+}
+
+func (a *PointerChasingFuncRequest) ReadOnly() bool {
+	return true
+}
+
+func (a *PointerChasingFuncRequest) Validate() error {
+	if a.NumHops < 0 {
+		return fmt.Errorf("numHops must not be negative")
+	}
+	return nil
+}
+
+func runPointerChasing(env Env, args *PointerChasingFuncRequest) (string, error) {
+	key := args.InitialKey
+	for i := 0; i < args.NumHops; i++ {
+		values, found, err := env.Get([]string{key})
+		if err != nil {
+			return "", fmt.Errorf("failed to fetch %s: %w", key, err)
+		}
+		if !found[0] {
+			break
+		}
+		key = values[0]
+	}
+	return key, nil
+}
+
+// ScriptFuncRequest runs a user-defined function written in the script
+// language of pkg/script. Limits left 0 are the server's, which are also the
+// maximum a request may set.
+type ScriptFuncRequest struct {
+	Source string `json:"source"`
+	// keys the script reads first, available to it as key(i)
+	StorageKeys []string `json:"storageKeys,omitempty"`
+	// declared as variables of the script, strings or integers
+	Params     map[string]interface{} `json:"params,omitempty"`
+	Fuel       int64                  `json:"fuel,omitempty"`
+	AllocBytes int64                  `json:"allocBytes,omitempty"`
+	KVOps      int                    `json:"kvOps,omitempty"`
+	// set by Validate
+	program *script.Program
+}
+
+func (a *ScriptFuncRequest) Keys() []string {
+	return a.StorageKeys
+}
+
+// ReadOnly reports whether the script never puts, which is known once it is
+// compiled by Validate.
+func (a *ScriptFuncRequest) ReadOnly() bool {
+	return a.program != nil && !a.program.Writes()
+}
+
+// Validate compiles the script.
+func (a *ScriptFuncRequest) Validate() error {
+	limits := script.DefaultLimits
+	if a.Fuel < 0 || a.Fuel > limits.Fuel {
+		return fmt.Errorf("fuel must be within [0, %d]", limits.Fuel)
+	}
+	if a.AllocBytes < 0 || a.AllocBytes > limits.AllocBytes {
+		return fmt.Errorf("allocBytes must be within [0, %d]", limits.AllocBytes)
+	}
+	if a.KVOps < 0 || a.KVOps > limits.KVOps {
+		return fmt.Errorf("kvOps must be within [0, %d]", limits.KVOps)
+	}
+	params := make([]string, 0, len(a.Params))
+	for name, v := range a.Params {
+		if err := script.CheckParam(v); err != nil {
+			return fmt.Errorf("param %s: %v", name, err)
+		}
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	program, err := script.Compile(a.Source, params)
+	if err != nil {
+		return err
+	}
+	a.program = program
+	return nil
+}
+
+func runScript(env Env, args *ScriptFuncRequest) (string, error) {
+	limits := script.Limits{Fuel: args.Fuel, AllocBytes: args.AllocBytes, KVOps: args.KVOps}
+	result, err := args.program.Run(scriptHost{env}, args.StorageKeys, args.Params, limits)
+	var scriptErr *script.Error
+	if errors.As(err, &scriptErr) {
+		return "", fmt.Errorf("%w: %v", ErrFunctionFailed, err)
+	}
+	return result, err
+}
+
+// scriptHost gives scripts single-key access to env.
+type scriptHost struct {
+	env Env
+}
+
+func (h scriptHost) Get(key string) (string, bool, error) {
+	values, found, err := h.env.Get([]string{key})
+	if err != nil {
+		return "", false, err
+	}
+	return values[0], found[0], nil
+}
+
+func (h scriptHost) Put(key, value string) error {
+	return h.env.Put([]string{key}, []string{value})
+}
+
+func (h scriptHost) Yield() {
+	h.env.Yield()
+}
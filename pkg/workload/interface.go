@@ -1,8 +1,12 @@
 package workload
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
@@ -11,33 +15,182 @@ type TaskProfile struct {
 	Percentage  float64 `json:"percentage"`
 	NumKV       int     `json:"numKV"`
 	ComputeSecs float64 `json:"computeSecs"`
+	// cpu kernel of pkg/kernel that computes for ComputeSecs, empty to sleep
+	Kernel string `json:"kernel,omitempty"`
+	// nil to send requests of this type to the scheduled tier only
+	Hedge *HedgePolicy `json:"hedge,omitempty"`
 }
 
-type DefaultFuncRequest struct {
-	StorageKeys []string `json:"storageKeys"`
-	ComputeSecs float64  `json:"computeSecs"`
+// HedgePolicy lets the gateway also send a request to the tier the arbiter did
+// not pick. The first success wins and the other attempt is canceled. Since
+// both attempts may run, only repeatable requests are hedged, see
+// ClientRequest.Repeatable.
+type HedgePolicy struct {
+	// send to both tiers at once
+	Race bool `json:"race,omitempty"`
+	// otherwise send to the other tier once the request took longer than this
+	// latency percentile of the scheduled tier, e.g. 95
+	Percentile float64 `json:"percentile,omitempty"`
+	// lower bound of the hedge delay, used alone until enough latencies were seen
+	DelaySecs float64 `json:"delaySecs,omitempty"`
 }
 
-type PointerChasingFuncRequest struct {
-	InitialKey string `json:"initialKey"`
-	NumHops    int    `json:"numHops"`
+// Validate reports policies that would never hedge.
+func (p *HedgePolicy) Validate() error {
+	if p.Percentile < 0 || p.Percentile >= 100 {
+		return fmt.Errorf("invalid hedge percentile %v, expected [0, 100)", p.Percentile)
+	}
+	if p.DelaySecs < 0 {
+		return fmt.Errorf("invalid hedge delay %v", p.DelaySecs)
+	}
+	if !p.Race && p.Percentile == 0 && p.DelaySecs == 0 {
+		return fmt.Errorf("hedge policy needs race, percentile or delaySecs")
+	}
+	return nil
 }
 
 type ClientRequest struct {
 	ID     string `json:"id"`
 	TypeID int    `json:"typeID"`
-	*DefaultFuncRequest
-	*PointerChasingFuncRequest
+	// name of a registered function and its json arguments
+	Function string          `json:"function"`
+	Args     json.RawMessage `json:"args,omitempty"`
+	// set by the caller if running the function twice has the same effect
+	// as running it once, so that the gateway may hedge and retry it
+	Idempotent bool `json:"idempotent,omitempty"`
+	// set by the gateway and passed on to the kv requests of the function
+	Deadline       Deadline `json:"deadline,omitempty"`
 	ResponseWriter http.ResponseWriter
-	done           chan struct{}
+	// done once the caller went away, nil if unknown
+	ctx  context.Context
+	done chan struct{}
+	// whether the request was picked up by a worker or abandoned by its handler
+	state  int32
+	failed bool
+	// set by Prepare
+	fn   *Function
+	args Args
+}
+
+// NewClientRequest encodes args as the arguments of function.
+func NewClientRequest(id string, typeID int, function string, args Args) (*ClientRequest, error) {
+	raw, err := json.Marshal(args)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal args of %s: %v", function, err)
+	}
+	return &ClientRequest{ID: id, TypeID: typeID, Function: function, Args: raw}, nil
+}
+
+// Prepare looks up the function of the request and decodes its arguments.
+func (c *ClientRequest) Prepare() error {
+	if c.fn != nil {
+		return nil
+	}
+	fn, err := LookupFunction(c.Function)
+	if err != nil {
+		return err
+	}
+	args, err := fn.Decode(c.Args)
+	if err != nil {
+		return err
+	}
+	c.fn, c.args = fn, args
+	return nil
+}
+
+// Keys returns the keys the function reads first, or nil if the request is
+// invalid.
+func (c *ClientRequest) Keys() []string {
+	if err := c.Prepare(); err != nil {
+		return nil
+	}
+	return c.args.Keys()
+}
+
+// Repeatable reports whether the request may run more than once: it is
+// idempotent or its function does not write with these arguments.
+func (c *ClientRequest) Repeatable() bool {
+	if c.Idempotent {
+		return true
+	}
+	if err := c.Prepare(); err != nil {
+		return false
+	}
+	readOnly, ok := c.args.(interface{ ReadOnly() bool })
+	return ok && readOnly.ReadOnly()
 }
 
+// Invoke runs the function of the request in env and returns its response
+// with the time spent on kv accesses and on compute.
+func (c *ClientRequest) Invoke(env Env) (*ClientResponse, error) {
+	if err := c.Prepare(); err != nil {
+		return nil, err
+	}
+	m := &meteredEnv{env: env}
+	start := time.Now()
+	result, err := c.fn.run(m, c.args)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientResponse{
+		ID:              c.ID,
+		Result:          result,
+		StorageTimeSecs: m.kvTime.Seconds(),
+		ComputeTimeSecs: (time.Since(start) - m.kvTime - m.yieldTime).Seconds(),
+	}, nil
+}
+
+const (
+	requestQueued int32 = iota
+	requestStarted
+	requestAbandoned
+)
+
 func (c *ClientRequest) SetResponseWriter(w http.ResponseWriter) *ClientRequest {
 	c.ResponseWriter = w
 	c.done = make(chan struct{})
 	return c
 }
 
+// SetContext sets the context of the caller, typically that of the http
+// request, so that servers stop working on requests nobody waits for.
+func (c *ClientRequest) SetContext(ctx context.Context) *ClientRequest {
+	c.ctx = ctx
+	return c
+}
+
+// Canceled is closed once the caller went away, or nil if it is unknown.
+func (c *ClientRequest) Canceled() <-chan struct{} {
+	if c.ctx == nil {
+		return nil
+	}
+	return c.ctx.Done()
+}
+
+// Check returns an error once the deadline of the request passed or its
+// caller went away.
+func (c *ClientRequest) Check() error {
+	if err := c.Deadline.Check(); err != nil {
+		return err
+	}
+	if c.ctx != nil && c.ctx.Err() != nil {
+		return ErrCanceled
+	}
+	return nil
+}
+
+// Start marks a queued request as picked up by a worker. It fails if the
+// request has been abandoned.
+func (c *ClientRequest) Start() bool {
+	return atomic.CompareAndSwapInt32(&c.state, requestQueued, requestStarted)
+}
+
+// Abandon marks a queued request as given up by its handler. It fails if a
+// worker has already started it.
+func (c *ClientRequest) Abandon() bool {
+	return atomic.CompareAndSwapInt32(&c.state, requestQueued, requestAbandoned)
+}
+
 func (c *ClientRequest) Done() <-chan struct{} {
 	return c.done
 }
@@ -47,9 +200,20 @@ func (c *ClientRequest) Close() {
 }
 
 func (c *ClientRequest) Error(err error, code int) {
+	c.failed = true
 	http.Error(c.ResponseWriter, err.Error(), code)
 }
 
+// Failed reports whether the request was answered with an error.
+func (c *ClientRequest) Failed() bool {
+	return c.failed
+}
+
+// TaskType names the task profile of the request in stats.
+func (c *ClientRequest) TaskType() string {
+	return "task" + strconv.Itoa(c.TypeID)
+}
+
 func (c *ClientRequest) Reply(response *ClientResponse) error {
 	c.ResponseWriter.Header().Set("Content-Type", "application/json")
 	return json.NewEncoder(c.ResponseWriter).Encode(response)
@@ -62,6 +226,10 @@ const (
 	FAIL_SEND
 	FAIL_EXECUTE
 	FAIL_UNMARSHAL
+	// rejected by admission control, may be retried later
+	FAIL_OVERLOADED
+	// the deadline of the request passed before it was served
+	FAIL_DEADLINE
 )
 
 type ClientResponse struct {
@@ -70,22 +238,183 @@ type ClientResponse struct {
 	Result          string  `json:"result,omitempty"`
 	StorageTimeSecs float64 `json:"storageTimeSecs"`
 	ComputeTimeSecs float64 `json:"computeTimeSecs"`
-	Latency         time.Duration
+	// set with FAIL_OVERLOADED
+	RetryAfterSecs float64 `json:"retryAfterSecs,omitempty"`
+	QueueDepth     int     `json:"queueDepth,omitempty"`
+	// attempts the gateway made and the tier of the last one, which is the
+	// winner if the attempt was hedged
+	Attempts int    `json:"attempts,omitempty"`
+	Tier     string `json:"tier,omitempty"`
+	Hedged   bool   `json:"hedged,omitempty"`
+	Latency  time.Duration
+}
+
+// tiers of ClientResponse
+const (
+	TierCompute = "compute"
+	TierStorage = "storage"
+)
+
+// InvalidationSubscription registers a compute server for invalidations of the
+// keys changed on a storage replica. The replica replies with its session,
+// which changes whenever invalidations for the subscriber may have been lost.
+type InvalidationSubscription struct {
+	URL     string `json:"url"`
+	Session int64  `json:"session,omitempty"`
 }
 
+type Invalidation struct {
+	Keys []string `json:"keys"`
+}
+
+// per-key kv operations
+const (
+	OpGet    = "GET"
+	OpPut    = "PUT"
+	OpDelete = "DELETE"
+	// put the value if the current value equals the expected one
+	OpCAS = "CAS"
+	// add the integer value (1 if empty) to the integer stored under the key
+	OpIncr        = "INCR"
+	OpPutIfAbsent = "PUT_IF_ABSENT"
+)
+
 type StorageRequest struct {
-	ID             string   `json:"id"`
-	Keys           []string `json:"keys,omitempty"`
-	Values         []string `json:"values,omitempty"`
+	ID     string   `json:"id"`
+	Keys   []string `json:"keys,omitempty"`
+	Values []string `json:"values,omitempty"`
+	// optional per-key operation, defaults to PUT if a value is given and GET otherwise
+	Ops []string `json:"ops,omitempty"`
+	// per-key expected values of CAS
+	Expected []string `json:"expected,omitempty"`
+	// optional per-key time-to-live of puts, 0 for no expiry
+	TTLSecs []float64 `json:"ttlSecs,omitempty"`
+	// apply all operations or none, keys must belong to the same shard
+	Atomic         bool     `json:"atomic,omitempty"`
+	Deadline       Deadline `json:"deadline,omitempty"`
 	ResponseWriter http.ResponseWriter
 	done           chan *StorageResponse
+	failed         bool
 }
 
+// Subset returns a request for the keys at idxs, keeping their per-key fields.
+func (s *StorageRequest) Subset(id string, idxs []int) *StorageRequest {
+	sub := &StorageRequest{ID: id, Deadline: s.Deadline}
+	for _, i := range idxs {
+		sub.Keys = append(sub.Keys, s.Keys[i])
+		if len(s.Values) > i {
+			sub.Values = append(sub.Values, s.Values[i])
+		}
+		if len(s.Ops) > i {
+			sub.Ops = append(sub.Ops, s.Ops[i])
+		}
+		if len(s.Expected) > i {
+			sub.Expected = append(sub.Expected, s.Expected[i])
+		}
+		if len(s.TTLSecs) > i {
+			sub.TTLSecs = append(sub.TTLSecs, s.TTLSecs[i])
+		}
+	}
+	return sub
+}
+
+func (s *StorageRequest) Op(i int) string {
+	if len(s.Ops) > i && s.Ops[i] != "" {
+		return s.Ops[i]
+	}
+	if len(s.Values) > i {
+		return OpPut
+	}
+	return OpGet
+}
+
+func (s *StorageRequest) Value(i int) (string, bool) {
+	if len(s.Values) > i {
+		return s.Values[i], true
+	}
+	return "", false
+}
+
+func (s *StorageRequest) TTL(i int) time.Duration {
+	if len(s.TTLSecs) > i {
+		return time.Duration(s.TTLSecs[i] * float64(time.Second))
+	}
+	return 0
+}
+
+// Validate checks that every key has a known operation with its arguments.
+func (s *StorageRequest) Validate() error {
+	for i, key := range s.Keys {
+		switch op := s.Op(i); op {
+		case OpGet, OpDelete:
+		case OpIncr:
+			if v, ok := s.Value(i); ok && v != "" {
+				if _, err := strconv.ParseInt(v, 10, 64); err != nil {
+					return fmt.Errorf("%s %s: invalid delta %q", op, key, v)
+				}
+			}
+		case OpPut, OpPutIfAbsent, OpCAS:
+			if _, ok := s.Value(i); !ok {
+				return fmt.Errorf("%s %s: missing value", op, key)
+			}
+			if op == OpCAS && len(s.Expected) <= i {
+				return fmt.Errorf("%s %s: missing expected value", op, key)
+			}
+		default:
+			return fmt.Errorf("unknown op %q on %s", op, key)
+		}
+	}
+	return nil
+}
+
+// HasWrites reports whether any of the operations may modify the store.
+func (s *StorageRequest) HasWrites() bool {
+	for i := range s.Keys {
+		if s.Op(i) != OpGet {
+			return true
+		}
+	}
+	return false
+}
+
+// StorageResponse holds one entry per requested key. Values carries the value
+// after the operation, or nothing for PUT and DELETE. Found tells whether the
+// key existed before the operation and Applied whether the store was modified.
 type StorageResponse struct {
-	ID     string   `json:"id"`
-	Keys   []string `json:"keys,omitempty"`
-	Values []string `json:"values,omitempty"`
-	Error  error
+	ID      string   `json:"id"`
+	Keys    []string `json:"keys,omitempty"`
+	Values  []string `json:"values,omitempty"`
+	Found   []bool   `json:"found,omitempty"`
+	Applied []bool   `json:"applied,omitempty"`
+	Error   error
+}
+
+// Entry returns the response for the j-th key alone.
+func (r *StorageResponse) Entry(j int) *StorageResponse {
+	return &StorageResponse{
+		ID:      r.ID,
+		Keys:    []string{r.Keys[j]},
+		Values:  []string{r.Values[j]},
+		Found:   []bool{r.Found[j]},
+		Applied: []bool{r.Applied[j]},
+	}
+}
+
+// Append adds the entries of other after those of r.
+func (r *StorageResponse) Append(other *StorageResponse) {
+	r.Keys = append(r.Keys, other.Keys...)
+	r.Values = append(r.Values, other.Values...)
+	r.Found = append(r.Found, other.Found...)
+	r.Applied = append(r.Applied, other.Applied...)
+}
+
+// Len returns the number of entries, or -1 if the fields are not aligned.
+func (r *StorageResponse) Len() int {
+	n := len(r.Keys)
+	if len(r.Values) != n || len(r.Found) != n || len(r.Applied) != n {
+		return -1
+	}
+	return n
 }
 
 func (s *StorageRequest) SetResponseWriter(w http.ResponseWriter) *StorageRequest {
@@ -106,6 +435,7 @@ func (s *StorageRequest) Close() {
 }
 
 func (s *StorageRequest) Error(err error, code int) {
+	s.failed = true
 	if s.ResponseWriter != nil {
 		http.Error(s.ResponseWriter, err.Error(), code)
 	} else {
@@ -116,6 +446,10 @@ func (s *StorageRequest) Error(err error, code int) {
 	}
 }
 
+func (s *StorageRequest) Failed() bool {
+	return s.failed
+}
+
 func (s *StorageRequest) Reply(response *StorageResponse) error {
 	if s.ResponseWriter != nil {
 		s.ResponseWriter.Header().Set("Content-Type", "application/json")
@@ -125,3 +459,58 @@ func (s *StorageRequest) Reply(response *StorageResponse) error {
 		return nil
 	}
 }
+
+// ScanRequest asks for the entries in [Start, End) or with the given Prefix in
+// key order. Token continues a previous scan where its response left off.
+type ScanRequest struct {
+	ID     string `json:"id"`
+	Start  string `json:"start,omitempty"`
+	End    string `json:"end,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+	Token  string `json:"token,omitempty"`
+	// set for scans of a single storage replica
+	Forwarded      bool                `json:"-"`
+	ResponseWriter http.ResponseWriter `json:"-"`
+	done           chan struct{}
+	failed         bool
+}
+
+// ScanEntry is one line of the newline-delimited scan response. The final
+// line has Last set and carries the continuation token if entries remain, or
+// the error that ended the scan after streaming began.
+type ScanEntry struct {
+	Key   string `json:"key,omitempty"`
+	Value string `json:"value,omitempty"`
+	Last  bool   `json:"last,omitempty"`
+	Next  string `json:"next,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+func (s *ScanRequest) SetResponseWriter(w http.ResponseWriter) *ScanRequest {
+	s.ResponseWriter = w
+	s.done = make(chan struct{})
+	return s
+}
+
+func (s *ScanRequest) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *ScanRequest) Close() {
+	close(s.done)
+}
+
+func (s *ScanRequest) Error(err error, code int) {
+	s.failed = true
+	http.Error(s.ResponseWriter, err.Error(), code)
+}
+
+// Fail marks a scan that broke off after its response was started.
+func (s *ScanRequest) Fail() {
+	s.failed = true
+}
+
+func (s *ScanRequest) Failed() bool {
+	return s.failed
+}
@@ -0,0 +1,30 @@
+package workload
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRepeatable(t *testing.T) {
+	script := func(src string) json.RawMessage {
+		raw, _ := json.Marshal(&ScriptFuncRequest{Source: src, StorageKeys: []string{"k"}})
+		return raw
+	}
+	for _, c := range []struct {
+		name string
+		req  ClientRequest
+		want bool
+	}{
+		{"default", ClientRequest{Function: FuncDefault}, true},
+		{"pointer chasing", ClientRequest{Function: FuncPointerChasing, Args: json.RawMessage(`{"initialKey":"k"}`)}, true},
+		{"reading script", ClientRequest{Function: FuncScript, Args: script(`return get(key(0))`)}, true},
+		{"writing script", ClientRequest{Function: FuncScript, Args: script(`put(key(0), "v")`)}, false},
+		{"idempotent writing script", ClientRequest{Function: FuncScript, Args: script(`put(key(0), "v")`), Idempotent: true}, true},
+		{"malformed script", ClientRequest{Function: FuncScript, Args: script(`return (`)}, false},
+		{"unknown function", ClientRequest{Function: "unknown"}, false},
+	} {
+		if got := c.req.Repeatable(); got != c.want {
+			t.Errorf("%s: repeatable %v, expected %v", c.name, got, c.want)
+		}
+	}
+}
@@ -1,25 +1,97 @@
 package workload
 
+import "fmt"
+
 const (
 	// compute
 	ComputeListenPort      = ":8080"
 	ComputeServiceNodePort = ":30080"
 	ComputeServiceURL      = "http://localhost" + ComputeServiceNodePort
+	// gateway-to-compute (in-cluster)
+	ComputeInternalURL = "http://pyxis-compute"
+	// load stats served by both compute and storage servers
+	StatsPath = "/stats"
+	// readiness probe of both compute and storage servers
+	ReadyPath = "/readyz"
+	// storage replicas send the keys changed on them to subscribed compute servers
+	ComputeInvalidatePath = "/invalidate"
 	// storage
 	StorageListenPort      = ":8081"
 	StorageServiceNodePort = ":30081"
 	// kv service
 	StorageKVPath = "/kv"
 	// compute-to-storage (in-cluster)
-	StorageKVInternalURL = "http://pyxis-storage" + StorageKVPath // resolves to pyxis-storage.<ns>.svc.cluster.local
+	StorageInternalURL   = "http://pyxis-storage" // resolves to pyxis-storage.<ns>.svc.cluster.local
+	StorageKVInternalURL = StorageInternalURL + StorageKVPath
+	// resolves to the addresses of every storage replica
+	StorageHeadlessHost = "pyxis-storage-headless"
+	// per-replica storage address behind the headless service of the statefulset
+	StorageShardInternalURLFormat = "http://pyxis-storage-%d.pyxis-storage-headless" + StorageListenPort
+	// binary kv protocol served next to http
+	StorageWireListenPort   = ":8082"
+	StorageWireInternalAddr = "pyxis-storage" + StorageWireListenPort
+	// per-replica address of the binary kv protocol
+	StorageShardWireAddrFormat = "pyxis-storage-%d.pyxis-storage-headless" + StorageWireListenPort
+	// set on kv requests forwarded between storage replicas
+	StorageForwardedHeader = "X-Pyxis-Forwarded"
+	// set on 429 responses of overloaded servers
+	QueueDepthHeader = "X-Pyxis-Queue-Depth"
+	// client-to-storage (out-of-cluster)
+	StorageServiceURL = "http://localhost" + StorageServiceNodePort
+	// client-to-storage (out-of-cluster)
+	StorgeKVServiceURL = StorageServiceURL + StorageKVPath
+	// range and prefix scans
+	StorageScanPath = "/scan"
 	// client-to-storage (out-of-cluster)
-	StorgeKVServiceURL = "http://localhost" + StorageServiceNodePort + StorageKVPath
+	StorageScanServiceURL = StorageServiceURL + StorageScanPath
 	// pushdown service
 	StoragePushdownPath = "/pushdown"
 	// client-to-storage (out-of-cluster)
-	StoragePushdownServiceURL = "http://localhost" + StorageServiceNodePort + StoragePushdownPath
+	StoragePushdownServiceURL = StorageServiceURL + StoragePushdownPath
 	// memory usage metric service
 	StorageMemoryUsageMetricPath = "/memory-usage"
 	// client-to-storage (out-of-cluster)
-	StorageMemoryUsageMetricServiceURL = "http://localhost" + StorageServiceNodePort + StorageMemoryUsageMetricPath
+	StorageMemoryUsageMetricServiceURL = StorageServiceURL + StorageMemoryUsageMetricPath
+	// per-class queue stats
+	StorageQueueStatsPath = "/queue-stats"
+	// client-to-storage (out-of-cluster)
+	StorageQueueStatsServiceURL = StorageServiceURL + StorageQueueStatsPath
+	// primary-backup replication between storage replicas
+	StorageReplicatePath         = "/replication/replicate"
+	StorageReplicationJoinPath   = "/replication/join"
+	StorageReplicationStatusPath = "/replication/status"
+	StoragePromotePath           = "/replication/promote"
+	// compute servers subscribe to invalidations of the keys they cache
+	StorageSubscribePath = "/invalidation/subscribe"
+	// gateway
+	GatewayListenPort      = ":8083"
+	GatewayServiceNodePort = ":30083"
+	// client-to-gateway (out-of-cluster)
+	GatewayServiceURL = "http://localhost" + GatewayServiceNodePort
 )
+
+// StorageShardInternalURLs lists the in-cluster base URLs of n storage replicas.
+// A single replica is addressed through the regular service.
+func StorageShardInternalURLs(n int) []string {
+	if n <= 1 {
+		return []string{StorageInternalURL}
+	}
+	urls := make([]string, n)
+	for i := range urls {
+		urls[i] = fmt.Sprintf(StorageShardInternalURLFormat, i)
+	}
+	return urls
+}
+
+// StorageShardWireAddrs lists the in-cluster binary protocol addresses of n
+// storage replicas in the order of StorageShardInternalURLs.
+func StorageShardWireAddrs(n int) []string {
+	if n <= 1 {
+		return []string{StorageWireInternalAddr}
+	}
+	addrs := make([]string, n)
+	for i := range addrs {
+		addrs[i] = fmt.Sprintf(StorageShardWireAddrFormat, i)
+	}
+	return addrs
+}
@@ -11,7 +11,7 @@ TAG=${TAG:-"latest"}
 export DOCKER_BUILDKIT=1
 
 function build {
-    targets=("compute" "storage")
+    targets=("compute" "storage" "gateway")
     if [ "$#" -gt 0 ]; then
         targets=("$@")
     fi
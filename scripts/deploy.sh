@@ -6,20 +6,55 @@ cd $ROOT_DIR
 
 set -ex
 
-# Usage: compute|storage num_nodes workers_per_node
+# Usage: compute|storage num_nodes workers_per_node [storage_replicas]
+# Set CACHE_ENTRIES to enable the kv cache of compute servers and
+# STORAGE_PROTOCOL=wire for binary kv requests from compute to storage
 function deploy_server {
     server=$1
     replicas=$2
     workers=$3
+    # compute needs the number of storage shards to route keys
+    storage_replicas=${4:-1}
+    kind=deployment
+    if [ "$server" == "storage" ]; then
+        kind=statefulset
+        storage_replicas=$replicas
+    fi
     # update the configmap
     kubectl delete configmap $server-config --ignore-not-found
     kubectl create configmap $server-config \
-        --from-literal=WORKERS=$workers
+        --from-literal=WORKERS=$workers \
+        --from-literal=REPLICAS=$replicas \
+        --from-literal=STORAGE_REPLICAS=$storage_replicas \
+        --from-literal=CACHE_ENTRIES=${CACHE_ENTRIES:-0} \
+        --from-literal=STORAGE_PROTOCOL=${STORAGE_PROTOCOL:-http}
     # delete to force reload the configmap
     kubectl delete -f $ROOT_DIR/manifests/$server.yaml --ignore-not-found
     kubectl apply -f $ROOT_DIR/manifests/$server.yaml
     # scale the deployment
-    kubectl scale deployment pyxis-$server --replicas=$replicas
+    kubectl scale $kind pyxis-$server --replicas=$replicas
+}
+
+# Usage: gateway num_nodes arbiter [storage_replicas]
+# Set RETRY=retry.json to retry failed requests
+function deploy_gateway {
+    replicas=$1
+    arbiter=$2
+    storage_replicas=${3:-1}
+    kubectl delete configmap gateway-config --ignore-not-found
+    kubectl create configmap gateway-config \
+        --from-literal=ARBITER=$arbiter \
+        --from-literal=STORAGE_REPLICAS=$storage_replicas \
+        --from-literal=RETRY=${RETRY:-}
+    kubectl delete configmap gateway-config-files --ignore-not-found
+    kubectl create configmap gateway-config-files \
+        --from-file=$ROOT_DIR/manifests/tasks.json \
+        --from-file=$ROOT_DIR/manifests/kayak.json \
+        --from-file=$ROOT_DIR/manifests/pyxis.json \
+        --from-file=$ROOT_DIR/manifests/retry.json
+    kubectl delete -f $ROOT_DIR/manifests/gateway.yaml --ignore-not-found
+    kubectl apply -f $ROOT_DIR/manifests/gateway.yaml
+    kubectl scale deployment pyxis-gateway --replicas=$replicas
 }
 
 # Usage: client [-debug] -arbiter=pyxis|kayak -maxout=8|16|32...
@@ -31,7 +66,12 @@ case $1 in
 compute|storage)
     deploy_server $@
     ;;
+gateway)
+    shift
+    deploy_gateway $@
+    ;;
 clean)
+    kubectl delete -f $ROOT_DIR/manifests/gateway.yaml --ignore-not-found
     kubectl delete -f $ROOT_DIR/manifests/compute.yaml --ignore-not-found
     kubectl delete -f $ROOT_DIR/manifests/storage.yaml --ignore-not-found
     ;;
@@ -40,7 +80,7 @@ client)
     deploy_client $@
     ;;
 *)
-    echo "Usage: $0 {compute|storage|client}"
+    echo "Usage: $0 {compute|storage|gateway|client}"
     exit 1
     ;;
 esac
\ No newline at end of file
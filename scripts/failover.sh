@@ -0,0 +1,58 @@
+#! /usr/bin/env bash
+
+# Runs a replicated storage group on localhost, kills the primary and checks
+# that the promoted backup still serves the data. Exits non-zero otherwise.
+
+BASE_DIR=`realpath $(dirname $0)`
+ROOT_DIR=$BASE_DIR/..
+cd $ROOT_DIR
+
+set -e
+
+N=${N:-3}
+BASE_PORT=${BASE_PORT:-18081}
+FAILOVER_TIMEOUT=${FAILOVER_TIMEOUT:-2}
+OUT_DIR=${OUT_DIR:-$(mktemp -d)}
+
+go build -o $OUT_DIR/storage cmd/storage/main.go
+echo "Logs in $OUT_DIR"
+
+peers=()
+for i in $(seq 0 $((N - 1))); do
+    peers+=("http://localhost:$((BASE_PORT + i))")
+done
+PEERS=$(IFS=,; echo "${peers[*]}")
+
+pids=()
+trap 'kill -9 ${pids[@]} 2>/dev/null' EXIT
+for i in $(seq 0 $((N - 1))); do
+    $OUT_DIR/storage -workers=2 -listen=:$((BASE_PORT + i)) -peers=$PEERS -peer-id=$i \
+        -failover-timeout=$FAILOVER_TIMEOUT > $OUT_DIR/storage-$i.log 2>&1 &
+    pids+=($!)
+done
+sleep $((FAILOVER_TIMEOUT * 2))
+
+for peer in ${peers[@]}; do
+    status=$(curl -sf $peer/replication/status)
+    echo "$peer: $status"
+done
+
+echo "Writing to the primary"
+curl -sf -X POST ${peers[0]}/kv -d '{"id":"put","keys":["a","b"],"values":["1","2"]}'
+
+echo "Killing the primary"
+kill -9 ${pids[0]}
+sleep $((FAILOVER_TIMEOUT * 3))
+
+for peer in ${peers[@]:1}; do
+    status=$(curl -sf $peer/replication/status)
+    echo "$peer: $status"
+done
+
+echo "Reading from the new primary"
+resp=$(curl -sf -X POST ${peers[1]}/kv -d '{"id":"get","keys":["a","b"]}')
+echo "$resp"
+if [[ $resp != *'"values":["1","2"]'* ]]; then
+    echo "The new primary lost the writes"
+    exit 1
+fi